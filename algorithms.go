@@ -0,0 +1,140 @@
+package sup
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHAlgorithms is a policy of algorithms offered during SSH handshake.
+// Empty lists fall back to DefaultSSHAlgorithms.
+type SSHAlgorithms struct {
+	Ciphers           []string `yaml:"ssh_ciphers,omitempty"`
+	KeyExchanges      []string `yaml:"ssh_kex,omitempty"`
+	MACs              []string `yaml:"ssh_macs,omitempty"`
+	HostKeyAlgorithms []string `yaml:"ssh_hostkey_algos,omitempty"`
+}
+
+// DefaultSSHAlgorithms are the modern defaults: AEAD and CTR ciphers only
+// (no CBC, no arcfour), no SHA-1 key exchanges and no SHA-1 MACs. Legacy
+// servers need to be allowed explicitly, ie. `ssh_kex: [diffie-hellman-group14-sha1]`.
+var DefaultSSHAlgorithms = SSHAlgorithms{
+	Ciphers: []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	},
+	KeyExchanges: []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+	},
+	MACs: []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+	},
+	HostKeyAlgorithms: []string{
+		ssh.CertAlgoED25519v01,
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	},
+}
+
+// Override returns a copy of a with the non-empty lists of b taking
+// precedence.
+func (a SSHAlgorithms) Override(b SSHAlgorithms) SSHAlgorithms {
+	if len(b.Ciphers) > 0 {
+		a.Ciphers = b.Ciphers
+	}
+	if len(b.KeyExchanges) > 0 {
+		a.KeyExchanges = b.KeyExchanges
+	}
+	if len(b.MACs) > 0 {
+		a.MACs = b.MACs
+	}
+	if len(b.HostKeyAlgorithms) > 0 {
+		a.HostKeyAlgorithms = b.HostKeyAlgorithms
+	}
+	return a
+}
+
+// Apply sets the algorithms to the SSH client config.
+func (a SSHAlgorithms) Apply(config *ssh.ClientConfig) {
+	a = DefaultSSHAlgorithms.Override(a)
+	config.Ciphers = a.Ciphers
+	config.KeyExchanges = a.KeyExchanges
+	config.MACs = a.MACs
+	config.HostKeyAlgorithms = a.HostKeyAlgorithms
+}
+
+// String returns the offered algorithms, used in handshake errors.
+func (a SSHAlgorithms) String() string {
+	a = DefaultSSHAlgorithms.Override(a)
+	return "ciphers: " + strings.Join(a.Ciphers, ",") +
+		"; kex: " + strings.Join(a.KeyExchanges, ",") +
+		"; macs: " + strings.Join(a.MACs, ",") +
+		"; hostkey algos: " + strings.Join(a.HostKeyAlgorithms, ",")
+}
+
+// OpenSSHOptions returns the explicitly set lists as ssh -o options.
+// Lists left empty are up to ssh and ~/.ssh/config.
+func (a SSHAlgorithms) OpenSSHOptions() []string {
+	var opts []string
+	if len(a.Ciphers) > 0 {
+		opts = append(opts, "Ciphers="+strings.Join(a.Ciphers, ","))
+	}
+	if len(a.KeyExchanges) > 0 {
+		opts = append(opts, "KexAlgorithms="+strings.Join(a.KeyExchanges, ","))
+	}
+	if len(a.MACs) > 0 {
+		opts = append(opts, "MACs="+strings.Join(a.MACs, ","))
+	}
+	if len(a.HostKeyAlgorithms) > 0 {
+		opts = append(opts, "HostKeyAlgorithms="+strings.Join(a.HostKeyAlgorithms, ","))
+	}
+	return opts
+}
+
+// sshConfigAlgorithms parses ssh_config style algorithm list, which may
+// append to (+), remove from (-) or prepend to (^) the defaults.
+func sshConfigAlgorithms(defaults []string, list []string) []string {
+	var items []string
+	for _, item := range list {
+		for _, v := range strings.Split(item, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				items = append(items, v)
+			}
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	switch items[0][0] {
+	case '+':
+		items[0] = items[0][1:]
+		return append(append([]string{}, defaults...), items...)
+	case '^':
+		items[0] = items[0][1:]
+		return append(items, defaults...)
+	case '-':
+		items[0] = items[0][1:]
+		var result []string
+		for _, v := range defaults {
+			removed := false
+			for _, item := range items {
+				if v == item {
+					removed = true
+				}
+			}
+			if !removed {
+				result = append(result, v)
+			}
+		}
+		return result
+	}
+	return items
+}
@@ -0,0 +1,173 @@
+package sup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// negotiationServer serves SSH on a local port, accepting the key only
+// by one of the signature algorithms, as sshd by PubkeyAcceptedAlgorithms.
+// It returns the port.
+func negotiationServer(t *testing.T, key ssh.PublicKey, algorithms []string) string {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyAuthAlgorithms: algorithms,
+		PublicKeyCallback: func(_ ssh.ConnMetadata, offered ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(offered.Marshal(), key.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if sconn, chans, reqs, err := ssh.NewServerConn(conn, config); err == nil {
+					go ssh.DiscardRequests(reqs)
+					go func() {
+						for ch := range chans {
+							ch.Reject(ssh.Prohibited, "no sessions")
+						}
+					}()
+					sconn.Wait()
+				}
+			}()
+		}
+	}()
+	return strings.TrimPrefix(l.Addr().String(), "127.0.0.1:")
+}
+
+// writeKey writes the private key in the PEM block to a file in dir.
+func writeKey(t *testing.T, dir, name string, block *pem.Block) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// TestSignatureNegotiation connects to servers accepting the RSA and
+// ed25519 keys, of the identity files and ssh-agent, by various
+// signature algorithms.
+func TestSignatureNegotiation(t *testing.T) {
+	initAuthMethodOnce.Do(func() {})
+	defer func(s []ssh.Signer) { signers = s }(signers)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	edOpenSSH, err := ssh.MarshalPrivateKey(edKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPKCS8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: rsaKey}); err != nil {
+		t.Fatal(err)
+	}
+	_, agentRSA, err := agentSigners(keyring.(agent.ExtendedAgent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type key struct {
+		priv    crypto.Signer
+		file    string       // Identity file of the key.
+		signers []ssh.Signer // Signers of the user's keys, ie. of ssh-agent.
+	}
+	keys := map[string]key{
+		"rsa":           {priv: rsaKey, file: writeKey(t, dir, "id_rsa", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})},
+		"rsa agent":     {priv: rsaKey, signers: agentRSA},
+		"ed25519":       {priv: edKey, file: writeKey(t, dir, "id_ed25519", edOpenSSH)},
+		"ed25519 pkcs8": {priv: edKey, file: writeKey(t, dir, "id_ed25519.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: edPKCS8})},
+	}
+
+	modern := []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256} // OpenSSH 8.8+
+	for _, tt := range []struct {
+		key        string
+		algorithms []string // PubkeyAcceptedAlgorithms of the server.
+		err        bool
+	}{
+		{"rsa", modern, false},
+		{"rsa agent", modern, false},
+		{"ed25519", modern, false},
+		{"ed25519 pkcs8", modern, false},
+		{"rsa", []string{ssh.KeyAlgoRSASHA256}, false},
+		{"rsa agent", []string{ssh.KeyAlgoRSASHA256}, false},
+		{"rsa", []string{ssh.KeyAlgoRSA}, false}, // Legacy.
+		{"rsa agent", []string{ssh.KeyAlgoRSA}, false},
+		{"rsa", []string{ssh.KeyAlgoED25519}, true},
+		{"rsa agent", []string{ssh.KeyAlgoED25519}, true},
+	} {
+		t.Run(tt.key+" "+strings.Join(tt.algorithms, ","), func(t *testing.T) {
+			k := keys[tt.key]
+			pub, err := ssh.NewPublicKey(k.priv.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			signers = k.signers
+			port := negotiationServer(t, pub, tt.algorithms)
+
+			c := &SSHClient{host: &Host{Address: "127.0.0.1", Port: port, User: "deploy", IdentityFile: k.file}}
+			err = c.ConnectWith(ssh.Dial)
+			if err == nil {
+				c.conn.Close()
+			}
+			if !tt.err {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			// The error names the key type and what the server accepts.
+			want := "offered keys: ssh-rsa " + ssh.FingerprintSHA256(pub)
+			if err == nil || !strings.Contains(err.Error(), want) || !strings.Contains(err.Error(), "PubkeyAcceptedAlgorithms") {
+				t.Fatalf("got error %v, want one listing %q", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package sup
+
+// ansiStripper filters CSI and OSC (and other ESC) escape sequences out of
+// a byte stream, one byte at a time, so sequences split across reads are
+// handled too. Malformed sequences are dropped up to the offending byte,
+// which is kept.
+type ansiStripper struct {
+	state int
+}
+
+const (
+	ansiGround    = iota
+	ansiEscape    // After ESC.
+	ansiEscInter  // ESC intermediate bytes, ie. ESC ( B.
+	ansiCSI       // ESC [ ... final byte.
+	ansiString    // ESC ] (OSC), ESC P (DCS), ... terminated by BEL or ST.
+	ansiStringEsc // ESC inside of a string, possibly ST (ESC \).
+)
+
+const esc = 0x1b
+
+// keep reports whether b is a legitimate, non-escape sequence byte.
+func (s *ansiStripper) keep(b byte) bool {
+	switch s.state {
+	case ansiEscape:
+		switch {
+		case b == '[':
+			s.state = ansiCSI
+			return false
+		case b == ']' || b == 'P' || b == 'X' || b == '^' || b == '_':
+			s.state = ansiString
+			return false
+		case b >= 0x20 && b <= 0x2f:
+			s.state = ansiEscInter
+			return false
+		case b >= 0x30 && b <= 0x7e:
+			s.state = ansiGround
+			return false
+		}
+	case ansiEscInter:
+		switch {
+		case b >= 0x20 && b <= 0x2f:
+			return false
+		case b >= 0x30 && b <= 0x7e:
+			s.state = ansiGround
+			return false
+		}
+	case ansiCSI:
+		switch {
+		case b >= 0x20 && b <= 0x3f: // Parameters and intermediates.
+			return false
+		case b >= 0x40 && b <= 0x7e: // Final byte.
+			s.state = ansiGround
+			return false
+		}
+	case ansiString:
+		switch {
+		case b == 0x07: // BEL terminates OSC.
+			s.state = ansiGround
+			return false
+		case b == esc:
+			s.state = ansiStringEsc
+			return false
+		case b >= 0x20 || b == '\t':
+			return false
+		}
+	case ansiStringEsc:
+		if b == '\\' {
+			s.state = ansiGround
+			return false
+		}
+		// Not ST, ESC starts a new sequence instead.
+		s.state = ansiEscape
+		return s.keep(b)
+	}
+
+	// Ground state, or a malformed sequence the byte doesn't belong to.
+	if b == esc {
+		s.state = ansiEscape
+		return false
+	}
+	s.state = ansiGround
+	return true
+}
+
+// StripANSI enables filtering of ANSI escape sequences (colors, cursor
+// movement, terminal titles) out of the commands' output.
+func (sup *Stackup) StripANSI(value bool) {
+	sup.stripANSI = value
+}
@@ -0,0 +1,131 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ansiSequences are well-formed escape sequences, stripped as a whole.
+var ansiSequences = []string{
+	"\x1b[31m",               // Color.
+	"\x1b[1;32;48;5;236m",    // Colors of parameters.
+	"\x1b[2K",                // Erase line.
+	"\x1b[?25l",              // Hide cursor.
+	"\x1b]0;title\x07",       // Terminal title, by BEL.
+	"\x1b]8;;http://x\x1b\\", // Hyperlink, by ST.
+	"\x1bPq#0\x1b\\",         // DCS.
+	"\x1b(B",                 // Character set.
+	"\x1b7",                  // Save cursor.
+}
+
+// stripANSI returns data without escape sequences, stripped at once.
+func stripANSI(data []byte) []byte {
+	var s ansiStripper
+	var out []byte
+	for _, b := range data {
+		if s.keep(b) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// chunkReader returns the data in reads of the sizes, the rest of it in
+// one read.
+type chunkReader struct {
+	data  []byte
+	sizes []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := len(r.data)
+	if len(r.sizes) > 0 {
+		n = int(r.sizes[0]) + 1
+		r.sizes = r.sizes[1:]
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	n = copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// emittedLines returns the lines emitLines emits of r, stripping escape
+// sequences across the reads.
+func emittedLines(t *testing.T, r io.Reader) []string {
+	sup := &Stackup{stripANSI: true, eventsMu: &sync.Mutex{}}
+	var lines []string
+	sup.OnEvent(func(e Event) {
+		lines = append(lines, e.Line)
+	})
+	if err := sup.emitLines(r, Event{}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestAnsiStripper(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"plain text", "plain text"},
+		{"\x1b[31mred\x1b[0m", "red"},
+		{"\x1b]0;title\x07prompt $ ", "prompt $ "},
+		{"\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"\x1b(Bcharset", "charset"},
+		{"tab\tand\x7f", "tab\tand\x7f"},
+		// Malformed sequences are dropped up to the offending byte.
+		{"\x1b[12\x01x", "\x01x"},
+		{"\x1b\x01x", "\x01x"},
+		{"\x1b]title\x01x", "\x01x"},
+		// ESC of a string not followed by \ starts a new sequence.
+		{"\x1b]title\x1b[31mx", "x"},
+		{"trailing \x1b", "trailing "},
+	} {
+		t.Run(fmt.Sprintf("%q", tt.in), func(t *testing.T) {
+			if got := string(stripANSI([]byte(tt.in))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// Split at each byte, the sequence is stripped the same.
+			for i := 1; i < len(tt.in); i++ {
+				r := &chunkReader{data: []byte(tt.in), sizes: []byte{byte(i - 1)}}
+				if got := strings.Join(emittedLines(t, r), "\n"); got != tt.want {
+					t.Errorf("split at %v: got %q, want %q", i, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// FuzzAnsiStripper checks output stripped at once is the same as the one
+// of emitLines, stripping the reads of any size, and that the bytes around
+// well-formed sequences are all kept.
+func FuzzAnsiStripper(f *testing.F) {
+	f.Add([]byte("plain"), uint8(0), []byte{2})
+	f.Add([]byte("\x1b[31mred\x1b[0m\n"), uint8(4), []byte{0, 1, 0})
+	f.Add([]byte("progress\r\x1b[2K50%\r"), uint8(5), []byte{3, 0})
+	f.Add([]byte("\x1b]0;ti\x1btle\x07x"), uint8(8), []byte{0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, text []byte, seq uint8, sizes []byte) {
+		// Any bytes, the same stripped at once or by reads.
+		want := emittedLines(t, bytes.NewReader(stripANSI(text)))
+		if got := emittedLines(t, &chunkReader{data: text, sizes: sizes}); fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+			t.Errorf("stripped by reads %v\n%q\nwant\n%q", sizes, got, want)
+		}
+
+		// Text with a well-formed sequence in the middle, the text is kept.
+		plain := bytes.ReplaceAll(text, []byte{esc}, nil)
+		i := len(plain) / 2
+		data := append(append(append([]byte{}, plain[:i]...), ansiSequences[int(seq)%len(ansiSequences)]...), plain[i:]...)
+		if got := stripANSI(data); !bytes.Equal(got, plain) {
+			t.Errorf("stripped %q into %q, want %q", data, got, plain)
+		}
+	})
+}
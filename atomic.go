@@ -0,0 +1,119 @@
+package sup
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// AtomicDirSymlink is the atomic_dir value uploading into a new release
+// directory and switching the "current" symlink to it.
+const AtomicDirSymlink = "symlink"
+
+// checkAtomic validates the atomic upload options.
+func (u Upload) checkAtomic() error {
+	switch {
+	case u.AtomicDir != "" && u.AtomicDir != AtomicDirSymlink:
+		return fmt.Errorf("unknown atomic_dir %q, expected %q", u.AtomicDir, AtomicDirSymlink)
+	case u.AtomicDir != "" && u.Atomic:
+		return fmt.Errorf("atomic and atomic_dir can't be used together")
+	case u.KeepReleases < 0:
+		return fmt.Errorf("keep_releases must not be negative, got %v", u.KeepReleases)
+	case u.KeepReleases > 0 && u.AtomicDir == "":
+		return fmt.Errorf("keep_releases requires atomic_dir: %v", AtomicDirSymlink)
+	}
+	return nil
+}
+
+// remoteCommand returns command to be run on remote host to receive the
+// TAR stream of src, the path the local files are archived by.
+// The release names the release directory of atomic_dir: symlink and
+// the stamp, if any, is written along with the files, see Upload.Stamp.
+func (u Upload) remoteCommand(src, release string, stamp []byte) (string, error) {
+	if err := u.checkAtomic(); err != nil {
+		return "", err
+	}
+	if err := u.checkMethod(); err != nil {
+		return "", err
+	}
+	var cmd string
+	var err error
+	switch {
+	case u.Method == UploadMethodSCP:
+		cmd, err = RemoteSCPCommand(u.Dst, u.DirMode)
+	case u.Atomic:
+		cmd, err = remoteAtomicUntarCommand(u.Dst, u.DirMode)
+	case u.AtomicDir == AtomicDirSymlink:
+		return remoteReleaseUntarCommand(u.Dst, u.DirMode, src, release, u.KeepReleases, stamp)
+	default:
+		cmd, err = RemoteUntarCommand(u.Dst, u.DirMode)
+	}
+	if err != nil || stamp == nil {
+		return cmd, err
+	}
+	return cmd + " && " + stampCommand(stamp, "$sup_dst"), nil
+}
+
+// remoteAtomicUntarCommand returns command receiving the TAR stream into
+// a temp directory in dir first. Once the whole stream is extracted and
+// synced, each file is renamed over its target, so no file is ever seen
+// partially written. The temp directory is removed in any case.
+func remoteAtomicUntarCommand(dir, dirMode string) (string, error) {
+	mkdir, err := remoteMkdir(`"$sup_dst"`, dirMode)
+	if err != nil {
+		return "", err
+	}
+	mkdirParent, err := remoteMkdir(`"$sup_dst/${sup_file%/*}"`, dirMode)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`sup_dst=%s; `+
+		`if [ -e "$sup_dst" ] && [ ! -d "$sup_dst" ]; then echo "upload: $sup_dst exists and is not a directory" >&2; exit 1; fi; `+
+		`%s && sup_dst=$(cd "$sup_dst" && pwd) && sup_tmp=$(mktemp -d "$sup_dst/.sup-tmp-XXXXXX") || exit 1; `+
+		`trap 'rm -rf "$sup_tmp"' EXIT; `+
+		`tar -C "$sup_tmp" -xzf - && sync && cd "$sup_tmp" && `+
+		`find . ! -type d -print | while IFS= read -r sup_file; do %s && mv -f "$sup_file" "$sup_dst/$sup_file" || exit 1; done`,
+		remotePath(dir), mkdir, mkdirParent), nil
+}
+
+// remoteReleaseUntarCommand returns command receiving the TAR stream into
+// dir/releases/<release>, staged in a temp directory until it's complete.
+// The dir/current symlink is then switched to the release by rename and
+// the oldest releases over keep (if positive) are removed. The stamp is
+// written into the release before the switch.
+func remoteReleaseUntarCommand(dir, dirMode, src, release string, keep int, stamp []byte) (string, error) {
+	mkdir, err := remoteMkdir(`"$sup_dst/releases"`, dirMode)
+	if err != nil {
+		return "", err
+	}
+
+	// The release is the uploaded directory itself, not its parents.
+	stage := `"$sup_tmp"`
+	if src = strings.TrimPrefix(path.Clean("/"+src), "/"); src != "" {
+		stage = `"$sup_tmp"/` + ShellQuote(src)
+	}
+
+	stampRelease := ""
+	if stamp != nil {
+		stampRelease = stampCommand(stamp, "$sup_dst/releases/$sup_rel") + " && "
+	}
+
+	cmd := fmt.Sprintf(`sup_dst=%s; sup_rel=%s; `+
+		`if [ -e "$sup_dst/current" ] && [ ! -L "$sup_dst/current" ]; then echo "upload: $sup_dst/current exists and is not a symlink" >&2; exit 1; fi; `+
+		`%s && sup_dst=$(cd "$sup_dst" && pwd) || exit 1; `+
+		`if [ -e "$sup_dst/releases/$sup_rel" ]; then echo "upload: release $sup_dst/releases/$sup_rel already exists" >&2; exit 1; fi; `+
+		`sup_tmp=$(mktemp -d "$sup_dst/releases/.sup-tmp-XXXXXX") || exit 1; `+
+		`trap 'rm -rf "$sup_tmp" "$sup_dst/.sup-current-$sup_rel"' EXIT; `+
+		`tar -C "$sup_tmp" -xzf - && sync && mv %s "$sup_dst/releases/$sup_rel" && %s`+
+		`ln -s "releases/$sup_rel" "$sup_dst/.sup-current-$sup_rel" && `+
+		// mv -T renames the symlink over the old one. ln -sfn is the
+		// non-atomic fallback for mv without -T.
+		`{ mv -Tf "$sup_dst/.sup-current-$sup_rel" "$sup_dst/current" 2>/dev/null || ln -sfn "releases/$sup_rel" "$sup_dst/current"; }`,
+		remotePath(dir), ShellQuote(release), mkdir, stage, stampRelease)
+	if keep > 0 {
+		cmd += fmt.Sprintf(` && ls -1 "$sup_dst/releases" | grep -v '^\.' | sort -r | tail -n +%v | `+
+			`while IFS= read -r sup_old; do [ "$sup_old" = "$sup_rel" ] || rm -rf "$sup_dst/releases/$sup_old"; done`, keep+1)
+	}
+	return cmd, nil
+}
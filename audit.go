@@ -0,0 +1,53 @@
+package sup
+
+// Audit configures the banner logged on the remote host before each
+// remote command, so the command can be attributed to the local user
+// and the sup run ($SUP_RUN_ID).
+type Audit struct {
+	Banner bool   `yaml:"audit_banner,omitempty"` // Log the banner via logger(1).
+	File   string `yaml:"audit_file,omitempty"`   // Append the banner to this remote file instead.
+}
+
+// Override returns a copy of the Supfile level audit config a with
+// network level values set in o.
+func (a Audit) Override(o Audit) Audit {
+	if o.Banner {
+		a.Banner = true
+	}
+	if o.File != "" {
+		a.File = o.File
+	}
+	return a
+}
+
+// Enabled reports whether the banner is to be logged.
+func (a Audit) Enabled() bool {
+	return a.Banner || a.File != ""
+}
+
+// banner returns the shell snippet logging the banner for cmd. It never
+// fails, ie. when logger is missing or the file isn't writable.
+func (a Audit) banner(cmd *Command) string {
+	fields := `"user=$SUP_USER" ` + ShellQuote("cmd="+cmd.Name) + ` "run=$SUP_RUN_ID"`
+	if a.File != "" {
+		return `{ echo "$(date -u +%Y-%m-%dT%H:%M:%SZ)" ` + fields + ` >>` + ShellQuote(a.File) + `; } 2>/dev/null || true;`
+	}
+	return `{ logger -t sup ` + fields + `; } 2>/dev/null || true;`
+}
+
+// apply prefixes the remote tasks of cmd with the banner.
+func (a Audit) apply(cmd *Command, tasks []*Task) {
+	if !a.Enabled() {
+		return
+	}
+	banner := a.banner(cmd)
+	for _, task := range tasks {
+		if task.Local {
+			continue
+		}
+		task.Run = banner + task.Run
+		for host, run := range task.hostRuns {
+			task.hostRuns[host] = banner + run
+		}
+	}
+}
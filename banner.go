@@ -0,0 +1,115 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Banners enables the lines written by the text output when each command
+// starts and finishes, ie. "==> restart-api (3/7) on 12 hosts". They're
+// enabled by default. The CommandBegin and CommandEnd events are emitted
+// to the handlers either way.
+func (sup *Stackup) Banners(value bool) {
+	sup.noBanners = !value
+}
+
+// commandBanner is the command being run, between its CommandBegin and
+// CommandEnd events.
+type commandBanner struct {
+	event  Event
+	start  time.Time
+	failed map[string]bool // Hosts which failed the command, ignored failures included.
+}
+
+// beginCommand emits CommandBegin of the i-th command of n run on the
+// hosts, with its desc rendered by the run env and the release templates.
+func (sup *Stackup) beginCommand(cmd *Command, i, n, hosts int, env EnvList) error {
+	desc, err := sup.renderDesc(cmd.Desc, env)
+	if err != nil {
+		return fmt.Errorf("%v: %v", cmd.Name, err)
+	}
+	banner := &commandBanner{
+		event: Event{
+			Command:  cmd.Name,
+			Index:    i + 1,
+			Commands: n,
+			Hosts:    hosts,
+			Desc:     desc,
+			hidden:   sup.noBanners,
+		},
+		start:  time.Now(),
+		failed: map[string]bool{},
+	}
+	begin := banner.event
+	begin.Type = CommandBegin
+	sup.emit(begin)
+
+	sup.eventsMu.Lock()
+	sup.banner = banner
+	sup.eventsMu.Unlock()
+	return nil
+}
+
+// endCommand emits CommandEnd of the command begun by beginCommand, if
+// any, with err of the command.
+func (sup *Stackup) endCommand(err error) {
+	sup.eventsMu.Lock()
+	banner := sup.banner
+	sup.banner = nil
+	var failed int
+	if banner != nil {
+		failed = len(banner.failed)
+	}
+	sup.eventsMu.Unlock()
+	if banner == nil {
+		return
+	}
+
+	end := banner.event
+	end.Type, end.Err = CommandEnd, err
+	end.Failed, end.Elapsed = failed, time.Since(banner.start)
+	sup.emit(end)
+}
+
+// trackBanner counts the hosts failing the command of the banner. Caller
+// holds sup.eventsMu.
+func (sup *Stackup) trackBanner(e Event) {
+	if sup.banner != nil && e.Type == CommandFinished && e.Err != nil && e.Command == sup.banner.event.Command {
+		sup.banner.failed[e.Host] = true
+	}
+}
+
+// renderDesc returns desc with $VAR and ${VAR} expanded by env, and the
+// {{.RunID}} and {{.Timestamp}} templates by the release. Vars env
+// doesn't set are expanded to empty strings.
+func (sup *Stackup) renderDesc(desc string, env EnvList) (string, error) {
+	desc = os.Expand(desc, func(key string) string {
+		return env.Get(key)
+	})
+	return sup.release.expand("desc", desc)
+}
+
+// bannerText returns the text output line of CommandBegin or CommandEnd.
+func bannerText(e Event) string {
+	if e.Type == CommandBegin {
+		hosts := "hosts"
+		if e.Hosts == 1 {
+			hosts = "host"
+		}
+		text := fmt.Sprintf("==> %v (%d/%d) on %d %v", e.Command, e.Index, e.Commands, e.Hosts, hosts)
+		if e.Desc != "" {
+			text += ": " + e.Desc
+		}
+		return text
+	}
+	status := "ok"
+	if e.Err != nil {
+		status = "failed"
+	}
+	elapsed := e.Elapsed.Round(time.Second)
+	if elapsed == 0 {
+		elapsed = e.Elapsed.Round(time.Millisecond)
+	}
+	return fmt.Sprintf("<== %v %v in %v, %d failed", e.Command, status, elapsed, e.Failed)
+}
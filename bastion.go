@@ -0,0 +1,65 @@
+package sup
+
+import (
+	"github.com/pkg/errors"
+)
+
+// bastionClients returns clients running commands on the bastions
+// themselves, once per distinct bastion. The native transport reuses the
+// connections established for jumping, the openssh transport connects
+// to the bastions directly, as does Dial.
+func (sup *Stackup) bastionClients(dns DNS, bastions []string, connected map[string]*SSHClient, openSSH bool, options []string, gssapi bool, env string) ([]Client, error) {
+	var clients []Client
+	for i, bastion := range removeDuplicates(bastions) {
+		bastionEnv := env + `export SUP_HOST="` + bastion + `";`
+		color := sup.color(i)
+
+		if sup.dial != nil {
+			host, err := sup.conf.resolver.NewHost(bastion, HostDefaults{})
+			if err != nil {
+				return nil, err
+			}
+			host.KnownAs = bastion
+			client, err := sup.dial(host, bastionEnv)
+			if err != nil {
+				return nil, errors.Wrapf(err, "connecting to bastion %v failed", bastion)
+			}
+			clients = append(clients, client)
+			continue
+		}
+
+		if !openSSH {
+			remote := connected[bastion]
+			remote.host.KnownAs = bastion
+			remote.env = bastionEnv
+			remote.color = color
+			clients = append(clients, remote)
+			continue
+		}
+
+		host, err := sup.conf.resolver.NewHost(bastion, HostDefaults{})
+		if err != nil {
+			return nil, err
+		}
+		host.KnownAs = bastion
+		addr, resolvedBy, err := dns.resolve(host.Address, true)
+		if err != nil {
+			return nil, errors.Wrap(err, "bastion "+bastion)
+		}
+		remote := &OpenSSHClient{
+			env:     bastionEnv,
+			host:    host,
+			options: options,
+			gssapi:  gssapi,
+			color:   color,
+		}
+		if resolvedBy != "" {
+			remote.hostName = addr
+		}
+		if err := remote.Connect(); err != nil {
+			return nil, errors.Wrapf(err, "connecting to bastion %v failed", bastion)
+		}
+		clients = append(clients, remote)
+	}
+	return clients, nil
+}
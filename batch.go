@@ -0,0 +1,74 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// ErrInteractive is returned in batch mode instead of prompting for input.
+type ErrInteractive struct {
+	Host    string // Host the input was needed for, if any.
+	Command string // Command the input was needed for, if any.
+	Input   string // Description of the input, ie. "typed confirmation".
+	Hint    string // How to provide the input non-interactively, if possible.
+}
+
+func (e ErrInteractive) Error() string {
+	msg := "batch mode: " + e.Input + " needed"
+	if e.Command != "" {
+		msg += " by command " + e.Command
+	}
+	if e.Host != "" {
+		msg += " on " + e.Host
+	}
+	if e.Hint != "" {
+		msg += ", " + e.Hint
+	}
+	return msg
+}
+
+// Batch makes the run non-interactive, for CI. Any prompt fails right away
+// with ErrInteractive: commands get no remote pty, so ie. sudo fails
+// instead of waiting for a password, stdin: true commands fail if stdin is
+// a terminal, security keys aren't asked to be touched and unknown hosts
+// fail the strict host key checking of the openssh transport. Host prefixes
+// are not colored.
+func (sup *Stackup) Batch(value bool) {
+	sup.batch = value
+}
+
+// checkBatch returns ErrInteractive for commands reading the terminal.
+func (sup *Stackup) checkBatch(commands []*Command) error {
+	if !sup.batch {
+		return nil
+	}
+	for _, cmd := range commands {
+		if cmd.Stdin && stdinIsTerminal() {
+			return ErrInteractive{Command: cmd.Name, Input: "terminal input (stdin: true)", Hint: "pipe the input to sup"}
+		}
+	}
+	return nil
+}
+
+// stdinIsTerminal reports whether os.Stdin is a terminal.
+var stdinIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// color returns the host prefix color of i-th client, none in batch mode.
+func (sup *Stackup) color(i int) string {
+	if sup.batch {
+		return ""
+	}
+	return Colors[i%len(Colors)]
+}
+
+// colorize wraps the host prefix in color, if any.
+func colorize(color, prefix string) string {
+	if color == "" {
+		return prefix
+	}
+	return fmt.Sprint(color, prefix, ResetColor)
+}
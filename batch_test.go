@@ -0,0 +1,206 @@
+package sup
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// failsFast runs f with os.Stdin a pipe nothing is written to, so reading
+// the terminal would block, and returns its error, failing the test if f
+// doesn't return in time.
+func failsFast(t *testing.T, f func() error) error {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = r
+
+	done := make(chan error, 1)
+	go func() { done <- f() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("blocked on input in batch mode")
+	}
+	return nil
+}
+
+// batchRun runs command of supfile on network in batch mode.
+func batchRun(t *testing.T, supfile, network, command string) error {
+	t.Helper()
+	conf, err := NewSupfile([]byte(supfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	net, _ := conf.Networks.Get(network)
+	if err := net.ResolveHosts(nil); err != nil {
+		t.Fatal(err)
+	}
+	cmd, _ := conf.Commands.Get(command)
+	cmd.Name = command
+
+	app, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Output(io.Discard, io.Discard)
+	app.Batch(true)
+	return failsFast(t, func() error { return app.Run(&net, nil, &cmd) })
+}
+
+// TestBatchStdin checks stdin: true commands fail instead of reading the
+// terminal.
+func TestBatchStdin(t *testing.T) {
+	defer func(isTerminal func() bool) { stdinIsTerminal = isTerminal }(stdinIsTerminal)
+	stdinIsTerminal = func() bool { return true }
+
+	err := batchRun(t, `
+networks:
+  production:
+    hosts: [db1]
+commands:
+  restore:
+    run: psql shop
+    stdin: true
+`, "production", "restore")
+	var batchErr ErrInteractive
+	if !errors.As(err, &batchErr) || batchErr.Command != "restore" {
+		t.Fatalf("got error %v, want ErrInteractive of restore", err)
+	}
+}
+
+// TestBatchHostKey checks unknown hosts fail the host key checking of
+// the openssh transport instead of being prompted for, by an ssh on PATH
+// recording its arguments.
+func TestBatchHostKey(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" >> "` + filepath.Join(dir, "args") + `"
+echo "Host key verification failed." >&2
+exit 255
+`
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	err := batchRun(t, `
+networks:
+  production:
+    transport: openssh
+    hosts: [web1]
+commands:
+  deploy:
+    run: ./deploy.sh
+`, "production", "deploy")
+	if err == nil || !strings.Contains(err.Error(), "Host key verification failed") {
+		t.Fatalf("got error %v, want failed host key verification", err)
+	}
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(args)), "\n") {
+		if !strings.Contains(line, "BatchMode=yes") || !strings.Contains(line, "StrictHostKeyChecking=yes") {
+			t.Errorf("ssh run by %q, want BatchMode=yes and StrictHostKeyChecking=yes", line)
+		}
+	}
+}
+
+// TestBatchNoTTY checks the tasks get no remote pty, so ie. sudo fails
+// instead of asking for a password.
+func TestBatchNoTTY(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "deploy.sh")
+	if err := os.WriteFile(script, []byte("sudo systemctl restart shop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := NewSupfile([]byte(`
+networks:
+  production:
+    hosts: [web1]
+commands:
+  restart:
+    run: sudo systemctl restart shop
+  deploy:
+    script: ` + script + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Batch(true)
+	host, err := NewHost("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"restart", "deploy"} {
+		cmd, _ := conf.Commands.Get(name)
+		cmd.Name = name
+		tasks, err := app.createTasks(&cmd, []Client{&SSHClient{host: host}}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tasks) == 0 {
+			t.Fatalf("%v has no tasks", name)
+		}
+		for _, task := range tasks {
+			if task.TTY {
+				t.Errorf("%v task %q is run with a pty", name, task.Run)
+			}
+		}
+	}
+}
+
+// touchKey is a security key waiting to be touched, until touched is
+// closed.
+type touchKey struct {
+	touched chan struct{}
+}
+
+func (k touchKey) PublicKey() ssh.PublicKey { return touchPublicKey{} }
+
+func (k touchKey) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	<-k.touched
+	return &ssh.Signature{Format: ssh.KeyAlgoSKED25519}, nil
+}
+
+type touchPublicKey struct{}
+
+func (touchPublicKey) Type() string                        { return ssh.KeyAlgoSKED25519 }
+func (touchPublicKey) Marshal() []byte                     { return []byte(ssh.KeyAlgoSKED25519) }
+func (touchPublicKey) Verify([]byte, *ssh.Signature) error { return nil }
+
+// TestBatchSecurityKey checks security keys fail instead of waiting to be
+// touched.
+func TestBatchSecurityKey(t *testing.T) {
+	host, err := NewHost("web1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := touchKey{touched: make(chan struct{})}
+	defer close(key.touched)
+
+	signer := hostSigners([]ssh.Signer{key}, host, true)[0]
+	err = failsFast(t, func() error {
+		_, err := signer.Sign(nil, []byte("session"))
+		return err
+	})
+	var batchErr ErrInteractive
+	if !errors.As(err, &batchErr) || batchErr.Host != "web1" {
+		t.Fatalf("got error %v, want ErrInteractive of web1", err)
+	}
+}
@@ -0,0 +1,111 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Build is a local command executed exactly once, before any host work.
+// The produced artifacts are uploaded to all hosts.
+type Build struct {
+	Run       string   `yaml:"run,omitempty"`       // Local build command.
+	Artifacts []string `yaml:"artifacts,omitempty"` // Globs of produced files, see Supfile.BaseDir().
+	Dst       string   `yaml:"dst,omitempty"`       // Remote directory to upload the artifacts to.
+}
+
+// Artifact is a file produced by Build.
+type Artifact struct {
+	Path   string
+	SHA256 string
+}
+
+// build runs the cmd.Build command locally and packs its artifacts into
+// a single tar file, so they're read only once no matter how many hosts
+// they're uploaded to.
+func (sup *Stackup) build(cmd *Command, env string) error {
+	b := cmd.Build
+	if b.Dst == "" && len(b.Artifacts) > 0 {
+		return fmt.Errorf("build.dst must be set for build.artifacts")
+	}
+
+	cwd, err := sup.conf.BaseDir()
+	if err != nil {
+		return errors.Wrap(err, "resolving CWD failed")
+	}
+
+	if b.Run != "" {
+		run := env + b.Run
+		if sup.debug {
+			run = "set -x;" + run
+		}
+		c := exec.Command("bash", "-c", run)
+		c.Dir = cwd
+		c.Stdout = sup.stdout
+		c.Stderr = sup.stderr
+		if err := c.Run(); err != nil {
+			return errors.Wrap(err, "build failed")
+		}
+	}
+
+	var paths []string
+	for _, pattern := range b.Artifacts {
+		matches, err := filepath.Glob(resolve(cwd, pattern))
+		if err != nil {
+			return errors.Wrapf(err, "build.artifacts: %v", pattern)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("build.artifacts: no files match %v", pattern)
+		}
+		for _, match := range matches {
+			// Keep paths relative, so they're relative to build.dst on hosts.
+			if rel, err := filepath.Rel(cwd, match); err == nil {
+				match = rel
+			}
+			paths = append(paths, match)
+		}
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	for _, path := range removeDuplicates(paths) {
+		sum, err := fileSHA256(resolve(cwd, path))
+		if err != nil {
+			return errors.Wrap(err, "build.artifacts")
+		}
+		cmd.artifacts = append(cmd.artifacts, Artifact{Path: path, SHA256: sum})
+	}
+
+	tarFile, err := NewTarFile(cwd, removeDuplicates(paths))
+	if err != nil {
+		return errors.Wrap(err, "build.artifacts")
+	}
+	cmd.artifactsTar = tarFile
+	return nil
+}
+
+// Artifacts returns files produced by the command's build, once it's done.
+func (cmd *Command) Artifacts() []Artifact {
+	return cmd.artifacts
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
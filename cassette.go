@@ -0,0 +1,553 @@
+package sup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CassetteVersion is the version of the cassette format. Cassettes of
+// other versions aren't replayed.
+const CassetteVersion = 1
+
+// localSuffix is appended to the hostname of the local clients running
+// local: commands of a host, see ConvertClientToLocal.
+const localSuffix = " (local)"
+
+// Cassette is the record of the tasks run on the hosts, written by
+// Recorder as one JSON-lines file per host: a CassetteHeader line
+// followed by a CassetteTask line for each task, in the order they were
+// run. Cassette.Dial replays it, without connecting to any host, so a run
+// can be reproduced from the cassette of a user's run:
+//
+//	{"cassette_version":1,"host":"web1","network":"production"}
+//	{"command":"restart","kind":"run","run":"systemctl restart app","started":"...","duration_ms":812,"output":[{"at_ms":790,"stream":"stderr","data":"Job failed\n"}],"exit":1,"error":"Process exited with status 1"}
+type Cassette struct {
+	Tapes []*CassetteTape // Sorted by host.
+}
+
+// CassetteTape is the record of the tasks of a host.
+type CassetteTape struct {
+	CassetteHeader
+	Tasks []*CassetteTask
+
+	next int // Index of the next task replayed.
+}
+
+// CassetteHeader is the first line of a cassette file.
+type CassetteHeader struct {
+	CassetteVersion int    `json:"cassette_version"`
+	Host            string `json:"host"` // Hostname, "web1 (local)" for the local: commands of web1.
+	Network         string `json:"network,omitempty"`
+}
+
+// CassetteTask is a task run on the host, see Task.
+type CassetteTask struct {
+	Command  string          `json:"command"`
+	Kind     string          `json:"kind"`
+	Run      string          `json:"run"` // Composed command, without the host's env exports.
+	Local    bool            `json:"local,omitempty"`
+	Started  time.Time       `json:"started"`
+	Duration int64           `json:"duration_ms"`
+	Output   []CassetteChunk `json:"output,omitempty"`
+	Exit     int             `json:"exit"`
+	Err      string          `json:"error,omitempty"`
+}
+
+// CassetteChunk is a chunk of the task's output, as read from the host.
+type CassetteChunk struct {
+	At     int64  `json:"at_ms"`  // Since the task started.
+	Stream string `json:"stream"` // Stdout or Stderr.
+	Data   string `json:"data"`
+}
+
+// Recorder records the tasks run on the hosts into cassette files of a
+// directory, see Cassette and Stackup.Record. Values of env vars named
+// like secrets are masked, as by Plan.
+type Recorder struct {
+	dir string
+
+	mu     sync.Mutex
+	files  map[string]*os.File // By host.
+	names  map[string]bool     // Names of the files.
+	masked secrets
+	err    error // First error of writing the files.
+}
+
+// NewRecorder returns recorder writing cassette files into dir, which is
+// created if needed.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, files: map[string]*os.File{}, names: map[string]bool{}}, nil
+}
+
+// Close closes the cassette files, returning the first error of writing
+// them, if any.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range r.files {
+		if err := f.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	r.files = map[string]*os.File{}
+	return r.err
+}
+
+// mask masks the values of the secret env vars in the tasks recorded.
+func (r *Recorder) mask(env EnvList) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.masked.add(env)
+}
+
+// write appends the task to the cassette file of the host.
+func (r *Recorder) write(host, network string, task *CassetteTask) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task.Run = r.masked.mask(task.Run)
+	task.Err = r.masked.mask(task.Err)
+	for i := range task.Output {
+		task.Output[i].Data = r.masked.mask(task.Output[i].Data)
+	}
+
+	f, ok := r.files[host]
+	if !ok {
+		name := cassetteFileName(host)
+		for i := 2; r.names[name]; i++ {
+			name = fmt.Sprintf("%v-%d", cassetteFileName(host), i)
+		}
+		var err error
+		if f, err = os.Create(filepath.Join(r.dir, name+".jsonl")); err != nil {
+			if r.err == nil {
+				r.err = err
+			}
+			return
+		}
+		r.files[host], r.names[name] = f, true
+		if err := writeJSONLine(f, CassetteHeader{CassetteVersion: CassetteVersion, Host: host, Network: network}); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	if err := writeJSONLine(f, task); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+var cassetteFileRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// cassetteFileName returns name of the cassette file of host, without
+// the extension.
+func cassetteFileName(host string) string {
+	return strings.Trim(cassetteFileRe.ReplaceAllString(host, "_"), "_.")
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
+
+// Record makes Run record the tasks it runs on the hosts by r, see
+// Cassette. Recorder may be shared by the runs of several networks.
+func (sup *Stackup) Record(r *Recorder) {
+	sup.recorder = r
+}
+
+// cassetteTape records a task run by the client, see Stackup.tape.
+type cassetteTape struct {
+	sup   *Stackup
+	host  string
+	start time.Time
+
+	mu   sync.Mutex
+	task CassetteTask
+}
+
+// tape returns the tape recording the task of the command run by the
+// client, nil if the run isn't recorded. Its methods are no-op on nil.
+func (sup *Stackup) tape(c Client, command string, task *Task) *cassetteTape {
+	if sup.recorder == nil {
+		return nil
+	}
+	run := task.Run
+	if host := clientHost(c); host != nil {
+		run = task.ForHost(host).Run
+	}
+	start := time.Now()
+	return &cassetteTape{
+		sup:   sup,
+		host:  clientHostname(c),
+		start: start,
+		task:  CassetteTask{Command: command, Kind: task.Kind, Run: run, Local: task.Local, Started: start.UTC()},
+	}
+}
+
+// reader returns r recording what's read as output of the stream.
+func (t *cassetteTape) reader(stream string, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &tapeReader{tape: t, stream: stream, r: r}
+}
+
+// finish records the task, which exited by err.
+func (t *cassetteTape) finish(err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.task.Duration = time.Since(t.start).Milliseconds()
+	if err != nil {
+		t.task.Exit, t.task.Err = exitStatus(err), err.Error()
+	}
+	t.sup.recorder.write(t.host, t.sup.network, &t.task)
+}
+
+type tapeReader struct {
+	tape   *cassetteTape
+	stream string
+	r      io.Reader
+}
+
+func (r *tapeReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		t := r.tape
+		t.mu.Lock()
+		t.task.Output = append(t.task.Output, CassetteChunk{At: time.Since(t.start).Milliseconds(), Stream: r.stream, Data: string(p[:n])})
+		t.mu.Unlock()
+	}
+	return n, err
+}
+
+// ReadCassette reads the cassette files of dir, written by Recorder.
+func ReadCassette(dir string) (*Cassette, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no cassette files in %v", dir)
+	}
+	c := &Cassette{}
+	for _, file := range files {
+		tape, err := readCassetteTape(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading cassette %v failed", file)
+		}
+		c.Tapes = append(c.Tapes, tape)
+	}
+	sort.Slice(c.Tapes, func(i, j int) bool { return c.Tapes[i].Host < c.Tapes[j].Host })
+	return c, nil
+}
+
+func readCassetteTape(file string) (*CassetteTape, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tape := &CassetteTape{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for line := 1; scanner.Scan(); line++ {
+		if line == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &tape.CassetteHeader); err != nil {
+				return nil, errors.Wrapf(err, "line %d", line)
+			}
+			if tape.CassetteVersion != CassetteVersion {
+				return nil, fmt.Errorf("cassette version %v, expected %v", tape.CassetteVersion, CassetteVersion)
+			}
+			continue
+		}
+		task := &CassetteTask{}
+		if err := json.Unmarshal(scanner.Bytes(), task); err != nil {
+			return nil, errors.Wrapf(err, "line %d", line)
+		}
+		tape.Tasks = append(tape.Tasks, task)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if tape.CassetteVersion == 0 {
+		return nil, errors.New("empty cassette")
+	}
+	return tape, nil
+}
+
+// Write writes the cassette files into dir, replacing the ones of the
+// same hosts.
+func (c *Cassette) Write(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	names := map[string]bool{}
+	for _, tape := range c.Tapes {
+		name := cassetteFileName(tape.Host)
+		for i := 2; names[name]; i++ {
+			name = fmt.Sprintf("%v-%d", cassetteFileName(tape.Host), i)
+		}
+		names[name] = true
+
+		var b strings.Builder
+		if err := writeJSONLine(&b, tape.CassetteHeader); err != nil {
+			return err
+		}
+		for _, task := range tape.Tasks {
+			if err := writeJSONLine(&b, task); err != nil {
+				return err
+			}
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".jsonl"), []byte(b.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var exportRe = regexp.MustCompile(`export ([A-Za-z_][A-Za-z0-9_]*)="((?:[^"\\]|\\.)*)";`)
+
+// Scrub replaces the hostnames of the cassette by host1, host2... and
+// masks values of the exported env vars named like secrets, see Plan, so
+// the cassette can be shared. The hostnames and secrets are replaced in
+// the commands and output too.
+func (c *Cassette) Scrub() {
+	var masked secrets
+	for _, tape := range c.Tapes {
+		for _, task := range tape.Tasks {
+			var env EnvList
+			for _, m := range exportRe.FindAllStringSubmatch(task.Run, -1) {
+				env = append(env, &EnvVar{Key: m[1], Value: m[2]})
+			}
+			masked.add(env)
+		}
+	}
+
+	// Longer names first, so "web1" doesn't replace part of "web10".
+	var hosts []string
+	seen := map[string]bool{}
+	for _, tape := range c.Tapes {
+		host := strings.TrimSuffix(tape.Host, localSuffix)
+		if !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	names := map[string]string{}
+	for i, host := range hosts {
+		names[host] = fmt.Sprintf("host%d", i+1)
+	}
+	sort.SliceStable(hosts, func(i, j int) bool { return len(hosts[i]) > len(hosts[j]) })
+	var oldnew []string
+	for _, host := range hosts {
+		oldnew = append(oldnew, host, names[host])
+	}
+	replacer := strings.NewReplacer(oldnew...)
+	scrub := func(text string) string {
+		return replacer.Replace(masked.mask(text))
+	}
+
+	for _, tape := range c.Tapes {
+		tape.Host = scrub(tape.Host)
+		for _, task := range tape.Tasks {
+			task.Run, task.Err = scrub(task.Run), scrub(task.Err)
+			for i := range task.Output {
+				task.Output[i].Data = scrub(task.Output[i].Data)
+			}
+		}
+	}
+	sort.Slice(c.Tapes, func(i, j int) bool { return c.Tapes[i].Host < c.Tapes[j].Host })
+}
+
+// Dial returns ClientFunc of clients replaying the cassette, see
+// Stackup.Dial: each task run on a host is answered by the next task
+// recorded for the host, with the output and exit status recorded, at the
+// pace recorded. The local: commands are answered by the tasks of the
+// host's local client. A task of another kind than the recorded one, or
+// beyond the recorded ones, fails to start.
+func (c *Cassette) Dial() ClientFunc {
+	var mu sync.Mutex
+	return func(host *Host, env string) (Client, error) {
+		return &replayClient{cassette: c, mu: &mu, host: host}, nil
+	}
+}
+
+// next returns the next task recorded for the host.
+func (c *Cassette) next(mu *sync.Mutex, host, kind string) (*CassetteTask, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, tape := range c.Tapes {
+		if tape.Host != host {
+			continue
+		}
+		if tape.next >= len(tape.Tasks) {
+			return nil, fmt.Errorf("cassette: no %v task of %v left, %d recorded", kind, host, len(tape.Tasks))
+		}
+		task := tape.Tasks[tape.next]
+		if task.Kind != kind {
+			return nil, fmt.Errorf("cassette: %v: %v task recorded as task #%d of %v, %v task replayed", task.Command, task.Kind, tape.next+1, host, kind)
+		}
+		tape.next++
+		return task, nil
+	}
+	return nil, fmt.Errorf("cassette: no tasks of %v recorded", host)
+}
+
+// replayClient replays the tasks of a host, one at a time, see
+// Cassette.Dial.
+type replayClient struct {
+	cassette *Cassette
+	mu       *sync.Mutex // Of the cassette's tapes.
+	host     *Host
+
+	stdout *io.PipeReader
+	stderr *io.PipeReader
+	stdin  *io.PipeWriter
+	done   chan error // Exit of the running task.
+
+	interruptMu sync.Mutex
+	interrupt   chan struct{} // Closed by Signal or Close.
+	interrupted bool
+}
+
+// replayError is the recorded error of a replayed task.
+type replayError struct {
+	msg    string
+	status int
+}
+
+func (e replayError) Error() string {
+	return e.msg
+}
+
+func (e replayError) ExitStatus() int {
+	return e.status
+}
+
+func (c *replayClient) Connect() error {
+	return nil
+}
+
+func (c *replayClient) Host() *Host {
+	return c.host
+}
+
+// Run starts replaying the next task recorded for the host. Its input,
+// if any, is read to the end.
+func (c *replayClient) Run(task *Task) error {
+	host := c.host.GetHostname()
+	if task.Local {
+		host += localSuffix
+	}
+	recorded, err := c.cassette.next(c.mu, host, task.Kind)
+	if err != nil {
+		return err
+	}
+
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	stdinR, stdin := io.Pipe()
+	c.stdout, c.stderr, c.stdin = stdout, stderr, stdin
+	c.done = make(chan error, 1)
+	c.interruptMu.Lock()
+	c.interrupt, c.interrupted = make(chan struct{}), false
+	interrupt := c.interrupt
+	c.interruptMu.Unlock()
+	go io.Copy(io.Discard, stdinR)
+
+	go func() {
+		var err error
+		if recorded.Err != "" {
+			err = replayError{recorded.Err, recorded.Exit}
+		}
+		start := time.Now()
+		wait := func(ms int64) bool {
+			select {
+			case <-time.After(time.Until(start.Add(time.Duration(ms) * time.Millisecond))):
+				return true
+			case <-interrupt:
+				err = replayError{"interrupted", 130}
+				return false
+			}
+		}
+		for _, chunk := range recorded.Output {
+			if !wait(chunk.At) {
+				break
+			}
+			w := stdoutW
+			if chunk.Stream == Stderr {
+				w = stderrW
+			}
+			io.WriteString(w, chunk.Data)
+		}
+		if err == nil || err.(replayError).status != 130 {
+			wait(recorded.Duration)
+		}
+		stdinR.Close()
+		stdoutW.Close()
+		stderrW.Close()
+		c.done <- err
+	}()
+	return nil
+}
+
+func (c *replayClient) Wait() error {
+	return <-c.done
+}
+
+// Close interrupts the running task, if any.
+func (c *replayClient) Close() error {
+	return c.Signal(os.Interrupt)
+}
+
+func (c *replayClient) Prefix() (string, int) {
+	prefix := c.host.GetPrefixText()
+	return prefix, len(prefix)
+}
+
+func (c *replayClient) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *replayClient) WriteClose() error {
+	return c.stdin.Close()
+}
+
+func (c *replayClient) Stdin() io.WriteCloser {
+	return c.stdin
+}
+
+func (c *replayClient) Stderr() io.Reader {
+	return c.stderr
+}
+
+func (c *replayClient) Stdout() io.Reader {
+	return c.stdout
+}
+
+// Signal interrupts the running task, which exits with status 130.
+func (c *replayClient) Signal(os.Signal) error {
+	c.interruptMu.Lock()
+	defer c.interruptMu.Unlock()
+	if c.interrupt != nil && !c.interrupted {
+		close(c.interrupt)
+		c.interrupted = true
+	}
+	return nil
+}
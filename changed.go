@@ -0,0 +1,227 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDeployedPath is the file of the commits the changed_paths
+// commands were last run at, relative to Supfile.
+const DefaultDeployedPath = ".sup/deployed.json"
+
+// ChangedSince sets the git ref the changed_paths of the commands are
+// compared to, ie. a tag of the last release. It takes precedence over
+// the commits recorded by Deployed.
+func (sup *Stackup) ChangedSince(ref string) {
+	sup.since = ref
+}
+
+// Deployed sets the records of the commits the commands were last run
+// at, the baseline of changed_paths unless ChangedSince is set.
+func (sup *Stackup) Deployed(d *Deployed) {
+	sup.deployed = d
+}
+
+// Deployed records the git commit each changed_paths command was last
+// run at successfully, on all hosts, by network. Register Handler of each
+// run with Stackup.OnEvent and Save the records once the runs are over.
+type Deployed struct {
+	path string
+
+	mu      sync.Mutex
+	commits map[string]map[string]string // Network -> command -> commit.
+}
+
+// LoadDeployed reads the records from the file at path. A missing or
+// corrupt file has no records.
+func LoadDeployed(path string) *Deployed {
+	d := &Deployed{path: path, commits: map[string]map[string]string{}}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &d.commits); err != nil || d.commits == nil {
+			d.commits = map[string]map[string]string{}
+		}
+	}
+	return d
+}
+
+// Commit returns the commit the command was last run at on the network,
+// empty if it has no record.
+func (d *Deployed) Commit(network, command string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.commits[network][command]
+}
+
+// Handler returns the event handler recording the changed_paths commands
+// of the run on the network which succeeded on all their hosts, at the
+// HEAD commit of the git repository of dir. Runs outside of a repository
+// aren't recorded.
+func (d *Deployed) Handler(network, dir string, commands []*Command) func(Event) {
+	commit := gitHead(dir)
+	names := map[string]bool{}
+	for _, cmd := range commands {
+		if len(cmd.ChangedPaths) > 0 {
+			names[cmd.Name] = true
+		}
+	}
+	return func(e Event) {
+		if commit == "" || e.Type != CommandEnd || e.Err != nil || e.Failed > 0 || !names[e.Command] {
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.commits[network] == nil {
+			d.commits[network] = map[string]string{}
+		}
+		d.commits[network][e.Command] = commit
+	}
+}
+
+// Save writes the records to the file.
+func (d *Deployed) Save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	data, err := json.Marshal(d.commits)
+	if err != nil {
+		return err
+	}
+	if err := writeStateFile(d.path, data); err != nil {
+		return errors.Wrap(err, "saving deployed commits failed")
+	}
+	return nil
+}
+
+// checkChangedPaths returns error of changed_paths pattern which isn't
+// a valid glob.
+func checkChangedPaths(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("changed_paths: invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// matchChangedPath reports whether the changed file, relative to the
+// Supfile directory, or any of its directories matches the pattern, so
+// "assets" and "assets/**" match all the files under assets/.
+func matchChangedPath(pattern, file string) bool {
+	pattern = strings.TrimSuffix(strings.TrimSuffix(pattern, "/**"), "/")
+	for p := file; p != "." && p != "/"; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// changeCheck is the outcome of the command's changed_paths.
+type changeCheck struct {
+	skip     bool   // None of changed_paths changed since the baseline.
+	fallback bool   // No baseline or git repository to compare to, the command is run.
+	note     string // Why, ie. "no changes to changed_paths since v1.4.0".
+}
+
+// checkChanged compares changed_paths of the command to the files changed
+// since the baseline, by git diff in the Supfile directory: the ref of
+// ChangedSince, or the commit the command was last run at on the network.
+// Unknown ChangedSince ref is an error, while a recorded commit git
+// doesn't know (ie. rebased away) falls back to running the command.
+func (sup *Stackup) checkChanged(cmd *Command, network string) (changeCheck, error) {
+	if len(cmd.ChangedPaths) == 0 {
+		return changeCheck{}, nil
+	}
+	cwd, err := sup.conf.BaseDir()
+	if err != nil {
+		return changeCheck{}, errors.Wrap(err, "resolving CWD failed")
+	}
+	if out, err := exec.Command("git", "-C", cwd, "rev-parse", "--is-inside-work-tree").Output(); err != nil || string(bytes.TrimSpace(out)) != "true" {
+		return changeCheck{fallback: true, note: "not in a git work tree"}, nil
+	}
+	baseline := sup.since
+	if baseline == "" && sup.deployed != nil {
+		baseline = sup.deployed.Commit(network, cmd.Name)
+	}
+	if baseline == "" {
+		return changeCheck{fallback: true, note: "no baseline, see -since"}, nil
+	}
+
+	git := exec.Command("git", "-C", cwd, "diff", "--name-only", "--relative", baseline, "--")
+	var stderr bytes.Buffer
+	git.Stderr = &stderr
+	out, err := git.Output()
+	if err != nil {
+		if sup.since == "" {
+			return changeCheck{fallback: true, note: fmt.Sprintf("recorded commit %v is unknown to git", shortRef(baseline))}, nil
+		}
+		return changeCheck{}, errors.Errorf("%v: changed_paths: git diff %v: %s", cmd.Name, baseline, bytes.TrimSpace(stderr.Bytes()))
+	}
+	var changed []string
+	for _, file := range strings.Split(string(out), "\n") {
+		if file == "" {
+			continue
+		}
+		for _, pattern := range cmd.ChangedPaths {
+			if matchChangedPath(pattern, file) {
+				changed = append(changed, file)
+				break
+			}
+		}
+	}
+	switch len(changed) {
+	case 0:
+		return changeCheck{skip: true, note: fmt.Sprintf("no changes to changed_paths since %v", shortRef(baseline))}, nil
+	case 1:
+		return changeCheck{note: fmt.Sprintf("%v changed since %v", changed[0], shortRef(baseline))}, nil
+	}
+	return changeCheck{note: fmt.Sprintf("%v and %d more changed since %v", changed[0], len(changed)-1, shortRef(baseline))}, nil
+}
+
+// skipUnchanged returns the commands not skipped by their changed_paths,
+// writing the skipped ones and the fallbacks to the text output.
+func (sup *Stackup) skipUnchanged(commands []*Command, network string) ([]*Command, error) {
+	var run []*Command
+	for _, cmd := range commands {
+		check, err := sup.checkChanged(cmd, network)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case check.skip:
+			sup.errorf("%v: skipped, %v\n", cmd.Name, check.note)
+			sup.emit(Event{Type: CommandSkipped, Command: cmd.Name, Reason: "changed_paths: " + check.note})
+			continue
+		case check.fallback:
+			sup.errorf("%v: changed_paths: %v, running it\n", cmd.Name, check.note)
+		}
+		run = append(run, cmd)
+	}
+	return run, nil
+}
+
+// shortRef returns the ref, commit hashes abbreviated as by git.
+func shortRef(ref string) string {
+	if len(ref) == 40 && strings.Trim(ref, "0123456789abcdef") == "" {
+		return ref[:12]
+	}
+	return ref
+}
+
+// gitHead returns the HEAD commit of the git repository of dir, empty
+// outside of a repository.
+func gitHead(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(out))
+}
@@ -0,0 +1,69 @@
+package sup
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// cleanEnvCommand starts the remote command with an empty environment,
+// except for a fixed PATH and locale.
+const cleanEnvCommand = `env -i PATH=/usr/sbin:/usr/bin:/sbin:/bin LANG=C.UTF-8 sh -c `
+
+var umaskRe = regexp.MustCompile(`^[0-7]{3,4}$`)
+
+// Sanitize configures the environment the remote commands are run in,
+// so they behave the same on all hosts regardless of their login shells.
+type Sanitize struct {
+	CleanEnv *bool  `yaml:"clean_env,omitempty"` // Wipe the remote env, only sup-managed vars are set. Nil if not set.
+	Umask    string `yaml:"umask,omitempty"`     // Octal umask set before the command, ie. "022".
+}
+
+// Override returns a copy of the network level config s with command
+// level values set in o, ie. clean_env: false of the command turns off
+// the network's clean_env: true.
+func (s Sanitize) Override(o Sanitize) Sanitize {
+	if o.CleanEnv != nil {
+		s.CleanEnv = o.CleanEnv
+	}
+	if o.Umask != "" {
+		s.Umask = o.Umask
+	}
+	return s
+}
+
+// cleanEnv reports whether clean_env is set to true.
+func (s Sanitize) cleanEnv() bool {
+	return s.CleanEnv != nil && *s.CleanEnv
+}
+
+// apply sets the config to the remote run, script and wait_for tasks
+// of cmd. Uploads and local commands are left intact.
+func (s Sanitize) apply(cmd *Command, tasks []*Task) error {
+	if s.Umask != "" && !umaskRe.MatchString(s.Umask) {
+		return fmt.Errorf("%v: invalid umask %q, expected octal value, ie. \"022\"", cmd.Name, s.Umask)
+	}
+	for _, task := range tasks {
+		if task.Kind == TaskUpload || task.Local {
+			continue
+		}
+		task.CleanEnv = s.cleanEnv()
+		task.Umask = s.Umask
+	}
+	return nil
+}
+
+// command returns the shell command running the task with its header and
+// env exports prepended. With CleanEnv, the exports are part of the
+// wrapped command, so they're not wiped by env -i. See Limits for the
+// wrapping order.
+func (t *Task) command(env string) string {
+	run := t.Header + env + t.Run
+	if t.Umask != "" {
+		run = "umask " + t.Umask + ";" + run
+	}
+	run = t.Limits.wrap(run)
+	if t.CleanEnv {
+		run = cleanEnvCommand + ShellQuote(run)
+	}
+	return run
+}
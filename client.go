@@ -5,6 +5,9 @@ import (
 	"os"
 )
 
+// Client runs tasks on a host: the native SSH client (SSHClient), the
+// local ssh binary (OpenSSHClient) or the local shell (LocalhostClient).
+// Other implementations, ie. in-memory fakes, are plugged in by Stackup.Dial.
 type Client interface {
 	Connect() error
 	Run(task *Task) error
@@ -18,3 +21,32 @@ type Client interface {
 	Stdout() io.Reader
 	Signal(os.Signal) error
 }
+
+// ClientFunc returns connected client of the host, which runs its tasks
+// with the env (export statements) prepended.
+type ClientFunc func(host *Host, env string) (Client, error)
+
+// Dial makes Run connect to the hosts and bastions of the network by dial,
+// instead of by SSH or the local shell. The clients are closed once Run
+// returns. Clients knowing their host should implement Host() *Host.
+// Jumping through bastions is up to dial, none is connected by Run. The
+// local: commands are run by the clients as well, with Task.Local set.
+func (sup *Stackup) Dial(dial ClientFunc) {
+	sup.dial = dial
+}
+
+// clientHost returns host of the client, if it's known.
+func clientHost(c Client) *Host {
+	if h, ok := c.(interface{ Host() *Host }); ok {
+		return h.Host()
+	}
+	return nil
+}
+
+// clientHostname returns hostname of the client's host, if it's known.
+func clientHostname(c Client) string {
+	if host := clientHost(c); host != nil {
+		return host.GetHostname()
+	}
+	return ""
+}
@@ -1,33 +1,103 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/pressly/sup"
+	"golang.org/x/term"
 )
 
 var (
 	supfile     string
+	project     string
+	workdir     string
 	envVars     flagStringSlice
 	sshConfig   string
+	sshConfigEx bool
 	onlyHosts   string
 	exceptHosts string
+	onlyCmds    string
+	skipCmds    string
+	selector    string
 	hostTargets flagStringSlice
+	hostList    string
+	hostsFile   string
+	like        string
+	limit       int
+	limitRandom int
+	seed        int64
+	useOpenSSH  bool
+	preferKey   string
 
-	debug         bool
-	disablePrefix bool
+	refreshInventory bool
+	noCache          bool
+	kubeContext      string
+
+	skipUnreachable  = optionalDuration{value: sup.DefaultUnreachableTTL}
+	retryUnreachable bool
+	unreachable      *sup.Unreachable // Records of -skip-unreachable, set by main.
+
+	since    string
+	deployed *sup.Deployed // Baselines of changed_paths, set by main.
+
+	parallelNetworks bool
+
+	controlSocket string
+	noDaemon      bool
+	record        string
+	replay        string
+	recorder      *sup.Recorder // Of --record, set by main.
+	cassette      *sup.Cassette // Of --replay, set by main.
+	syncDir       string
+	syncClean     bool
+
+	iKnowWhatImDoing   bool
+	batch              bool
+	metricsPushgateway string
+	metricsFile        string
+
+	debug          bool
+	disablePrefix  bool
+	prefixFormat   string
+	quiet          bool
+	lint           bool
+	strictEnv      bool
+	diffEnv        bool
+	plan           bool
+	checkInventory bool
+	planOut        string
+	freeze         string
+	frozen         string
+	output         string
+	stripANSI      bool
+	maxOutputBytes int64
+	noBanners      bool
+	keepTunnels    bool
 
 	showVersion bool
 	showHelp    bool
 
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] [-p PROJECT] NETWORK COMMAND [...]\n       sup [OPTIONS] --hosts HOST[,...] [--like NETWORK] COMMAND [...]\n       sup [-f Supfile] fmt [-w] [-check]\n       sup [OPTIONS] [-f Supfile] doctor [NETWORK]\n       sup ctl status|hosts --socket PATH\n       sup cassette scrub DIR OUT\n       sup daemon start|stop|status [--idle-timeout 10m]\n       sup [ --help | -v | --version ]")
 	ErrUnknownNetwork   = errors.New("Unknown network")
 	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
 	ErrCmd              = errors.New("Unknown command/target")
@@ -46,18 +116,99 @@ func (f *flagStringSlice) Set(value string) error {
 	return nil
 }
 
+// optionalDuration is a flag with an optional duration value, ie.
+// -skip-unreachable or -skip-unreachable=30m.
+type optionalDuration struct {
+	set   bool
+	value time.Duration
+}
+
+func (f *optionalDuration) String() string {
+	if !f.set {
+		return ""
+	}
+	return f.value.String()
+}
+
+func (f *optionalDuration) Set(value string) error {
+	switch value {
+	case "true":
+		f.set = true
+	case "false":
+		f.set = false
+	default:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		f.set, f.value = true, d
+	}
+	return nil
+}
+
+func (f *optionalDuration) IsBoolFlag() bool {
+	return true
+}
+
 func init() {
 	flag.StringVar(&supfile, "f", "", "Custom path to ./Supfile[.yml]")
+	flag.StringVar(&project, "p", "", "Project of multi-document Supfile")
+	flag.StringVar(&workdir, "workdir", "", "Resolve relative paths in Supfile against this directory")
 	flag.Var(&envVars, "e", "Set environment variables")
 	flag.Var(&envVars, "env", "Set environment variables")
 	flag.StringVar(&sshConfig, "sshconfig", "", "Read SSH Config file, ie. ~/.ssh/config file")
+	flag.BoolVar(&sshConfigEx, "sshconfig-exec", false, "Evaluate Match exec criteria of SSH Config file")
 	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using regexp")
 	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using regexp")
+	flag.StringVar(&onlyCmds, "only-commands", "", "Run only these comma separated commands of the targets")
+	flag.StringVar(&skipCmds, "skip-commands", "", "Skip these comma separated commands of the targets")
+	flag.StringVar(&selector, "selector", "", "Filter hosts using label selector, ie. 'role=web,az!=eu-west-1a'")
+	flag.IntVar(&limit, "limit", 0, "Run on the first N hosts only")
+	flag.IntVar(&limitRandom, "limit-random", 0, "Run on N randomly sampled hosts only")
+	flag.Int64Var(&seed, "seed", 0, "Random seed for --limit-random and splay")
 	flag.Var(&hostTargets, "t", "Specified hosts will be added to the network with the name '_dynamic'")
+	flag.StringVar(&hostList, "hosts", "", "Run on comma separated hosts instead of a network, ie. 'deploy@10.0.0.5,deploy@10.0.0.6'")
+	flag.StringVar(&hostsFile, "hosts-file", "", "Run on hosts listed in file (one per line) instead of a network")
+	flag.StringVar(&like, "like", "", "Inherit env and bastion of this network for --hosts or --hosts-file")
+	flag.BoolVar(&useOpenSSH, "use-openssh", false, "Use local ssh binary instead of the native SSH client")
+	flag.StringVar(&preferKey, "prefer-key", "", "Try ssh-agent key with this comment or fingerprint first")
+	flag.BoolVar(&refreshInventory, "refresh-inventory", false, "Run the inventory command even if its output is cached")
+	flag.BoolVar(&noCache, "no-cache", false, "Don't read nor write the inventory cache")
+	flag.StringVar(&kubeContext, "kube-context", "", "Kubeconfig context of the k8s:// hosts, overriding kube_context")
+	flag.Var(&skipUnreachable, "skip-unreachable", "Skip hosts which failed to connect within TTL, ie. -skip-unreachable=30m (default 10m)")
+	flag.BoolVar(&retryUnreachable, "retry-unreachable", false, "Forget the unreachable hosts of the network recorded by -skip-unreachable")
+	flag.StringVar(&since, "since", "", "Git ref the changed_paths of the commands are compared to, instead of the commit of their last run")
+	flag.BoolVar(&parallelNetworks, "parallel-networks", false, "Run on comma separated list of networks in parallel")
+	flag.StringVar(&syncDir, "sync", "", "Upload the changed files of local directory to the hosts and run the commands there, see $SUP_SYNC_DIR")
+	flag.BoolVar(&syncClean, "sync-clean", false, "Remove the -sync directory (default .) from the hosts of the network")
+	flag.BoolVar(&noDaemon, "no-daemon", false, "Connect directly, not by the running sup daemon")
+	flag.StringVar(&record, "record", "", "Record the commands run on the hosts and their output into cassette files of directory")
+	flag.StringVar(&replay, "replay", "", "Replay the cassette files of directory recorded by -record instead of connecting to the hosts")
+	flag.StringVar(&controlSocket, "control-socket", "", "Serve read-only JSON status of the run on unix socket, see sup ctl")
+	flag.BoolVar(&iKnowWhatImDoing, "i-know-what-im-doing", false, "Skip confirmation of runs against protected networks")
+	flag.BoolVar(&iKnowWhatImDoing, "yes", false, "Same as -i-know-what-im-doing")
+	flag.BoolVar(&batch, "batch", false, "Never prompt: fail on any input needed, disable colors")
+	flag.StringVar(&metricsPushgateway, "metrics-pushgateway", "", "Push run metrics to Prometheus Pushgateway URL")
+	flag.StringVar(&metricsFile, "metrics-file", "", "Write run metrics to node_exporter textfile collector file")
 
 	flag.BoolVar(&debug, "D", false, "Enable debug mode")
 	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
 	flag.BoolVar(&disablePrefix, "disable-prefix", false, "Disable hostname prefix")
+	flag.StringVar(&prefixFormat, "prefix-format", "", "Template of the output prefixes, ie. '{{.Time \"15:04:05\"}} {{.Host}} | ', overrides prefix_format of Supfile")
+	flag.BoolVar(&quiet, "q", false, "Suppress Supfile warnings")
+	flag.BoolVar(&lint, "lint", false, "Check Supfile commands for shell issues and exit")
+	flag.BoolVar(&strictEnv, "strict-env", false, "Fail if the commands reference env vars no env defines")
+	flag.BoolVar(&diffEnv, "diff-env", false, "Compare resolved env of two networks, ie. -diff-env staging production, and exit")
+	flag.BoolVar(&checkInventory, "check-inventory", false, "Report hosts: missing from the network's inventory and vice versa, and exit")
+	flag.BoolVar(&plan, "plan", false, "Print the resolved plan of the run and exit")
+	flag.StringVar(&planOut, "plan-out", "", "Write the resolved plan of the run as JSON to file and exit")
+	flag.StringVar(&freeze, "freeze", "", "Write the lock of the run (hashes of the Supfile, env values, hosts, commands and uploaded files) to file and exit")
+	flag.StringVar(&frozen, "frozen", "", "Refuse to run if the run differs from the lock file written by -freeze")
+	flag.StringVar(&output, "output", "text", "Output format of -plan and -diff-env: text or json")
+	flag.Int64Var(&maxOutputBytes, "max-output-bytes", 0, "Truncate the output of each host's command to N bytes, still reading it to the end (default no limit)")
+	flag.BoolVar(&noBanners, "no-banners", false, "Don't print the line when each command starts and finishes")
+	flag.BoolVar(&keepTunnels, "keep-tunnels", false, "Keep the network's tunnels open after the local commands, until Enter is pressed")
+	flag.BoolVar(&stripANSI, "strip-ansi", !isTerminal(os.Stdout), "Strip ANSI escape sequences from commands' output, on by default if stdout is not a terminal")
 
 	flag.BoolVar(&showVersion, "v", false, "Print version")
 	flag.BoolVar(&showVersion, "version", false, "Print version")
@@ -65,6 +216,19 @@ func init() {
 	flag.BoolVar(&showHelp, "help", false, "Show help")
 }
 
+func projectUsage(set *sup.SupfileSet) {
+	w := &tabwriter.Writer{}
+	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	// Print available projects and their networks.
+	fmt.Fprintln(w, "Projects:\t")
+	for _, conf := range set.Projects {
+		fmt.Fprintf(w, "- %v\t%v\n", conf.Name, strings.Join(conf.Networks.Names, " "))
+	}
+	fmt.Fprintln(w)
+}
+
 func networkUsage(conf *sup.Supfile) {
 	w := &tabwriter.Writer{}
 	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
@@ -102,23 +266,81 @@ func cmdUsage(conf *sup.Supfile) {
 	fmt.Fprintln(w)
 }
 
-// parseArgs parses args and returns network and commands to be run.
-// On error, it prints usage and exits.
-func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
+// networkVars returns the env vars of the run on network: Supfile and
+// network env resolved by the local shell, pass_env values, -e vars and
+// $SUP_ENV.
+func networkVars(conf *sup.Supfile, network *sup.Network) (sup.EnvList, error) {
+	var vars sup.EnvList
+	for _, val := range append(conf.Env, network.Env...) {
+		vars.Set(val.Key, val.Value)
+	}
+	vars, err := vars.ResolveValues()
+	if err != nil {
+		return nil, err
+	}
+
+	// Capture local env vars listed in pass_env. Values are taken and
+	// exported as-is.
+	for _, pass := range []struct {
+		patterns []string
+		required bool
+	}{
+		{conf.PassEnv, conf.PassEnvRequired},
+		{network.PassEnv, network.PassEnvRequired},
+	} {
+		passVars, err := sup.PassEnv(pass.patterns, pass.required)
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range passVars {
+			vars.SetLiteral(val.Key, val.Value)
+		}
+	}
+
+	// Parse CLI --env flag env vars, define $SUP_ENV and override values defined in Supfile.
+	var cliVars sup.EnvList
+	for _, env := range envVars {
+		if len(env) == 0 {
+			continue
+		}
+		i := strings.Index(env, "=")
+		if i < 0 {
+			if len(env) > 0 {
+				vars.Set(env, "")
+			}
+			continue
+		}
+		vars.Set(env[:i], env[i+1:])
+		cliVars.Set(env[:i], env[i+1:])
+	}
+
+	// SUP_ENV is generated only from CLI env vars.
+	// Separate loop to omit duplicates.
+	supEnv := ""
+	for _, v := range cliVars {
+		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
+	}
+	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
+	return vars, nil
+}
+
+// parseArgs parses args and returns network, commands and env vars of
+// the run. On error, it prints usage and exits.
+func parseArgs(conf *sup.Supfile, resolver *sup.Resolver, name string) (*sup.Network, []*sup.Command, sup.EnvList, error) {
 	var commands []*sup.Command
 
-	args := flag.Args()
+	args := cliArgs
 	if len(args) < 1 {
 		networkUsage(conf)
-		return nil, nil, ErrUsage
+		return nil, nil, nil, ErrUsage
 	}
 
 	if len(hostTargets) > 0 {
 		dynamicNetwork := &sup.Network{}
 		for _, host := range hostTargets {
-			supHost, err := sup.NewHost(host)
+			supHost, err := resolver.NewHost(host, sup.HostDefaults{})
 			if err != nil {
-				return nil, nil, err
+				return nil, nil, nil, err
 			}
 			dynamicNetwork.HostsFromConfig = append(dynamicNetwork.HostsFromConfig, host)
 			dynamicNetwork.Hosts = append(dynamicNetwork.Hosts, supHost)
@@ -127,10 +349,10 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	}
 
 	// Does the <network> exist?
-	network, ok := conf.Networks.Get(args[0])
+	network, ok := conf.Networks.Get(name)
 	if !ok {
 		networkUsage(conf)
-		return nil, nil, ErrUnknownNetwork
+		return nil, nil, nil, ErrUnknownNetwork
 	}
 
 	// Parse CLI --env flag env vars, override values defined in Network env.
@@ -148,38 +370,34 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		network.Env.Set(env[:i], env[i+1:])
 	}
 
-	hosts, err := network.ParseInventory()
-	if err != nil {
-		return nil, nil, err
-	}
-	network.Hosts = append(network.Hosts, hosts...)
-
-	// Does the <network> have at least one host?
-	if len(network.Hosts) == 0 {
-		networkUsage(conf)
-		return nil, nil, ErrNetworkNoHosts
-	}
-
-	// Check for the second argument
-	if len(args) < 2 {
-		cmdUsage(conf)
-		return nil, nil, ErrUsage
-	}
-
 	// In case of the network.Env needs an initialization
 	if network.Env == nil {
 		network.Env = make(sup.EnvList, 0)
 	}
 
 	// Add default env variable with current network
-	network.Env.Set("SUP_NETWORK", args[0])
+	network.Env.Set("SUP_NETWORK", name)
 
-	// Add default nonce
-	network.Env.Set("SUP_TIME", time.Now().UTC().Format(time.RFC3339))
+	// Add default nonce, the same for all the networks run in parallel.
+	network.Env.Set("SUP_TIME", runTime.Format(time.RFC3339))
 	if os.Getenv("SUP_TIME") != "" {
 		network.Env.Set("SUP_TIME", os.Getenv("SUP_TIME"))
 	}
 
+	// Add run id, so remote logs can be joined with the local ones.
+	// Nested sup runs inherit it.
+	if os.Getenv("SUP_RUN_ID") != "" {
+		network.Env.Set("SUP_RUN_ID", os.Getenv("SUP_RUN_ID"))
+	} else {
+		if runID == "" {
+			var err error
+			if runID, err = newRunID(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		network.Env.Set("SUP_RUN_ID", runID)
+	}
+
 	// Add user
 	if os.Getenv("SUP_USER") != "" {
 		network.Env.Set("SUP_USER", os.Getenv("SUP_USER"))
@@ -187,20 +405,102 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		network.Env.Set("SUP_USER", os.Getenv("USER"))
 	}
 
+	baseDir, err := conf.BaseDir()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Hosts referencing env vars are resolved by the env of the run,
+	// before the inventory hosts are added.
+	vars, err := networkVars(conf, &network)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := network.ResolveHosts(vars); err != nil {
+		return nil, nil, nil, err
+	}
+
+	network.Workdir = baseDir
+	network.RefreshInventory = refreshInventory
+	network.NoInventoryCache = noCache
+	// Ctrl-C kills a hanging inventory command.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	hosts, err := network.ParseInventoryContext(ctx)
+	if err != nil {
+		stop()
+		return nil, nil, nil, err
+	}
+	if network.InventorySkew, err = network.CheckInventory(hosts); err != nil {
+		stop()
+		return nil, nil, nil, errors.Wrap(err, "checking inventory")
+	}
+	network.Hosts = append(network.Hosts, hosts...)
+
+	// --check-inventory needs no command.
+	if checkInventory {
+		stop()
+		return &network, nil, vars, nil
+	}
+	if kubeContext != "" {
+		network.KubeContext = kubeContext
+	}
+	err = network.ExpandPods(ctx)
+	stop()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Does the <network> have at least one host? Networks of tunnels may
+	// run local commands without any.
+	if len(network.Hosts) == 0 && len(network.Tunnels) == 0 {
+		networkUsage(conf)
+		return nil, nil, nil, ErrNetworkNoHosts
+	}
+
+	// sup doctor needs no command either.
+	if doctor {
+		return &network, nil, vars, nil
+	}
+
+	// Check for the second argument, --sync-clean runs its own command.
+	if len(args) < 2 && !syncClean {
+		cmdUsage(conf)
+		return nil, nil, nil, ErrUsage
+	}
+
+	if syncClean {
+		if len(args) > 1 {
+			return nil, nil, nil, errors.New("--sync-clean takes no commands")
+		}
+		commands = append(commands, sup.SyncCleanCommand())
+	}
+
+	var targetCmds []string // Commands of the targets, for -only-commands and -skip-commands.
 	for _, cmd := range args[1:] {
 		// Target?
 		target, isTarget := conf.Targets.Get(cmd)
+		_, isPipe := conf.Targets.Pipe(cmd)
+		if isPipe && len(args) > 2 {
+			return nil, nil, nil, fmt.Errorf("pipe target %v can't be run along with other commands", cmd)
+		}
+		if isTarget && (onlyCmds != "" || skipCmds != "") {
+			if isPipe {
+				return nil, nil, nil, fmt.Errorf("-only-commands and -skip-commands can't filter pipe target %v", cmd)
+			}
+			targetCmds = append(targetCmds, target...)
+		}
 		if isTarget {
 			// Loop over target's commands.
 			for _, cmd := range target {
 				command, isCommand := conf.Commands.Get(cmd)
 				if !isCommand {
 					cmdUsage(conf)
-					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
+					return nil, nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
 				}
 				command.Name = cmd
 				commands = append(commands, &command)
 			}
+			// A command of the same name is shadowed, see Supfile.Prefer.
+			continue
 		}
 
 		// Command?
@@ -210,152 +510,1363 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 			commands = append(commands, &command)
 		}
 
-		if !isTarget && !isCommand {
+		if !isCommand {
 			cmdUsage(conf)
-			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
+			return nil, nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
+		}
+		if onlyCmds != "" || skipCmds != "" {
+			return nil, nil, nil, fmt.Errorf("-only-commands and -skip-commands filter the commands of targets, %v is a command", cmd)
 		}
 	}
+	if err := checkCommandFilters(targetCmds); err != nil {
+		return nil, nil, nil, err
+	}
 
-	return &network, commands, nil
+	return &network, commands, vars, nil
 }
 
-func main() {
-	flag.Parse()
+// checkCommandFilters checks the names of -only-commands and
+// -skip-commands are commands of the targets being run.
+func checkCommandFilters(targetCmds []string) error {
+	for _, filter := range []struct{ flag, names string }{{"only-commands", onlyCmds}, {"skip-commands", skipCmds}} {
+		for _, name := range splitNames(filter.names) {
+			if !containsName(targetCmds, name) {
+				return fmt.Errorf("-%v: %v is not a command of the target, expected one of: %v", filter.flag, name, strings.Join(uniqueNames(targetCmds), ", "))
+			}
+		}
+	}
+	return nil
+}
 
-	if showHelp {
-		fmt.Fprintln(os.Stderr, ErrUsage, "\n\nOptions:")
-		flag.PrintDefaults()
-		return
+// skippedCommands returns names of the commands left out by
+// -only-commands and -skip-commands.
+func skippedCommands(commands []*sup.Command) []string {
+	only, skip := splitNames(onlyCmds), splitNames(skipCmds)
+	var skipped []string
+	for _, cmd := range commands {
+		if (len(only) > 0 && !containsName(only, cmd.Name)) || containsName(skip, cmd.Name) {
+			skipped = append(skipped, cmd.Name)
+		}
 	}
+	return skipped
+}
 
-	if showVersion {
-		fmt.Fprintln(os.Stderr, sup.VERSION)
-		return
+// splitNames splits comma separated names, ie. of -skip-commands.
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
 	}
+	return names
+}
 
-	// Read SSH Config file, ie. ~/.ssh/config file
-	// --sshconfig flag location for ssh_config file
-	_, err := sup.ParseAndLoadSSHConfig(sshConfig)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
 	}
+	return false
+}
 
-	if supfile == "" {
-		supfile = "./Supfile"
+// uniqueNames returns the names without duplicates, in order.
+func uniqueNames(names []string) []string {
+	var unique []string
+	for _, name := range names {
+		if !containsName(unique, name) {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// controlClient runs sup ctl status|hosts [--socket PATH]: prints the JSON
+// served on the control socket of a running sup, see --control-socket.
+func controlClient(args []string) error {
+	usage := errors.New("Usage: sup ctl status|hosts --socket PATH")
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	socket := fs.String("socket", controlSocket, "Control socket of the run")
+	if err := fs.Parse(args); err != nil {
+		return usage
 	}
-	data, err := os.ReadFile(sup.ResolvePath(supfile))
+	if fs.NArg() == 0 {
+		return usage
+	}
+	what := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil || fs.NArg() > 0 || *socket == "" {
+		return usage
+	}
+	if what != "status" && what != "hosts" {
+		return usage
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", *socket)
+			},
+		},
+	}
+	resp, err := client.Get("http://sup/" + what)
 	if err != nil {
-		firstErr := err
-		data, err = os.ReadFile("./Supfile.yml") // Alternative to ./Supfile.
+		return errors.Wrap(err, "control socket")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control socket: %v", resp.Status)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+// daemonCommand runs sup daemon start|stop|status [--socket PATH]
+// [--idle-timeout 10m], see sup.ServeDaemon.
+func daemonCommand(args []string) error {
+	usage := errors.New("Usage: sup daemon start|stop|status [--socket PATH] [--idle-timeout 10m]")
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := fs.String("socket", sup.DaemonSocket(), "Socket of the daemon")
+	idle := fs.Duration("idle-timeout", sup.DefaultDaemonIdleTimeout, "Stop the daemon once it's not used for this long")
+	if err := fs.Parse(args); err != nil {
+		return usage
+	}
+	if fs.NArg() == 0 {
+		return usage
+	}
+	what := fs.Arg(0)
+	if err := fs.Parse(fs.Args()[1:]); err != nil || fs.NArg() > 0 || *socket == "" || *idle <= 0 {
+		return usage
+	}
+
+	switch what {
+	case "start":
+		if err := sup.StartDaemon(*socket, *idle); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "sup daemon listening at %v, idle timeout %v\n", *socket, *idle)
+		return nil
+	case "serve":
+		// Run by start in the background.
+		return sup.ServeDaemon(*socket, *idle)
+	case "stop":
+		return sup.StopDaemon(*socket)
+	case "status":
+		status, err := sup.GetDaemonStatus(*socket)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, firstErr)
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return fmt.Errorf("sup daemon is not running at %v", *socket)
+		}
+		if output == "json" {
+			return json.NewEncoder(os.Stdout).Encode(status)
+		}
+		fmt.Printf("pid %v, socket %v, started %v, idle timeout %v\n", status.PID, status.Socket, status.Started.Format(time.RFC3339), status.IdleTimeout)
+		for _, conn := range status.Connections {
+			fmt.Printf("%v\tsince %v\tlast used %v\t%v channels\n", conn.Host, conn.Since.Format(time.RFC3339), conn.LastUsed.Format(time.RFC3339), conn.Channels)
 		}
+		return nil
+	}
+	return usage
+}
+
+// cassetteCommand runs sup cassette scrub DIR OUT: writes the cassettes
+// of DIR recorded by --record into OUT, with the hostnames and secrets
+// replaced, see sup.Cassette.Scrub.
+func cassetteCommand(args []string) error {
+	usage := errors.New("Usage: sup cassette scrub DIR OUT")
+	if len(args) != 3 || args[0] != "scrub" {
+		return usage
+	}
+	dir, out := args[1], args[2]
+	if filepath.Clean(dir) == filepath.Clean(out) {
+		return errors.New("sup cassette scrub: OUT must differ from DIR, so no unscrubbed file is left in it")
 	}
-	conf, err := sup.NewSupfile(data)
+	c, err := sup.ReadCassette(dir)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		return err
 	}
+	c.Scrub()
+	if err := c.Write(out); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Scrubbed %d cassettes into %v, check them for anything else private before sharing\n", len(c.Tapes), out)
+	return nil
+}
 
-	// Parse network and commands to be run from args.
-	network, commands, err := parseArgs(conf)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+// ErrNotFormatted is returned by sup fmt -check for Supfile that isn't
+// formatted.
+var ErrNotFormatted = errors.New("Supfile is not formatted, run sup fmt -w")
+
+// formatSupfile runs sup fmt [-w] [-check]: prints the formatted Supfile
+// at path, writes it back with -w, or fails with -check if it isn't
+// formatted. Supfile that fails to parse is left intact.
+func formatSupfile(path string, data []byte, args []string) error {
+	fs := flag.NewFlagSet("fmt", flag.ContinueOnError)
+	write := fs.Bool("w", false, "Write the formatted Supfile back to the file")
+	check := fs.Bool("check", false, "Exit non-zero if the Supfile isn't formatted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("Usage: sup [-f Supfile] fmt [-w] [-check]")
 	}
 
-	// --only flag filters hosts
-	if onlyHosts != "" {
-		expr, err := regexp.CompilePOSIX(onlyHosts)
+	out, err := sup.FormatSupfile(data)
+	if err != nil {
+		return errors.Wrap(err, path)
+	}
+	switch {
+	case *check:
+		if !bytes.Equal(out, data) {
+			return errors.Wrap(ErrNotFormatted, path)
+		}
+		return nil
+	case *write:
+		if bytes.Equal(out, data) {
+			return nil
+		}
+		info, err := os.Stat(path)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			return err
 		}
+		return os.WriteFile(path, out, info.Mode().Perm())
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
 
-		var hosts []*sup.Host
-		for _, host := range network.Hosts {
-			if expr.MatchString(host.GetHostname()) {
-				hosts = append(hosts, host)
-			}
-		}
-		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts))
-			os.Exit(1)
+// ErrDoctorFailed is returned by sup doctor if any of its checks failed.
+var ErrDoctorFailed = errors.New("sup doctor: some checks failed")
+
+// doctorCommand runs sup doctor [NETWORK]: the checks of the Supfile and
+// the local environment, and of the network's hosts, if given. The hosts
+// are filtered by -only, -except, -selector and -limit as in the runs.
+func doctorCommand(resolver *sup.Resolver, supfilePath string, data []byte, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return errors.New("Usage: sup [OPTIONS] [-f Supfile] doctor [NETWORK]")
+	}
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown --output format %q", output)
+	}
+
+	check := sup.DoctorCheck{Name: "supfile", Status: sup.DoctorPass, Message: supfilePath}
+	set, err := sup.NewSupfileSetWithOptions(data, sup.ParseOptions{Resolver: resolver, Format: sup.FormatFromPath(supfilePath)})
+	var conf *sup.Supfile
+	if err == nil {
+		conf, err = set.Get(project)
+	}
+	if err == nil {
+		conf.Dir, err = filepath.Abs(filepath.Dir(supfilePath))
+	}
+	var checks sup.DoctorChecks
+	if err != nil {
+		check.Status, check.Message, check.Hint = sup.DoctorFail, err.Error(), "fix the Supfile, run sup --lint for more"
+		checks = append(checks, check)
+		conf = nil
+	} else if len(conf.Warnings) > 0 {
+		for _, warning := range conf.Warnings {
+			check.Status, check.Message, check.Hint = sup.DoctorWarn, fmt.Sprint(warning), "run sup --lint for more"
+			checks = append(checks, check)
 		}
-		network.Hosts = hosts
+	} else {
+		checks = append(checks, check)
 	}
+	checks = append(checks, sup.DoctorLocal()...)
 
-	// --except flag filters out hosts
-	if exceptHosts != "" {
-		expr, err := regexp.CompilePOSIX(exceptHosts)
+	if fs.NArg() == 1 && conf != nil {
+		conf.Workdir = workdir
+		cliArgs, doctor = fs.Args(), true
+		r, err := prepareRun(conf, resolver, fs.Arg(0))
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			checks = append(checks, sup.DoctorCheck{Name: "network", Status: sup.DoctorFail, Message: err.Error(), Hint: "fix the network of the Supfile"})
+		} else {
+			checks = append(checks, r.app.Doctor(r.network, r.vars)...)
 		}
+	}
 
-		var hosts []*sup.Host
-		for _, host := range network.Hosts {
-			if !expr.MatchString(host.GetHostname()) {
-				hosts = append(hosts, host)
-			}
+	if output == "json" {
+		data, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			return err
 		}
-		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts))
-			os.Exit(1)
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return err
 		}
-		network.Hosts = hosts
+	} else if err := checks.WriteText(os.Stdout); err != nil {
+		return err
+	}
+	if checks.Failed() {
+		return ErrDoctorFailed
 	}
+	return nil
+}
 
-	var vars sup.EnvList
-	for _, val := range append(conf.Env, network.Env...) {
-		vars.Set(val.Key, val.Value)
+// hostsNetworkName names the ephemeral network of --hosts and --hosts-file.
+const hostsNetworkName = "_hosts"
+
+// cliArgs are the positional args, NETWORK COMMAND [...]. The network is
+// hostsNetworkName for --hosts and --hosts-file runs.
+var cliArgs []string
+
+// doctor is set by sup doctor, whose network is checked without commands.
+var doctor bool
+
+// setHostsNetwork adds the ephemeral network of --hosts and --hosts-file
+// hosts to conf, with env and bastion of the --like network, if set.
+func setHostsNetwork(conf *sup.Supfile, resolver *sup.Resolver) error {
+	if len(hostTargets) > 0 || parallelNetworks {
+		return errors.New("--hosts and --hosts-file can't be combined with -t or --parallel-networks")
 	}
-	if err := vars.ResolveValues(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	// With --hosts, all the positional args are commands. A network name
+	// there is most likely meant as --like.
+	if flag.NArg() > 0 {
+		if _, ok := conf.Networks.Get(flag.Arg(0)); ok {
+			return fmt.Errorf("%q is a network, but --hosts replaces the network argument; use --like %v to inherit its env and bastion", flag.Arg(0), flag.Arg(0))
+		}
 	}
 
-	// Parse CLI --env flag env vars, define $SUP_ENV and override values defined in Supfile.
-	var cliVars sup.EnvList
-	for _, env := range envVars {
-		if len(env) == 0 {
-			continue
+	hosts := strings.Split(hostList, ",")
+	if hostsFile != "" {
+		data, err := os.ReadFile(hostsFile)
+		if err != nil {
+			return errors.Wrap(err, "--hosts-file")
 		}
-		i := strings.Index(env, "=")
-		if i < 0 {
-			if len(env) > 0 {
-				vars.Set(env, "")
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); !strings.HasPrefix(line, "#") {
+				hosts = append(hosts, line)
 			}
-			continue
 		}
-		vars.Set(env[:i], env[i+1:])
-		cliVars.Set(env[:i], env[i+1:])
 	}
 
-	// SUP_ENV is generated only from CLI env vars.
-	// Separate loop to omit duplicates.
-	supEnv := ""
-	for _, v := range cliVars {
-		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
+	network := &sup.Network{}
+	if like != "" {
+		likeNetwork, ok := conf.Networks.Get(like)
+		if !ok {
+			networkUsage(conf)
+			return errors.Wrap(ErrUnknownNetwork, "--like "+like)
+		}
+		for _, v := range likeNetwork.Env {
+			network.Env.Set(v.Key, v.Value)
+		}
+		network.Bastion = likeNetwork.Bastion
 	}
-	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		supHost, err := resolver.NewHost(host, sup.HostDefaults{})
+		if err != nil {
+			return err
+		}
+		network.HostsFromConfig = append(network.HostsFromConfig, host)
+		network.Hosts = append(network.Hosts, supHost)
+	}
+	if len(network.Hosts) == 0 {
+		return errors.New("no hosts given by --hosts or --hosts-file")
+	}
+	conf.Networks.Set(hostsNetworkName, network)
+	return nil
+}
 
-	// Create new Stackup app.
-	app, err := sup.New(conf)
+// writePlan writes the plan to --plan-out file, or to stdout in --output format.
+func writePlan(r *networkRun) error {
+	p, err := r.app.Plan(r.name, r.network, r.vars, r.commands...)
+	if err != nil {
+		return err
+	}
+	if planOut == "" && output == "text" {
+		return p.WriteText(os.Stdout)
+	}
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown --output format %q", output)
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if planOut != "" {
+		return os.WriteFile(planOut, data, 0644)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// writeInventorySkew writes the inventory skew of the networks to stdout
+// in --output format, and returns ErrInventorySkew of the first network
+// with inventory_strict and a skew.
+func writeInventorySkew(conf *sup.Supfile, resolver *sup.Resolver, names []string) error {
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown --output format %q", output)
+	}
+	type networkSkew struct {
+		Network       string             `json:"network"`
+		InventorySkew *sup.InventorySkew `json:"inventory_skew"`
+	}
+	var skews []networkSkew
+	var strictErr error
+	for _, name := range names {
+		network, _, _, err := parseArgs(conf, resolver, name)
+		if err != nil {
+			return err
+		}
+		if network.InventorySkew == nil {
+			return fmt.Errorf("network %v: --check-inventory needs both hosts: and inventory", name)
+		}
+		skews = append(skews, networkSkew{name, network.InventorySkew})
+		if network.InventoryStrict && !network.InventorySkew.Empty() && strictErr == nil {
+			strictErr = sup.ErrInventorySkew{Network: name, Skew: network.InventorySkew}
+		}
+	}
+	if output == "json" {
+		data, err := json.MarshalIndent(skews, "", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stdout.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	} else {
+		for _, skew := range skews {
+			if err := skew.InventorySkew.WriteText(os.Stdout, skew.Network); err != nil {
+				return err
+			}
+		}
+	}
+	return strictErr
+}
+
+// writeEnvDiff writes difference of the env of the two networks given by
+// args to stdout in --output format.
+func writeEnvDiff(conf *sup.Supfile) error {
+	if flag.NArg() != 2 {
+		return errors.New("Usage: sup -diff-env NETWORK_A NETWORK_B")
+	}
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown --output format %q", output)
+	}
+	var vars sup.EnvList
+	for _, env := range envVars {
+		if env == "" {
+			continue
+		}
+		kv := strings.SplitN(env, "=", 2)
+		vars.Set(kv[0], strings.Join(kv[1:], ""))
+	}
+	diff, err := conf.DiffEnv(flag.Arg(0), flag.Arg(1), vars)
+	if err != nil {
+		return err
+	}
+	if output == "text" {
+		return diff.WriteText(os.Stdout)
+	}
+	data, err := json.MarshalIndent(diff, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+// Time and id of the run, shared by the networks run in parallel.
+var (
+	runTime = time.Now().UTC()
+	runID   string
+)
+
+// newRunID returns random (version 4) UUID.
+func newRunID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := cryptorand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generating run id failed")
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// needsConfirmation reports whether the run on the network is confirmed
+// by confirmRun: the ones of protected networks are, unless
+// --i-know-what-im-doing is passed or nothing is run, ie. by -plan.
+func needsConfirmation(network *sup.Network) bool {
+	return network.Protected && !iKnowWhatImDoing && !plan && planOut == "" && freeze == "" && !doctor
+}
+
+// hasInventory reports whether the network has hosts of an inventory,
+// which aren't known until it's run.
+func hasInventory(network *sup.Network) bool {
+	return network.Inventory != "" || network.InventoryHTTP != nil
+}
+
+// confirmRun asks the user to type the protected network name back.
+func confirmRun(stdin *os.File, name string, hosts int, inventory bool, targets []string) error {
+	if batch {
+		return sup.ErrInteractive{Input: "typed confirmation of protected network " + name, Hint: "pass --yes to skip it"}
+	}
+	if !isTerminal(stdin) {
+		return fmt.Errorf("network %v is protected, pass --i-know-what-im-doing to run non-interactively", name)
+	}
+	return confirmName(stdin, os.Stderr, name, hosts, inventory, targets)
+}
+
+// confirmName prompts on w for the protected network name, which has to
+// be typed back on r. The hosts of the inventory aren't counted, as the
+// prompt comes before it's run.
+func confirmName(r io.Reader, w io.Writer, name string, hosts int, inventory bool, targets []string) error {
+	on := fmt.Sprintf("%v host(s)", hosts)
+	if inventory {
+		on += " and the hosts of its inventory"
+	}
+	fmt.Fprintf(w, "Network %v is protected. You're about to run %v on %v.\n", name, strings.Join(targets, " "), on)
+	fmt.Fprintf(w, "Type the network name to confirm: ")
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != name {
+		return fmt.Errorf("confirmation failed, aborting")
+	}
+	return nil
+}
+
+// isTerminal reports whether f is a terminal.
+var isTerminal = func(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// isFlagSet reports whether the flag was passed on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// replayFlags are dropped from the replay command, as they'd select
+// different hosts than the failed ones.
+var replayFlags = map[string]bool{"only": true, "limit": true, "limit-random": true, "seed": true, "parallel-networks": true, "skip-unreachable": true}
+
+// hasHost reports whether the network has host of the name.
+func hasHost(network *sup.Network, name string) bool {
+	for _, host := range network.Hosts {
+		if host.GetHostname() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// replayCommand returns the command line re-running the invocation on
+// the failed hosts of the network only, or on all of them if none.
+func replayCommand(network string, failed []string) string {
+	args := []string{os.Args[0]}
+	flagArgs := os.Args[1 : len(os.Args)-flag.NArg()]
+	for i := 0; i < len(flagArgs); i++ {
+		arg := flagArgs[i]
+		name := strings.TrimLeft(arg, "-")
+		name, _, hasValue := strings.Cut(name, "=")
+		takesValue := false
+		if f := flag.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				takesValue = !hasValue
+			}
+		}
+		if replayFlags[name] {
+			if takesValue {
+				i++
+			}
+			continue
+		}
+		args = append(args, arg)
+		if takesValue && i+1 < len(flagArgs) {
+			i++
+			args = append(args, flagArgs[i])
+		}
+	}
+
+	quoted := make([]string, len(failed))
+	for i, host := range failed {
+		quoted[i] = regexp.QuoteMeta(host)
+	}
+	if len(failed) > 0 {
+		args = append(args, "-only", "^("+strings.Join(quoted, "|")+")$")
+	}
+	if network != hostsNetworkName {
+		args = append(args, network) // --hosts runs have no network argument.
+	}
+	args = append(args, cliArgs[1:]...)
+
+	// Plain words are left unquoted, so the line reads as typed.
+	for i, arg := range args {
+		if arg == "" || strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-") != "" {
+			args[i] = sup.ShellQuote(arg)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// sampleHosts applies --limit or --limit-random to hosts and prints
+// the chosen hosts.
+func sampleHosts(hosts []*sup.Host) ([]*sup.Host, error) {
+	if isFlagSet("limit") && isFlagSet("limit-random") {
+		return nil, errors.New("--limit and --limit-random can't be used together")
+	}
+
+	var sample []*sup.Host
+	var how string
+	if isFlagSet("limit") {
+		if limit <= 0 {
+			return nil, fmt.Errorf("--limit must be positive, got %v", limit)
+		}
+		sample = hosts
+		if limit < len(hosts) {
+			sample = hosts[:limit]
+		}
+		how = fmt.Sprintf("--limit %v", limit)
+	} else {
+		if limitRandom <= 0 {
+			return nil, fmt.Errorf("--limit-random must be positive, got %v", limitRandom)
+		}
+		if !isFlagSet("seed") {
+			seed = time.Now().UnixNano()
+		}
+		// Keep the sampled hosts in the network order.
+		perm := rand.New(rand.NewSource(seed)).Perm(len(hosts))
+		if limitRandom < len(perm) {
+			perm = perm[:limitRandom]
+		}
+		sort.Ints(perm)
+		for _, i := range perm {
+			sample = append(sample, hosts[i])
+		}
+		how = fmt.Sprintf("--limit-random %v --seed %v", limitRandom, seed)
+	}
+
+	names := make([]string, len(sample))
+	for i, host := range sample {
+		names[i] = host.GetHostname()
+	}
+	fmt.Fprintf(os.Stderr, "Running on %v of %v hosts (%v): %v\n", len(sample), len(hosts), how, strings.Join(names, ", "))
+	return sample, nil
+}
+
+func main() {
+	flag.Parse()
+
+	if showHelp {
+		fmt.Fprintln(os.Stderr, ErrUsage, "\n\nOptions:")
+		flag.PrintDefaults()
+		return
+	}
+
+	if showVersion {
+		fmt.Fprintln(os.Stderr, sup.VERSION)
+		return
+	}
+
+	// sup ctl reads the control socket of a run, no Supfile is needed.
+	if flag.Arg(0) == "ctl" {
+		if err := controlClient(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// sup cassette scrubs the cassettes of --record, no Supfile is needed.
+	if flag.Arg(0) == "cassette" {
+		if err := cassetteCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// sup daemon manages the connection sharing daemon, no Supfile is needed.
+	if flag.Arg(0) == "daemon" {
+		if err := daemonCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Read SSH Config file, ie. ~/.ssh/config file
+	// --sshconfig flag location for ssh_config file
+	resolver, err := sup.NewResolver(sshConfig, sshConfigEx)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	app.Debug(debug)
-	app.Prefix(!disablePrefix)
 
-	// Run all the commands in the given network.
-	err = app.Run(network, vars, commands...)
+	if supfile == "" {
+		supfile = "./Supfile"
+	}
+	supfilePath := sup.ResolvePath(supfile)
+	data, err := os.ReadFile(supfilePath)
+	if err != nil {
+		firstErr := err
+		supfilePath = "./Supfile.yml"
+		data, err = os.ReadFile(supfilePath) // Alternative to ./Supfile.
+		if err != nil {
+			fmt.Fprintln(os.Stderr, firstErr)
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// sup doctor checks the Supfile parses, along with everything else.
+	if flag.Arg(0) == "doctor" {
+		if err := doctorCommand(resolver, supfilePath, data, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// sup fmt formats the Supfile instead of running anything.
+	if flag.Arg(0) == "fmt" {
+		if err := formatSupfile(supfilePath, data, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	set, err := sup.NewSupfileSetWithOptions(data, sup.ParseOptions{Resolver: resolver, Format: sup.FormatFromPath(supfilePath)})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conf, err := set.Get(project)
+	if err != nil {
+		if project == "" && (flag.NArg() == 0 || flag.Arg(0) == "list") {
+			projectUsage(set)
+			fmt.Fprintln(os.Stderr, ErrUsage)
+		} else {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+	conf.Dir, err = filepath.Abs(filepath.Dir(supfilePath))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	conf.Workdir = workdir
+	if !quiet {
+		for _, warning := range conf.Warnings {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+	}
+
+	// --lint checks the Supfile only, no network or command is needed.
+	if lint {
+		var vars []string
+		for _, env := range envVars {
+			vars = append(vars, strings.SplitN(env, "=", 2)[0])
+		}
+		findings := conf.Lint(vars...)
+		for _, finding := range findings {
+			fmt.Fprintln(os.Stderr, finding)
+		}
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// --diff-env compares the env of two networks, no host is connected to.
+	if diffEnv {
+		if err := writeEnvDiff(conf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Prepare the run for each network at once, so all the usage errors
+	// and confirmations come before any of the runs starts.
+	cliArgs = flag.Args()
+	if hostList != "" || hostsFile != "" {
+		if err := setHostsNetwork(conf, resolver); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		cliArgs = append([]string{hostsNetworkName}, cliArgs...)
+	} else if like != "" {
+		fmt.Fprintln(os.Stderr, "--like requires --hosts or --hosts-file")
+		os.Exit(1)
+	}
+	if len(cliArgs) == 0 {
+		networkUsage(conf)
+		fmt.Fprintln(os.Stderr, ErrUsage)
+		os.Exit(1)
+	}
+	if skipUnreachable.set || retryUnreachable {
+		baseDir, err := conf.BaseDir()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		unreachable = sup.LoadUnreachable(filepath.Join(baseDir, sup.DefaultUnreachablePath))
+	}
+	if baseDir, err := conf.BaseDir(); err == nil {
+		deployed = sup.LoadDeployed(filepath.Join(baseDir, sup.DefaultDeployedPath))
+	}
+	names := []string{cliArgs[0]}
+	if parallelNetworks {
+		names = strings.Split(cliArgs[0], ",")
+	}
+
+	// --check-inventory reports the skew of hosts: and the inventory only.
+	if checkInventory {
+		if err := writeInventorySkew(conf, resolver, names); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// --record records the runs into cassettes, --replay replays them
+	// instead of connecting to the hosts.
+	if record != "" && replay != "" {
+		fmt.Fprintln(os.Stderr, "--record and --replay are mutually exclusive")
+		os.Exit(1)
+	}
+	if replay != "" {
+		if cassette, err = sup.ReadCassette(replay); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	var runs []*networkRun
+	for _, name := range names {
+		r, err := prepareRun(conf, resolver, name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		runs = append(runs, r)
+	}
+	if !quiet {
+		for _, warning := range conf.PathWarnings(runs[0].commands) {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		for _, warning := range conf.ScriptsDirWarnings(runs[0].commands) {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		for _, warning := range conf.ScriptWarnings(runs[0].commands) {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		for _, r := range runs {
+			for _, warning := range conf.InventorySkewWarnings(r.name, r.network.InventorySkew) {
+				fmt.Fprintln(os.Stderr, warning)
+			}
+		}
+	}
+
+	// Env vars nothing references, and references of ones no env defines,
+	// which fail the run with --strict-env.
+	seen := map[string]bool{}
+	var undefined []sup.Warning
+	for _, r := range runs {
+		for _, warning := range conf.EnvWarnings(r.name, r.network, r.vars, r.commands) {
+			if seen[warning.String()] {
+				continue
+			}
+			seen[warning.String()] = true
+			switch {
+			case strictEnv && warning.Code == sup.WarnUndefinedEnv:
+				undefined = append(undefined, warning)
+			case !quiet:
+				fmt.Fprintln(os.Stderr, warning)
+			}
+		}
+	}
+	if len(undefined) > 0 {
+		for _, warning := range undefined {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+		fmt.Fprintf(os.Stderr, "--strict-env: %d references of env vars no env defines\n", len(undefined))
+		os.Exit(1)
+	}
+
+	// --plan prints the plan instead of running it.
+	if plan || planOut != "" {
+		if planOut != "" && len(runs) > 1 {
+			fmt.Fprintln(os.Stderr, "--plan-out supports a single network only")
+			os.Exit(1)
+		}
+		for _, r := range runs {
+			if err := writePlan(r); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	// --freeze writes the lock of the runs instead of running them, and
+	// --frozen refuses to run what differs from the lock.
+	if freeze != "" || frozen != "" {
+		lock := conf.NewLock()
+		for _, r := range runs {
+			run, err := r.app.LockRun(r.name, r.network, r.vars, r.commands...)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			lock.Runs = append(lock.Runs, run)
+		}
+		if freeze != "" {
+			if err := lock.Write(freeze); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+		locked, err := sup.ReadLock(frozen)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if diffs := locked.Diff(lock); len(diffs) > 0 {
+			for _, diff := range diffs {
+				fmt.Fprintln(os.Stderr, diff)
+			}
+			fmt.Fprintf(os.Stderr, "--frozen: the run differs from %v in %d ways, see above\n", frozen, len(diffs))
+			os.Exit(1)
+		}
+	}
+
+	// inventory_strict networks don't run with stale hosts:.
+	for _, r := range runs {
+		if r.network.InventoryStrict && !r.network.InventorySkew.Empty() {
+			fmt.Fprintln(os.Stderr, sup.ErrInventorySkew{Network: r.name, Skew: r.network.InventorySkew})
+			os.Exit(1)
+		}
+	}
+
+	// --metrics-* flags override Supfile metrics config.
+	if metricsPushgateway != "" {
+		conf.Metrics.Pushgateway = metricsPushgateway
+	}
+	if metricsFile != "" {
+		conf.Metrics.File = metricsFile
+	}
+
+	// --control-socket serves the progress of the runs.
+	var control *sup.Control
+	if controlSocket != "" {
+		var err error
+		if control, err = sup.NewControl(controlSocket); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, r := range runs {
+			r.app.OnEvent(control.Track(r.name, r.network, r.commands))
+		}
+	}
+
+	if record != "" {
+		if recorder, err = sup.NewRecorder(record); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, r := range runs {
+			r.app.Record(recorder)
+		}
+	}
+
+	// Run all the commands in the given network(s).
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, r := range runs {
+		wg.Add(1)
+		go func(i int, r *networkRun) {
+			defer wg.Done()
+			errs[i] = r.run(conf, supfilePath)
+		}(i, r)
+	}
+	wg.Wait()
+	if conf.Metrics.File != "" {
+		var metrics []*sup.Metrics
+		for _, r := range runs {
+			if r.metrics != nil {
+				metrics = append(metrics, r.metrics)
+			}
+		}
+		if err := sup.WriteMetricsFile(sup.ResolvePath(conf.Metrics.File), metrics...); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+	for _, r := range runs {
+		if r.recordsDeployed() {
+			if err := deployed.Save(); err != nil {
+				fmt.Fprintln(os.Stderr, "Warning:", err)
+			}
+			break
+		}
+	}
+	if unreachable != nil {
+		var ttl time.Duration
+		if skipUnreachable.set {
+			ttl = skipUnreachable.value
+		}
+		if err := unreachable.Save(ttl); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+	if control != nil {
+		if err := control.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+	if recorder != nil {
+		if err := recorder.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: --record:", err)
+		}
+	}
+
+	// Exit with the status of the first failed network.
+	var failed error
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(sup.ErrExitStatus); !ok {
+			if len(runs) > 1 {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", runs[i].name, err)
+			} else {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		if failed == nil {
+			failed = err
+		}
+	}
+	if e, ok := failed.(sup.ErrExitStatus); ok {
+		os.Exit(e.Status)
+	}
+	if failed != nil {
+		if _, ok := failed.(sup.ErrAborted); ok {
+			os.Exit(sup.ExitAborted)
+		}
+		os.Exit(1)
+	}
+}
+
+// networkRun is a prepared run of the commands on a single network.
+type networkRun struct {
+	name     string
+	network  *sup.Network
+	vars     sup.EnvList
+	commands []*sup.Command
+	app      *sup.Stackup
+	pipe     *sup.Pipe    // Pipe target run instead of the commands, see sup.Pipe.
+	metrics  *sup.Metrics // Of the run, written to the metrics file by main.
+	skipped  []string     // Hosts skipped by -skip-unreachable.
+	partial  bool         // Some hosts of the network are filtered out.
+}
+
+// recordsDeployed reports whether the run records the commits of its
+// changed_paths commands: runs on some of the network's hosts only don't.
+func (r *networkRun) recordsDeployed() bool {
+	if deployed == nil || r.partial {
+		return false
+	}
+	for _, cmd := range r.commands {
+		if len(cmd.ChangedPaths) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareRun parses the network and commands from args and applies the
+// host filtering flags.
+func prepareRun(conf *sup.Supfile, resolver *sup.Resolver, name string) (*networkRun, error) {
+	hostSelector, err := sup.ParseSelector(selector)
+	if err != nil {
+		return nil, errors.Wrap(err, "--selector")
+	}
+
+	// Protected networks need the run to be confirmed, before their env
+	// and inventory are resolved by local commands.
+	if network, ok := conf.Networks.Get(name); ok && needsConfirmation(&network) {
+		if err := confirmRun(os.Stdin, name, len(network.Hosts), hasInventory(&network), cliArgs[1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Parse network and commands to be run from args.
+	network, commands, vars, err := parseArgs(conf, resolver, name)
+	if err != nil {
+		return nil, err
+	}
+	hostCount := len(network.Hosts)
+
+	// --only flag filters hosts
+	if onlyHosts != "" {
+		expr, err := regexp.CompilePOSIX(onlyHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		var hosts []*sup.Host
+		for _, host := range network.Hosts {
+			if expr.MatchString(host.GetHostname()) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("no hosts match --only '%v' regexp", onlyHosts)
+		}
+		network.Hosts = hosts
+	}
+
+	// --except flag filters out hosts
+	if exceptHosts != "" {
+		expr, err := regexp.CompilePOSIX(exceptHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		var hosts []*sup.Host
+		for _, host := range network.Hosts {
+			if !expr.MatchString(host.GetHostname()) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts)
+		}
+		network.Hosts = hosts
+	}
+
+	// --selector flag filters hosts by labels
+	if selector != "" {
+		var hosts []*sup.Host
+		for _, host := range network.Hosts {
+			if hostSelector.Matches(host.Labels) {
+				hosts = append(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("no hosts match --selector '%v'", selector)
+		}
+		network.Hosts = hosts
+	}
+
+	// --retry-unreachable forgets and --skip-unreachable skips the hosts,
+	// which failed to connect recently.
+	if retryUnreachable {
+		unreachable.Clear(name)
+	}
+	var skipped []string
+	if skipUnreachable.set {
+		var hosts []*sup.Host
+		hosts, skipped = unreachable.Skip(name, network.Hosts, skipUnreachable.value)
+		if len(skipped) > 0 {
+			fmt.Fprintf(os.Stderr, "Skipping %v of %v hosts unreachable within %v (-retry-unreachable to try them): %v\n", len(skipped), len(network.Hosts), skipUnreachable.value, strings.Join(skipped, ", "))
+		}
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("all hosts of %v are unreachable, see -retry-unreachable", name)
+		}
+		network.Hosts = hosts
+	}
+
+	// --limit and --limit-random flags sample hosts
+	if isFlagSet("limit") || isFlagSet("limit-random") {
+		hosts, err := sampleHosts(network.Hosts)
+		if err != nil {
+			return nil, err
+		}
+		network.Hosts = hosts
+	}
+
+	// --use-openssh flag overrides network transport
+	if useOpenSSH {
+		network.Transport = sup.TransportOpenSSH
+	}
+
+	// Create new Stackup app.
+	app, err := sup.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	app.Debug(debug)
+	app.PreferKey(preferKey)
+	app.Prefix(!disablePrefix)
+	if isFlagSet("prefix-format") {
+		if err := app.PrefixFormat(prefixFormat); err != nil {
+			return nil, err
+		}
+	}
+	app.StripANSI(stripANSI || batch)
+	app.MaxOutputBytes(maxOutputBytes)
+	app.Banners(!noBanners)
+	if keepTunnels {
+		app.KeepTunnels(os.Stdin)
+	}
+	app.ChangedSince(since)
+	if skipped := skippedCommands(commands); len(skipped) > 0 {
+		app.SkipCommands(skipped...)
+	}
+	if deployed != nil {
+		app.Deployed(deployed)
+	}
+	app.Batch(batch)
+	if isFlagSet("seed") {
+		app.Seed(seed)
+	}
+	if syncDir != "" || syncClean {
+		if syncDir == "" {
+			syncDir = "."
+		}
+		if err := app.Sync(syncDir); err != nil {
+			return nil, err
+		}
+	}
+	if cassette != nil {
+		app.Dial(cassette.Dial())
+	}
+	if socket := sup.DaemonSocket(); !noDaemon && cassette == nil {
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			app.Daemon(socket)
+		}
+	}
+
+	if skipUnreachable.set {
+		app.OnEvent(unreachable.Handler(name))
+	}
+
+	var pipe *sup.Pipe
+	if len(cliArgs) == 2 {
+		pipe, _ = conf.Targets.Pipe(cliArgs[1])
+	}
+
+	partial := len(network.Hosts) < hostCount
+	return &networkRun{name: name, network: network, vars: vars, commands: commands, app: app, pipe: pipe, skipped: skipped, partial: partial}, nil
+}
+
+// run runs the commands on the network.
+func (r *networkRun) run(conf *sup.Supfile, supfilePath string) error {
+	app := r.app
+
+	if conf.Metrics.Pushgateway != "" || conf.Metrics.File != "" {
+		r.metrics = sup.NewMetrics(map[string]string{
+			"network": r.name,
+			"target":  strings.Join(cliArgs[1:], " "),
+			"supfile": filepath.Base(supfilePath),
+		})
+		app.OnEvent(r.metrics.Handle)
+	}
+
+	// Failed hosts, for the replay command, and the timeouts they failed by.
+	failed := map[string]bool{}
+	timedOut := map[string][]string{}
+	app.OnEvent(func(e sup.Event) {
+		if (e.Type == sup.HostConnected || e.Type == sup.CommandFinished) && e.Err != nil && !e.Ignored && e.Host != "" {
+			failed[e.Host] = true
+			if reason := sup.FailureReason(e.Err); reason != "" {
+				timedOut[reason] = append(timedOut[reason], e.Host)
+			}
+		}
+	})
+
+	// Commands skipped by changed_paths, for the summary. The ones run on
+	// all hosts of the network record the commit they were run at, the
+	// baseline of their changed_paths in the next runs.
+	var unchanged, userSkipped []string
+	app.OnEvent(func(e sup.Event) {
+		switch {
+		case e.Type != sup.CommandSkipped || e.Host != "":
+		case e.Reason == sup.SkippedByUser:
+			userSkipped = append(userSkipped, e.Command)
+		default:
+			unchanged = append(unchanged, e.Command)
+		}
+	})
+	if r.recordsDeployed() {
+		if baseDir, err := conf.BaseDir(); err == nil {
+			app.OnEvent(deployed.Handler(r.name, baseDir, r.commands))
+		}
+	}
+
+	// OpenTelemetry tracing, enabled by OTEL_EXPORTER_OTLP_* env vars.
+	tracer := sup.NewTracerFromEnv(r.name)
+	if tracer != nil {
+		app.OnEvent(tracer.Handle)
+	}
+
+	// Run all the commands in the given network, or the pipe target.
+	var err error
+	if r.pipe != nil {
+		err = app.Pipe(r.network, r.vars, r.pipe)
+	} else {
+		err = app.Run(r.network, r.vars, r.commands...)
+	}
+
+	if tracer != nil {
+		if err := tracer.Export(); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+
+	// Metrics failures are not fatal. The metrics file of all the
+	// networks is written by main.
+	if r.metrics != nil && conf.Metrics.Pushgateway != "" {
+		if err := r.metrics.Push(conf.Metrics.Pushgateway, conf.Metrics.Job); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning:", err)
+		}
+	}
+
+	if len(r.skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped unreachable hosts: %v\n", strings.Join(r.skipped, ", "))
+	}
+	if len(userSkipped) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped commands: %v (%v)\n", strings.Join(userSkipped, ", "), sup.SkippedByUser)
+	}
+	if len(unchanged) > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped unchanged commands: %v\n", strings.Join(unchanged, ", "))
+	}
+	for _, reason := range []string{sup.ReasonConnectTimeout, sup.ReasonTimeout, sup.ReasonIdleTimeout} {
+		if hosts := timedOut[reason]; len(hosts) > 0 {
+			sort.Strings(hosts)
+			fmt.Fprintf(os.Stderr, "Hosts failed by %v: %v\n", reason, strings.Join(hosts, ", "))
+		}
+	}
+	switch {
+	case err != nil && len(failed) > 0:
+		// The "local" pseudo-host of local: also commands can't be
+		// selected by -only, it runs along with any of the hosts.
+		var hosts []string
+		for host := range failed {
+			if host != sup.LocalHostname || hasHost(r.network, host) {
+				hosts = append(hosts, host)
+			}
+		}
+		sort.Strings(hosts)
+		what := "failed hosts"
+		if len(hosts) == 0 {
+			what = "failed local command"
+		}
+		if len(r.skipped) > 0 {
+			hosts = append(hosts, r.skipped...)
+			what = "failed and skipped hosts"
+		}
+		fmt.Fprintf(os.Stderr, "Retry the %v with:\n  %v\n", what, replayCommand(r.name, hosts))
+	case len(r.skipped) > 0:
+		fmt.Fprintf(os.Stderr, "Run on the skipped hosts once they're back with:\n  %v\n", replayCommand(r.name, r.skipped))
+	}
+	return err
 }
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pressly/sup"
+)
+
+func TestConfirmName(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		answer string
+		ok     bool
+	}{
+		{"correct name", "production\n", true},
+		{"spaces around", "  production \n", true},
+		{"no newline", "production", true},
+		{"wrong name", "staging\n", false},
+		{"prefix", "prod\n", false},
+		{"case", "Production\n", false},
+		{"empty", "\n", false},
+		{"eof", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var prompt bytes.Buffer
+			err := confirmName(strings.NewReader(tt.answer), &prompt, "production", 3, false, []string{"deploy", "restart"})
+			if tt.ok && err != nil {
+				t.Errorf("got error %v, want the run confirmed", err)
+			}
+			if !tt.ok && (err == nil || err.Error() != "confirmation failed, aborting") {
+				t.Errorf("got error %v, want confirmation failed", err)
+			}
+			want := "Network production is protected. You're about to run deploy restart on 3 host(s).\nType the network name to confirm: "
+			if prompt.String() != want {
+				t.Errorf("got prompt %q, want %q", prompt.String(), want)
+			}
+		})
+	}
+}
+
+func TestConfirmNameInventory(t *testing.T) {
+	var prompt bytes.Buffer
+	if err := confirmName(strings.NewReader("production\n"), &prompt, "production", 2, true, []string{"deploy"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "Network production is protected. You're about to run deploy on 2 host(s) and the hosts of its inventory.\nType the network name to confirm: "
+	if prompt.String() != want {
+		t.Errorf("got prompt %q, want %q", prompt.String(), want)
+	}
+}
+
+// TestConfirmBeforeResolving checks the prompt of a protected network
+// comes before the local commands of its env and inventory are run.
+func TestConfirmBeforeResolving(t *testing.T) {
+	defer func(args []string, stdin *os.File, terminal func(*os.File) bool) {
+		cliArgs, os.Stdin, isTerminal = args, stdin, terminal
+	}(cliArgs, os.Stdin, isTerminal)
+	isTerminal = func(*os.File) bool { return true }
+	cliArgs = []string{"production", "deploy"}
+
+	for _, tt := range []struct {
+		answer   string
+		resolved bool // The env and inventory are resolved.
+	}{
+		{"staging\n", false},
+		{"production\n", true},
+	} {
+		t.Run(strings.TrimSpace(tt.answer), func(t *testing.T) {
+			dir := t.TempDir()
+			conf, err := sup.NewSupfile([]byte(fmt.Sprintf(`
+version: 0.5
+networks:
+  production:
+    protected: true
+    hosts: [web1]
+    env:
+      RESOLVED: $(touch %[1]v/env && echo yes)
+    inventory: touch %[1]v/inventory
+commands:
+  deploy:
+    run: echo $RESOLVED
+`, dir)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resolver, err := sup.NewResolver("", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdin := filepath.Join(dir, "stdin")
+			if err := os.WriteFile(stdin, []byte(tt.answer), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if os.Stdin, err = os.Open(stdin); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Stdin.Close()
+
+			_, err = prepareRun(conf, resolver, "production")
+			if !tt.resolved && (err == nil || err.Error() != "confirmation failed, aborting") {
+				t.Errorf("got error %v, want confirmation failed", err)
+			}
+			for _, file := range []string{"env", "inventory"} {
+				_, statErr := os.Stat(filepath.Join(dir, file))
+				if resolved := statErr == nil; resolved != tt.resolved {
+					t.Errorf("%v resolved %v, want %v (error %v)", file, resolved, tt.resolved, err)
+				}
+			}
+		})
+	}
+}
+
+// TestConfirmBatch checks the prompt fails in batch mode instead of
+// reading the terminal, a pipe nothing is written to.
+func TestConfirmBatch(t *testing.T) {
+	defer func(b bool, terminal func(*os.File) bool) { batch, isTerminal = b, terminal }(batch, isTerminal)
+	batch, isTerminal = true, func(*os.File) bool { return true }
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- confirmRun(r, "production", 2, false, []string{"deploy"}) }()
+	select {
+	case err := <-done:
+		var batchErr sup.ErrInteractive
+		if !errors.As(err, &batchErr) {
+			t.Fatalf("got error %v, want ErrInteractive", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("confirmation blocked on input in batch mode")
+	}
+}
+
+func TestNeedsConfirmation(t *testing.T) {
+	defer func(yes, p bool) { iKnowWhatImDoing, plan = yes, p }(iKnowWhatImDoing, plan)
+
+	for _, tt := range []struct {
+		name      string
+		protected bool
+		yes       bool // --i-know-what-im-doing or --yes.
+		plan      bool
+		want      bool
+	}{
+		{name: "protected", protected: true, want: true},
+		{name: "not protected"},
+		{name: "override", protected: true, yes: true},
+		{name: "plan", protected: true, plan: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			iKnowWhatImDoing, plan = tt.yes, tt.plan
+			if got := needsConfirmation(&sup.Network{Protected: tt.protected}); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
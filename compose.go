@@ -0,0 +1,105 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ComposeOptions are the run-wide settings shaping the remote command
+// string of ComposeRemoteCommand, which Stackup takes from the Supfile,
+// the network and its flags.
+type ComposeOptions struct {
+	Fragments map[string]string // Fragments of the Supfile, see Command.Use.
+	Audit     Audit             // Audit config, the Supfile's overridden by the network's.
+	Sanitize  Sanitize          // Network level clean_env and umask, overridden by the command's.
+	PassEnv   EnvList           // Local env vars of the command's pass_env, see PassEnv.
+	Sync      bool              // Start in $SUP_SYNC_DIR, see Stackup.Sync.
+	Trace     bool              // Trace the command by set -x, as -D does.
+	TTY       bool              // Run with a pseudo terminal, ie. by docker exec -it.
+	Header    string            // Comment line(s) starting the command, see Supfile.EmbedContext.
+}
+
+// ComposeRemoteCommand returns the command string sent to the shell of
+// the host for the run: (or steps and service action) of cmd, exactly as
+// sup runs it: the audit banner, the env exports, the fragments and the
+// umask, clean_env, nice/ionice/cpu_limit and docker/kubectl exec
+// wrappers. env holds the Supfile and network env vars, including the
+// SUP_* ones, which are followed by the host's env, labels and SUP_HOST.
+// Local commands get none of the wrappers. It has no side effects, so
+// library users may audit the commands without connecting to any host.
+func ComposeRemoteCommand(cmd Command, host *Host, env EnvList, opts ComposeOptions) (string, error) {
+	conf := &Supfile{Fragments: opts.Fragments}
+	run, err := conf.commandRun(&cmd)
+	if err != nil {
+		return "", err
+	}
+	if run == "" {
+		return "", fmt.Errorf("%v: no run, steps or service to compose", cmd.Name)
+	}
+
+	prefix := opts.PassEnv.AsExport()
+	if opts.Sync && !cmd.Local {
+		prefix += syncChdirCommand
+	}
+	task := &Task{Run: prefix + traced(run, opts.Trace), TTY: opts.TTY, Kind: TaskRun, Local: cmd.Local}
+	if !cmd.Local {
+		task.Header = opts.Header
+	}
+	exports := env.AsExport()
+	if host != nil {
+		exports = host.exports(exports)
+	}
+	if cmd.Local {
+		return task.command(exports), nil
+	}
+	tasks := []*Task{task}
+	opts.Audit.apply(&cmd, tasks)
+	if err := cmd.Limits.apply(&cmd, tasks); err != nil {
+		return "", err
+	}
+	if err := opts.Sanitize.Override(cmd.Sanitize).apply(&cmd, tasks); err != nil {
+		return "", err
+	}
+	return host.remoteCommand(task, exports, opts.TTY), nil
+}
+
+// commandRun returns the run: (or steps) of cmd followed by its service
+// action, with the fragments of use: prepended, or "" if it has neither.
+func (s *Supfile) commandRun(cmd *Command) (string, error) {
+	run := cmd.runScript()
+	if cmd.Service != nil {
+		script, err := cmd.Service.Script()
+		if err != nil {
+			return "", err
+		}
+		if run != "" {
+			run = strings.TrimRight(run, "\n") + "\n"
+		}
+		run += script
+	}
+	if run == "" {
+		return "", nil
+	}
+	return s.useScript(cmd, run)
+}
+
+// traced returns run traced by set -x if trace is set.
+func traced(run string, trace bool) string {
+	if trace {
+		return "set -x;" + run
+	}
+	return run
+}
+
+// exports returns the env exports of the host's tasks: env followed by
+// the host's env, labels and SUP_HOST.
+func (h *Host) exports(env string) string {
+	labelEnv := h.LabelEnv()
+	return env + h.Env.AsExport() + labelEnv.AsExport() + `export SUP_HOST="` + h.GetHostname() + `";`
+}
+
+// remoteCommand returns the command string of the task sent to the host,
+// env being the exports of Host.exports. All clients run the tasks by it.
+func (h *Host) remoteCommand(task *Task, env string, tty bool) string {
+	return h.exec(task.ForHost(h).command(env), tty)
+}
@@ -0,0 +1,134 @@
+package sup_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+const composeSupfile = `
+version: 0.5
+fragments:
+  strict: set -eu
+  retry: retry() { "$@" || "$@"; }
+commands:
+  plain:
+    run: echo hello
+  steps:
+    run:
+      - make build
+      - make install
+  use:
+    use: [strict, retry]
+    run: retry ./deploy.sh
+  service:
+    run: ./migrate.sh
+    service: {name: app, action: reload}
+  clean:
+    run: env
+    clean_env: true
+  dirty:
+    run: env
+    clean_env: false
+  umask:
+    run: touch file
+    umask: "027"
+  limits:
+    run: ./backup.sh
+    nice: 10
+    ionice: idle
+    cpu_limit: 50%
+  all:
+    use: [strict]
+    run: ./deploy.sh "$VERSION"
+    clean_env: true
+    umask: "022"
+    nice: 5
+    ionice: "2"
+  local:
+    local: true
+    run: make dist
+    nice: 10
+`
+
+// TestComposeRemoteCommand locks the remote commands of a matrix of
+// commands, hosts and options, so the order of the wrappers doesn't change
+// unnoticed. Run with SUPTEST_UPDATE=1 to update the golden file.
+func TestComposeRemoteCommand(t *testing.T) {
+	conf, err := sup.NewSupfile([]byte(composeSupfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := func(name string) *sup.Host {
+		h, err := sup.NewHost(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	web := host("deploy@web1")
+	web.Env = sup.EnvList{{Key: "ROLE", Value: "web"}}
+	web.Labels = map[string]string{"tier": "frontend"}
+
+	var env sup.EnvList
+	env.Set("VERSION", "1.2.3")
+	env.Set("SUP_NETWORK", "production")
+
+	var b strings.Builder
+	for _, tt := range []struct {
+		name    string
+		command string
+		host    *sup.Host
+		opts    sup.ComposeOptions
+	}{
+		{name: "plain", command: "plain", host: host("web1")},
+		{name: "no host", command: "plain"},
+		{name: "host env and labels", command: "plain", host: web},
+		{name: "steps", command: "steps", host: host("web1")},
+		{name: "fragments", command: "use", host: host("web1")},
+		{name: "service", command: "service", host: host("web1")},
+		{name: "clean_env", command: "clean", host: host("web1")},
+		{name: "network clean_env", command: "plain", host: host("web1"), opts: sup.ComposeOptions{Sanitize: sup.Sanitize{CleanEnv: boolPtr(true)}}},
+		{name: "command clean_env false", command: "dirty", host: host("web1"), opts: sup.ComposeOptions{Sanitize: sup.Sanitize{CleanEnv: boolPtr(true), Umask: "077"}}},
+		{name: "umask", command: "umask", host: host("web1")},
+		{name: "limits", command: "limits", host: host("web1")},
+		{name: "audit banner", command: "plain", host: host("web1"), opts: sup.ComposeOptions{Audit: sup.Audit{Banner: true}}},
+		{name: "audit file", command: "plain", host: host("web1"), opts: sup.ComposeOptions{Audit: sup.Audit{File: "/var/log/sup.log"}}},
+		{name: "pass_env", command: "plain", host: host("web1"), opts: sup.ComposeOptions{PassEnv: sup.EnvList{{Key: "TOKEN", Value: "it's secret"}}}},
+		{name: "sync", command: "plain", host: host("web1"), opts: sup.ComposeOptions{Sync: true}},
+		{name: "trace", command: "plain", host: host("web1"), opts: sup.ComposeOptions{Trace: true}},
+		{name: "header", command: "plain", host: host("web1"), opts: sup.ComposeOptions{Header: "# sup: deploy\n"}},
+		{name: "docker", command: "plain", host: host("docker://app")},
+		{name: "docker tty", command: "plain", host: host("docker://app"), opts: sup.ComposeOptions{TTY: true}},
+		{name: "kubectl", command: "plain", host: host("k8s://shop/web-1/nginx")},
+		{name: "all", command: "all", host: host("docker://deploy@build1/worker"), opts: sup.ComposeOptions{
+			Audit:   sup.Audit{Banner: true},
+			PassEnv: sup.EnvList{{Key: "TOKEN", Value: "secret"}},
+			Sync:    true,
+			Trace:   true,
+			Header:  "# sup: all\n",
+		}},
+		{name: "local", command: "local", host: host("web1"), opts: sup.ComposeOptions{Audit: sup.Audit{Banner: true}, Sync: true}},
+	} {
+		cmd, ok := conf.Commands.Get(tt.command)
+		if !ok {
+			t.Fatalf("%v: unknown command %v", tt.name, tt.command)
+		}
+		cmd.Name = tt.command
+		opts := tt.opts
+		opts.Fragments = conf.Fragments
+		got, err := sup.ComposeRemoteCommand(cmd, tt.host, env, opts)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		fmt.Fprintf(&b, "== %v\n%v\n\n", tt.name, got)
+	}
+	suptest.Golden(t, "testdata/compose.golden", strings.TrimSuffix(b.String(), "\n"))
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,81 @@
+package sup
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// connectLimiter is a token bucket of connect_rate, gating the dials of
+// the hosts and bastions of a network. The bucket holds up to count
+// tokens, refilled one per period/count, so the dials start with a burst
+// of count connections and go on at the rate. Throttled dials wait for a
+// random extra fraction of the refill interval, so they don't go out in
+// lockstep.
+type connectLimiter struct {
+	rate     string
+	count    int
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // When the bucket is full again.
+}
+
+// newConnectLimiter returns limiter of the network's connect_rate, or nil
+// if it's unlimited.
+func newConnectLimiter(network *Network) (*connectLimiter, error) {
+	if network.ConnectRate == "" {
+		return nil, nil
+	}
+	count, period, err := parseRate(network.ConnectRate)
+	if err != nil {
+		return nil, fmt.Errorf("connect_rate: invalid value %q, expected connections per period, ie. \"10/s\"", network.ConnectRate)
+	}
+	return &connectLimiter{rate: network.ConnectRate, count: count, interval: period / time.Duration(count)}, nil
+}
+
+// reserve takes a token and returns how long to wait before dialing.
+func (l *connectLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	// The token is available once the bucket is at most count-1 tokens
+	// short of full.
+	wait := l.next.Add(-time.Duration(l.count-1) * l.interval).Sub(now)
+	l.next = l.next.Add(l.interval)
+	if wait <= 0 {
+		return 0
+	}
+	return wait + time.Duration(rand.Int63n(int64(l.interval)/2+1))
+}
+
+// waitConnect blocks until name may be dialed, see Network.ConnectRate.
+// Waits are reported in debug mode.
+func (sup *Stackup) waitConnect(l *connectLimiter, name string) {
+	if l == nil {
+		return
+	}
+	wait := l.reserve()
+	if wait <= 0 {
+		return
+	}
+	if sup.debug {
+		sup.errorf("%v: connect_rate %v: dial throttled for %v\n", name, l.rate, wait.Round(time.Millisecond))
+	}
+	time.Sleep(wait)
+}
+
+// ConnectEstimate returns how long connect_rate alone stretches dialing
+// of the hosts, not counting the time the connections take.
+func (n Network) ConnectEstimate(hosts int) (time.Duration, error) {
+	l, err := newConnectLimiter(&n)
+	if err != nil || l == nil || hosts <= l.count {
+		return 0, err
+	}
+	return time.Duration(hosts-l.count) * l.interval, nil
+}
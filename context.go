@@ -0,0 +1,61 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// contextHeader returns the comment line of embed_context describing the
+// run of the command: run ID, sup version, network, command, local user
+// and host, timestamp and SHA256 of the Supfile. Only these values are
+// written, never the env of the run.
+func (r Release) contextHeader(network, command string, supfile []byte) string {
+	hostname, _ := os.Hostname()
+	fields := []string{
+		"run_id=" + r.RunID,
+		"version=" + VERSION,
+		"network=" + network,
+		"command=" + command,
+		"user=" + r.User,
+		"host=" + hostname,
+		"time=" + r.Timestamp,
+		fmt.Sprintf("supfile_sha256=%x", sha256.Sum256(supfile)),
+	}
+	for i, field := range fields {
+		fields[i] = strings.Join(strings.Fields(field), "_")
+	}
+	return "# sup: " + strings.Join(fields, " ") + "\n"
+}
+
+// commentsByHash reports whether the interpreter of a script comments
+// lines by #, so the embed_context header can be written into it.
+func commentsByHash(interpreter string) bool {
+	if isShell(interpreter) {
+		return true
+	}
+	fields := strings.Fields(interpreter)
+	if len(fields) > 1 && path.Base(fields[0]) == "env" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	name := strings.TrimRight(path.Base(fields[0]), "0123456789.")
+	switch name {
+	case "python", "ruby", "perl":
+		return true
+	}
+	return false
+}
+
+// embedContext returns the header of embed_context for the remote command,
+// or "" if the Supfile doesn't set it or the command is local.
+func (sup *Stackup) embedContext(cmd *Command) string {
+	if !sup.conf.EmbedContext || cmd.Local {
+		return ""
+	}
+	return sup.release.contextHeader(sup.network, cmd.Name, sup.conf.data)
+}
@@ -0,0 +1,211 @@
+package sup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Control serves a read-only view of the runs as JSON over HTTP on a unix
+// socket, for wrapper scripts and hooks: GET /status and GET /hosts. The
+// socket is readable by the user only. Nothing can be run through it.
+type Control struct {
+	path     string
+	listener net.Listener
+	server   *http.Server
+
+	mu      sync.Mutex
+	started time.Time
+	runs    []*ControlRun
+	hosts   []*ControlHost
+}
+
+// ControlStatus is the progress of the runs, served by GET /status.
+type ControlStatus struct {
+	Started time.Time     `json:"started"`
+	Runs    []*ControlRun `json:"runs"`
+}
+
+// ControlRun is the progress of the run on a network.
+type ControlRun struct {
+	Network  string   `json:"network"`
+	Commands []string `json:"commands"`
+	Command  string   `json:"command,omitempty"` // Running command, if any.
+	Done     int      `json:"done"`              // Commands finished, of Commands.
+	Hosts    int      `json:"hosts"`
+	Failed   []string `json:"failed,omitempty"` // Hosts failed so far.
+	Finished bool     `json:"finished"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Host states of ControlHost.
+const (
+	ControlHostPending   = "pending"
+	ControlHostConnected = "connected"
+	ControlHostFailed    = "failed"
+)
+
+// ControlHost is a host of a run, served by GET /hosts.
+type ControlHost struct {
+	Network string `json:"network"`
+	Host    string `json:"host"`    // Host as specified in Supfile.
+	Address string `json:"address"` // Address connected to, after host_overrides and resolver.
+	Port    string `json:"port,omitempty"`
+	User    string `json:"user,omitempty"`
+	Bastion string `json:"bastion,omitempty"` // Bastion the host is connected through.
+	State   string `json:"state"`
+	Error   string `json:"error,omitempty"`
+}
+
+// NewControl starts serving on the unix socket at path. A stale socket of
+// a crashed run is replaced.
+func NewControl(path string) (*Control, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("control socket %v: file exists", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %v is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrap(err, "control socket")
+		}
+	}
+
+	// The socket is created in a private directory and moved to path once
+	// its mode is set, so it's never accessible by others.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sup-control-")
+	if err != nil {
+		return nil, errors.Wrap(err, "control socket")
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, errors.Wrap(err, "control socket")
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "control socket")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "control socket")
+	}
+
+	c := &Control{path: path, listener: listener, started: time.Now()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.serve(func() interface{} {
+		return ControlStatus{Started: c.started, Runs: c.runs}
+	}))
+	mux.HandleFunc("/hosts", c.serve(func() interface{} {
+		return c.hosts
+	}))
+	c.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go c.server.Serve(listener)
+	return c, nil
+}
+
+// serve returns handler writing the value as JSON.
+func (c *Control) serve(value func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "read-only: GET only", http.StatusMethodNotAllowed)
+			return
+		}
+		c.mu.Lock()
+		data, err := json.MarshalIndent(value(), "", "  ")
+		c.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(append(data, '\n'))
+	}
+}
+
+// Track adds the run of commands on the network and returns the handler
+// to be registered with Stackup.OnEvent of the run.
+func (c *Control) Track(name string, network *Network, commands []*Command) func(Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	run := &ControlRun{Network: name, Commands: []string{}, Hosts: len(network.Hosts)}
+	for _, cmd := range commands {
+		run.Commands = append(run.Commands, cmd.Name)
+	}
+	c.runs = append(c.runs, run)
+	hosts := map[string]*ControlHost{}
+	for _, host := range network.Hosts {
+		h := &ControlHost{
+			Network: name,
+			Host:    host.GetHostname(),
+			Address: host.Address,
+			Port:    host.Port,
+			User:    host.User,
+			Bastion: host.jumpHost(network.Bastion),
+			State:   ControlHostPending,
+		}
+		hosts[h.Host] = h
+		c.hosts = append(c.hosts, h)
+	}
+
+	failed := map[string]bool{}
+	return func(e Event) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if e.Err != nil && !e.Ignored && e.Host != "" && !failed[e.Host] && (e.Type == HostConnected || e.Type == CommandFinished) {
+			failed[e.Host] = true
+			run.Failed = append(run.Failed, e.Host)
+		}
+		switch e.Type {
+		case HostConnected:
+			h, ok := hosts[e.Host]
+			if !ok {
+				return
+			}
+			h.State, h.Error = ControlHostConnected, ""
+			if e.Addr != "" {
+				h.Address = e.Addr
+			}
+			if e.Err != nil {
+				h.State, h.Error = ControlHostFailed, e.Err.Error()
+			}
+		case CommandStarted:
+			if e.Command != run.Command {
+				if run.Command != "" {
+					run.Done++
+				}
+				run.Command = e.Command
+			}
+		case RunFinished:
+			run.Finished = true
+			if e.Err != nil {
+				run.Error = e.Err.Error()
+			} else {
+				run.Done = len(run.Commands)
+				run.Command = ""
+			}
+		}
+	}
+}
+
+// Close stops serving and removes the socket.
+func (c *Control) Close() error {
+	c.server.Close()
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "control socket")
+	}
+	return nil
+}
@@ -0,0 +1,923 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultDaemonIdleTimeout is how long the daemon keeps running without
+// any sessions, see ServeDaemon.
+const DefaultDaemonIdleTimeout = 10 * time.Minute
+
+// DaemonSocket returns the unix socket of sup daemon, $SUP_DAEMON_SOCKET
+// or daemon.sock in a directory of the user in the temp directory.
+func DaemonSocket() string {
+	if path := os.Getenv("SUP_DAEMON_SOCKET"); path != "" {
+		return path
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("sup-%d", os.Getuid()), "daemon.sock")
+}
+
+// DaemonStatus describes the running daemon, see sup daemon status.
+type DaemonStatus struct {
+	PID         int                `json:"pid"`
+	Socket      string             `json:"socket"`
+	Started     time.Time          `json:"started"`
+	IdleTimeout string             `json:"idle_timeout"`
+	Connections []DaemonConnection `json:"connections"`
+}
+
+// DaemonConnection is a connection kept by the daemon.
+type DaemonConnection struct {
+	Host     string    `json:"host"` // user@address:port
+	Since    time.Time `json:"since"`
+	LastUsed time.Time `json:"last_used"`
+	Channels int       `json:"channels"` // Sessions and forwards open.
+}
+
+// daemonHost is a host connected to by the daemon. The daemon connects
+// the same way as Run does, by SSHClient.ConnectWith, so host keys and
+// auth are checked the same whether or not the daemon is used.
+type daemonHost struct {
+	Address        string        `json:"address"`
+	Port           string        `json:"port"`
+	User           string        `json:"user"`
+	IdentityFile   string        `json:"identity_file,omitempty"`
+	Dial           string        `json:"dial,omitempty"` // Address dialed instead, ie. of host_overrides.
+	Algorithms     SSHAlgorithms `json:"algorithms"`     // Of the network.
+	HostAlgorithms SSHAlgorithms `json:"host_algorithms"`
+	Timeout        time.Duration `json:"timeout,omitempty"` // Network's connect_timeout, 0 if unlimited.
+}
+
+// daemonRequest is the first line of each connection to the daemon.
+// Connections of open requests go on with frames of the channel.
+type daemonRequest struct {
+	Op        string      `json:"op"` // status, stop, connect, open or request.
+	Host      *daemonHost `json:"host,omitempty"`
+	Type      string      `json:"type,omitempty"` // Channel type of open, request type of request.
+	Data      []byte      `json:"data,omitempty"`
+	WantReply bool        `json:"want_reply,omitempty"`
+}
+
+type daemonResponse struct {
+	Error         string        `json:"error,omitempty"`
+	OK            bool          `json:"ok,omitempty"`
+	Data          []byte        `json:"data,omitempty"`
+	ServerVersion string        `json:"server_version,omitempty"`
+	Status        *DaemonStatus `json:"status,omitempty"`
+}
+
+// Frames of channels proxied by the daemon.
+const (
+	frameData    byte = iota + 1 // Channel data.
+	frameStderr                  // Extended data.
+	frameEOF                     // No more data in this direction.
+	frameClose                   // Channel closed.
+	frameRequest                 // Channel request, daemonFrameRequest.
+	frameReply                   // Reply to a channel request, daemonFrameRequest.
+)
+
+// maxFrame limits frame payloads, data is split into frames of this size.
+const maxFrame = 32 * 1024
+
+type daemonFrameRequest struct {
+	ID        int    `json:"id"`
+	Type      string `json:"type,omitempty"`
+	WantReply bool   `json:"want_reply,omitempty"`
+	OK        bool   `json:"ok,omitempty"`
+	Payload   []byte `json:"payload,omitempty"`
+}
+
+// frameWriter writes frames, from any goroutine.
+type frameWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (f *frameWriter) write(typ byte, payload []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var header [5]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	if _, err := f.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := f.w.Write(payload)
+	return err
+}
+
+// writeData writes p as data frames of the type.
+func (f *frameWriter) writeData(typ byte, p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		if err := f.write(typ, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (f *frameWriter) writeJSON(typ byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return f.write(typ, data)
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrame {
+		return 0, nil, fmt.Errorf("daemon: frame of %v bytes too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// writeLine writes v as a JSON line.
+func writeLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readLine reads a JSON line into v.
+func readLine(r *bufio.Reader, v interface{}) error {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
+
+// daemon keeps SSH connections alive for sequential sup invocations.
+type daemon struct {
+	path     string
+	idle     time.Duration
+	started  time.Time
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    map[string]*daemonConnEntry
+	active   int // Requests and channels in progress.
+	lastUsed time.Time
+	stopped  bool
+}
+
+// daemonConnEntry is a connection of the daemon, connected at most once
+// at a time.
+type daemonConnEntry struct {
+	mu       sync.Mutex
+	host     daemonHost
+	client   *SSHClient
+	since    time.Time
+	lastUsed time.Time
+	channels int
+}
+
+// ServeDaemon keeps authenticated SSH connections of the native transport
+// alive for sup invocations talking to the unix socket at path, until the
+// idle timeout passes without any of them, or sup daemon stop. Only the
+// user running the daemon is served.
+func ServeDaemon(path string, idle time.Duration) error {
+	if err := checkPeerCred(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrap(err, "daemon socket")
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil {
+		return errors.Wrap(err, "daemon socket")
+	} else if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("daemon socket %v: directory is accessible by other users", path)
+	}
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("daemon socket %v: file exists", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("daemon is already running at %v", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "daemon socket")
+		}
+	}
+
+	// The socket is created in a private directory and moved to path once
+	// its mode is set, as the control socket is.
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sup-daemon-")
+	if err != nil {
+		return errors.Wrap(err, "daemon socket")
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return errors.Wrap(err, "daemon socket")
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return errors.Wrap(err, "daemon socket")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return errors.Wrap(err, "daemon socket")
+	}
+	defer os.Remove(path)
+
+	d := &daemon{path: path, idle: idle, started: time.Now(), listener: listener, conns: map[string]*daemonConnEntry{}, lastUsed: time.Now()}
+	go d.expire()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			d.mu.Lock()
+			stopped := d.stopped
+			d.mu.Unlock()
+			if stopped {
+				d.closeConns()
+				return nil
+			}
+			return errors.Wrap(err, "daemon")
+		}
+		go d.serve(conn.(*net.UnixConn))
+	}
+}
+
+// expire stops the daemon once it's idle for the idle timeout.
+func (d *daemon) expire() {
+	tick := d.idle / 10
+	if tick < time.Second {
+		tick = time.Second
+	}
+	for range time.Tick(tick) {
+		d.mu.Lock()
+		idle := d.active == 0 && time.Since(d.lastUsed) >= d.idle
+		d.mu.Unlock()
+		if idle {
+			d.stop()
+			return
+		}
+	}
+}
+
+func (d *daemon) stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+	d.listener.Close()
+}
+
+func (d *daemon) closeConns() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, entry := range d.conns {
+		if entry.client != nil {
+			entry.client.Close()
+		}
+	}
+}
+
+// use marks a request or channel in progress until done is called.
+func (d *daemon) use() (done func()) {
+	d.mu.Lock()
+	d.active++
+	d.lastUsed = time.Now()
+	d.mu.Unlock()
+	return func() {
+		d.mu.Lock()
+		d.active--
+		d.lastUsed = time.Now()
+		d.mu.Unlock()
+	}
+}
+
+func (d *daemon) serve(conn *net.UnixConn) {
+	defer conn.Close()
+	if uid, err := peerUID(conn); err != nil || uid != os.Getuid() {
+		// Other users get nothing, not even an error.
+		return
+	}
+	defer d.use()()
+
+	r := bufio.NewReader(conn)
+	var req daemonRequest
+	if err := readLine(r, &req); err != nil {
+		return
+	}
+	respond := func(resp daemonResponse) error {
+		return writeLine(conn, resp)
+	}
+	fail := func(err error) {
+		respond(daemonResponse{Error: err.Error()})
+	}
+
+	switch req.Op {
+	case "status":
+		respond(daemonResponse{OK: true, Status: d.status()})
+		return
+	case "stop":
+		respond(daemonResponse{OK: true})
+		d.stop()
+		return
+	}
+
+	if req.Host == nil {
+		fail(fmt.Errorf("daemon: %v: missing host", req.Op))
+		return
+	}
+	entry, err := d.connect(*req.Host)
+	if err != nil {
+		fail(err)
+		return
+	}
+	client := entry.client.conn
+
+	switch req.Op {
+	case "connect":
+		respond(daemonResponse{OK: true, ServerVersion: string(client.ServerVersion())})
+	case "request":
+		ok, data, err := client.SendRequest(req.Type, req.WantReply, req.Data)
+		if err != nil {
+			fail(err)
+			return
+		}
+		respond(daemonResponse{OK: ok, Data: data})
+	case "open":
+		ch, reqs, err := client.OpenChannel(req.Type, req.Data)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if err := respond(daemonResponse{OK: true}); err != nil {
+			ch.Close()
+			return
+		}
+		entry.track(1)
+		defer entry.track(-1)
+		proxyChannel(ch, reqs, r, &frameWriter{w: conn})
+	default:
+		fail(fmt.Errorf("daemon: unknown op %q", req.Op))
+	}
+}
+
+// connect returns connection of the host, connecting if there's none or
+// it's dead.
+func (d *daemon) connect(host daemonHost) (*daemonConnEntry, error) {
+	// Connections are shared by the invocations whatever their timeout.
+	keyHost := host
+	keyHost.Timeout = 0
+	key, err := json.Marshal(keyHost)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	entry, ok := d.conns[string(key)]
+	if !ok {
+		entry = &daemonConnEntry{host: host}
+		d.conns[string(key)] = entry
+	}
+	d.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	entry.lastUsed = time.Now()
+	if entry.client != nil {
+		if _, _, err := entry.client.conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return entry, nil
+		}
+		entry.client.Close()
+		entry.client = nil
+	}
+
+	// Prompts can't be answered by the daemon, they fail instead and the
+	// invocation connects by itself.
+	client := &SSHClient{
+		host:       &Host{Address: host.Address, Port: host.Port, User: host.User, IdentityFile: host.IdentityFile, Algorithms: host.HostAlgorithms},
+		algorithms: host.Algorithms,
+		batch:      true,
+		timeout:    host.Timeout,
+	}
+	dial := SSHDialFunc(ssh.Dial)
+	if host.Dial != "" {
+		dial = dialer(host.Dial, nil)
+	}
+	if err := client.ConnectWith(dial); err != nil {
+		return nil, err
+	}
+	entry.client, entry.since = client, time.Now()
+	return entry, nil
+}
+
+func (e *daemonConnEntry) track(delta int) {
+	e.mu.Lock()
+	e.channels += delta
+	e.lastUsed = time.Now()
+	e.mu.Unlock()
+}
+
+func (d *daemon) status() *DaemonStatus {
+	status := &DaemonStatus{PID: os.Getpid(), Socket: d.path, Started: d.started, IdleTimeout: d.idle.String(), Connections: []DaemonConnection{}}
+	d.mu.Lock()
+	entries := make([]*daemonConnEntry, 0, len(d.conns))
+	for _, entry := range d.conns {
+		entries = append(entries, entry)
+	}
+	d.mu.Unlock()
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if entry.client != nil {
+			status.Connections = append(status.Connections, DaemonConnection{
+				Host:     fmt.Sprintf("%v@%v:%v", entry.host.User, entry.host.Address, entry.host.Port),
+				Since:    entry.since,
+				LastUsed: entry.lastUsed,
+				Channels: entry.channels,
+			})
+		}
+		entry.mu.Unlock()
+	}
+	sort.Slice(status.Connections, func(i, j int) bool {
+		return status.Connections[i].Host < status.Connections[j].Host
+	})
+	return status
+}
+
+// proxyChannel passes the channel data and requests between the SSH
+// channel and the frames of the invocation, until either side closes it.
+func proxyChannel(ch ssh.Channel, reqs <-chan *ssh.Request, r io.Reader, w *frameWriter) {
+	defer ch.Close()
+
+	// Data of the host, followed by EOF once both streams are done.
+	var out sync.WaitGroup
+	out.Add(2)
+	go func() {
+		defer out.Done()
+		io.Copy(dataWriter{w, frameData}, ch)
+	}()
+	go func() {
+		defer out.Done()
+		io.Copy(dataWriter{w, frameStderr}, ch.Stderr())
+	}()
+	closed := make(chan struct{})
+	go func() {
+		out.Wait()
+		w.write(frameEOF, nil)
+		// Requests of the host, ie. exit-status, end with the channel.
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			w.writeJSON(frameRequest, daemonFrameRequest{Type: req.Type, Payload: req.Payload})
+		}
+		w.write(frameClose, nil)
+		close(closed)
+	}()
+
+	// Frames of the invocation.
+	go func() {
+		for {
+			typ, payload, err := readFrame(r)
+			if err != nil {
+				ch.Close()
+				return
+			}
+			switch typ {
+			case frameData:
+				ch.Write(payload)
+			case frameStderr:
+				ch.Stderr().Write(payload)
+			case frameEOF:
+				ch.CloseWrite()
+			case frameClose:
+				ch.Close()
+				return
+			case frameRequest:
+				var req daemonFrameRequest
+				if err := json.Unmarshal(payload, &req); err != nil {
+					ch.Close()
+					return
+				}
+				ok, err := ch.SendRequest(req.Type, req.WantReply, req.Payload)
+				if req.WantReply {
+					w.writeJSON(frameReply, daemonFrameRequest{ID: req.ID, OK: ok && err == nil})
+				}
+			}
+		}
+	}()
+	<-closed
+}
+
+// dataWriter writes data frames of the type.
+type dataWriter struct {
+	w   *frameWriter
+	typ byte
+}
+
+func (d dataWriter) Write(p []byte) (int, error) {
+	return d.w.writeData(d.typ, p)
+}
+
+// daemonCall sends the request to the daemon at path and returns its
+// response, along with the connection, which is closed unless keep is set.
+func daemonCall(path string, req daemonRequest, keep bool) (daemonResponse, net.Conn, *bufio.Reader, error) {
+	var resp daemonResponse
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		return resp, nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	if err := writeLine(conn, req); err != nil {
+		conn.Close()
+		return resp, nil, nil, err
+	}
+	if err := readLine(r, &resp); err != nil {
+		conn.Close()
+		return resp, nil, nil, errors.Wrap(err, "daemon")
+	}
+	if resp.Error != "" {
+		conn.Close()
+		return resp, nil, nil, errors.New(resp.Error)
+	}
+	if !keep {
+		conn.Close()
+		return resp, nil, nil, nil
+	}
+	return resp, conn, r, nil
+}
+
+// StartDaemon starts sup daemon serve in the background, see ServeDaemon,
+// and waits for it to listen.
+func StartDaemon(path string, idle time.Duration) error {
+	if err := checkPeerCred(); err != nil {
+		return err
+	}
+	if _, err := GetDaemonStatus(path); err == nil {
+		return fmt.Errorf("daemon is already running at %v", path)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "daemon")
+	}
+	cmd := exec.Command(exe, "daemon", "serve", "-socket", path, "-idle-timeout", idle.String())
+	// Errors of the daemon go to a removed file rather than a pipe, which
+	// would break once sup daemon start exits.
+	stderr, err := os.CreateTemp("", "sup-daemon-")
+	if err != nil {
+		return errors.Wrap(err, "daemon")
+	}
+	defer stderr.Close()
+	os.Remove(stderr.Name())
+	cmd.Stderr = stderr
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "daemon")
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			stderr.Seek(0, io.SeekStart)
+			data, _ := io.ReadAll(stderr)
+			if msg := bytes.TrimSpace(data); len(msg) > 0 {
+				return errors.New(string(msg))
+			}
+			return fmt.Errorf("daemon: exited: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := GetDaemonStatus(path); err == nil {
+			cmd.Process.Release()
+			return nil
+		}
+	}
+	cmd.Process.Kill()
+	return fmt.Errorf("daemon: not listening at %v after 5s", path)
+}
+
+// GetDaemonStatus returns status of the daemon at path.
+func GetDaemonStatus(path string) (*DaemonStatus, error) {
+	resp, _, _, err := daemonCall(path, daemonRequest{Op: "status"}, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Status, nil
+}
+
+// StopDaemon stops the daemon at path, closing its connections.
+func StopDaemon(path string) error {
+	_, _, _, err := daemonCall(path, daemonRequest{Op: "stop"}, false)
+	return err
+}
+
+// Daemon makes the SSH connections of the native transport go through
+// sup daemon listening at socket, see ServeDaemon. Hosts are connected
+// directly whenever the daemon isn't running or fails to connect them.
+func (sup *Stackup) Daemon(socket string) {
+	sup.daemon = socket
+}
+
+// directDialer returns dialer of a host connected directly, not through a
+// bastion, at addr if not empty, ie. resolved by the network's dns, and by
+// the daemon at socket if not empty. --prefer-key skips the daemon, whose
+// ssh-agent keys aren't picked by the invocation, and so do the hosts of
+// identity_key_env and identity_key_file, whose keys the daemon lacks.
+func (c *SSHClient) directDialer(addr, socket string) SSHDialFunc {
+	dial := SSHDialFunc(ssh.Dial)
+	if addr != "" {
+		dial = dialer(addr, nil)
+	}
+	if socket == "" || c.preferKey != "" || c.host.identityKey != nil {
+		return dial
+	}
+	return c.viaDaemon(socket, addr, dial)
+}
+
+// viaDaemon returns dialer connecting to the host by the daemon at path,
+// or by dial if the daemon isn't running or fails to connect, ie. because
+// the auth needs a prompt or isn't the same as the daemon's. Hosts dialed
+// at addr instead of their address, ie. by host_overrides, pass it.
+func (c *SSHClient) viaDaemon(path, addr string, dial SSHDialFunc) SSHDialFunc {
+	host := &daemonHost{
+		Address:        c.host.Address,
+		Port:           c.host.Port,
+		User:           c.host.User,
+		IdentityFile:   c.host.IdentityFile,
+		Dial:           addr,
+		Algorithms:     c.algorithms,
+		HostAlgorithms: c.host.Algorithms,
+		Timeout:        c.timeout,
+	}
+	return func(network, hostPort string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		resp, _, _, err := daemonCall(path, daemonRequest{Op: "connect", Host: host}, false)
+		if err != nil {
+			return dial(network, hostPort, config)
+		}
+		conn := &daemonConn{path: path, host: host, serverVersion: resp.ServerVersion, closed: make(chan struct{}), chans: make(chan ssh.NewChannel)}
+		return ssh.NewClient(conn, conn.chans, nil), nil
+	}
+}
+
+// daemonConn is ssh.Conn of a connection kept by the daemon: each channel
+// is proxied by a connection to the daemon.
+type daemonConn struct {
+	path          string
+	host          *daemonHost
+	serverVersion string
+
+	once   sync.Once
+	closed chan struct{}
+	chans  chan ssh.NewChannel // Never any, forwarding isn't supported.
+}
+
+func (c *daemonConn) User() string          { return c.host.User }
+func (c *daemonConn) SessionID() []byte     { return nil }
+func (c *daemonConn) ClientVersion() []byte { return []byte("SSH-2.0-Go") }
+func (c *daemonConn) ServerVersion() []byte { return []byte(c.serverVersion) }
+func (c *daemonConn) LocalAddr() net.Addr   { return &net.UnixAddr{Name: c.path, Net: "unix"} }
+
+func (c *daemonConn) RemoteAddr() net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(c.host.Address, c.host.Port))
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+func (c *daemonConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	resp, _, _, err := daemonCall(c.path, daemonRequest{Op: "request", Host: c.host, Type: name, WantReply: wantReply, Data: payload}, false)
+	if err != nil {
+		return false, nil, err
+	}
+	return resp.OK, resp.Data, nil
+}
+
+func (c *daemonConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	_, conn, r, err := daemonCall(c.path, daemonRequest{Op: "open", Host: c.host, Type: name, Data: data}, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := &daemonChannel{
+		conn:    conn,
+		w:       &frameWriter{w: conn},
+		stdout:  newDaemonBuffer(),
+		stderr:  newDaemonBuffer(),
+		reqs:    make(chan *ssh.Request, 16),
+		replies: map[int]chan bool{},
+	}
+	go ch.read(r)
+	return ch, ch.reqs, nil
+}
+
+// Close closes the connection of the invocation, the daemon keeps its own.
+func (c *daemonConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		close(c.chans)
+	})
+	return nil
+}
+
+func (c *daemonConn) Wait() error {
+	<-c.closed
+	return nil
+}
+
+// daemonChannel is ssh.Channel proxied by the daemon.
+type daemonChannel struct {
+	conn   net.Conn
+	w      *frameWriter
+	stdout *daemonBuffer
+	stderr *daemonBuffer
+	reqs   chan *ssh.Request
+
+	mu      sync.Mutex
+	nextID  int
+	replies map[int]chan bool
+}
+
+// read passes the frames of the daemon to the channel buffers and requests.
+func (ch *daemonChannel) read(r io.Reader) {
+	defer func() {
+		ch.stdout.close()
+		ch.stderr.close()
+		close(ch.reqs)
+		ch.mu.Lock()
+		for id, reply := range ch.replies {
+			close(reply)
+			delete(ch.replies, id)
+		}
+		ch.mu.Unlock()
+		ch.conn.Close()
+	}()
+	for {
+		typ, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case frameData:
+			ch.stdout.write(payload)
+		case frameStderr:
+			ch.stderr.write(payload)
+		case frameEOF:
+			ch.stdout.close()
+			ch.stderr.close()
+		case frameClose:
+			return
+		case frameRequest:
+			var req daemonFrameRequest
+			if json.Unmarshal(payload, &req) == nil {
+				ch.reqs <- &ssh.Request{Type: req.Type, Payload: req.Payload}
+			}
+		case frameReply:
+			var req daemonFrameRequest
+			if json.Unmarshal(payload, &req) == nil {
+				ch.mu.Lock()
+				if reply, ok := ch.replies[req.ID]; ok {
+					reply <- req.OK
+					delete(ch.replies, req.ID)
+				}
+				ch.mu.Unlock()
+			}
+		}
+	}
+}
+
+func (ch *daemonChannel) Read(p []byte) (int, error)  { return ch.stdout.Read(p) }
+func (ch *daemonChannel) Write(p []byte) (int, error) { return ch.w.writeData(frameData, p) }
+func (ch *daemonChannel) CloseWrite() error           { return ch.w.write(frameEOF, nil) }
+
+func (ch *daemonChannel) Close() error {
+	ch.w.write(frameClose, nil)
+	// Data no longer read is dropped, instead of blocking read.
+	ch.stdout.close()
+	ch.stderr.close()
+	return ch.conn.Close()
+}
+
+func (ch *daemonChannel) Stderr() io.ReadWriter {
+	return daemonStderr{ch}
+}
+
+func (ch *daemonChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	req := daemonFrameRequest{Type: name, WantReply: wantReply, Payload: payload}
+	var reply chan bool
+	if wantReply {
+		reply = make(chan bool, 1)
+		ch.mu.Lock()
+		ch.nextID++
+		req.ID = ch.nextID
+		ch.replies[req.ID] = reply
+		ch.mu.Unlock()
+	}
+	if err := ch.w.writeJSON(frameRequest, req); err != nil {
+		return false, err
+	}
+	if !wantReply {
+		return false, nil
+	}
+	ok, received := <-reply
+	if !received {
+		return false, io.EOF
+	}
+	return ok, nil
+}
+
+type daemonStderr struct {
+	ch *daemonChannel
+}
+
+func (s daemonStderr) Read(p []byte) (int, error)  { return s.ch.stderr.Read(p) }
+func (s daemonStderr) Write(p []byte) (int, error) { return s.ch.w.writeData(frameStderr, p) }
+
+// daemonBufferSize is how much data of a stream of a channel is buffered
+// before the channel stops reading the daemon, like SSH channel windows.
+const daemonBufferSize = 1 << 20
+
+// daemonBuffer is buffer of channel data, so a stream not read doesn't
+// block the other one until the buffer fills up. Writes wait for reads
+// then, which stops reading the daemon, and so the daemon reading the
+// channel of the host.
+type daemonBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	size   int // Max bytes buffered, before a write.
+	closed bool
+}
+
+func newDaemonBuffer() *daemonBuffer {
+	b := &daemonBuffer{size: daemonBufferSize}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// write waits for the buffer to have room, unless it's closed, which
+// drops p.
+func (b *daemonBuffer) write(p []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() >= b.size && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed {
+		return
+	}
+	b.buf.Write(p)
+	b.cond.Broadcast()
+}
+
+func (b *daemonBuffer) close() {
+	b.mu.Lock()
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+func (b *daemonBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	b.cond.Broadcast()
+	return b.buf.Read(p)
+}
@@ -0,0 +1,92 @@
+package sup
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDaemonBuffer(t *testing.T) {
+	b := newDaemonBuffer()
+	b.size = 4
+	b.write([]byte("abcd"))
+
+	// The buffer is full, the write waits for a read.
+	written := make(chan struct{})
+	go func() {
+		b.write([]byte("ef"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write to full buffer didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p := make([]byte, 3)
+	if n, _ := b.Read(p); string(p[:n]) != "abc" {
+		t.Fatalf("read %q, want abc", p[:n])
+	}
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write didn't go on after read")
+	}
+
+	// Closing drops the writes waiting, the data buffered is still read.
+	b.write([]byte("gh"))
+	dropped := make(chan struct{})
+	go func() {
+		b.write([]byte("ij"))
+		close(dropped)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	b.close()
+	select {
+	case <-dropped:
+	case <-time.After(time.Second):
+		t.Fatal("write to closed buffer didn't return")
+	}
+	data, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "defgh" {
+		t.Errorf("read %q, want defgh", data)
+	}
+}
+
+// TestDaemonConnectTimeout connects to a server never answering the SSH
+// handshake, which the daemon gives up on by the network's timeout.
+func TestDaemonConnectTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	d := &daemon{conns: map[string]*daemonConnEntry{}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.connect(daemonHost{Address: "127.0.0.1", Port: port, User: "deploy", Timeout: 100 * time.Millisecond})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if _, ok := err.(ErrConnectTimeout); !ok {
+			t.Errorf("got error %v, want ErrConnectTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon didn't give up connecting by the timeout")
+	}
+}
@@ -0,0 +1,144 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// Defaults are the values of the fields the commands and networks of the
+// Supfile don't set themselves, ie.
+//
+//	defaults:
+//	  command:
+//	    serial: 2
+//	    timeout: 10m
+//	  network:
+//	    user: deploy
+//	    connect_timeout: 10s
+//
+// A field set by the command or network wins, even if it's set to the
+// zero value, ie. serial: 0. Maps and lists are replaced, not merged.
+type Defaults struct {
+	Command yaml.MapSlice `yaml:"command,omitempty"` // Any Command field but run, script and scripts_dir.
+	Network yaml.MapSlice `yaml:"network,omitempty"` // Any Network field but hosts and the inventory ones.
+}
+
+// noDefault lists the fields of defaults: command and network making no
+// sense for each of the commands or networks.
+var noDefault = map[string][]string{
+	"command": {"run", "script", "scripts_dir"},
+	"network": {"hosts", "inventory", "inventory_http"},
+}
+
+// applyDefaults returns the YAML data with the fields of defaults: copied
+// to the commands and networks which don't set them, along with the
+// "key: value" fields each command and network got, by name. The copy is
+// made on the nodes, before any of them is decoded, so set fields are told
+// from absent ones. Data without defaults: is returned intact, and so is
+// data which doesn't parse, ie. of nil doc, which is left to the Supfile
+// parser to report.
+func applyDefaults(data []byte, doc *yamlv3.Node) (out []byte, commands, networks map[string][]string, err error) {
+	if doc == nil || len(doc.Content) == 0 {
+		return data, nil, nil, nil
+	}
+	root := doc.Content[0]
+	defaults := mappingValue(root, "defaults")
+	if defaults == nil {
+		return data, nil, nil, nil
+	}
+	for section, keys := range noDefault {
+		fields := mappingValue(defaults, section)
+		for _, key := range keys {
+			if mappingValue(fields, key) != nil {
+				msg := fmt.Sprintf("defaults: %v: %v can't have a default", section, key)
+				if line := findLine(data, "defaults", section, key); line > 0 {
+					return nil, nil, nil, fmt.Errorf("line %v: %v", line, msg)
+				}
+				return nil, nil, nil, errors.New(msg)
+			}
+		}
+	}
+	commands = mergeDefaults(mappingValue(root, "commands"), mappingValue(defaults, "command"))
+	networks = mergeDefaults(mappingValue(root, "networks"), mappingValue(defaults, "network"))
+	if out, err = yamlv3.Marshal(doc); err != nil {
+		return nil, nil, nil, err
+	}
+	return out, commands, networks, nil
+}
+
+// mergeDefaults appends the fields of defaults to each item of the
+// items mapping which doesn't have them, and returns the "key: value"
+// fields appended to each item.
+func mergeDefaults(items, defaults *yamlv3.Node) map[string][]string {
+	if items == nil || items.Kind != yamlv3.MappingNode || defaults == nil || defaults.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	merged := map[string][]string{}
+	for i := 0; i+1 < len(items.Content); i += 2 {
+		item := items.Content[i+1]
+		if item.Kind == yamlv3.ScalarNode && item.Tag == "!!null" {
+			*item = yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+		}
+		if item.Kind != yamlv3.MappingNode {
+			continue
+		}
+		set := mappingKeys(item)
+		for j := 0; j+1 < len(defaults.Content); j += 2 {
+			key, value := defaults.Content[j], defaults.Content[j+1]
+			if set[key.Value] {
+				continue
+			}
+			item.Content = append(item.Content, key, value)
+			name := items.Content[i].Value
+			merged[name] = append(merged[name], key.Value+": "+flowValue(value))
+		}
+	}
+	return merged
+}
+
+// mappingKeys returns the keys of the mapping node, including the ones
+// of its << merge keys.
+func mappingKeys(node *yamlv3.Node) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if key.Value != "<<" || key.Tag != "!!merge" {
+			keys[key.Value] = true
+			continue
+		}
+		merged := []*yamlv3.Node{value}
+		if value.Kind == yamlv3.SequenceNode {
+			merged = value.Content
+		}
+		for _, m := range merged {
+			if m.Kind == yamlv3.AliasNode {
+				m = m.Alias
+			}
+			if m.Kind == yamlv3.MappingNode {
+				for key := range mappingKeys(m) {
+					keys[key] = true
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// flowValue returns the value node as a single line of YAML, ie.
+// "[a, b]" or "{file: x}" for lists and maps.
+func flowValue(node *yamlv3.Node) string {
+	if node.Kind == yamlv3.ScalarNode {
+		return node.Value
+	}
+	flow := *node
+	flow.Style |= yamlv3.FlowStyle
+	out, err := yamlv3.Marshal(&flow)
+	if err != nil {
+		return "..."
+	}
+	return strings.TrimSpace(string(out))
+}
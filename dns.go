@@ -0,0 +1,131 @@
+package sup
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dnsTimeout limits lookups by the network resolver.
+const dnsTimeout = 10 * time.Second
+
+// DNS configures how the network host and bastion names are resolved,
+// ie. for private zones served by an internal DNS server only.
+type DNS struct {
+	Resolver      string            `yaml:"resolver,omitempty"`       // DNS server ip:port used instead of the system resolver.
+	HostOverrides map[string]string `yaml:"host_overrides,omitempty"` // Host name to IP, consulted before DNS.
+}
+
+// check validates the resolver address and the override IPs.
+func (d DNS) check() error {
+	if d.Resolver != "" {
+		if _, err := d.resolverAddr(); err != nil {
+			return err
+		}
+	}
+	for name, ip := range d.HostOverrides {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("host_overrides: %v: invalid IP %q", name, ip)
+		}
+	}
+	return nil
+}
+
+// resolverAddr returns the resolver as ip:port, port 53 by default.
+func (d DNS) resolverAddr() (string, error) {
+	addr := d.Resolver
+	if net.ParseIP(addr) != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", fmt.Errorf("resolver: invalid address %q, expected ip:port", d.Resolver)
+	}
+	return addr, nil
+}
+
+// resolve returns the address host is connected to, along with what
+// produced it: "host_overrides", "resolver <ip:port>" or "" for names left
+// to the system resolver. The network resolver is used for direct
+// connections only, hosts behind a bastion are resolved by the bastion.
+func (d DNS) resolve(host string, direct bool) (addr, by string, err error) {
+	if ip, ok := d.HostOverrides[host]; ok {
+		return ip, "host_overrides", nil
+	}
+	if !direct || d.Resolver == "" || net.ParseIP(host) != nil || host == "localhost" {
+		return host, "", nil
+	}
+	server, err := d.resolverAddr()
+	if err != nil {
+		return "", "", err
+	}
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return "", "", fmt.Errorf("resolver %v: %v", server, err)
+	}
+	return addrs[0], "resolver " + server, nil
+}
+
+// dialer returns SSHDialFunc connecting to addr instead of the host part
+// of the dialed address, directly or through dial, ie. a bastion.
+func dialer(addr string, dial SSHDialFunc) SSHDialFunc {
+	return func(network, hostPort string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		target := hostPort
+		if _, port, err := net.SplitHostPort(hostPort); err == nil {
+			target = net.JoinHostPort(addr, port)
+		}
+		if dial != nil {
+			return dial(network, target, config)
+		}
+		// The dialed address is kept for the handshake, as by ssh.Dial.
+		conn, err := net.DialTimeout(network, target, config.Timeout)
+		if err != nil {
+			return nil, err
+		}
+		c, chans, reqs, err := ssh.NewClientConn(conn, hostPort, config)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return ssh.NewClient(c, chans, reqs), nil
+	}
+}
+
+// jumpSpec returns the bastion [user@]host[:port] with the host resolved.
+func (d DNS) jumpSpec(r *Resolver, bastion string) (string, error) {
+	host, err := r.NewHost(bastion, HostDefaults{})
+	if err != nil {
+		return "", err
+	}
+	addr, by, err := d.resolve(host.Address, true)
+	if err != nil || by == "" {
+		return bastion, err
+	}
+	user, _ := splitUser(bastion)
+	if user != "" {
+		user += "@"
+	}
+	return user + net.JoinHostPort(addr, host.Port), nil
+}
+
+// planAddress returns the resolved address of host for the plan, or nil
+// if it's left to the system resolver.
+func (d DNS) planAddress(host string, direct bool) (*PlanAddress, error) {
+	addr, by, err := d.resolve(host, direct)
+	if err != nil || by == "" {
+		return nil, err
+	}
+	return &PlanAddress{Address: addr, By: by}, nil
+}
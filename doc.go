@@ -0,0 +1,9 @@
+// Package sup runs Supfile commands on networks of hosts over SSH. The sup
+// CLI (cmd/sup) is a thin layer of flags over this package, which can be
+// imported on its own: parse a Supfile by NewSupfile or NewSupfileFromFile,
+// pick its network, resolve the network's env and hosts, and run commands
+// by Stackup.Run, watching the run by Stackup.OnEvent. See the examples.
+//
+// The package doesn't depend on the CLI, cmd/sup adds no modules of its
+// own; `make tidy-check` verifies go.mod lists no more than they need.
+package sup
@@ -0,0 +1,73 @@
+package sup
+
+import (
+	"fmt"
+	"os/user"
+	"regexp"
+	"strings"
+)
+
+// DockerScheme prefixes hosts which are docker containers: the tasks are
+// run by docker exec, locally for docker://<container> or on the host
+// connected to by SSH for docker://[<user>@]<host:port>/<container>.
+const DockerScheme = "docker://"
+
+// containerRe matches docker container names and IDs.
+var containerRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// newContainerHost creates Host of docker://[[<user>@]<host:port>/]<container>
+// string, named by the string unless alias is set.
+func (r *Resolver) newContainerHost(hostStr, alias string, defaults HostDefaults) (*Host, error) {
+	spec := strings.TrimPrefix(hostStr, DockerScheme)
+	remote, container := "", spec
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		remote, container = spec[:i], spec[i+1:]
+		if remote == "" {
+			return nil, fmt.Errorf("host %q: missing host before /%v", hostStr, container)
+		}
+	}
+	if !containerRe.MatchString(container) {
+		return nil, fmt.Errorf("host %q: invalid container name %q", hostStr, container)
+	}
+
+	var host *Host
+	if remote == "" {
+		// Local containers are run by the local docker, as localhost.
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		host = &Host{Address: "localhost", Port: "22", User: u.Username, Bastion: BastionNone}
+	} else {
+		var err error
+		if host, err = r.NewHost(remote, defaults); err != nil {
+			return nil, fmt.Errorf("host %q: %v", hostStr, err)
+		}
+	}
+	host.Container = container
+	host.alias = alias
+	host.KnownAs = hostStr
+	if alias != "" {
+		host.KnownAs = alias
+	}
+	return host, nil
+}
+
+// exec returns run as run by the host: in its pod by kubectl exec or in
+// its container by docker exec, if it's either, with a terminal if tty is
+// set.
+func (h *Host) exec(run string, tty bool) string {
+	switch {
+	case h == nil:
+		return run
+	case h.Pod != "":
+		return h.kubectlExec(run, tty)
+	case h.Container == "":
+		return run
+	}
+	flags := "-i"
+	if tty {
+		flags = "-it"
+	}
+	return "docker exec " + flags + " " + h.Container + " sh -c " + ShellQuote(run)
+}
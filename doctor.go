@@ -0,0 +1,449 @@
+package sup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Statuses of DoctorCheck.
+const (
+	DoctorPass = "pass"
+	DoctorWarn = "warn"
+	DoctorFail = "fail"
+)
+
+// doctorTimeout limits each lookup, dial and agent request of the checks.
+const doctorTimeout = 10 * time.Second
+
+// doctorConnectTimeout is the connect_timeout of the hosts of networks
+// without one, so hosts hanging in the handshake are reported, too.
+const doctorConnectTimeout = "30s"
+
+// doctorParallel is the number of hosts checked at once by Doctor.
+var doctorParallel = 10
+
+// DoctorCheck is a check of sup doctor, of the local environment if Host
+// is empty, of the network's host otherwise.
+type DoctorCheck struct {
+	Host    string `json:"host,omitempty"`
+	Name    string `json:"check"`
+	Status  string `json:"status"` // DoctorPass, DoctorWarn or DoctorFail.
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"` // Remediation of warn and fail checks.
+}
+
+// DoctorChecks are the checks of sup doctor, in order.
+type DoctorChecks []DoctorCheck
+
+// Failed reports whether any of the checks failed. Warnings don't fail
+// sup doctor.
+func (c DoctorChecks) Failed() bool {
+	for _, check := range c {
+		if check.Status == DoctorFail {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteText writes the checks as a table, the hint of each warn and fail
+// check below it, followed by the counts by status.
+func (c DoctorChecks) WriteText(out io.Writer) error {
+	counts := map[string]int{}
+	w := &tabwriter.Writer{}
+	w.Init(out, 4, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tCHECK\tSTATUS\tMESSAGE")
+	for _, check := range c {
+		host := check.Host
+		if host == "" {
+			host = "(local)"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", host, check.Name, check.Status, check.Message)
+		if check.Hint != "" {
+			fmt.Fprintf(w, "\t\t\t-> %v\n", check.Hint)
+		}
+		counts[check.Status]++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "\n%d passed, %d warnings, %d failed\n", counts[DoctorPass], counts[DoctorWarn], counts[DoctorFail])
+	return err
+}
+
+// DoctorLocal runs the checks of the local environment: ssh-agent, the
+// ~/.ssh/id_* keys, ~/.ssh/known_hosts and bash.
+func DoctorLocal() DoctorChecks {
+	checks := DoctorChecks{doctorAgent()}
+	checks = append(checks, doctorIdentityFiles()...)
+	return append(checks, doctorKnownHosts(), doctorBash())
+}
+
+// doctorAgent checks that ssh-agent of SSH_AUTH_SOCK responds and holds
+// any keys.
+func doctorAgent() DoctorCheck {
+	check := DoctorCheck{Name: "ssh-agent"}
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return check.warn("SSH_AUTH_SOCK is not set", "start ssh-agent and ssh-add your key, or rely on ~/.ssh/id_* keys")
+	}
+	conn, err := net.DialTimeout("unix", sock, doctorTimeout)
+	if err != nil {
+		return check.fail(fmt.Sprintf("%v: %v", sock, err), "SSH_AUTH_SOCK is stale, restart ssh-agent or reconnect the session forwarding it")
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(doctorTimeout))
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return check.fail(fmt.Sprintf("%v: not responding: %v", sock, err), "restart ssh-agent")
+	}
+	if len(keys) == 0 {
+		return check.warn(sock+": no keys", "ssh-add your key")
+	}
+	return check.pass(fmt.Sprintf("%v: %d keys", sock, len(keys)))
+}
+
+// doctorIdentityFiles checks that the ~/.ssh/id_* keys, offered to the
+// hosts after the agent's, can be read by sup.
+func doctorIdentityFiles() []DoctorCheck {
+	home := os.Getenv("HOME")
+	files, _ := filepath.Glob(filepath.Join(home, ".ssh", "id_*"))
+	var checks []DoctorCheck
+	for _, file := range files {
+		if strings.HasSuffix(file, ".pub") {
+			continue
+		}
+		check := DoctorCheck{Name: "identity"}
+		name := "~" + strings.TrimPrefix(file, home)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			checks = append(checks, check.warn(err.Error(), "fix the permissions of the key, sup skips it"))
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			checks = append(checks, check.warn(name+": encrypted, sup doesn't ask for passphrases", "ssh-add it to ssh-agent"))
+			continue
+		}
+		if err != nil {
+			checks = append(checks, check.warn(name+": not a parseable private key", "remove it or convert it by ssh-keygen -p, sup skips it"))
+			continue
+		}
+		checks = append(checks, check.pass(name+": "+describeKey(signer.PublicKey())))
+	}
+	if len(checks) == 0 {
+		checks = append(checks, DoctorCheck{Name: "identity"}.warn("no ~/.ssh/id_* keys", "rely on ssh-agent, identity_file or identity_key_file, or create a key by ssh-keygen"))
+	}
+	return checks
+}
+
+// doctorKnownHosts checks that ~/.ssh/known_hosts parses. The native
+// transport doesn't check host keys, ssh of the openssh transport does.
+func doctorKnownHosts() DoctorCheck {
+	check := DoctorCheck{Name: "known_hosts"}
+	file := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return check.warn("~/.ssh/known_hosts doesn't exist", "ssh of the openssh transport refuses unknown hosts in -batch runs, add them by ssh-keyscan")
+	}
+	if err != nil {
+		return check.fail(err.Error(), "fix the permissions of ~/.ssh/known_hosts")
+	}
+	if _, err := knownhosts.New(file); err != nil {
+		return check.warn(err.Error(), "fix or remove the line")
+	}
+	entries := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			entries++
+		}
+	}
+	return check.pass(fmt.Sprintf("~/.ssh/known_hosts: %d entries", entries))
+}
+
+// doctorBash checks for bash, which resolves the env values of every run
+// and runs local: commands and builds.
+func doctorBash() DoctorCheck {
+	check := DoctorCheck{Name: "bash"}
+	path, err := exec.LookPath("bash")
+	if err != nil {
+		return check.fail("bash not found in PATH", "install bash, sup resolves the env values and runs local: commands and builds by bash -c")
+	}
+	return check.pass(path)
+}
+
+// sudoRe matches sudo invocations of run: and steps.
+var sudoRe = regexp.MustCompile(`(^|[\s;&|(])sudo\s`)
+
+// doctorNeeds are the remote tools the commands of the Supfile use.
+type doctorNeeds struct {
+	sudo, tar, scp bool
+}
+
+func (s *Supfile) doctorNeeds() doctorNeeds {
+	var needs doctorNeeds
+	for _, name := range s.Commands.Names {
+		cmd, _ := s.Commands.Get(name)
+		if cmd.Local {
+			continue
+		}
+		if sudoRe.MatchString(cmd.runScript()) || cmd.Service != nil && cmd.Service.Sudo {
+			needs.sudo = true
+		}
+		for _, upload := range cmd.Upload {
+			if upload.Method == UploadMethodSCP {
+				needs.scp = true
+			} else {
+				needs.tar = true
+			}
+		}
+		if cmd.Build != nil && cmd.Build.Dst != "" {
+			needs.tar = true
+		}
+	}
+	return needs
+}
+
+// probe returns the command checking the remote shell and tools, its
+// output lines being "shell", "tool <name>" and "sudo".
+func (n doctorNeeds) probe() string {
+	probe := "echo shell; for t in tar scp sha256sum shasum; do command -v $t >/dev/null 2>&1 && echo tool $t; done; "
+	if n.sudo {
+		probe += "sudo -n true >/dev/null 2>&1 && echo sudo; "
+	}
+	return probe + "true"
+}
+
+// Doctor runs the checks of the network's hosts: resolving and dialing
+// the hosts connected to directly, the keys of identity_file and
+// identity_key_env/file, connecting along with auth, the remote shell,
+// the tools uploads and verify use, and sudo -n, if any command of the
+// Supfile runs sudo. The checks are run on doctorParallel hosts at once,
+// each host connected to by its own run of sup, so hosts failing don't
+// stop the others.
+func (sup *Stackup) Doctor(network *Network, envVars EnvList) DoctorChecks {
+	needs := sup.conf.doctorNeeds()
+	results := make([][]DoctorCheck, len(network.Hosts))
+	sem := make(chan struct{}, doctorParallel)
+	var wg sync.WaitGroup
+	for i, host := range network.Hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, host *Host) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = sup.doctorHost(network, host, envVars, needs)
+		}(i, host)
+	}
+	wg.Wait()
+	var checks DoctorChecks
+	for _, result := range results {
+		checks = append(checks, result...)
+	}
+	return checks
+}
+
+// doctorHost runs the checks of the host, stopping at the first failed
+// one the next depend on.
+func (sup *Stackup) doctorHost(network *Network, host *Host, envVars EnvList, needs doctorNeeds) []DoctorCheck {
+	var checks []DoctorCheck
+	add := func(check DoctorCheck) bool {
+		check.Host = host.GetHostname()
+		checks = append(checks, check)
+		return check.Status != DoctorFail
+	}
+
+	bastion := host.jumpHost(network.Bastion)
+	if bastion == "" && host.Pod == "" {
+		addr, ok := doctorDNS(network.DNS, host, add)
+		if !ok {
+			return checks
+		}
+		check := DoctorCheck{Name: "tcp"}
+		target := net.JoinHostPort(addr, host.Port)
+		conn, err := net.DialTimeout("tcp", target, doctorTimeout)
+		if err != nil {
+			add(check.fail(err.Error(), "check the port, the firewall and that sshd is running"))
+			return checks
+		}
+		conn.Close()
+		add(check.pass(target))
+	}
+
+	if source := host.keySource(); source != "" {
+		check := DoctorCheck{Name: "key"}
+		cwd, _ := sup.conf.BaseDir()
+		key, err := parseIdentityKey(cwd, host, source)
+		if err != nil {
+			add(check.fail(err.Error(), "fix the key of the host"))
+			return checks
+		}
+		add(check.pass(source + ": " + describeKey(key.signer.PublicKey())))
+	}
+	if host.IdentityFile != "" {
+		check := DoctorCheck{Name: "key"}
+		signer, err := identitySigner(host.IdentityFile)
+		if err != nil {
+			add(check.fail(err.Error(), "fix the identity_file of the host"))
+			return checks
+		}
+		add(check.pass(host.IdentityFile + ": " + describeKey(signer.PublicKey())))
+	}
+
+	// The probe is run by a quiet run of sup, connecting exactly as the
+	// runs do, bastions, daemon and transport included.
+	probe, err := New(sup.conf)
+	if err != nil {
+		add(DoctorCheck{Name: "ssh"}.fail(err.Error(), ""))
+		return checks
+	}
+	probe.daemon, probe.dial = sup.daemon, sup.dial
+	probe.batch, probe.noBanners = true, true
+	probe.stdout, probe.stderr = io.Discard, io.Discard
+	var connErr error
+	connected := false
+	lines := map[string]bool{}
+	probe.OnEvent(func(e Event) {
+		switch {
+		case e.Type == HostConnected && e.Host == host.GetHostname():
+			connErr, connected = e.Err, e.Err == nil
+		case e.Type == OutputLine && e.Stream == Stdout:
+			lines[strings.TrimSpace(e.Line)] = true
+		}
+	})
+	single := *network
+	single.Hosts = []*Host{host}
+	single.Tunnels = nil
+	if single.ConnectTimeout == "" {
+		single.ConnectTimeout = doctorConnectTimeout
+	}
+	// Run may set the vars of the list in place, ie. SUP_SYNC_DIR, so
+	// each host is given its own copy.
+	var env EnvList
+	for _, v := range envVars {
+		env.set(v.Key, v.Value, v.Literal)
+	}
+	runErr := probe.Run(&single, env, &Command{Name: "doctor", Run: needs.probe()})
+
+	check := DoctorCheck{Name: "ssh"}
+	if !connected {
+		if connErr == nil {
+			connErr = runErr
+		}
+		hint := "check the address, port and bastion of the host"
+		if strings.Contains(fmt.Sprint(connErr), "unable to authenticate") {
+			hint = "ssh-add the key authorized on the host, or set its identity_file"
+		}
+		add(check.fail(fmt.Sprint(connErr), hint))
+		return checks
+	}
+	via := ""
+	if bastion != "" {
+		via = " via " + bastion
+	}
+	add(check.pass(fmt.Sprintf("connected as %v%v", host.User, via)))
+
+	check = DoctorCheck{Name: "shell"}
+	if !lines["shell"] {
+		msg := "the probe printed nothing"
+		if runErr != nil {
+			msg = runErr.Error()
+		}
+		add(check.fail(msg, "check the login shell of "+host.User+" on the host"))
+		return checks
+	}
+	add(check.pass("runs commands"))
+
+	for _, tool := range []struct {
+		name, alt string
+		needed    bool
+		use       string
+	}{
+		{"tar", "", needs.tar, "upload: and build: dst"},
+		{"scp", "", needs.scp, "upload: method: scp"},
+		{"sha256sum", "shasum", false, "--verify and resumed uploads"},
+	} {
+		check := DoctorCheck{Name: tool.name}
+		switch {
+		case lines["tool "+tool.name]:
+			add(check.pass("found"))
+		case tool.alt != "" && lines["tool "+tool.alt]:
+			add(check.pass(tool.alt + " found"))
+		case tool.needed:
+			add(check.fail("not found, needed by "+tool.use, "install "+tool.name+" on the host"))
+		default:
+			add(check.warn("not found, needed by "+tool.use, "install "+tool.name+" on the host"))
+		}
+	}
+
+	if needs.sudo {
+		check := DoctorCheck{Name: "sudo"}
+		if lines["sudo"] {
+			add(check.pass("sudo -n works"))
+		} else {
+			add(check.fail("sudo -n true failed, sup runs commands without a password prompt", "install sudo and allow "+host.User+" NOPASSWD sudo"))
+		}
+	}
+	return checks
+}
+
+// doctorDNS checks the host's address resolves, by the network's dns:
+// if set, and returns the address it's dialed at.
+func doctorDNS(dns DNS, host *Host, add func(DoctorCheck) bool) (string, bool) {
+	check := DoctorCheck{Name: "dns"}
+	addr, by, err := dns.resolve(host.Address, true)
+	if err != nil {
+		return "", add(check.fail(err.Error(), "check the host name, or the resolver of the network's dns:"))
+	}
+	if by != "" {
+		return addr, add(check.pass(fmt.Sprintf("%v (%v)", addr, by)))
+	}
+	if net.ParseIP(addr) != nil {
+		return addr, add(check.pass(addr))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, addr)
+	if err != nil {
+		return "", add(check.fail(err.Error(), "check the host name, or resolve it by the network's dns: host_overrides"))
+	}
+	return addrs[0], add(check.pass(addr + " " + addrs[0]))
+}
+
+// describeKey returns the type and fingerprint of the key.
+func describeKey(key ssh.PublicKey) string {
+	return key.Type() + " " + ssh.FingerprintSHA256(key)
+}
+
+func (c DoctorCheck) result(status, message, hint string) DoctorCheck {
+	c.Status, c.Message, c.Hint = status, message, hint
+	return c
+}
+
+func (c DoctorCheck) pass(message string) DoctorCheck {
+	return c.result(DoctorPass, message, "")
+}
+
+func (c DoctorCheck) warn(message, hint string) DoctorCheck {
+	return c.result(DoctorWarn, message, hint)
+}
+
+func (c DoctorCheck) fail(message, hint string) DoctorCheck {
+	return c.result(DoctorFail, message, hint)
+}
@@ -0,0 +1,114 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WarnUploadDst is a warning code of upload destinations which look like
+// the result of a templating mistake.
+const WarnUploadDst = "upload-dst"
+
+// dangerousPaths are the upload destinations refused unless the command
+// sets allow_dangerous_paths, see Command.AllowDangerousPaths.
+var dangerousPaths = map[string]bool{
+	"/":    true,
+	"/etc": true,
+	"/usr": true,
+	"/bin": true,
+	"/var": true,
+}
+
+// ErrDangerousPath is returned for upload to one of dangerousPaths.
+type ErrDangerousPath struct {
+	Command string
+	Dst     string // Dst as written in Supfile.
+	Path    string // Dst resolved for the host.
+	Host    string
+}
+
+func (e ErrDangerousPath) Error() string {
+	return fmt.Sprintf("%v: upload dst %q resolves to %v on %v, refusing to upload over a system path (set allow_dangerous_paths: true to allow it)", e.Command, e.Dst, e.Path, e.Host)
+}
+
+// resolveDst returns dst with the env vars known locally expanded, along
+// with the names of those expanding to empty value. Vars not in env, ie.
+// $HOME, and values the remote shell would expand further are kept,
+// since they're only known on the host.
+func resolveDst(dst string, env EnvList) (string, []string) {
+	values := map[string]string{}
+	for _, v := range env {
+		values[v.Key] = v.Value
+	}
+	var empty []string
+	resolved := os.Expand(dst, func(key string) string {
+		value, ok := values[key]
+		if !ok || strings.ContainsAny(value, "$`") {
+			return "${" + key + "}"
+		}
+		if value == "" {
+			empty = append(empty, key)
+		}
+		return value
+	})
+	return resolved, empty
+}
+
+// checkUploadDsts checks the upload and build destinations of the
+// commands, resolved for each host of the network, before connecting to
+// any. Destinations in dangerousPaths fail, unless allowed by the
+// command. Absolute ones of fewer than two components, or using vars
+// expanding to empty value, are returned as warnings.
+func (sup *Stackup) checkUploadDsts(network *Network, envVars EnvList, commands []*Command) ([]Warning, error) {
+	release := newRelease(envVars)
+	var warnings []Warning
+	seen := map[string]bool{}
+	warn := func(cmd *Command, msg string) {
+		if !seen[msg] {
+			seen[msg] = true
+			warnings = append(warnings, Warning{
+				Code:    WarnUploadDst,
+				Message: msg,
+				Line:    findLine(sup.conf.data, "commands", cmd.Name),
+			})
+		}
+	}
+	for _, cmd := range commands {
+		if cmd.Local {
+			continue
+		}
+		var dsts []string
+		for _, upload := range cmd.Upload {
+			dst, err := release.expand("dst", upload.Dst)
+			if err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+			dsts = append(dsts, dst)
+		}
+		if cmd.Build != nil && cmd.Build.Dst != "" {
+			dsts = append(dsts, cmd.Build.Dst)
+		}
+		for _, dst := range dsts {
+			for _, host := range network.Hosts {
+				// As the host's exports, later vars take precedence.
+				env := append(append(append(EnvList{}, envVars...), host.Env...), host.LabelEnv()...)
+				env = append(env, &EnvVar{Key: "SUP_HOST", Value: host.GetHostname()})
+				resolved, empty := resolveDst(dst, env)
+				clean := path.Clean(resolved)
+				if dangerousPaths[clean] && !cmd.AllowDangerousPaths {
+					return nil, ErrDangerousPath{cmd.Name, dst, clean, host.GetHostname()}
+				}
+				if len(empty) > 0 {
+					warn(cmd, fmt.Sprintf("commands.%v: upload dst %q resolves to %v, $%v is empty", cmd.Name, dst, clean, strings.Join(empty, ", $")))
+				} else if path.IsAbs(clean) && strings.Count(clean, "/") < 2 && !dangerousPaths[clean] {
+					warn(cmd, fmt.Sprintf("commands.%v: upload dst %q is a top-level directory", cmd.Name, clean))
+				}
+			}
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,66 @@
+package sup
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckUploadDsts(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		dst     string
+		warning string // Message of the warning, if any.
+		err     bool   // Refused as a dangerous path.
+	}{
+		{name: "tilde", dst: "~/releases/current"},
+		{name: "tilde alone", dst: "~"},
+		{name: "absolute", dst: "/srv/shop"},
+		{name: "relative", dst: "releases/shop"},
+		{name: "relative top-level", dst: "shop"},
+		{name: "host var", dst: "/srv/$SUP_HOST"},
+		{name: "remote var", dst: "$HOME/shop"},
+		{name: "absolute top-level", dst: "/srv", warning: `commands.upload: upload dst "/srv" is a top-level directory`},
+		{name: "empty var", dst: "/srv/$APP/current", warning: `commands.upload: upload dst "/srv/$APP/current" resolves to /srv/current, $APP is empty`},
+		{name: "dangerous", dst: "/etc/", err: true},
+		{name: "dangerous by empty var", dst: "/$APP", err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := NewSupfile([]byte(`
+networks:
+  production:
+    hosts: [web1]
+commands:
+  upload:
+    upload:
+      - src: ./dist
+        dst: "` + tt.dst + `"
+`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			network, _ := conf.Networks.Get("production")
+			if err := network.ResolveHosts(nil); err != nil {
+				t.Fatal(err)
+			}
+			cmd, _ := conf.Commands.Get("upload")
+			cmd.Name = "upload"
+			app, err := New(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			warnings, err := app.checkUploadDsts(&network, EnvList{{Key: "APP", Value: ""}}, []*Command{&cmd})
+			var dangerous ErrDangerousPath
+			if tt.err != errors.As(err, &dangerous) {
+				t.Fatalf("got error %v, want dangerous path %v", err, tt.err)
+			}
+			var got string
+			if len(warnings) > 0 {
+				got = warnings[0].Message
+			}
+			if len(warnings) > 1 || got != tt.warning {
+				t.Errorf("got warnings %v, want %q", warnings, tt.warning)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// EnvDiff is the difference of the resolved env of two networks.
+type EnvDiff struct {
+	A         string         `json:"a"`
+	B         string         `json:"b"`
+	OnlyA     []PlanEnv      `json:"only_a"`    // Vars set by network A only.
+	OnlyB     []PlanEnv      `json:"only_b"`    // Vars set by network B only.
+	Different []EnvDiffValue `json:"different"` // Vars set by both, to different values.
+}
+
+// EnvDiffValue is a var set to different values by the networks.
+type EnvDiffValue struct {
+	Name string `json:"name"`
+	A    string `json:"a"`
+	B    string `json:"b"`
+}
+
+// NetworkEnv returns the effective env of the network: Supfile env, then
+// the network env, resolved once by the local shell (with $SUP_NETWORK
+// set), vars overriding them as-is and finally the pass_env values. No host
+// is connected to and the network inventory isn't run.
+func (s *Supfile) NetworkEnv(name string, vars EnvList) (EnvList, error) {
+	network, ok := s.Networks.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown network %v", name)
+	}
+
+	var env EnvList
+	env.Set("SUP_NETWORK", name)
+	for _, v := range append(append(EnvList{}, s.Env...), network.Env...) {
+		env.Set(v.Key, v.Value)
+	}
+	env, err := env.ResolveValues()
+	if err != nil {
+		return nil, fmt.Errorf("network %v: %v", name, err)
+	}
+	for _, v := range vars {
+		env.set(v.Key, v.Value, v.Literal)
+	}
+
+	for _, pass := range []struct {
+		patterns []string
+		required bool
+	}{
+		{s.PassEnv, s.PassEnvRequired},
+		{network.PassEnv, network.PassEnvRequired},
+	} {
+		passVars, err := PassEnv(pass.patterns, pass.required)
+		if err != nil {
+			return nil, fmt.Errorf("network %v: %v", name, err)
+		}
+		for _, v := range passVars {
+			env.SetLiteral(v.Key, v.Value)
+		}
+	}
+	return env, nil
+}
+
+// DiffEnv compares the effective env of networks a and b, see NetworkEnv.
+// Values of secret env vars are masked, as by Plan. $SUP_NETWORK, which
+// always differs, is left out.
+func (s *Supfile) DiffEnv(a, b string, vars EnvList) (*EnvDiff, error) {
+	envA, err := s.NetworkEnv(a, vars)
+	if err != nil {
+		return nil, err
+	}
+	envB := envA
+	if b != a {
+		if envB, err = s.NetworkEnv(b, vars); err != nil {
+			return nil, err
+		}
+	}
+	var masked secrets
+	masked.add(envA)
+	masked.add(envB)
+
+	values := func(env EnvList) map[string]string {
+		m := map[string]string{}
+		for _, v := range env {
+			if v.Key != "SUP_NETWORK" {
+				m[v.Key] = v.Value
+			}
+		}
+		return m
+	}
+	valuesA, valuesB := values(envA), values(envB)
+
+	// Values are compared before masking, so different secrets are
+	// reported too.
+	diff := &EnvDiff{A: a, B: b, OnlyA: []PlanEnv{}, OnlyB: []PlanEnv{}, Different: []EnvDiffValue{}}
+	for _, name := range sortedKeys(valuesA) {
+		valueB, ok := valuesB[name]
+		switch {
+		case !ok:
+			diff.OnlyA = append(diff.OnlyA, PlanEnv{Name: name, Value: masked.mask(valuesA[name])})
+		case valueB != valuesA[name]:
+			diff.Different = append(diff.Different, EnvDiffValue{Name: name, A: masked.mask(valuesA[name]), B: masked.mask(valueB)})
+		}
+	}
+	for _, name := range sortedKeys(valuesB) {
+		if _, ok := valuesA[name]; !ok {
+			diff.OnlyB = append(diff.OnlyB, PlanEnv{Name: name, Value: masked.mask(valuesB[name])})
+		}
+	}
+	return diff, nil
+}
+
+// Empty reports whether the networks have the same env.
+func (d *EnvDiff) Empty() bool {
+	return len(d.OnlyA) == 0 && len(d.OnlyB) == 0 && len(d.Different) == 0
+}
+
+// WriteText writes the diff as a table of the var name and its value in
+// network A and B, vars set by A only first, then by B only, then the
+// different values.
+func (d *EnvDiff) WriteText(out io.Writer) error {
+	if d.Empty() {
+		_, err := fmt.Fprintf(out, "No env differences between %v and %v\n", d.A, d.B)
+		return err
+	}
+	const unset = "(unset)"
+	w := &tabwriter.Writer{}
+	w.Init(out, 4, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\t%v\t%v\n", d.A, d.B)
+	for _, v := range d.OnlyA {
+		fmt.Fprintf(w, "%v\t%q\t%v\n", v.Name, v.Value, unset)
+	}
+	for _, v := range d.OnlyB {
+		fmt.Fprintf(w, "%v\t%v\t%q\n", v.Name, unset, v.Value)
+	}
+	for _, v := range d.Different {
+		fmt.Fprintf(w, "%v\t%q\t%q\n", v.Name, v.A, v.B)
+	}
+	return w.Flush()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Warning codes of EnvWarnings.
+const (
+	WarnUnusedEnv    = "unused-env"
+	WarnUndefinedEnv = "undefined-env"
+)
+
+// EnvWarnings returns warnings of the Supfile and network env keys which
+// nothing references, and of the variables the commands' run strings,
+// steps and scripts expand which no env defines, ie. $DEPOY_ENV typos
+// expanding to empty strings.
+//
+// Keys count as referenced by $KEY or ${KEY} anywhere in the Supfile (run
+// strings, upload paths, other env values...) or in the script: and
+// scripts_dir files of any command. Variables count as defined by vars,
+// the env of the run, the hosts' env, pass_env, the SUP_* builtins, the
+// usual shell and login variables (HOME, PATH...) and the names or globs
+// of known_env, which lists the variables expected on the hosts or read by
+// the remote programs. known_env keys aren't reported unused either.
+// Expansions in single quotes, escaped \$VAR and ${VAR:-default} forms
+// aren't reported, nor are the commands with lint_ignore: [undefined-variable].
+func (s *Supfile) EnvWarnings(name string, network *Network, vars EnvList, commands []*Command) []Warning {
+	base, err := s.BaseDir()
+	if err != nil {
+		return nil
+	}
+	var warnings []Warning
+
+	// Keys nothing references.
+	refs := string(s.data)
+	for _, cmdName := range s.Commands.Names {
+		cmd, _ := s.Commands.Get(cmdName)
+		for _, script := range cmdScripts(base, &cmd) {
+			refs += "\n" + script.text
+		}
+	}
+	unused := func(key string, path ...string) {
+		if !strings.HasPrefix(key, "SUP_") && !references(refs, key) && !matchEnv(s.KnownEnv, key) {
+			warnings = append(warnings, Warning{
+				Code:    WarnUnusedEnv,
+				Message: fmt.Sprintf("%v.%v is never referenced, list it in known_env if the remote programs read it", strings.Join(path, "."), key),
+				Line:    findLine(s.data, append(path, key)...),
+			})
+		}
+	}
+	for _, v := range s.Env {
+		unused(v.Key, "env")
+	}
+	for _, v := range network.Env {
+		unused(v.Key, "networks", name, "env")
+	}
+
+	// Expansions no env defines.
+	defined := map[string]bool{}
+	for _, v := range vars {
+		defined[v.Key] = true
+	}
+	for _, host := range network.Hosts {
+		for _, v := range host.Env {
+			defined[v.Key] = true
+		}
+	}
+	for _, v := range shellVars {
+		defined[v] = true
+	}
+	var patterns []string
+	patterns = append(patterns, s.PassEnv...)
+	patterns = append(patterns, network.PassEnv...)
+	patterns = append(patterns, s.KnownEnv...)
+	for _, cmd := range commands {
+		if containsString(cmd.LintIgnore, LintUndefined) {
+			continue
+		}
+		l := linter{
+			defined:     defined,
+			patterns:    append(append([]string{}, patterns...), cmd.PassEnv...),
+			assignments: map[string]bool{},
+		}
+		use, _ := s.fragments(cmd.Use) // Unknown fragments fail the parsing.
+		for _, script := range cmdScripts(base, cmd) {
+			for _, v := range l.undefined(use + script.text) {
+				warnings = append(warnings, Warning{
+					Code:    WarnUndefinedEnv,
+					Message: fmt.Sprintf("commands.%v.%v: $%v is not defined in any env, list it in known_env if the hosts set it", cmd.Name, script.source, v),
+					Line:    findLine(s.data, "commands", cmd.Name, script.key),
+				})
+			}
+		}
+	}
+	return warnings
+}
+
+// cmdScript is shell code run by a command.
+type cmdScript struct {
+	key    string // Key of the command defining it, ie. "script".
+	source string // "run" or the key and file, ie. `script "deploy.sh"`.
+	text   string
+}
+
+// cmdScripts returns the run string, steps and readable script files of
+// the command. Unreadable files are reported by the run.
+func cmdScripts(base string, cmd *Command) []cmdScript {
+	var scripts []cmdScript
+	if cmd.Run != "" {
+		scripts = append(scripts, cmdScript{"run", "run", cmd.Run})
+	}
+	if len(cmd.Steps) > 0 {
+		// The steps run in one shell, one after another.
+		scripts = append(scripts, cmdScript{"run", "run", strings.Join(cmd.Steps, "\n")})
+	}
+	if cmd.Script != "" {
+		if data, err := os.ReadFile(resolve(base, cmd.Script)); err == nil {
+			scripts = append(scripts, cmdScript{"script", fmt.Sprintf("script %q", cmd.Script), string(data)})
+		}
+	}
+	if cmd.ScriptsDir != "" {
+		files, _ := cmd.scriptsDirFiles(base)
+		for _, file := range files {
+			if data, err := os.ReadFile(file); err == nil {
+				scripts = append(scripts, cmdScript{"scripts_dir", fmt.Sprintf("scripts_dir %q", filepath.Join(cmd.ScriptsDir, filepath.Base(file))), string(data)})
+			}
+		}
+	}
+	return scripts
+}
+
+// references reports whether text contains $key or ${key.
+func references(text, key string) bool {
+	for _, ref := range []string{"${" + key, "$" + key} {
+		for rest := text; ; {
+			i := strings.Index(rest, ref)
+			if i < 0 {
+				break
+			}
+			rest = rest[i+len(ref):]
+			if rest == "" || !isNameChar(rest[0]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isNameChar reports whether c can be part of a shell variable name.
+func isNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// matchEnv reports whether the env var name matches any of the names or
+// globs of patterns.
+func matchEnv(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,284 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is a type of Event.
+type EventType string
+
+// Event types emitted during Stackup.Run.
+const (
+	HostConnecting  EventType = "host_connecting"
+	HostConnected   EventType = "host_connected" // Err is set if connecting failed.
+	CommandBegin    EventType = "command_begin"  // Once per command, before its hosts start it.
+	CommandStarted  EventType = "command_started"
+	OutputLine      EventType = "output_line"
+	UploadProgress  EventType = "upload_progress"
+	PipeProgress    EventType = "pipe_progress"    // Bytes piped from the source of Pipe so far.
+	CommandFinished EventType = "command_finished" // Err is set if the command failed.
+	CommandSkipped  EventType = "command_skipped"  // Reason is set to the guard skipping the command.
+	CommandEnd      EventType = "command_end"      // Once per command, Err is set if the command failed.
+	RunFinished     EventType = "run_finished"     // Err is set if the run failed.
+)
+
+// Output streams of OutputLine events.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// Event is emitted by Stackup.Run to report its progress. Handlers
+// registered with Stackup.OnEvent are called synchronously, one event
+// at a time, in order of occurrence. A slow handler slows down the run.
+// Use EventChannel to consume events asynchronously.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Host    string // Host as specified in Supfile, empty for RunFinished.
+	Command string // Command name, empty for Host* and RunFinished.
+	Task    string // Task kind, see Task.Kind.
+
+	Stream string // OutputLine: Stdout or Stderr.
+	Line   string // OutputLine: line of output, without trailing newline.
+	Prefix string // OutputLine: padded hostname prefix, empty if disabled.
+	Step   int    // OutputLine: 1-based step of Command.Steps the line is output of, 0 if none.
+
+	Addr string // HostConnected: address connected to, if resolved by host_overrides or resolver.
+
+	Bytes int64 // UploadProgress: bytes uploaded so far, PipeProgress: bytes piped so far.
+	Total int64 // UploadProgress: total bytes, 0 if unknown.
+
+	Reason string // CommandSkipped: guard the host skipped the command by, ie. "creates: /opt/app/.installed".
+
+	Index    int           // CommandBegin, CommandEnd: 1-based index of the command in the run.
+	Commands int           // CommandBegin, CommandEnd: number of commands of the run.
+	Hosts    int           // CommandBegin, CommandEnd: number of hosts the command is run on.
+	Desc     string        // CommandBegin, CommandEnd: desc of the command, rendered by the run env.
+	Failed   int           // CommandEnd: number of hosts which failed the command, ignored failures included.
+	Elapsed  time.Duration // CommandEnd: time since CommandBegin.
+
+	Err     error
+	Ignored bool // CommandFinished: Err is ignored, see Command.IgnoreErrors.
+
+	hidden bool // Not written by the text output, see Command.Output and Stackup.Banners.
+}
+
+func (e Event) String() string {
+	switch e.Type {
+	case OutputLine:
+		return e.Prefix + e.Line
+	case UploadProgress:
+		if e.Total > 0 {
+			return fmt.Sprintf("%v: %v %v: %v/%v bytes (%d%%)", e.Type, e.Host, e.Command, e.Bytes, e.Total, e.Bytes*100/e.Total)
+		}
+		return fmt.Sprintf("%v: %v %v: %v bytes", e.Type, e.Host, e.Command, e.Bytes)
+	case PipeProgress:
+		return fmt.Sprintf("%v: %v %v: %v bytes", e.Type, e.Host, e.Command, e.Bytes)
+	case CommandSkipped:
+		return fmt.Sprintf("%v: %v %v: %v", e.Type, e.Host, e.Command, e.Reason)
+	case CommandBegin, CommandEnd:
+		return fmt.Sprintf("%v: %v", e.Type, bannerText(e))
+	}
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %v %v: %v", e.Type, e.Host, e.Command, e.Err)
+	}
+	return fmt.Sprintf("%v: %v %v", e.Type, e.Host, e.Command)
+}
+
+// OnEvent registers handler to be called for each event during Run.
+func (sup *Stackup) OnEvent(handler func(Event)) {
+	sup.handlers = append(sup.handlers, handler)
+}
+
+// Output sets writers of the text output, which is os.Stdout and os.Stderr
+// by default. Nil writers disable the text output.
+func (sup *Stackup) Output(stdout, stderr io.Writer) {
+	sup.stdout = stdout
+	sup.stderr = stderr
+}
+
+// emit delivers the event to the text output and all handlers.
+func (sup *Stackup) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	sup.eventsMu.Lock()
+	defer sup.eventsMu.Unlock()
+
+	sup.trackBanner(e)
+	if !e.hidden {
+		sup.writeOutput(e)
+	}
+	for _, handler := range sup.handlers {
+		handler(e)
+	}
+}
+
+// writeOutput is the text output consumer of the events.
+func (sup *Stackup) writeOutput(e Event) {
+	if e.Type == CommandBegin || e.Type == CommandEnd {
+		if sup.stdout != nil {
+			fmt.Fprintln(sup.stdout, bannerText(e))
+		}
+		return
+	}
+	if e.Type != OutputLine {
+		return
+	}
+	w := sup.stdout
+	if e.Stream == Stderr {
+		w = sup.stderr
+	}
+	if w != nil {
+		fmt.Fprintln(w, e.Prefix+e.Line)
+	}
+}
+
+// writeText writes the event to the text output only.
+func (sup *Stackup) writeText(e Event) {
+	sup.eventsMu.Lock()
+	defer sup.eventsMu.Unlock()
+
+	sup.writeOutput(e)
+}
+
+// errorf writes a message to the text output stderr, if enabled.
+func (sup *Stackup) errorf(format string, args ...interface{}) {
+	sup.eventsMu.Lock()
+	defer sup.eventsMu.Unlock()
+
+	if sup.stderr != nil {
+		fmt.Fprintf(sup.stderr, format, args...)
+	}
+}
+
+// partialLineTimeout is how long a line without trailing newline is held
+// before it's emitted, so progress output isn't held until the stream ends.
+const partialLineTimeout = 200 * time.Millisecond
+
+// emitLines emits OutputLine event for each line read from r. Only complete
+// lines are emitted, so lines of different hosts never interleave. Partial
+// lines are emitted after partialLineTimeout or when r is closed, and \r
+// (ie. of progress bars) ends a line the same way as \n does. Escape
+// sequences are filtered out first, if StripANSI is enabled. Lines of
+// run: steps carry their step. Prefixes of the lines are rendered by
+// prefix at the time of the line, if set. The text output of the lines is
+// filtered by out, if set.
+func (sup *Stackup) emitLines(r io.Reader, e Event, prefix func(time.Time) string, out *hostOutput) error {
+	e.Type = OutputLine
+
+	var mu sync.Mutex
+	var line []byte
+	var afterCR bool
+	var ansi *ansiStripper
+	if sup.stripANSI {
+		ansi = &ansiStripper{}
+	}
+	flush := func(force bool) {
+		if len(line) > 0 || force {
+			// Step markers set the step of the following lines, see
+			// stepsScript. STDOUT ones are shown as the step titles.
+			step, title := parseStepMarker(string(line))
+			switch {
+			case step > 0 && title == "":
+				e.Step = step
+				line = line[:0]
+				return
+			case step > 0:
+				e.Step, e.Line = step, title
+			default:
+				e.Line = string(line)
+			}
+			e.Time = time.Time{}
+			if prefix != nil {
+				e.Time = time.Now()
+				e.Prefix = prefix(e.Time)
+			}
+			e.hidden = false
+			out.line(&e)
+			sup.emit(e)
+			line = line[:0]
+		}
+	}
+	timer := time.AfterFunc(partialLineTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		flush(false)
+	})
+	timer.Stop()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+
+		mu.Lock()
+		timer.Stop()
+		for _, b := range buf[:n] {
+			if ansi != nil && !ansi.keep(b) {
+				continue
+			}
+			switch {
+			case b == '\n' && afterCR:
+				// \r\n line ending, the line was already emitted.
+			case b == '\n':
+				flush(true)
+			case b == '\r':
+				flush(false)
+			default:
+				line = append(line, b)
+			}
+			afterCR = b == '\r'
+		}
+		if err != nil {
+			flush(false)
+			mu.Unlock()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(line) > 0 {
+			timer.Reset(partialLineTimeout)
+		}
+		mu.Unlock()
+	}
+}
+
+// progressWriter emits UploadProgress events for bytes written to w.
+type progressWriter struct {
+	w     io.Writer
+	sup   *Stackup
+	event Event
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.event.Bytes += int64(n)
+	p.event.Time = time.Time{}
+	p.sup.emit(p.event)
+	return n, err
+}
+
+// EventChannel returns a bounded channel of events and a handler for
+// Stackup.OnEvent feeding it. The handler never blocks the run: when
+// the channel is full, the event is dropped and the dropped counter
+// is incremented. It's up to the caller to close the channel after Run
+// returns.
+func EventChannel(size int) (events chan Event, handler func(Event), dropped *uint64) {
+	events = make(chan Event, size)
+	dropped = new(uint64)
+	handler = func(e Event) {
+		select {
+		case events <- e:
+		default:
+			atomic.AddUint64(dropped, 1)
+		}
+	}
+	return events, handler, dropped
+}
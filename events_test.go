@@ -0,0 +1,125 @@
+package sup_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+// partialLineTimeout is how long sup holds a line without newline before
+// it's emitted, as in events.go.
+const partialLineTimeout = 200 * time.Millisecond
+
+// TestOutputLines runs a command printing complete, \r-terminated and
+// partial lines on many hosts at once. Each line is emitted whole, as the
+// host printed it, and is written to the text output as such.
+func TestOutputLines(t *testing.T) {
+	var hosts []string
+	var fakes []suptest.FakeHost
+	want := map[string][]string{}
+	for i := 1; i <= 50; i++ {
+		host := fmt.Sprintf("web%02d", i)
+		hosts = append(hosts, host)
+		fakes = append(fakes, suptest.FakeHost{Host: host, Responses: []suptest.Response{{
+			Stdout: host + " line 1\n" + host + " line 2\r\n" + host + " progress 10%\r" + host + " progress 50%\r",
+			Chunks: []suptest.Chunk{
+				// Finished before the timeout, the line is emitted once.
+				{Stdout: host + " part"},
+				{Delay: partialLineTimeout / 4, Stdout: "ial line\n"},
+				// Held past the timeout, the partial line is emitted first.
+				{Stdout: host + " slow"},
+				{Delay: partialLineTimeout * 2, Stdout: " rest\r"},
+				// Emitted at the end of the output.
+				{Stdout: host + " tail"},
+			},
+		}}})
+		want[host] = []string{
+			host + " line 1", host + " line 2", host + " progress 10%", host + " progress 50%",
+			host + " partial line", host + " slow", " rest", host + " tail",
+		}
+	}
+	conf, err := sup.NewSupfile([]byte(`
+version: 0.5
+networks:
+  production:
+    hosts: [` + strings.Join(hosts, ", ") + `]
+commands:
+  progress:
+    run: ./progress.sh
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := suptest.Run(conf, "production", suptest.NewFakeNetwork(fakes...), "progress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Err != nil {
+		t.Fatalf("run failed: %v\n%v", report.Err, report.Stderr)
+	}
+
+	got := map[string][]string{}
+	var text []string // Lines of the events, as in the text output.
+	for _, e := range report.Events {
+		if e.Type == sup.OutputLine {
+			got[e.Host] = append(got[e.Host], e.Line)
+			text = append(text, e.Prefix+e.Line)
+		}
+	}
+	for _, host := range hosts {
+		if fmt.Sprintf("%q", got[host]) != fmt.Sprintf("%q", want[host]) {
+			t.Errorf("%v output lines\n%q\nwant\n%q", host, got[host], want[host])
+		}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(report.Stdout, "\n") {
+		if strings.Contains(line, "web") {
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	sort.Strings(text)
+	if strings.Join(lines, "\n") != strings.Join(text, "\n") {
+		t.Errorf("text output\n%v\nwant the lines of the events\n%v", strings.Join(lines, "\n"), strings.Join(text, "\n"))
+	}
+}
+
+// TestEventChannel overflows the channel of events nobody reads: the
+// handler doesn't block, the overflow is counted and the events which fit
+// are delivered in order.
+func TestEventChannel(t *testing.T) {
+	const size, sent = 8, 20
+	events, handler, dropped := sup.EventChannel(size)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < sent; i++ {
+			handler(sup.Event{Type: sup.OutputLine, Line: fmt.Sprint(i)})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler blocked on the full channel")
+	}
+	if n := atomic.LoadUint64(dropped); n != sent-size {
+		t.Errorf("dropped %v events, want %v", n, sent-size)
+	}
+
+	close(events)
+	var got []string
+	for e := range events {
+		got = append(got, e.Line)
+	}
+	if want := "[0 1 2 3 4 5 6 7]"; fmt.Sprint(got) != want {
+		t.Errorf("got events %v, want %v", got, want)
+	}
+}
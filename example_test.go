@@ -0,0 +1,88 @@
+package sup_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pressly/sup"
+)
+
+const exampleSupfile = `
+version: 0.5
+networks:
+  local:
+    hosts: [localhost]
+    env:
+      GREETING: hello
+commands:
+  greet:
+    run: echo "$GREETING from $SUP_NETWORK"
+  fail:
+    run: exit 3
+targets:
+  all: [greet, fail]
+`
+
+func ExampleNewSupfile() {
+	conf, err := sup.NewSupfile([]byte(exampleSupfile))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network, _ := conf.Networks.Get("local")
+	for _, host := range network.Hosts {
+		fmt.Println("host:", host.GetHostname())
+	}
+	target, _ := conf.Targets.Get("all")
+	fmt.Println("target all:", target)
+	// Output:
+	// host: localhost
+	// target all: [greet fail]
+}
+
+// Example_run parses a Supfile, picks a network and runs a command on
+// its hosts, then inspects the report of the run by its events.
+func Example_run() {
+	conf, err := sup.NewSupfile([]byte(exampleSupfile))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	network, _ := conf.Networks.Get("local")
+	env, err := conf.NetworkEnv("local", nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := network.ResolveHosts(env); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	app, err := sup.New(conf)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	app.Output(os.Stdout, io.Discard)
+	app.Prefix(false)
+	app.Banners(false)
+	app.OnEvent(func(e sup.Event) {
+		if e.Type == sup.CommandFinished {
+			fmt.Printf("%v finished on %v, error: %v\n", e.Command, e.Host, e.Err)
+		}
+	})
+	for _, name := range []string{"greet", "fail"} {
+		cmd, _ := conf.Commands.Get(name)
+		cmd.Name = name
+		if err := app.Run(&network, env, &cmd); err != nil {
+			fmt.Println("run failed:", err)
+		}
+	}
+	// Output:
+	// hello from local
+	// greet finished on localhost, error: <nil>
+	// fail finished on localhost, error: exit status 3
+	// run failed: exit status 3
+}
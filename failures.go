@@ -0,0 +1,150 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExitAborted is the exit status of sup when a command was aborted,
+// because its max_failures threshold was exceeded.
+const ExitAborted = 3
+
+// ErrAborted is returned when the number of failed hosts exceeded
+// the command's max_failures threshold.
+type ErrAborted struct {
+	Command      string
+	MaxFailures  int
+	Succeeded    int
+	Failed       int
+	NotAttempted int
+}
+
+func (e ErrAborted) Error() string {
+	return fmt.Sprintf("%v: aborted, more than %v host(s) failed (succeeded: %v, failed: %v, not attempted: %v)",
+		e.Command, e.MaxFailures, e.Succeeded, e.Failed, e.NotAttempted)
+}
+
+// ErrFailed is returned when some hosts failed, but the command's
+// max_failures threshold was not exceeded.
+type ErrFailed struct {
+	Command   string
+	Succeeded int
+	Failed    int
+}
+
+func (e ErrFailed) Error() string {
+	return fmt.Sprintf("%v: %v host(s) failed (succeeded: %v)", e.Command, e.Failed, e.Succeeded)
+}
+
+// parseMaxFailures parses max_failures value, which is either an absolute
+// count ("3") or a percentage of hosts ("20%").
+func parseMaxFailures(value string, hosts int) (int, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, fmt.Errorf("max_failures: invalid percentage %q", value)
+		}
+		return int(percent * float64(hosts) / 100), nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("max_failures: invalid count %q", value)
+	}
+	return count, nil
+}
+
+// failureTracker keeps track of host results of a command with
+// max_failures set. Failed hosts are not started again, and once
+// the threshold is exceeded, no new hosts are started at all.
+type failureTracker struct {
+	cmd      *Command
+	max      int
+	hosts    int
+	hardStop bool
+
+	mu        sync.Mutex
+	attempted map[Client]bool
+	failed    map[Client]bool
+	running   map[Client]bool
+}
+
+func newFailureTracker(cmd *Command, hosts int) (*failureTracker, error) {
+	max, err := parseMaxFailures(cmd.MaxFailures, hosts)
+	if err != nil {
+		return nil, err
+	}
+	return &failureTracker{
+		cmd:       cmd,
+		max:       max,
+		hosts:     hosts,
+		hardStop:  cmd.HardStop,
+		attempted: map[Client]bool{},
+		failed:    map[Client]bool{},
+		running:   map[Client]bool{},
+	}, nil
+}
+
+// start filters out failed clients and marks the rest as running.
+func (t *failureTracker) start(clients []Client) []Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var started []Client
+	for _, c := range clients {
+		if t.failed[c] {
+			continue
+		}
+		t.attempted[c] = true
+		t.running[c] = true
+		started = append(started, c)
+	}
+	return started
+}
+
+// finish records the client result. In case the threshold gets exceeded
+// and hard_stop is set, the rest of running clients are interrupted.
+func (t *failureTracker) finish(c Client, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.running, c)
+	if err == nil {
+		return
+	}
+	t.failed[c] = true
+	if len(t.failed) > t.max && t.hardStop {
+		for running := range t.running {
+			if err := running.Signal(os.Interrupt); err != nil {
+				fmt.Fprintf(os.Stderr, "hard_stop: %v\n", err)
+			}
+		}
+	}
+}
+
+// err returns ErrAborted when the threshold is exceeded, or ErrFailed
+// when some hosts failed when the command is done.
+func (t *failureTracker) err(done bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.failed) > t.max {
+		return ErrAborted{
+			Command:      t.cmd.Name,
+			MaxFailures:  t.max,
+			Succeeded:    len(t.attempted) - len(t.failed),
+			Failed:       len(t.failed),
+			NotAttempted: t.hosts - len(t.attempted),
+		}
+	}
+	if done && len(t.failed) > 0 {
+		return ErrFailed{
+			Command:   t.cmd.Name,
+			Succeeded: len(t.attempted) - len(t.failed),
+			Failed:    len(t.failed),
+		}
+	}
+	return nil
+}
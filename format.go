@@ -0,0 +1,201 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Supfile formats, see ParseOptions.Format.
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// FormatFromPath returns Supfile format by the file extension, ".json"
+// and ".toml", or "" to be detected from the contents.
+func FormatFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	case ".yml", ".yaml":
+		return FormatYAML
+	}
+	return ""
+}
+
+// detectFormat returns format, if set. Otherwise data starting with "{"
+// is JSON, YAML if not.
+func detectFormat(data []byte, format string) string {
+	if format != "" {
+		return format
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// NewSupfileFromFile reads and parses Supfile in the format given by its
+// extension, see FormatFromPath. Relative paths are resolved against the
+// Supfile directory, if enabled by paths: or version.
+func NewSupfileFromFile(path string) (*Supfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	return NewSupfileWithOptions(data, ParseOptions{Dir: dir, Format: FormatFromPath(path)})
+}
+
+// toYAML converts JSON or TOML data into YAML with the same order of keys,
+// so all the formats are unmarshalled the same way.
+func toYAML(data []byte, format string) ([]byte, error) {
+	var v interface{}
+	var err error
+	switch format {
+	case FormatJSON:
+		v, err = decodeJSON(data)
+	case FormatTOML:
+		v, err = decodeTOML(data)
+	default:
+		return nil, fmt.Errorf("unknown Supfile format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// decodeJSON decodes JSON document by the streaming decoder, so objects
+// become yaml.MapSlice keeping the order of keys.
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("json: unexpected data after the top-level value")
+	}
+	return v, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '{' {
+			m := yaml.MapSlice{}
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeJSONValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				m = append(m, yaml.MapItem{Key: key, Value: value})
+			}
+			_, err := dec.Token() // Closing }.
+			return m, err
+		}
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token() // Closing ].
+		return list, err
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+		return t.Float64()
+	}
+	return token, nil
+}
+
+// decodeTOML decodes TOML document, ordering keys of the tables as they
+// were declared.
+func decodeTOML(data []byte) (interface{}, error) {
+	var m map[string]interface{}
+	md, err := toml.Decode(string(data), &m)
+	if err != nil {
+		return nil, err
+	}
+	// Tables declared implicitly, like commands.upload by
+	// [[commands.upload.upload]], aren't keys of their own, so they're
+	// ordered by the first key under them.
+	order := map[string]int{}
+	for i, key := range md.Keys() {
+		for j := 1; j <= len(key); j++ {
+			if _, ok := order[key[:j].String()]; !ok {
+				order[key[:j].String()] = i
+			}
+		}
+	}
+	return orderTOML(m, nil, order), nil
+}
+
+func orderTOML(v interface{}, path toml.Key, order map[string]int) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		index := func(key string) int {
+			if i, ok := order[append(path[:len(path):len(path)], key).String()]; ok {
+				return i
+			}
+			return len(order)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if a, b := index(keys[i]), index(keys[j]); a != b {
+				return a < b
+			}
+			return keys[i] < keys[j]
+		})
+		m := yaml.MapSlice{}
+		for _, key := range keys {
+			m = append(m, yaml.MapItem{Key: key, Value: orderTOML(t[key], append(path[:len(path):len(path)], key), order)})
+		}
+		return m
+	case []map[string]interface{}:
+		list := make([]interface{}, len(t))
+		for i, item := range t {
+			list[i] = orderTOML(item, path, order)
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(t))
+		for i, item := range t {
+			list[i] = orderTOML(item, path, order)
+		}
+		return list
+	}
+	return v
+}
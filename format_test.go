@@ -0,0 +1,27 @@
+package sup
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestFormats parses the same Supfile written in each format.
+func TestFormats(t *testing.T) {
+	want, err := NewSupfileFromFile("testdata/formats/Supfile.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.data = nil // The source differs by the format.
+	for _, file := range []string{"Supfile.json", "Supfile.toml"} {
+		t.Run(file, func(t *testing.T) {
+			got, err := NewSupfileFromFile("testdata/formats/" + file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got.data = nil
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%v parsed as\n%#v\nwant\n%#v", file, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package sup
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// useDirective is the comment of script files using fragments, in addition
+// to the ones of the command's use:, ie. "# sup:use strict logging".
+const useDirective = "# sup:use "
+
+// ErrUnknownFragment is returned for use: (or # sup:use) of fragment not
+// defined by the Supfile's fragments:.
+type ErrUnknownFragment struct {
+	Name    string
+	Defined []string
+}
+
+func (e ErrUnknownFragment) Error() string {
+	if len(e.Defined) == 0 {
+		return fmt.Sprintf("unknown fragment %q, Supfile has no fragments:", e.Name)
+	}
+	return fmt.Sprintf("unknown fragment %q, defined fragments: %v", e.Name, strings.Join(e.Defined, ", "))
+}
+
+// checkFragments returns error of the first fragment of names the Supfile
+// doesn't define.
+func (s *Supfile) checkFragments(names []string) error {
+	for _, name := range names {
+		if _, ok := s.Fragments[name]; !ok {
+			defined := make([]string, 0, len(s.Fragments))
+			for name := range s.Fragments {
+				defined = append(defined, name)
+			}
+			sort.Strings(defined)
+			return ErrUnknownFragment{name, defined}
+		}
+	}
+	return nil
+}
+
+// fragments returns the fragments of names, each once, in order.
+func (s *Supfile) fragments(names []string) (string, error) {
+	if err := s.checkFragments(names); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		b.WriteString(strings.TrimRight(s.Fragments[name], "\n"))
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// scriptUse returns the fragments of the # sup:use directive of script,
+// on its first line or the one following #! line.
+func scriptUse(script string) []string {
+	lines := strings.SplitN(script, "\n", 3)
+	if len(lines) > 1 && strings.HasPrefix(lines[0], "#!") {
+		lines = lines[1:]
+	}
+	if rest, ok := strings.CutPrefix(strings.TrimSpace(lines[0]), useDirective); ok {
+		return strings.Fields(rest)
+	}
+	return nil
+}
+
+// useScript returns script prefixed with the fragments of the command's
+// use: and the script's # sup:use directive, if any, after its #! line.
+func (s *Supfile) useScript(cmd *Command, script string) (string, error) {
+	use, err := s.fragments(append(append([]string{}, cmd.Use...), scriptUse(script)...))
+	if err != nil {
+		return "", err
+	}
+	return insertAfterShebang(script, use), nil
+}
@@ -0,0 +1,371 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LockVersion is the version of the Lock JSON schema. Locks of other
+// versions don't match any run.
+const LockVersion = 1
+
+// lockVolatileEnv are the env vars which differ on each run, left out of
+// the locks.
+var lockVolatileEnv = []string{"SUP_RUN_ID", "SUP_TIME", "SUP_USER"}
+
+// Lock is the fingerprint of runs, written by sup --freeze, so a later run
+// (ie. by CI) can prove, by --frozen, it runs what was reviewed: the same
+// Supfile, env values, hosts, command text and uploaded files. Values are
+// stored as SHA256 hashes only, secrets included.
+type Lock struct {
+	LockVersion int       `json:"lock_version"`
+	Supfile     string    `json:"supfile_sha256"`
+	Runs        []LockRun `json:"runs"`
+}
+
+// LockRun is the fingerprint of the run of the commands on a network.
+type LockRun struct {
+	Network  string        `json:"network"`
+	Env      []LockValue   `json:"env"`   // Sorted by name.
+	Hosts    []string      `json:"hosts"` // "name user@address:port", in order of the run.
+	Commands []LockCommand `json:"commands"`
+}
+
+// LockValue is an env var and the SHA256 of its value.
+type LockValue struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// LockCommand is the fingerprint of a command: SHA256 of its composed
+// text (run or steps, the script or the scripts_dir scripts with the
+// fragments, script_args, service and build commands), its pass_env values
+// and the files of its uploads.
+type LockCommand struct {
+	Name    string       `json:"name"`
+	SHA256  string       `json:"sha256"`
+	Env     []LockValue  `json:"env,omitempty"`
+	Uploads []LockUpload `json:"uploads,omitempty"`
+}
+
+// LockUpload is an upload of a command, as in Supfile, and the SHA256 of
+// its files in sha256sum format, sorted. Files of a src missing when the
+// lock was computed, ie. built by an earlier command, aren't known.
+type LockUpload struct {
+	Upload  string   `json:"upload"` // "<src> -> <dst>"
+	Files   []string `json:"files,omitempty"`
+	Missing bool     `json:"missing,omitempty"`
+}
+
+// NewLock returns lock of the Supfile, without any runs.
+func (s *Supfile) NewLock() *Lock {
+	return &Lock{LockVersion: LockVersion, Supfile: hashValue(string(s.data))}
+}
+
+// ReadLock reads the lock written to file.
+func ReadLock(file string) (*Lock, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var lock Lock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, errors.Wrapf(err, "parsing lock %v failed", file)
+	}
+	return &lock, nil
+}
+
+// Write writes the lock as JSON to file.
+func (l *Lock) Write(file string) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false) // The "->" of uploads.
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	return os.WriteFile(file, b.Bytes(), 0644)
+}
+
+// LockRun returns the fingerprint of running the commands on the network,
+// computed by Plan without connecting to any host.
+func (sup *Stackup) LockRun(name string, network *Network, envVars EnvList, commands ...*Command) (LockRun, error) {
+	cwd, err := sup.conf.BaseDir()
+	if err != nil {
+		return LockRun{}, errors.Wrap(err, "resolving CWD failed")
+	}
+
+	// The volatile vars are left out and have fixed values in the plan, so
+	// the {{.RunID}} and {{.Timestamp}} templates expand the same way.
+	var env EnvList
+	for _, v := range envVars {
+		if !containsString(lockVolatileEnv, v.Key) {
+			env.set(v.Key, v.Value, v.Literal)
+		}
+	}
+	planEnv := append(EnvList{}, env...)
+	planEnv.Set("SUP_RUN_ID", "frozen")
+	planEnv.Set("SUP_TIME", "1970-01-01T00:00:00Z")
+	plan, err := sup.Plan(name, network, planEnv, commands...)
+	if err != nil {
+		return LockRun{}, err
+	}
+
+	run := LockRun{Network: name, Env: lockValues(env), Hosts: []string{}, Commands: []LockCommand{}}
+	for _, host := range plan.Hosts {
+		line := fmt.Sprintf("%v %v@%v:%v", host.Name, host.User, host.Address, host.Port)
+		if host.Bastion != "" {
+			line += " via " + host.Bastion
+		}
+		run.Hosts = append(run.Hosts, line)
+	}
+	exports := env.AsExport()
+	for i, c := range plan.Commands {
+		cmd := commands[i]
+		text := []string{c.Run, strings.Join(c.Steps, "\n"), strings.Join(c.ScriptArgs, "\n"), c.Service, c.Build}
+		for _, script := range c.Scripts {
+			data, err := os.ReadFile(script)
+			if err != nil {
+				return LockRun{}, errors.Wrap(err, cmd.Name)
+			}
+			text = append(text, string(data))
+		}
+		lc := LockCommand{Name: cmd.Name, SHA256: hashValue(strings.Join(text, "\x00"))}
+
+		passEnv, err := PassEnv(cmd.PassEnv, cmd.PassEnvRequired)
+		if err != nil {
+			return LockRun{}, errors.Wrap(err, cmd.Name)
+		}
+		if len(passEnv) > 0 {
+			lc.Env = lockValues(passEnv)
+		}
+
+		for _, upload := range cmd.Upload {
+			lu := LockUpload{Upload: upload.Src + " -> " + upload.Dst}
+			src, err := ResolveLocalPath(cwd, upload.Src, exports)
+			if err != nil {
+				return LockRun{}, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			if _, err := os.Stat(resolve(cwd, src)); os.IsNotExist(err) {
+				lu.Missing = true
+				lc.Uploads = append(lc.Uploads, lu)
+				continue
+			}
+			var files []string
+			if cmd.gitTracked(upload) {
+				if files, err = gitFiles(cwd, src, upload.IncludeUntracked, upload.Exc); err != nil {
+					return LockRun{}, errors.Wrap(err, "upload: "+upload.Src)
+				}
+			}
+			manifest, err := uploadManifest(cwd, src, upload.Exc, files, filepath.Base(src))
+			if err != nil {
+				return LockRun{}, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			if manifest != "" {
+				lu.Files = strings.Split(strings.TrimSuffix(manifest, "\n"), "\n")
+			}
+			lc.Uploads = append(lc.Uploads, lu)
+		}
+		run.Commands = append(run.Commands, lc)
+	}
+	return run, nil
+}
+
+// Diff returns the differences of the lock l to the lock of the actual
+// run, one per line, ie. "network production: env DB_HOST: value changed".
+// Identical locks have none.
+func (l *Lock) Diff(actual *Lock) []string {
+	var diffs []string
+	if l.LockVersion != actual.LockVersion {
+		return []string{fmt.Sprintf("lock_version %v, expected %v", l.LockVersion, actual.LockVersion)}
+	}
+	if l.Supfile != actual.Supfile {
+		diffs = append(diffs, fmt.Sprintf("Supfile: sha256 %.12v changed to %.12v", l.Supfile, actual.Supfile))
+	}
+	runs := map[string]LockRun{}
+	for _, run := range l.Runs {
+		runs[run.Network] = run
+	}
+	for _, run := range actual.Runs {
+		locked, ok := runs[run.Network]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("network %v: not in the lock", run.Network))
+			continue
+		}
+		delete(runs, run.Network)
+		for _, diff := range locked.diff(run) {
+			diffs = append(diffs, fmt.Sprintf("network %v: %v", run.Network, diff))
+		}
+	}
+	for _, run := range l.Runs {
+		if _, ok := runs[run.Network]; ok {
+			diffs = append(diffs, fmt.Sprintf("network %v: locked, but not run", run.Network))
+		}
+	}
+	return diffs
+}
+
+// diff returns the differences of the locked run r to the actual one.
+func (r LockRun) diff(actual LockRun) []string {
+	diffs := diffValues("env", r.Env, actual.Env)
+	diffs = append(diffs, diffLists("hosts", r.Hosts, actual.Hosts)...)
+
+	var locked, run []string
+	for _, cmd := range r.Commands {
+		locked = append(locked, cmd.Name)
+	}
+	for _, cmd := range actual.Commands {
+		run = append(run, cmd.Name)
+	}
+	if strings.Join(locked, " ") != strings.Join(run, " ") {
+		diffs = append(diffs, fmt.Sprintf("commands: %v, locked %v", strings.Join(run, ", "), strings.Join(locked, ", ")))
+		return diffs
+	}
+	for i, cmd := range actual.Commands {
+		lockedCmd := r.Commands[i]
+		prefix := "command " + cmd.Name + ": "
+		if cmd.SHA256 != lockedCmd.SHA256 {
+			diffs = append(diffs, prefix+"command text changed")
+		}
+		for _, diff := range diffValues("pass_env", lockedCmd.Env, cmd.Env) {
+			diffs = append(diffs, prefix+diff)
+		}
+		uploads := map[string]LockUpload{}
+		for _, upload := range lockedCmd.Uploads {
+			uploads[upload.Upload] = upload
+		}
+		for _, upload := range cmd.Uploads {
+			lockedUpload, ok := uploads[upload.Upload]
+			switch {
+			case !ok:
+				diffs = append(diffs, prefix+"upload "+upload.Upload+": not in the lock")
+			case upload.Missing != lockedUpload.Missing:
+				diffs = append(diffs, fmt.Sprintf("%vupload %v: src missing %v, locked %v", prefix, upload.Upload, upload.Missing, lockedUpload.Missing))
+			default:
+				for _, diff := range diffFiles(lockedUpload.Files, upload.Files) {
+					diffs = append(diffs, prefix+"upload "+upload.Upload+": "+diff)
+				}
+			}
+			delete(uploads, upload.Upload)
+		}
+		for _, upload := range lockedCmd.Uploads {
+			if _, ok := uploads[upload.Upload]; ok {
+				diffs = append(diffs, prefix+"upload "+upload.Upload+": locked, but not run")
+			}
+		}
+	}
+	return diffs
+}
+
+// diffValues returns the env vars added, removed or changed.
+func diffValues(key string, locked, actual []LockValue) []string {
+	values := map[string]string{}
+	for _, v := range locked {
+		values[v.Name] = v.SHA256
+	}
+	var diffs []string
+	for _, v := range actual {
+		sum, ok := values[v.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("%v %v: added", key, v.Name))
+		case sum != v.SHA256:
+			diffs = append(diffs, fmt.Sprintf("%v %v: value changed", key, v.Name))
+		}
+		delete(values, v.Name)
+	}
+	for _, v := range locked {
+		if _, ok := values[v.Name]; ok {
+			diffs = append(diffs, fmt.Sprintf("%v %v: removed", key, v.Name))
+		}
+	}
+	return diffs
+}
+
+// diffLists returns the items added to or removed from the list, or that
+// its order changed.
+func diffLists(key string, locked, actual []string) []string {
+	var diffs []string
+	for _, item := range actual {
+		if !containsString(locked, item) {
+			diffs = append(diffs, fmt.Sprintf("%v: + %v", key, item))
+		}
+	}
+	for _, item := range locked {
+		if !containsString(actual, item) {
+			diffs = append(diffs, fmt.Sprintf("%v: - %v", key, item))
+		}
+	}
+	if len(diffs) == 0 && strings.Join(locked, "\n") != strings.Join(actual, "\n") {
+		diffs = append(diffs, key+": order changed")
+	}
+	return diffs
+}
+
+// diffFiles returns the files of sha256sum lines added, removed or changed.
+func diffFiles(locked, actual []string) []string {
+	sums := map[string]string{}
+	for _, line := range locked {
+		sum, name := splitManifestLine(line)
+		sums[name] = sum
+	}
+	var diffs []string
+	for _, line := range actual {
+		sum, name := splitManifestLine(line)
+		lockedSum, ok := sums[name]
+		switch {
+		case !ok:
+			diffs = append(diffs, name+": added")
+		case lockedSum != sum:
+			diffs = append(diffs, name+": changed")
+		}
+		delete(sums, name)
+	}
+	var removed []string
+	for name := range sums {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		diffs = append(diffs, name+": removed")
+	}
+	return diffs
+}
+
+// splitManifestLine returns the checksum and the name of a line of
+// manifestLine.
+func splitManifestLine(line string) (sum, name string) {
+	line = strings.TrimPrefix(line, `\`)
+	if i := strings.Index(line, "  "); i >= 0 {
+		return line[:i], line[i+2:]
+	}
+	return "", line
+}
+
+// lockValues returns the env vars with their values hashed, sorted by
+// name.
+func lockValues(env EnvList) []LockValue {
+	values := []LockValue{}
+	for _, v := range env {
+		values = append(values, LockValue{Name: v.Key, SHA256: hashValue(v.Value)})
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Name < values[j].Name
+	})
+	return values
+}
+
+// hashValue returns the hex SHA256 of value.
+func hashValue(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,147 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gitTracked reports whether the upload is restricted to the files
+// tracked by git, by itself or by the command.
+func (cmd *Command) gitTracked(upload Upload) bool {
+	return upload.GitTracked || cmd.GitTracked
+}
+
+// gitFiles returns the files of src (relative to cwd) listed by git
+// ls-files, along with the untracked files which aren't ignored if
+// untracked is set, except the ones matching exclude patterns. The paths
+// are relative to src, "." if src is a file. Listed files missing in the
+// work tree (ie. deleted, not committed yet) are left out.
+func gitFiles(cwd, src string, untracked bool, exclude string) ([]string, error) {
+	path := resolve(cwd, src)
+	srcInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	dir, pathspec := path, "."
+	if !srcInfo.IsDir() {
+		dir, pathspec = filepath.Dir(path), filepath.Base(path)
+	}
+
+	if out, err := exec.Command("git", "-C", dir, "rev-parse", "--is-inside-work-tree").Output(); err != nil || string(bytes.TrimSpace(out)) != "true" {
+		return nil, fmt.Errorf("git_tracked: %v is not in a git work tree", src)
+	}
+	args := []string{"-C", dir, "ls-files", "-z", "--cached"}
+	if untracked {
+		args = append(args, "--others", "--exclude-standard")
+	}
+	cmd := exec.Command("git", append(args, "--", pathspec)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "git_tracked: git ls-files: %s", bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	excluded := excludeFunc(exclude)
+	seen := map[string]bool{}
+	files := []string{}
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file == "" || seen[file] {
+			continue
+		}
+		seen[file] = true
+		if info, err := os.Lstat(filepath.Join(dir, file)); err != nil || info.IsDir() {
+			// Deleted files and submodules.
+			continue
+		}
+		rel := "."
+		if srcInfo.IsDir() {
+			rel = filepath.FromSlash(file)
+			if excludedPath(excluded, rel) {
+				continue
+			}
+		}
+		files = append(files, rel)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("git_tracked: %v has no files tracked by git", src)
+	}
+	return files, nil
+}
+
+// excludedPath reports whether the relative path or any of its
+// directories is excluded, as by tar.
+func excludedPath(excluded func(rel string) bool, rel string) bool {
+	for p := rel; p != "."; p = filepath.Dir(p) {
+		if excluded(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFilter returns function reporting whether the relative path of
+// an upload is left out: it matches exclude patterns or, if the files of
+// the upload are listed (see gitFiles), it's neither one of them nor a
+// directory of one.
+func uploadFilter(exclude string, files []string) func(rel string) bool {
+	if files == nil {
+		return excludeFunc(exclude)
+	}
+	keep := map[string]bool{}
+	for _, file := range files {
+		for p := file; p != "."; p = filepath.Dir(p) {
+			keep[p] = true
+		}
+	}
+	return func(rel string) bool {
+		return !keep[rel]
+	}
+}
+
+// filesSize returns the total size of the files of src.
+func filesSize(cwd, src string, files []string) int64 {
+	var size int64
+	for _, file := range files {
+		if info, err := os.Lstat(filepath.Join(resolve(cwd, src), file)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// listGitFiles runs git once for each git_tracked upload of the commands,
+// before any remote activity, so a src outside a git work tree fails the
+// run up front.
+func (sup *Stackup) listGitFiles(commands []*Command, env string) error {
+	cwd, err := sup.conf.BaseDir()
+	if err != nil {
+		return errors.Wrap(err, "resolving CWD failed")
+	}
+	for _, cmd := range commands {
+		for i, upload := range cmd.Upload {
+			if !cmd.gitTracked(upload) {
+				continue
+			}
+			src, err := ResolveLocalPath(cwd, upload.Src, env)
+			if err != nil {
+				return errors.Wrap(err, cmd.Name+": upload: "+upload.Src)
+			}
+			files, err := gitFiles(cwd, src, upload.IncludeUntracked, upload.Exc)
+			if err != nil {
+				return errors.Wrap(err, cmd.Name+": upload: "+upload.Src)
+			}
+			if sup.uploadFiles == nil {
+				sup.uploadFiles = map[*Upload][]string{}
+			}
+			sup.uploadFiles[&cmd.Upload[i]] = files
+		}
+	}
+	return nil
+}
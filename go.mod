@@ -5,16 +5,14 @@ go 1.21
 toolchain go1.21.7
 
 require (
-	github.com/goware/prefixer v0.0.0-20160118172347-395022866408
-	github.com/jsnjack/sshconfig v0.1.2-0.20240224161741-ca9d472789e9
+	github.com/BurntSushi/toml v1.4.0
 	github.com/pkg/errors v0.9.1
 	golang.org/x/crypto v0.19.0
+	golang.org/x/sys v0.17.0
+	golang.org/x/term v0.17.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
+	mvdan.cc/sh/v3 v3.8.0
 )
 
-require (
-	github.com/kr/pretty v0.2.0 // indirect
-	github.com/mitchellh/go-homedir v1.1.0 // indirect
-	golang.org/x/sys v0.17.0 // indirect
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
-)
+require gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
@@ -0,0 +1,71 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Supported network auth methods.
+const (
+	AuthGSSAPI = "gssapi"
+)
+
+// ErrKerberos describes a Kerberos ticket problem found before connecting.
+type ErrKerberos struct {
+	Reason string
+	Hint   string
+}
+
+func (e ErrKerberos) Error() string {
+	return fmt.Sprintf("gssapi: %v\n\n%v", e.Reason, e.Hint)
+}
+
+// gssapiOptions returns ssh options enabling GSSAPI-with-MIC authentication.
+func gssapiOptions(delegate bool) []string {
+	opts := []string{
+		"GSSAPIAuthentication=yes",
+		"PreferredAuthentications=gssapi-with-mic",
+	}
+	if delegate {
+		opts = append(opts, "GSSAPIDelegateCredentials=yes")
+	} else {
+		opts = append(opts, "GSSAPIDelegateCredentials=no")
+	}
+	return opts
+}
+
+// checkKerberosTicket makes sure there's a valid ticket in the credentials
+// cache, which is picked up from $KRB5CCNAME by klist and ssh alike.
+func checkKerberosTicket() error {
+	klist, err := exec.LookPath("klist")
+	if err != nil {
+		return ErrKerberos{"klist not found in $PATH", "Install Kerberos client tools (krb5-user, krb5-workstation or heimdal-clients)."}
+	}
+
+	// klist -s exits silently with non-zero status if there's no valid ticket.
+	if err := exec.Command(klist, "-s").Run(); err == nil {
+		return nil
+	}
+
+	cache := os.Getenv("KRB5CCNAME")
+	if cache == "" {
+		cache = "default credentials cache"
+	}
+	out, _ := exec.Command(klist).CombinedOutput()
+	text := strings.ToLower(string(out))
+	if strings.Contains(text, "no credentials cache") || strings.Contains(text, "not found") || strings.Contains(text, "no ccache") {
+		return ErrKerberos{"no Kerberos ticket in " + cache, "Run `kinit user@REALM` to obtain a ticket, or point $KRB5CCNAME to a valid cache."}
+	}
+	return ErrKerberos{"Kerberos ticket in " + cache + " has expired", "Run `kinit -R` to renew it, or `kinit user@REALM` to obtain a new one."}
+}
+
+// gssapiConnectError translates ssh GSSAPI failures into actionable errors.
+func gssapiConnectError(err ErrConnect, host *Host) error {
+	if strings.Contains(err.Reason, "Permission denied") {
+		err.Reason += "\n\nThe server rejected the Kerberos ticket. Check that your ticket's realm (see `klist`)" +
+			" matches the host's realm, and that the host principal host/" + host.Address + " exists."
+	}
+	return err
+}
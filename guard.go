@@ -0,0 +1,175 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Guards make a command idempotent: each host runs a single check before
+// the command, and skips the command if any guard says it's not needed.
+// Paths are relative to the directory the command runs in, which is the
+// remote user's home directory (or $SUP_SYNC_DIR with Stackup.Sync), and may
+// reference env vars.
+type Guards struct {
+	Creates string `yaml:"creates,omitempty"` // Skip the command if the path exists.
+	Removes string `yaml:"removes,omitempty"` // Skip the command unless the path exists.
+	Unless  string `yaml:"unless,omitempty"`  // Skip the command if the shell snippet exits with 0.
+	OnlyIf  string `yaml:"only_if,omitempty"` // Skip the command unless the shell snippet exits with 0.
+}
+
+// guard is a shell condition of Guards, true if the command is skipped.
+type guard struct {
+	reason string // Shown for skipped hosts, ie. "creates: /opt/app/.installed".
+	skip   string
+}
+
+// list returns the guards which are set.
+func (g Guards) list() []guard {
+	var guards []guard
+	if g.Creates != "" {
+		guards = append(guards, guard{"creates: " + g.Creates, "[ -e " + remotePath(g.Creates) + " ]"})
+	}
+	if g.Removes != "" {
+		guards = append(guards, guard{"removes: " + g.Removes, "[ ! -e " + remotePath(g.Removes) + " ]"})
+	}
+	if g.Unless != "" {
+		guards = append(guards, guard{"unless: " + g.Unless, "( " + g.Unless + " ) >/dev/null 2>&1 </dev/null"})
+	}
+	if g.OnlyIf != "" {
+		guards = append(guards, guard{"only_if: " + g.OnlyIf, "! ( " + g.OnlyIf + " ) >/dev/null 2>&1 </dev/null"})
+	}
+	return guards
+}
+
+// Reasons returns the guards which are set, as shown for skipped hosts.
+func (g Guards) Reasons() []string {
+	var reasons []string
+	for _, guard := range g.list() {
+		reasons = append(reasons, guard.reason)
+	}
+	return reasons
+}
+
+// script returns the check printing index of the first guard which skips
+// the command, or nothing if the command is to be run.
+func (g Guards) script() string {
+	var b strings.Builder
+	for i, guard := range g.list() {
+		fmt.Fprintf(&b, "if %s; then echo %d; exit 0; fi; ", guard.skip, i)
+	}
+	return b.String()
+}
+
+// guard runs the guards of cmd on the clients of the tasks, one check per
+// host, and returns the tasks without the hosts skipping the command. The
+// checks share the env and clean_env/umask of the command.
+func (sup *Stackup) guard(cmd *Command, tasks []*Task, maxLen int) ([]*Task, error) {
+	passEnv, err := PassEnv(cmd.PassEnv, cmd.PassEnvRequired)
+	if err != nil {
+		return nil, errors.Wrap(err, cmd.Name)
+	}
+	check := &Task{Run: passEnv.AsExport() + sup.syncChdir(cmd) + cmd.Guards.script(), Kind: TaskGuard}
+	for _, task := range tasks {
+		if task.Kind == TaskRun || task.Kind == TaskScript {
+			check.CleanEnv, check.Umask = task.CleanEnv, task.Umask
+			break
+		}
+	}
+	guards := cmd.Guards.list()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var checkErr error
+	skipped := map[Client]bool{}
+	for _, c := range taskClients(tasks) {
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			prefix := sup.paddedPrefix(c, cmd.Name, time.Now(), maxLen)
+			out, err := sup.runCheck(c, cmd.Name, check)
+			if err != nil {
+				mu.Lock()
+				if checkErr == nil {
+					checkErr = errors.Wrap(err, prefix+"guard check failed")
+				}
+				mu.Unlock()
+				return
+			}
+			if out == "" {
+				return
+			}
+			i, err := strconv.Atoi(out)
+			if err != nil || i < 0 || i >= len(guards) {
+				mu.Lock()
+				if checkErr == nil {
+					checkErr = fmt.Errorf("%sguard check failed: unexpected output %q", prefix, out)
+				}
+				mu.Unlock()
+				return
+			}
+			sup.emit(Event{Type: CommandSkipped, Host: clientHostname(c), Command: cmd.Name, Reason: guards[i].reason})
+			sup.errorf("%sskipped (%v)\n", prefix, guards[i].reason)
+			mu.Lock()
+			skipped[c] = true
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	var guarded []*Task
+	for _, task := range tasks {
+		var clients []Client
+		for _, c := range task.Clients {
+			if !skipped[c] {
+				clients = append(clients, c)
+			}
+		}
+		if len(clients) == 0 {
+			continue
+		}
+		copy := *task
+		copy.Clients = clients
+		guarded = append(guarded, &copy)
+	}
+	return guarded, nil
+}
+
+// runCheck runs the task of the command on the client and returns its
+// trimmed STDOUT. Failures carry the task's STDERR.
+func (sup *Stackup) runCheck(c Client, command string, task *Task) (string, error) {
+	tape := sup.tape(c, command, task)
+	if err := c.Run(task); err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(&stdout, tape.reader(Stdout, c.Stdout()))
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&stderr, tape.reader(Stderr, c.Stderr()))
+	}()
+	wg.Wait()
+	err := c.Wait()
+	tape.finish(err)
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%v: %v", err, msg)
+		}
+		return "", err
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,96 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnsetHostVar is returned by Network.ResolveHosts for hosts: entry
+// referencing env var which isn't set.
+type ErrUnsetHostVar struct {
+	Network string
+	Host    string // Entry as written in Supfile, see HostConfig.String().
+	Var     string
+}
+
+func (e ErrUnsetHostVar) Error() string {
+	return fmt.Sprintf("network %v: host %q: $%v is not set", e.Network, e.Host, e.Var)
+}
+
+// hasVars reports whether the hosts: entry references env vars, ie.
+// "deploy@$PROD_LB", which are resolved by Network.ResolveHosts.
+func (h HostConfig) hasVars() bool {
+	return strings.Contains(h.Host+h.User+h.Port, "$")
+}
+
+// expand returns the entry with $VAR and ${VAR} of its host, user and port
+// expanded by env, or the name of the first var env doesn't set.
+func (h HostConfig) expand(env EnvList) (HostConfig, string) {
+	values := map[string]string{}
+	for _, v := range env {
+		values[v.Key] = v.Value
+	}
+	var unset string
+	expand := func(s string) string {
+		return os.Expand(s, func(key string) string {
+			value, ok := values[key]
+			if !ok && unset == "" {
+				unset = key
+			}
+			return value
+		})
+	}
+	h.Host = expand(h.Host)
+	h.User = expand(h.User)
+	h.Port = expand(h.Port)
+	return h, unset
+}
+
+// ResolveHosts creates the hosts of hosts: entries, with the env vars they
+// reference resolved by env, ie. the Supfile and network env merged with
+// pass_env and -e vars, as passed to Stackup.Run. It replaces Hosts, so
+// it's called before the inventory hosts are added.
+//
+// Entries are resolved as soon as the Supfile is parsed, the ones with
+// env vars by empty env, so networks not using them are left as they are
+// and work without calling it.
+func (n *Network) ResolveHosts(env EnvList) error {
+	if !n.hostVars {
+		return nil
+	}
+	r := n.resolver
+	if r == nil {
+		r = defaultResolver
+	}
+	var hosts []*Host
+	for _, item := range n.hostConfigs {
+		if item.hasVars() {
+			raw := item.String()
+			var unset string
+			if item, unset = item.expand(env); unset != "" {
+				return ErrUnsetHostVar{n.name, raw, unset}
+			}
+		}
+		host, err := r.NewHostFromConfig(item, n.HostDefaults())
+		if err != nil {
+			return fmt.Errorf("network %v: %v", n.name, err)
+		}
+		hosts = append(hosts, host)
+	}
+	if err := checkAliases(hosts); err != nil {
+		return fmt.Errorf("network %v: %v", n.name, err)
+	}
+	n.Hosts = hosts
+	n.hostVars = false
+	return nil
+}
+
+// checkHostsResolved returns error if hosts: entries referencing env vars
+// weren't resolved by ResolveHosts.
+func (n *Network) checkHostsResolved() error {
+	if n.hostVars {
+		return fmt.Errorf("network %v: hosts: reference env vars, resolve them by Network.ResolveHosts first", n.name)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// TemplateData is the data of the run and steps of template: commands,
+// rendered for each host the command runs on, ie. a clustering command
+// joining the other hosts:
+//
+//	join:
+//	  template: true
+//	  run: consul agent -retry-join={{join .PeerAddresses ","}}
+//
+// The commands are rendered before any of their tasks run, so errors
+// (ie. {{index .PeerAddresses 1}} of a single host) fail the command on
+// all hosts.
+type TemplateData struct {
+	Network       string
+	Bastion       string         // Network bastion, if any.
+	Host          TemplateHost   // Host the command is rendered for.
+	Hosts         []TemplateHost // Hosts the command runs on, filtered, deduplicated and selected by run_on.
+	PeerAddresses []string       // Addresses of Hosts other than Host.
+	RunID         string
+	Timestamp     string
+}
+
+// TemplateHost is a host of TemplateData.
+type TemplateHost struct {
+	Name    string // Host as specified in Supfile, or its alias.
+	Alias   string // Alias given in Supfile or inventory, if any.
+	Address string
+	Port    string
+	User    string
+	Bastion string // Bastion the host is connected through, if any.
+}
+
+// templateFuncs are the functions of the templates, besides the builtin
+// ones, ie. index.
+var templateFuncs = template.FuncMap{
+	"join": func(list []string, sep string) string {
+		return strings.Join(list, sep)
+	},
+	"first": func(list []string) string {
+		if len(list) == 0 {
+			return ""
+		}
+		return list[0]
+	},
+}
+
+// parseTemplate parses the text of the command's key, ie. "run".
+func parseTemplate(key, text string) (*template.Template, error) {
+	tmpl, err := template.New(key).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", key, err)
+	}
+	return tmpl, nil
+}
+
+// checkTemplate returns error of template: command whose run or steps
+// don't parse, rendering them once so unknown fields fail too.
+func (cmd *Command) checkTemplate() error {
+	if !cmd.Template {
+		return nil
+	}
+	if cmd.Run == "" && len(cmd.Steps) == 0 {
+		return fmt.Errorf("template requires run")
+	}
+	_, err := cmd.render(TemplateData{PeerAddresses: []string{}}, true)
+	return err
+}
+
+// render returns copy of the template: command with its run and steps
+// rendered by data. Dry renders only fail on unknown fields and functions,
+// not on the missing data, ie. of index.
+func (cmd *Command) render(data TemplateData, dry bool) (*Command, error) {
+	rendered := *cmd
+	execute := func(key, text string) (string, error) {
+		tmpl, err := parseTemplate(key, text)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		if dry {
+			if err := tmpl.Execute(io.Discard, data); err != nil && strings.Contains(err.Error(), "can't evaluate field") {
+				return "", err
+			}
+			return text, nil
+		}
+		if err := tmpl.Execute(&b, data); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	var err error
+	if rendered.Run, err = execute("run", cmd.Run); err != nil {
+		return nil, err
+	}
+	rendered.Steps = make([]string, len(cmd.Steps))
+	for i, step := range cmd.Steps {
+		if rendered.Steps[i], err = execute(fmt.Sprintf("run[%d]", i), step); err != nil {
+			return nil, err
+		}
+	}
+	if len(cmd.Steps) == 0 {
+		rendered.Steps = nil
+	}
+	return &rendered, nil
+}
+
+// templateHost returns the host of TemplateData.
+func (sup *Stackup) templateHost(h *Host) TemplateHost {
+	return TemplateHost{
+		Name:    h.GetHostname(),
+		Alias:   h.alias,
+		Address: h.Address,
+		Port:    h.Port,
+		User:    h.User,
+		Bastion: h.jumpHost(sup.bastion),
+	}
+}
+
+// hostRuns returns the run of each client of the template: command, as
+// by commandRun, keyed by the host of the client. The clients are the
+// local ones of local commands, converted from the remote clients, which
+// the commands are rendered for. Commands without template: have none.
+func (sup *Stackup) hostRuns(cmd *Command, remote, clients []Client, prefix string) (map[*Host]string, error) {
+	if !cmd.Template {
+		return nil, nil
+	}
+	data := TemplateData{
+		Network:   sup.network,
+		Bastion:   sup.bastion,
+		Hosts:     []TemplateHost{},
+		RunID:     sup.release.RunID,
+		Timestamp: sup.release.Timestamp,
+	}
+	for _, c := range selectClients(cmd, remote) {
+		if host := clientHost(c); host != nil {
+			data.Hosts = append(data.Hosts, sup.templateHost(host))
+		}
+	}
+	runs := map[*Host]string{}
+	for i, c := range clients {
+		host, current := clientHost(c), clientHost(remote[i])
+		if host == nil || current == nil {
+			continue
+		}
+		data.Host = sup.templateHost(current)
+		data.PeerAddresses = []string{}
+		for _, h := range data.Hosts {
+			if h != data.Host {
+				data.PeerAddresses = append(data.PeerAddresses, h.Address)
+			}
+		}
+		rendered, err := cmd.render(data, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "host %v", current.GetHostname())
+		}
+		run, err := sup.conf.commandRun(rendered)
+		if err != nil {
+			return nil, err
+		}
+		runs[host] = prefix + traced(run, sup.debug)
+	}
+	return runs, nil
+}
+
+// ForHost returns the task as run on the host, with the host's run of
+// template: commands. Clients of Stackup.Dial run the tasks by it.
+func (t *Task) ForHost(h *Host) *Task {
+	run, ok := t.hostRuns[h]
+	if !ok {
+		return t
+	}
+	copy := *t
+	copy.Run = run
+	return &copy
+}
@@ -0,0 +1,104 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// identityKey is the private key of a host's identity_key_env or
+// identity_key_file, parsed once per run by loadIdentityKeys. The key
+// material is never written to disk, nor passed to ssh or the daemon.
+type identityKey struct {
+	source string // "identity_key_env $DEPLOY_KEY" or "identity_key_file /run/secrets/deploy_key".
+	file   string // Path of identity_key_file, resolved against the Supfile directory.
+	signer ssh.Signer
+}
+
+// checkIdentityKey returns error if both key sources are set.
+func checkIdentityKey(env, file string) error {
+	if env != "" && file != "" {
+		return fmt.Errorf("identity_key_env and identity_key_file are mutually exclusive")
+	}
+	return nil
+}
+
+// keySource returns the identity_key_env or identity_key_file source of
+// the host, empty if it has none.
+func (h *Host) keySource() string {
+	switch {
+	case h.IdentityKeyEnv != "":
+		return "identity_key_env $" + h.IdentityKeyEnv
+	case h.IdentityKeyFile != "":
+		return "identity_key_file " + h.IdentityKeyFile
+	}
+	return ""
+}
+
+// loadIdentityKeys parses the identity_key_env and identity_key_file keys
+// of the network's hosts, each source once however many hosts use it.
+// Relative key files are resolved against the Supfile directory. The
+// errors name the source but never any of its contents, as the key
+// material is secret.
+func (sup *Stackup) loadIdentityKeys(network *Network) error {
+	cwd, err := sup.conf.BaseDir()
+	if err != nil {
+		return errors.Wrap(err, "resolving CWD failed")
+	}
+	openSSH := network.Transport == TransportOpenSSH || network.Auth == AuthGSSAPI
+	keys := map[string]*identityKey{}
+	for _, host := range network.Hosts {
+		source := host.keySource()
+		if source == "" {
+			continue
+		}
+		if openSSH && host.IdentityKeyEnv != "" {
+			return fmt.Errorf("host %v: identity_key_env requires the %v transport, ssh reads keys from files only", host.GetHostname(), TransportNative)
+		}
+		key, ok := keys[source]
+		if !ok {
+			if key, err = parseIdentityKey(cwd, host, source); err != nil {
+				return fmt.Errorf("host %v: %v", host.GetHostname(), err)
+			}
+			keys[source] = key
+		}
+		host.identityKey = key
+	}
+	return nil
+}
+
+// parseIdentityKey reads and parses the key of the host's source.
+func parseIdentityKey(cwd string, host *Host, source string) (*identityKey, error) {
+	key := &identityKey{source: source}
+	var data []byte
+	if host.IdentityKeyEnv != "" {
+		value, ok := os.LookupEnv(host.IdentityKeyEnv)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("%v is not set", source)
+		}
+		data = []byte(value)
+	} else {
+		key.file = resolve(cwd, host.IdentityKeyFile)
+		var err error
+		if data, err = os.ReadFile(key.file); err != nil {
+			return nil, fmt.Errorf("%v: %v", source, err)
+		}
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("%v is encrypted, add it to ssh-agent instead", source)
+	}
+	if err != nil {
+		// The error of the parser may quote the data.
+		return nil, fmt.Errorf("%v is not a parseable private key", source)
+	}
+	key.signer = preferSHA2(signer)
+	return key, nil
+}
+
+// fingerprint returns the SHA256 fingerprint of the key, as by ssh-keygen -l.
+func (k *identityKey) fingerprint() string {
+	return ssh.FingerprintSHA256(k.signer.PublicKey())
+}
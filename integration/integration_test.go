@@ -0,0 +1,244 @@
+//go:build integration
+
+// Package integration runs sup against dockerized sshd instances, the
+// published bastion and two hosts behind it, see docker-compose.yml.
+// Needs docker compose. Run by `go test -tags integration ./integration`.
+package integration
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pressly/sup"
+	"golang.org/x/crypto/ssh"
+)
+
+const project = "sup-it"
+
+func TestMain(m *testing.M) {
+	os.Exit(runMain(m))
+}
+
+func runMain(m *testing.M) int {
+	home, err := os.MkdirTemp("", "sup-it")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(home)
+	defer os.Remove("authorized_keys")
+
+	// Key auth by a throwaway key, read from ~/.ssh like the user's keys,
+	// for the bastion and the hosts alike.
+	if err := writeKey(home); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Setenv("HOME", home)
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	defer compose("down", "-v")
+	if err := compose("up", "-d", "--build"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for i := 0; ; i++ {
+		if _, err := run("bastion", nil, "hostname"); err == nil {
+			break
+		} else if i == 30 {
+			fmt.Fprintf(os.Stderr, "bastion is not up: %v\n", err)
+			return 1
+		}
+		time.Sleep(time.Second)
+	}
+	return m.Run()
+}
+
+// writeKey writes a new key to home/.ssh and its public key to
+// authorized_keys, which the Dockerfile copies into the images.
+func writeKey(home string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "sup-it")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519"), pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile("authorized_keys", ssh.MarshalAuthorizedKey(key), 0644)
+}
+
+func compose(args ...string) error {
+	cmd := exec.Command("docker", append([]string{"compose", "-p", project}, args...)...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
+
+// syncBuffer is written by the run and read by the test at once.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// run runs the commands of Supfile on the network by Stackup.Run,
+// returning the lines of its output. Output is written to out too, if
+// it's not nil.
+func run(network string, out *syncBuffer, names ...string) ([]string, error) {
+	conf, err := sup.NewSupfileFromFile("Supfile")
+	if err != nil {
+		return nil, err
+	}
+	net, ok := conf.Networks.Get(network)
+	if !ok {
+		return nil, fmt.Errorf("unknown network %v", network)
+	}
+	var commands []*sup.Command
+	for _, name := range names {
+		cmd, ok := conf.Commands.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown command %v", name)
+		}
+		cmd.Name = name
+		commands = append(commands, &cmd)
+	}
+	env, err := conf.NetworkEnv(network, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := net.ResolveHosts(env); err != nil {
+		return nil, err
+	}
+
+	app, err := sup.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		out = &syncBuffer{}
+	}
+	var stderr syncBuffer
+	app.Output(out, &stderr)
+	app.Prefix(false)
+	app.Batch(true)
+	if err := app.Run(&net, env, commands...); err != nil {
+		return nil, fmt.Errorf("%v\n%v", err, stderr.String())
+	}
+	return strings.Split(strings.TrimSpace(out.String()), "\n"), nil
+}
+
+func TestRun(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		network string
+		command string
+		stdin   string
+		want    []string // Prefixes of the output lines, in order.
+	}{
+		{"key auth", "bastion", "hostname", "", []string{"hostname "}},
+		{"bastion hop", "hosts", "hostname", "", []string{"hostname ", "hostname "}},
+		{"once", "hosts", "once", "", []string{"once host"}},
+		{"serial", "hosts", "serial", "", []string{"serial start host", "serial end host", "serial start host", "serial end host"}},
+		{"upload", "hosts", "upload", "", []string{"uploaded file", "uploaded file"}},
+		{"stdin", "hosts", "stdin", "hello\n", []string{"stdin hello", "stdin hello"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.stdin != "" {
+				defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+				file := filepath.Join(t.TempDir(), "stdin")
+				if err := os.WriteFile(file, []byte(tt.stdin), 0644); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Open(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				os.Stdin = f
+			}
+
+			lines, err := run(tt.network, nil, tt.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(lines) != len(tt.want) {
+				t.Fatalf("got output %q, want lines starting with %q", lines, tt.want)
+			}
+			for i, line := range lines {
+				if !strings.HasPrefix(line, tt.want[i]) {
+					t.Errorf("got output %q, want lines starting with %q", lines, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	_, err := run("hosts", nil, "fail")
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+		t.Fatalf("got error %v, want exit status 3", err)
+	}
+}
+
+// TestInterrupt checks Ctrl-C stops the remote commands and fails the run.
+func TestInterrupt(t *testing.T) {
+	var out syncBuffer
+	done := make(chan error, 1)
+	go func() {
+		_, err := run("hosts", &out, "sleep")
+		done <- err
+	}()
+	for i := 0; strings.Count(out.String(), "sleeping") < 2; i++ {
+		if i == 100 {
+			t.Fatalf("hosts didn't start sleeping, output:\n%v", out.String())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("interrupted run succeeded")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("sup still running")
+	}
+}
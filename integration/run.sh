@@ -0,0 +1,88 @@
+#!/usr/bin/env bash
+# Integration harness: runs sup against dockerized sshd instances, the
+# published bastion and two hosts behind it. Needs docker compose and
+# ssh-keygen/ssh-agent. Run by `make integration`.
+set -u
+
+cd "$(dirname "$0")"
+compose="docker compose -p sup-it"
+
+work=$(mktemp -d)
+cleanup() {
+	$compose down -v >/dev/null 2>&1
+	[ -n "${SSH_AGENT_PID:-}" ] && kill "$SSH_AGENT_PID" 2>/dev/null
+	rm -rf "$work" authorized_keys
+}
+trap cleanup EXIT
+
+# Key auth by a throwaway key, offered through ssh-agent to the bastion
+# and the hosts alike.
+ssh-keygen -q -t ed25519 -N "" -f "$work/id_ed25519" || exit 1
+cp "$work/id_ed25519.pub" authorized_keys
+eval "$(ssh-agent -s)" >/dev/null
+ssh-add -q "$work/id_ed25519" || exit 1
+
+go build -o "$work/sup" ../cmd/sup || exit 1
+sup() {
+	"$work/sup" -f Supfile -batch -disable-prefix "$@"
+}
+export work
+export -f sup
+
+$compose up -d --build || exit 1
+for i in $(seq 30); do
+	sup bastion hostname >/dev/null 2>&1 && break
+	sleep 1
+done
+
+failed=0
+# check NAME EXPECTED_STATUS GREP_PATTERN COMMAND... runs sup with the
+# arguments and checks its exit status and output.
+check() {
+	local name=$1 status=$2 pattern=$3
+	shift 3
+	local out
+	out=$("$@" 2>&1)
+	local got=$?
+	if [ "$got" != "$status" ] || ! grep -q -- "$pattern" <<<"$out"; then
+		echo "FAIL $name: exit status $got, expected $status and output matching $pattern:"
+		sed 's/^/    /' <<<"$out"
+		failed=1
+		return
+	fi
+	echo "ok   $name"
+}
+
+check "key auth" 0 "hostname" sup bastion hostname
+check "bastion hop" 0 "hostname" sup hosts hostname
+check "once" 0 "once host" sup hosts once
+check "once runs on one host" 0 "^1$" bash -c 'sup hosts once | grep -c "^once"'
+check "serial" 0 "serial end host1 serial start host2" bash -c 'sup hosts serial | tr "\n" " "'
+check "upload" 0 "uploaded file" sup hosts upload
+check "stdin" 0 "stdin hello" bash -c 'echo hello | sup hosts stdin'
+check "exit status" 3 "exit status 3" sup hosts fail
+
+# Ctrl-C stops the remote commands and fails the run.
+"$work/sup" -f Supfile -disable-prefix hosts sleep >"$work/sleep.out" 2>&1 &
+pid=$!
+for i in $(seq 20); do
+	[ "$(grep -c sleeping "$work/sleep.out")" = 2 ] && break
+	sleep 0.5
+done
+kill -INT "$pid"
+for i in $(seq 20); do
+	kill -0 "$pid" 2>/dev/null || break
+	sleep 0.5
+done
+if kill -0 "$pid" 2>/dev/null; then
+	echo "FAIL ctrl-c: sup still running"
+	kill -9 "$pid"
+	failed=1
+elif wait "$pid"; then
+	echo "FAIL ctrl-c: sup exited with status 0"
+	failed=1
+else
+	echo "ok   ctrl-c"
+fi
+
+exit $failed
@@ -0,0 +1,124 @@
+package sup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults of the inventory cache.
+const (
+	DefaultInventoryCachePath = ".sup/inventory.json"
+	DefaultInventoryCacheTTL  = 10 * time.Minute
+)
+
+// InventoryCache keeps the output of the network's inventory command on
+// disk, so consecutive runs don't query a slow (ie. cloud API) inventory
+// again. Entries are keyed by the inventory command and the network env.
+type InventoryCache struct {
+	Path string `yaml:"path,omitempty"` // Relative to Supfile, default ".sup/inventory.json".
+	TTL  string `yaml:"ttl,omitempty"`  // Default 10m.
+}
+
+// inventoryMemo is the result of the network's inventory, so the command
+// runs at most once per process.
+type inventoryMemo struct {
+	once  sync.Once
+	hosts []*Host
+	err   error
+}
+
+// inventoryCacheEntry is an inventory output in the cache file.
+type inventoryCacheEntry struct {
+	Time   time.Time `json:"time"`
+	Output string    `json:"output"`
+}
+
+// inventoryOutput returns the inventory output from the cache, if it's
+// enabled and fresh, or runs the inventory command and caches its output.
+func (n Network) inventoryOutput(ctx context.Context) (string, error) {
+	if n.InventoryCache == nil || n.NoInventoryCache {
+		return n.runInventory(ctx)
+	}
+	ttl, err := parseDuration(n.InventoryCache.TTL, DefaultInventoryCacheTTL)
+	if err != nil {
+		return "", errors.Wrap(err, "inventory_cache: ttl")
+	}
+	path := n.InventoryCache.Path
+	if path == "" {
+		path = DefaultInventoryCachePath
+	}
+	path = resolve(n.Workdir, path)
+	key := n.inventoryCacheKey()
+
+	// A missing or corrupt cache file is a miss.
+	entries := map[string]inventoryCacheEntry{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			entries = map[string]inventoryCacheEntry{}
+		}
+	}
+	if entry, ok := entries[key]; ok && !n.RefreshInventory && time.Since(entry.Time) < ttl {
+		return entry.Output, nil
+	}
+
+	output, err := n.runInventory(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// Failing to write the cache doesn't fail the run, the next run
+	// queries the inventory again.
+	now := time.Now()
+	for k, entry := range entries {
+		if now.Sub(entry.Time) >= ttl {
+			delete(entries, k)
+		}
+	}
+	entries[key] = inventoryCacheEntry{Time: now, Output: output}
+	if data, err := json.Marshal(entries); err == nil {
+		writeStateFile(path, data)
+	}
+	return output, nil
+}
+
+// inventoryCacheKey returns the cache key of the inventory command run
+// with the network env.
+func (n Network) inventoryCacheKey() string {
+	h := sha256.New()
+	h.Write([]byte(n.Inventory))
+	for _, v := range n.Env.Slice() {
+		h.Write([]byte{0})
+		h.Write([]byte(v))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeStateFile replaces the file at path by data, atomically. The file
+// is readable by the user only, as ie. inventories may list hosts which
+// aren't meant to be public.
+func writeStateFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".sup-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
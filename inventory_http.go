@@ -0,0 +1,158 @@
+package sup
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// InventoryHTTP fetches the network's hosts from a JSON endpoint, ie. of
+// a CMDB. The hosts are strings or objects, as hosts: entries of Supfile.
+type InventoryHTTP struct {
+	URL                string            `yaml:"url"`
+	Headers            map[string]string `yaml:"headers,omitempty"`  // Values may reference env vars, ie. "Bearer $CMDB_TOKEN".
+	Timeout            string            `yaml:"timeout,omitempty"`  // Default 30s.
+	JSONPath           string            `yaml:"jsonpath,omitempty"` // Fields of the hosts in the response, ie. "data.hosts" or "items[*].address".
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// inventoryHTTP returns the hosts of the network's HTTP inventory.
+func (n Network) inventoryHTTP(ctx context.Context) ([]*Host, error) {
+	inv := n.InventoryHTTP
+	url := n.expandEnv(inv.URL)
+	if url == "" {
+		return nil, fmt.Errorf("inventory_http: url is not set")
+	}
+	timeout, err := parseDuration(inv.Timeout, DefaultInventoryTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "inventory_http: timeout")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "inventory_http")
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range inv.Headers {
+		req.Header.Set(key, n.expandEnv(value))
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if inv.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("inventory_http %v: timed out after %v", url, timeout)
+		}
+		return nil, errors.Wrapf(err, "inventory_http %v", url)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "inventory_http %v", url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("inventory_http %v: %v", url, resp.Status)
+		if tail := lastLines(string(body), inventoryStderrLines); tail != "" {
+			err = fmt.Errorf("%v:\n%v", err, tail)
+		}
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, errors.Wrapf(err, "inventory_http %v: %v: invalid JSON", url, resp.Status)
+	}
+	items, err := selectJSONPath(doc, inv.JSONPath)
+	if err != nil {
+		return nil, fmt.Errorf("inventory_http %v: jsonpath %q: %v", url, inv.JSONPath, err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("inventory_http %v: %v: no hosts at jsonpath %q", url, resp.Status, inv.JSONPath)
+	}
+
+	var hosts []*Host
+	for _, item := range items {
+		// Items are decoded as hosts: entries, strings or maps.
+		data, err := yaml.Marshal(item)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inventory_http %v", url)
+		}
+		var conf HostConfig
+		if err := yaml.Unmarshal(data, &conf); err != nil {
+			return nil, errors.Wrapf(err, "inventory_http %v: host %s", url, strings.TrimSpace(string(data)))
+		}
+		host, err := n.resolver.NewHostFromConfig(conf, n.HostDefaults())
+		if err != nil {
+			return nil, errors.Wrapf(err, "inventory_http %v", url)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// expandEnv replaces $VAR and ${VAR} of s by the network env, or the
+// local env.
+func (n Network) expandEnv(s string) string {
+	return os.Expand(s, func(key string) string {
+		for _, v := range n.Env {
+			if v.Key == key {
+				return v.Value
+			}
+		}
+		return os.Getenv(key)
+	})
+}
+
+// selectJSONPath returns the values at path of doc, dot separated fields
+// with optional leading "$." and "[*]" suffixes. Arrays are walked
+// through, so "items.address" is "items[*].address", and arrays found at
+// the end of path are flattened into their items.
+func selectJSONPath(doc interface{}, path string) ([]interface{}, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	nodes := []interface{}{doc}
+	if path != "" {
+		for _, field := range strings.Split(path, ".") {
+			field = strings.TrimSuffix(field, "[*]")
+			if field == "" {
+				return nil, fmt.Errorf("empty field")
+			}
+			var next []interface{}
+			for _, node := range flattenJSON(nodes) {
+				object, ok := node.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("%v: not an object", field)
+				}
+				if value, ok := object[field]; ok && value != nil {
+					next = append(next, value)
+				}
+			}
+			nodes = next
+		}
+	}
+	return flattenJSON(nodes), nil
+}
+
+// flattenJSON replaces arrays of nodes by their items.
+func flattenJSON(nodes []interface{}) []interface{} {
+	var flat []interface{}
+	for _, node := range nodes {
+		if items, ok := node.([]interface{}); ok {
+			flat = append(flat, items...)
+		} else {
+			flat = append(flat, node)
+		}
+	}
+	return flat
+}
@@ -0,0 +1,84 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// itemNames returns the keys of the items mapping node in order of the
+// document, or error naming the first duplicate key of the kind, ie.
+// "command", which the decoder would silently overwrite.
+func itemNames(items *yamlv3.Node, kind string) ([]string, error) {
+	if items != nil && items.Kind == yamlv3.AliasNode {
+		items = items.Alias
+	}
+	if items == nil || items.Kind != yamlv3.MappingNode {
+		return nil, nil
+	}
+	names := make([]string, 0, len(items.Content)/2)
+	seen := make(map[string]bool, len(items.Content)/2)
+	for i := 0; i+1 < len(items.Content); i += 2 {
+		key := items.Content[i]
+		if key.Value == "<<" && key.Tag == "!!merge" {
+			continue
+		}
+		if seen[key.Value] {
+			return nil, fmt.Errorf("duplicate %v %q", kind, key.Value)
+		}
+		seen[key.Value] = true
+		names = append(names, key.Value)
+	}
+	return names, nil
+}
+
+// inOrder returns names in order they're listed by order. Names it doesn't
+// list, ie. the ones of << merge keys, follow in order they're given.
+func inOrder(names, order []string) []string {
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for _, name := range order {
+		if known[name] {
+			sorted = append(sorted, name)
+			delete(known, name)
+		}
+	}
+	for _, name := range names {
+		if known[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	return sorted
+}
+
+// itemOrder returns the names of the networks, commands and targets of the
+// document node in order of the document, by section, or error on a
+// duplicate key. The order is kept per parse, so Supfiles parsed
+// concurrently don't share any state.
+func itemOrder(doc *yamlv3.Node) (map[string][]string, error) {
+	order := map[string][]string{}
+	if doc == nil || len(doc.Content) == 0 {
+		return order, nil
+	}
+	for _, section := range []string{"networks", "commands", "targets"} {
+		kind := strings.TrimSuffix(section, "s")
+		names, err := itemNames(mappingValue(doc.Content[0], section), kind)
+		if err != nil {
+			return nil, err
+		}
+		order[section] = names
+	}
+	return order, nil
+}
+
+// orderItems puts the Names of the networks, commands and targets in
+// order, as returned by itemOrder.
+func (s *Supfile) orderItems(order map[string][]string) {
+	s.Networks.Names = inOrder(s.Networks.Names, order["networks"])
+	s.Commands.Names = inOrder(s.Commands.Names, order["commands"])
+	s.Targets.Names = inOrder(s.Targets.Names, order["targets"])
+}
@@ -0,0 +1,86 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestItemsOrder(t *testing.T) {
+	conf, err := NewSupfile([]byte(`
+version: 0.5
+networks:
+  staging:
+    hosts: [stg1]
+  production:
+    hosts: [web1]
+commands:
+  y:
+    run: echo y
+  build: {run: make}
+  n:
+    run: echo n
+targets: {deploy: [build, y], all: [n]}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		kind      string
+		got, want []string
+	}{
+		{"networks", conf.Networks.Names, []string{"staging", "production"}},
+		{"commands", conf.Commands.Names, []string{"y", "build", "n"}},
+		{"targets", conf.Targets.Names, []string{"deploy", "all"}},
+	} {
+		if strings.Join(tt.got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%v are %v, want %v", tt.kind, tt.got, tt.want)
+		}
+	}
+}
+
+func TestItemsDuplicateKeys(t *testing.T) {
+	for _, tt := range []struct {
+		name, supfile, err string
+	}{
+		{"network", "networks:\n  prod:\n    hosts: [a]\n  prod:\n    hosts: [b]\n", `duplicate network "prod"`},
+		{"command", "commands:\n  deploy:\n    run: a\n  build:\n    run: b\n  deploy:\n    run: c\n", `duplicate command "deploy"`},
+		{"target", "commands:\n  a:\n    run: a\ntargets:\n  all: [a]\n  all: [a, a]\n", `duplicate target "all"`},
+		{"flow", "commands: {a: {run: a}, a: {run: b}}\n", `duplicate command "a"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, strict := range []bool{false, true} {
+				_, err := NewSupfileWithOptions([]byte("version: 0.5\n"+tt.supfile), ParseOptions{Strict: strict})
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("strict %v: got error %v, want %v", strict, err, tt.err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkNewSupfileCommands parses a generated Supfile of 5000 commands
+// and a target of each.
+func BenchmarkNewSupfileCommands(b *testing.B) {
+	var s strings.Builder
+	s.WriteString("version: 0.5\nnetworks:\n  prod:\n    hosts: [web1, web2]\ncommands:\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&s, "  cmd%d:\n    desc: Command %d\n    run: echo %d\n    serial: 2\n", i, i, i)
+	}
+	s.WriteString("targets:\n")
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&s, "  target%d: [cmd%d]\n", i, i)
+	}
+	data := []byte(s.String())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conf, err := NewSupfile(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(conf.Commands.Names) != 5000 {
+			b.Fatalf("parsed %v commands, want 5000", len(conf.Commands.Names))
+		}
+	}
+}
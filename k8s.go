@@ -0,0 +1,164 @@
+package sup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KubeScheme prefixes hosts which are Kubernetes pods, k8s://<namespace>/<pod>
+// or k8s://<namespace>/<pod>/<container>, and selectors of the running pods
+// of a namespace, k8s://<namespace>?selector=<labels>, see ExpandPods. The
+// tasks are run by kubectl exec, with the local kubeconfig.
+const KubeScheme = "k8s://"
+
+// kubeNameRe matches names of Kubernetes namespaces, pods and containers.
+var kubeNameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]*[a-z0-9])?$`)
+
+// newPodHost creates Host of k8s:// string, named <namespace>/<pod> unless
+// alias is set.
+func (r *Resolver) newPodHost(hostStr, alias string) (*Host, error) {
+	host := &Host{Address: "localhost", Port: "22", Bastion: BastionNone, alias: alias}
+	spec := strings.TrimPrefix(hostStr, KubeScheme)
+	if namespace, query, ok := strings.Cut(spec, "?"); ok {
+		values, err := url.ParseQuery(query)
+		if err != nil || len(values) != 1 || values.Get("selector") == "" {
+			return nil, fmt.Errorf("host %q: expected k8s://<namespace>?selector=<labels>", hostStr)
+		}
+		if alias != "" {
+			return nil, fmt.Errorf("host %q: pods of a selector can't have an alias", hostStr)
+		}
+		host.Namespace, host.podSelector = namespace, values.Get("selector")
+	} else {
+		parts := strings.Split(spec, "/")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("host %q: expected k8s://<namespace>/<pod>[/<container>]", hostStr)
+		}
+		host.Namespace, host.Pod = parts[0], parts[1]
+		if len(parts) == 3 {
+			host.Container = parts[2]
+		}
+	}
+	for _, name := range []string{host.Namespace, host.Pod, host.Container} {
+		if name != "" && !kubeNameRe.MatchString(name) {
+			return nil, fmt.Errorf("host %q: invalid name %q", hostStr, name)
+		}
+	}
+	if host.Namespace == "" {
+		return nil, fmt.Errorf("host %q: missing namespace", hostStr)
+	}
+
+	host.KnownAs = hostStr
+	if host.Pod != "" {
+		host.KnownAs = host.Namespace + "/" + host.Pod
+	}
+	if alias != "" {
+		host.KnownAs = alias
+	}
+	return host, nil
+}
+
+// ExpandPods replaces hosts of k8s:// selectors by the running pods
+// matching them, and sets the network's kube_context to the pod hosts.
+// Pods of a selector share the env, group and labels of its hosts: entry.
+func (n *Network) ExpandPods(ctx context.Context) error {
+	var hosts []*Host
+	for _, host := range n.Hosts {
+		if host.Namespace == "" {
+			hosts = append(hosts, host)
+			continue
+		}
+		host.KubeContext = n.KubeContext
+		if host.podSelector == "" {
+			hosts = append(hosts, host)
+			continue
+		}
+		pods, err := kubectl(ctx, n.KubeContext, "get", "pods", "-n", host.Namespace, "-l", host.podSelector,
+			"--field-selector=status.phase=Running", "-o", `jsonpath={range .items[*]}{.metadata.name}{"\n"}{end}`)
+		if err != nil {
+			return errors.Wrapf(err, "%v: listing pods failed", host.GetHostname())
+		}
+		names := strings.Fields(pods)
+		if len(names) == 0 {
+			return fmt.Errorf("%v: no running pods match the selector", host.GetHostname())
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pod := *host
+			pod.Pod, pod.podSelector = name, ""
+			pod.KnownAs = host.Namespace + "/" + name
+			hosts = append(hosts, &pod)
+		}
+	}
+	n.Hosts = hosts
+	return nil
+}
+
+// checkPodExec verifies the user of the host's kube context may exec into
+// its pod, so a missing RBAC permission fails the host up front, instead
+// of each of its tasks.
+func checkPodExec(host *Host) error {
+	out, err := kubectl(context.Background(), host.KubeContext, "auth", "can-i", "create", "pods", "--subresource=exec", "-n", host.Namespace)
+	if strings.TrimSpace(out) == "no" {
+		return fmt.Errorf("k8s: not allowed to exec into pods of namespace %v%v, RBAC needs to allow create on pods/exec", host.Namespace, kubeContextText(host.KubeContext))
+	}
+	return err
+}
+
+// kubectl runs kubectl with the args and returns its output. Errors carry
+// kubectl's error text, ie. "Forbidden" messages of RBAC.
+func kubectl(ctx context.Context, kubeContext string, args ...string) (string, error) {
+	if _, err := exec.LookPath("kubectl"); err != nil {
+		return "", fmt.Errorf("k8s: kubectl not found in $PATH")
+	}
+	if kubeContext != "" {
+		args = append([]string{"--context", kubeContext}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "Forbidden") {
+			msg += ", check the RBAC permissions of the user" + kubeContextText(kubeContext)
+		}
+		if msg == "" {
+			return string(out), errors.Wrap(err, "kubectl")
+		}
+		return string(out), fmt.Errorf("kubectl: %v", msg)
+	}
+	return string(out), nil
+}
+
+// kubeContextText describes the kube context in messages.
+func kubeContextText(kubeContext string) string {
+	if kubeContext == "" {
+		return " (current kube context)"
+	}
+	return fmt.Sprintf(" (kube context %v)", kubeContext)
+}
+
+// kubectlExec returns run as run in the host's pod by kubectl exec.
+func (h *Host) kubectlExec(run string, tty bool) string {
+	args := "kubectl"
+	if h.KubeContext != "" {
+		args += " --context " + ShellQuote(h.KubeContext)
+	}
+	flags := "-i"
+	if tty {
+		flags = "-it"
+	}
+	args += " exec " + flags + " -n " + h.Namespace + " " + h.Pod
+	if h.Container != "" {
+		args += " -c " + h.Container
+	}
+	return args + " -- sh -c " + ShellQuote(run)
+}
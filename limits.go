@@ -0,0 +1,114 @@
+package sup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Limits lowers the priority of the remote command, so it doesn't compete
+// with production traffic, ie. {nice: 10, ionice: "7", cpu_limit: "50%"}.
+// Wrappers missing on a host are skipped with a warning, unless StrictLimits
+// fails the host instead.
+//
+// The remote command is composed from the outside in as: clean_env's env -i,
+// the CPU limiter (cpulimit or systemd-run), nice, ionice, sh -c, umask, the
+// env exports and the command. Any sudo within the command inherits the
+// limits, as does everything it starts.
+type Limits struct {
+	Nice         int    `yaml:"nice,omitempty"`          // Niceness, -20 to 19, ie. 10.
+	IONice       string `yaml:"ionice,omitempty"`        // Best-effort IO priority 0 to 7, or "idle".
+	CPULimit     string `yaml:"cpu_limit,omitempty"`     // CPU percentage of one core, ie. "50%".
+	StrictLimits bool   `yaml:"strict_limits,omitempty"` // Fail the host if a wrapper is missing.
+}
+
+// IsZero reports whether no limit is set.
+func (l Limits) IsZero() bool {
+	return l.Nice == 0 && l.IONice == "" && l.CPULimit == ""
+}
+
+// check validates the limits.
+func (l Limits) check() error {
+	if l.Nice < -20 || l.Nice > 19 {
+		return fmt.Errorf("nice: %v out of range -20 to 19", l.Nice)
+	}
+	if _, err := l.ioniceArgs(); err != nil {
+		return err
+	}
+	if _, err := l.cpuPercent(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ioniceArgs returns the ionice class and priority arguments.
+func (l Limits) ioniceArgs() (string, error) {
+	if l.IONice == "" {
+		return "", nil
+	}
+	if l.IONice == "idle" {
+		return "-c3", nil
+	}
+	n, err := strconv.Atoi(l.IONice)
+	if err != nil || n < 0 || n > 7 {
+		return "", fmt.Errorf("ionice: invalid value %q, expected priority 0 to 7 or \"idle\"", l.IONice)
+	}
+	return fmt.Sprintf("-c2 -n%d", n), nil
+}
+
+// cpuPercent returns the cpu_limit percentage, 0 if not set.
+func (l Limits) cpuPercent() (int, error) {
+	if l.CPULimit == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(l.CPULimit), "%"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("cpu_limit: invalid value %q, expected percentage, ie. \"50%%\"", l.CPULimit)
+	}
+	return n, nil
+}
+
+// apply sets the limits to the remote run and script tasks of cmd.
+func (l Limits) apply(cmd *Command, tasks []*Task) error {
+	if err := l.check(); err != nil {
+		return fmt.Errorf("%v: %v", cmd.Name, err)
+	}
+	for _, task := range tasks {
+		if (task.Kind != TaskRun && task.Kind != TaskScript) || task.Local {
+			continue
+		}
+		task.Limits = l
+	}
+	return nil
+}
+
+// wrap returns command running run by sh -c under the limits. Each wrapper
+// is looked up on the host first and skipped with a warning if missing, or
+// fails the command with exit status 127 if StrictLimits.
+func (l Limits) wrap(run string) string {
+	if l.IsZero() {
+		return run
+	}
+	missing := func(what string) string {
+		if l.StrictLimits {
+			return fmt.Sprintf(`echo %s >&2; exit 127`, ShellQuote(what+" not found, strict_limits is set"))
+		}
+		return fmt.Sprintf(`echo %s >&2`, ShellQuote(what+" not found, running without it"))
+	}
+
+	var b strings.Builder
+	b.WriteString("sup_limits=; ")
+	if cpu, _ := l.cpuPercent(); cpu > 0 {
+		fmt.Fprintf(&b, `if command -v cpulimit >/dev/null 2>&1; then sup_limits="cpulimit -l %d --"; `+
+			`elif command -v systemd-run >/dev/null 2>&1 && [ -d /run/systemd/system ]; then sup_limits="systemd-run --scope --quiet -p CPUQuota=%d%% --"; `+
+			`else %s; fi; `, cpu, cpu, missing("cpu_limit: cpulimit or systemd-run"))
+	}
+	if l.Nice != 0 {
+		fmt.Fprintf(&b, `if command -v nice >/dev/null 2>&1; then sup_limits="$sup_limits nice -n %d"; else %s; fi; `, l.Nice, missing("nice"))
+	}
+	if args, _ := l.ioniceArgs(); args != "" {
+		fmt.Fprintf(&b, `if command -v ionice >/dev/null 2>&1; then sup_limits="$sup_limits ionice %s"; else %s; fi; `, args, missing("ionice"))
+	}
+	b.WriteString("$sup_limits sh -c " + ShellQuote(run))
+	return b.String()
+}
@@ -0,0 +1,315 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// Lint finding codes. Each of them can be suppressed per command
+// with lint_ignore.
+const (
+	LintSyntax           = "syntax-error"
+	LintUnquoted         = "unquoted-expansion"
+	LintUndefined        = "undefined-variable"
+	LintUnknownCommand   = "unknown-command"
+	LintUnreadableScript = "unreadable-script"
+)
+
+// lintDangerousCommands get their arguments checked for unquoted expansions.
+const lintDangerousCommands = "rm mv cp ln chmod chown chgrp rsync dd find tar"
+
+// LintFinding is a problem found by Supfile.Lint. Line and Col are
+// positions within the command's run string (or script file), starting
+// at 1, or 0 if unknown.
+type LintFinding struct {
+	Command string `json:"command"`
+	Line    int    `json:"line,omitempty"`
+	Col     int    `json:"col,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (f LintFinding) String() string {
+	pos := f.Command
+	if f.Line > 0 {
+		pos += fmt.Sprintf(":%d:%d", f.Line, f.Col)
+	}
+	return fmt.Sprintf("%v: %v [%v]", pos, f.Message, f.Code)
+}
+
+// shellVars are variables set by the shell itself or present
+// in a usual login environment.
+var shellVars = strings.Fields(`HOME PATH USER LOGNAME PWD OLDPWD SHELL TERM LANG LC_ALL HOSTNAME
+	IFS RANDOM LINENO SECONDS UID EUID PPID OPTARG OPTIND REPLY PIPESTATUS BASH_SOURCE FUNCNAME TMPDIR`)
+
+// Lint checks shell syntax of the commands' run strings and scripts,
+// prefixed by the env export preamble, and reports unquoted variable
+// expansions in arguments of destructive commands (ie. rm -rf $DIR/)
+// and variables not defined in any env layer. Variables in vars are
+// considered defined, ie. the ones passed by -e flags.
+func (conf *Supfile) Lint(vars ...string) []LintFinding {
+	var findings []LintFinding
+
+	// Targets referencing unknown commands.
+	for _, name := range conf.Targets.Names {
+		cmds, _ := conf.Targets.Get(name)
+		for _, cmd := range cmds {
+			if _, ok := conf.Commands.Get(cmd); !ok {
+				findings = append(findings, LintFinding{Command: name, Code: LintUnknownCommand,
+					Message: fmt.Sprintf("target references unknown command %q", cmd)})
+			}
+		}
+	}
+
+	// Env layers, which are exported before each command.
+	defined := map[string]bool{}
+	var patterns []string
+	preamble := conf.Env.AsExport()
+	for _, v := range conf.Env {
+		defined[v.Key] = true
+	}
+	patterns = append(patterns, conf.PassEnv...)
+	patterns = append(patterns, conf.KnownEnv...)
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
+		preamble += network.Env.AsExport()
+		for _, v := range network.Env {
+			defined[v.Key] = true
+		}
+		for _, host := range network.Hosts {
+			for _, v := range host.Env {
+				defined[v.Key] = true
+			}
+		}
+		patterns = append(patterns, network.PassEnv...)
+	}
+	for _, v := range append(shellVars, vars...) {
+		defined[v] = true
+	}
+
+	preambleLines := strings.Count(preamble, "\n")
+	if _, err := syntax.NewParser().Parse(strings.NewReader(preamble), ""); err != nil {
+		findings = append(findings, LintFinding{Command: "env", Code: LintSyntax, Message: err.Error()})
+		preamble, preambleLines = "", 0
+	}
+
+	for _, name := range conf.Commands.Names {
+		cmd, _ := conf.Commands.Get(name)
+		l := linter{
+			command:     name,
+			ignore:      map[string]bool{},
+			defined:     defined,
+			patterns:    append(append([]string{}, patterns...), cmd.PassEnv...),
+			lineOffset:  preambleLines,
+			assignments: map[string]bool{},
+		}
+		for _, code := range cmd.LintIgnore {
+			l.ignore[code] = true
+		}
+
+		if cmd.Run != "" {
+			l.lint(preamble + "\n" + cmd.Run)
+		}
+		if len(cmd.Steps) > 0 {
+			// The steps run in one shell, one after another.
+			l.lint(preamble + "\n" + strings.Join(cmd.Steps, "\n"))
+		}
+		if cmd.Script != "" {
+			dir, err := conf.BaseDir()
+			if err == nil {
+				var data []byte
+				data, err = os.ReadFile(resolve(dir, cmd.Script))
+				if err == nil {
+					l.lint(preamble + "\n" + string(data))
+				}
+			}
+			if err != nil {
+				l.report(0, 0, LintUnreadableScript, err.Error())
+			}
+		}
+		if cmd.ScriptsDir != "" {
+			dir, err := conf.BaseDir()
+			var files []string
+			if err == nil {
+				files, err = cmd.scriptsDirFiles(dir)
+			}
+			for _, file := range files {
+				var data []byte
+				if data, err = os.ReadFile(file); err != nil {
+					break
+				}
+				l.lint(preamble + "\n" + string(data))
+			}
+			if err != nil {
+				l.report(0, 0, LintUnreadableScript, err.Error())
+			}
+		}
+		findings = append(findings, l.findings...)
+	}
+
+	return findings
+}
+
+// linter lints a single command.
+type linter struct {
+	command     string
+	ignore      map[string]bool
+	defined     map[string]bool
+	patterns    []string
+	lineOffset  int // Lines of the preamble
+	assignments map[string]bool
+	findings    []LintFinding
+}
+
+func (l *linter) report(line, col uint, code, message string) {
+	if l.ignore[code] {
+		return
+	}
+	// Translate the position to the run string, past the preamble line(s).
+	pos := LintFinding{Command: l.command, Code: code, Message: message}
+	if n := int(line) - l.lineOffset - 1; n > 0 {
+		pos.Line, pos.Col = n, int(col)
+	}
+	l.findings = append(l.findings, pos)
+}
+
+func (l *linter) lint(script string) {
+	file, err := syntax.NewParser().Parse(strings.NewReader(script), "")
+	if err != nil {
+		if e, ok := err.(syntax.ParseError); ok {
+			l.report(e.Pos.Line(), e.Pos.Col(), LintSyntax, e.Text)
+		} else {
+			l.report(0, 0, LintSyntax, err.Error())
+		}
+		return
+	}
+
+	// Collect variables assigned by the script itself first.
+	l.assign(file)
+
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch n := node.(type) {
+		case *syntax.CallExpr:
+			l.lintCall(n)
+		case *syntax.ParamExp:
+			l.lintParam(n)
+		}
+		return true
+	})
+}
+
+// assign collects the variables assigned by the script.
+func (l *linter) assign(file *syntax.File) {
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch n := node.(type) {
+		case *syntax.Assign:
+			if n.Name != nil {
+				l.assignments[n.Name.Value] = true
+			}
+		case *syntax.WordIter:
+			l.assignments[n.Name.Value] = true
+		case *syntax.CallExpr:
+			if len(n.Args) > 1 && (n.Args[0].Lit() == "read" || n.Args[0].Lit() == "getopts") {
+				for _, arg := range n.Args[1:] {
+					l.assignments[arg.Lit()] = true
+				}
+			}
+		}
+		return true
+	})
+}
+
+// lintCall reports unquoted expansions in arguments of destructive commands.
+func (l *linter) lintCall(call *syntax.CallExpr) {
+	args := call.Args
+	for len(args) > 0 && (args[0].Lit() == "sudo" || args[0].Lit() == "exec" || args[0].Lit() == "command") {
+		args = args[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0].Lit(), "-") {
+			if (args[0].Lit() == "-u" || args[0].Lit() == "-g") && len(args) > 1 {
+				args = args[1:] // sudo -u <user>
+			}
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 || !strings.Contains(" "+lintDangerousCommands+" ", " "+path.Base(args[0].Lit())+" ") {
+		return
+	}
+	for _, arg := range args[1:] {
+		for _, part := range arg.Parts {
+			if p, ok := part.(*syntax.ParamExp); ok {
+				l.report(p.Pos().Line(), p.Pos().Col(), LintUnquoted,
+					fmt.Sprintf("unquoted $%v in %v arguments, quote it: \"$%v\"", p.Param.Value, args[0].Lit(), p.Param.Value))
+			}
+		}
+	}
+}
+
+// lintParam reports variables not defined in any env layer.
+func (l *linter) lintParam(p *syntax.ParamExp) {
+	if !l.isUndefined(p) {
+		return
+	}
+	l.report(p.Pos().Line(), p.Pos().Col(), LintUndefined,
+		fmt.Sprintf("$%v is not defined in any env, use lint_ignore: [%v] if it comes from the remote environment", p.Param.Value, LintUndefined))
+}
+
+// isUndefined reports whether the expansion is of a variable not defined
+// in any env layer, which the script doesn't handle being unset.
+func (l *linter) isUndefined(p *syntax.ParamExp) bool {
+	if p.Param == nil || p.Excl || p.Names != 0 || l.isDefined(p.Param.Value) {
+		return false
+	}
+	if p.Exp != nil {
+		switch p.Exp.Op {
+		case syntax.DefaultUnset, syntax.DefaultUnsetOrNull, syntax.AssignUnset, syntax.AssignUnsetOrNull,
+			syntax.AlternateUnset, syntax.AlternateUnsetOrNull, syntax.ErrorUnset, syntax.ErrorUnsetOrNull:
+			return false // The script handles the variable being unset.
+		}
+	}
+	return true
+}
+
+// undefined returns the variables not defined in any env layer the script
+// expands, each once, in order. Scripts of invalid syntax have none, they
+// are reported by Lint.
+func (l *linter) undefined(script string) []string {
+	file, err := syntax.NewParser().Parse(strings.NewReader(script), "")
+	if err != nil {
+		return nil
+	}
+	l.assign(file)
+
+	var names []string
+	seen := map[string]bool{}
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if p, ok := node.(*syntax.ParamExp); ok && l.isUndefined(p) && !seen[p.Param.Value] {
+			seen[p.Param.Value] = true
+			names = append(names, p.Param.Value)
+		}
+		return true
+	})
+	return names
+}
+
+func (l *linter) isDefined(name string) bool {
+	if l.defined[name] || l.assignments[name] || strings.HasPrefix(name, "SUP_") {
+		return true
+	}
+	switch name {
+	case "@", "*", "#", "?", "-", "$", "!", "0":
+		return true
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		return true // Positional parameters.
+	}
+	for _, pattern := range l.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// LocalHostname is the $SUP_HOST and prefix of localhost running
+// local: also commands.
+const LocalHostname = "local"
+
 // Client is a wrapper over the SSH connection/sessions.
 type LocalhostClient struct {
 	cmd     *exec.Cmd
@@ -21,6 +25,13 @@ type LocalhostClient struct {
 	color   string
 }
 
+// NewLocalhostClient returns client running the tasks of host in the local
+// shell, with the env prepended. Used by Stackup.Dial, it rehearses a run
+// without connecting to any host.
+func NewLocalhostClient(host *Host, env string) *LocalhostClient {
+	return &LocalhostClient{host: host, env: env}
+}
+
 func (c *LocalhostClient) Connect() error {
 	return nil
 }
@@ -32,7 +43,7 @@ func (c *LocalhostClient) Run(task *Task) error {
 		return fmt.Errorf("Command already running")
 	}
 
-	cmd := exec.Command("bash", "-c", c.env+task.Run)
+	cmd := exec.Command("bash", "-c", c.host.remoteCommand(task, c.env, false))
 	c.cmd = cmd
 
 	c.stdout, err = cmd.StdoutPipe()
@@ -83,9 +94,14 @@ func (c *LocalhostClient) Stdout() io.Reader {
 	return c.stdout
 }
 
+// Host returns the host the client is connected to.
+func (c *LocalhostClient) Host() *Host {
+	return c.host
+}
+
 func (c *LocalhostClient) Prefix() (string, int) {
 	host := c.host.GetPrefixText()
-	return c.color + host + ResetColor, len(host)
+	return colorize(c.color, host), len(host)
 }
 
 func (c *LocalhostClient) Write(p []byte) (n int, err error) {
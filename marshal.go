@@ -0,0 +1,165 @@
+package sup
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Marshal returns the Supfile as YAML, which parses back into the same
+// Supfile. Networks, commands, targets and env vars are written in their
+// declared order, see the Names fields, and empty fields are left out.
+// Parse-time fixups, ie. of deprecated run_once, are part of the output,
+// while the fields set by defaults: are not repeated in each item.
+func (s *Supfile) Marshal() ([]byte, error) {
+	type NewSupfile Supfile
+	return yaml.Marshal((*NewSupfile)(s))
+}
+
+// MarshalYAML writes the vars as a map in the list order.
+func (e EnvList) MarshalYAML() (interface{}, error) {
+	items := make(yaml.MapSlice, 0, len(e))
+	for _, v := range e {
+		items = append(items, yaml.MapItem{Key: v.Key, Value: v.Value})
+	}
+	return items, nil
+}
+
+// MarshalYAML writes the networks in the order of Names.
+func (n Networks) MarshalYAML() (interface{}, error) {
+	items := make(yaml.MapSlice, 0, len(n.Names))
+	for _, name := range n.Names {
+		items = append(items, yaml.MapItem{Key: name, Value: n.nets[name]})
+	}
+	return items, nil
+}
+
+// MarshalYAML writes the network with its hosts: entries, or the
+// HostsFromConfig strings of networks built by code, ie. by Networks.Set.
+func (n Network) MarshalYAML() (interface{}, error) {
+	type NewNetwork Network
+	network := struct {
+		NewNetwork `yaml:",inline"`
+		Hosts      []HostConfig `yaml:"hosts,omitempty"`
+	}{NewNetwork: NewNetwork(n), Hosts: n.hostConfigs}
+	if network.Hosts == nil {
+		for _, host := range n.HostsFromConfig {
+			host, alias := splitAlias(host)
+			network.Hosts = append(network.Hosts, HostConfig{Host: host, Alias: alias})
+		}
+	}
+	return withoutDefaults(network, n.defaults)
+}
+
+// MarshalYAML writes the host as "<host> [as <alias>]" string, unless it
+// sets any other field.
+func (h HostConfig) MarshalYAML() (interface{}, error) {
+	if h.User == "" && h.Port == "" && h.IdentityFile == "" && h.IdentityKeyEnv == "" && h.IdentityKeyFile == "" && h.Bastion == "" && h.Group == "" && len(h.Env) == 0 && len(h.Labels) == 0 {
+		if h.Alias != "" {
+			return h.Host + " as " + h.Alias, nil
+		}
+		return h.Host, nil
+	}
+	type NewHostConfig HostConfig
+	return NewHostConfig(h), nil
+}
+
+// MarshalYAML writes the command with run: string, or list of Steps,
+// and local: true or LocalAlso.
+func (cmd Command) MarshalYAML() (interface{}, error) {
+	type NewCommand Command
+	var run, local interface{}
+	switch {
+	case cmd.Steps != nil:
+		run = cmd.Steps
+	case cmd.Run != "":
+		run = cmd.Run
+	}
+	switch {
+	case cmd.LocalAlso:
+		local = LocalAlso
+	case cmd.Local:
+		local = true
+	}
+	return withoutDefaults(struct {
+		NewCommand `yaml:",inline"`
+		Local      interface{} `yaml:"local,omitempty"`
+		Run        interface{} `yaml:"run,omitempty"`
+	}{NewCommand(cmd), local, run}, cmd.defaults)
+}
+
+// withoutDefaults leaves the fields set by defaults: out of v, since
+// defaults: is written as well.
+func withoutDefaults(v interface{}, defaults []string) (interface{}, error) {
+	if len(defaults) == 0 {
+		return v, nil
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields yaml.MapSlice
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, field := range defaults {
+		skip[strings.SplitN(field, ":", 2)[0]] = true
+	}
+	items := make(yaml.MapSlice, 0, len(fields))
+	for _, item := range fields {
+		if key, _ := item.Key.(string); !skip[key] {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// MarshalYAML writes the commands in the order of Names.
+func (c Commands) MarshalYAML() (interface{}, error) {
+	items := make(yaml.MapSlice, 0, len(c.Names))
+	for _, name := range c.Names {
+		items = append(items, yaml.MapItem{Key: name, Value: c.cmds[name]})
+	}
+	return items, nil
+}
+
+// MarshalYAML writes the targets in the order of Names.
+func (t Targets) MarshalYAML() (interface{}, error) {
+	items := make(yaml.MapSlice, 0, len(t.Names))
+	for _, name := range t.Names {
+		if pipe, ok := t.pipes[name]; ok {
+			items = append(items, yaml.MapItem{Key: name, Value: pipe})
+			continue
+		}
+		items = append(items, yaml.MapItem{Key: name, Value: t.targets[name]})
+	}
+	return items, nil
+}
+
+// MarshalYAML writes the upload with exclude patterns as a list, or as
+// the deprecated string, if it was parsed from one.
+func (u Upload) MarshalYAML() (interface{}, error) {
+	var exclude interface{}
+	switch {
+	case u.excString:
+		exclude = u.Exc
+	case u.Exc != "":
+		exclude = strings.Split(u.Exc, ",")
+	}
+	return struct {
+		Src          string      `yaml:"src,omitempty"`
+		Dst          string      `yaml:"dst,omitempty"`
+		Exc          interface{} `yaml:"exclude,omitempty"`
+		DirMode      string      `yaml:"dir_mode,omitempty"`
+		Atomic       bool        `yaml:"atomic,omitempty"`
+		AtomicDir    string      `yaml:"atomic_dir,omitempty"`
+		KeepReleases int         `yaml:"keep_releases,omitempty"`
+		Stamp        bool        `yaml:"stamp,omitempty"`
+		Via          string      `yaml:"via,omitempty"`
+		Method       string      `yaml:"method,omitempty"`
+		GitTracked   bool        `yaml:"git_tracked,omitempty"`
+		Untracked    bool        `yaml:"include_untracked,omitempty"`
+		Verify       string      `yaml:"verify,omitempty"`
+	}{u.Src, u.Dst, exclude, u.DirMode, u.Atomic, u.AtomicDir, u.KeepReleases, u.Stamp, u.Via, u.Method, u.GitTracked, u.IncludeUntracked, u.Verify}, nil
+}
@@ -0,0 +1,59 @@
+package sup
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	data, err := os.ReadFile("testdata/roundtrip.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, data)
+}
+
+// FuzzMarshalRoundTrip checks that any Supfile which parses is marshaled
+// into one parsing back into the same Supfile.
+func FuzzMarshalRoundTrip(f *testing.F) {
+	data, err := os.ReadFile("testdata/roundtrip.yml")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(data)
+	f.Add([]byte("version: 0.5\nenv:\n  B: 1\n  A: \"\"\ncommands:\n  b:\n    run: \"true\"\n  a:\n    run: [\"false\"]\n"))
+	// Duplicate fields, the last of them wins.
+	f.Add([]byte("version: 0.5\ncommands:\n  a:\n    run: date\n    run: [date]\n    local: true\n    local: also\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := NewSupfile(data); err != nil {
+			t.Skip()
+		}
+		roundTrip(t, data)
+	})
+}
+
+// roundTrip parses data, marshals the Supfile and parses it again,
+// expecting the same Supfile but the source data and the warnings.
+func roundTrip(t *testing.T, data []byte) {
+	t.Helper()
+	conf, err := NewSupfile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := conf.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewSupfile(out)
+	if err != nil {
+		t.Fatalf("parse of the marshaled Supfile: %v\n%s", err, out)
+	}
+
+	for _, s := range []*Supfile{conf, again} {
+		s.data, s.Warnings = nil, nil
+	}
+	if !reflect.DeepEqual(conf, again) {
+		t.Errorf("Supfile changed by the round trip, marshaled as\n%s", out)
+	}
+}
@@ -0,0 +1,208 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MetricsConfig configures where run metrics are pushed to.
+type MetricsConfig struct {
+	Pushgateway string `yaml:"pushgateway,omitempty"` // Prometheus Pushgateway URL.
+	Job         string `yaml:"job,omitempty"`         // Pushgateway job name, "sup" by default.
+	File        string `yaml:"file,omitempty"`        // node_exporter textfile collector file.
+}
+
+// Metrics collects run metrics from events. Register Handle with
+// Stackup.OnEvent.
+type Metrics struct {
+	labels map[string]string
+
+	mu       sync.Mutex
+	start    time.Time
+	duration time.Duration
+	hosts    map[string]bool // host -> failed
+	cmdStart map[string]time.Time
+	cmdEnd   map[string]time.Time
+	cmds     []string
+}
+
+// NewMetrics creates metrics collector. Labels, ie. network, target and
+// supfile, are added to all the metrics.
+func NewMetrics(labels map[string]string) *Metrics {
+	return &Metrics{
+		labels:   labels,
+		start:    time.Now(),
+		hosts:    map[string]bool{},
+		cmdStart: map[string]time.Time{},
+		cmdEnd:   map[string]time.Time{},
+	}
+}
+
+// Handle records the event.
+func (m *Metrics) Handle(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e.Type {
+	case HostConnecting:
+		if _, ok := m.hosts[e.Host]; !ok {
+			m.hosts[e.Host] = false
+		}
+	case HostConnected:
+		if e.Err != nil {
+			m.hosts[e.Host] = true
+		}
+	case CommandStarted:
+		if _, ok := m.cmdStart[e.Command]; !ok {
+			m.cmdStart[e.Command] = e.Time
+			m.cmds = append(m.cmds, e.Command)
+		}
+	case CommandFinished:
+		m.cmdEnd[e.Command] = e.Time
+		if e.Err != nil && !e.Ignored {
+			m.hosts[e.Host] = true
+		}
+	case RunFinished:
+		m.duration = e.Time.Sub(m.start)
+	}
+}
+
+// WriteTo writes the metrics in Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	return writeMetrics(w, []*Metrics{m})
+}
+
+// writeMetrics writes the metrics of the runs in Prometheus text
+// exposition format, each metric family once, told apart by the labels of
+// the runs.
+func writeMetrics(w io.Writer, runs []*Metrics) (int64, error) {
+	for _, m := range runs {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# HELP sup_run_duration_seconds Duration of the sup run.\n# TYPE sup_run_duration_seconds gauge\n")
+	for _, m := range runs {
+		fmt.Fprintf(&buf, "sup_run_duration_seconds%v %v\n", formatLabels(m.labels), m.duration.Seconds())
+	}
+	fmt.Fprintf(&buf, "# HELP sup_hosts_total Number of hosts in the run.\n# TYPE sup_hosts_total gauge\n")
+	for _, m := range runs {
+		fmt.Fprintf(&buf, "sup_hosts_total%v %v\n", formatLabels(m.labels), len(m.hosts))
+	}
+	fmt.Fprintf(&buf, "# HELP sup_hosts_failed Number of failed hosts in the run.\n# TYPE sup_hosts_failed gauge\n")
+	for _, m := range runs {
+		failed := 0
+		for _, f := range m.hosts {
+			if f {
+				failed++
+			}
+		}
+		fmt.Fprintf(&buf, "sup_hosts_failed%v %v\n", formatLabels(m.labels), failed)
+	}
+	fmt.Fprintf(&buf, "# HELP sup_command_duration_seconds Duration of the command on all hosts.\n# TYPE sup_command_duration_seconds gauge\n")
+	for _, m := range runs {
+		for _, cmd := range m.cmds {
+			cmdLabels := map[string]string{"command": cmd}
+			for k, v := range m.labels {
+				cmdLabels[k] = v
+			}
+			fmt.Fprintf(&buf, "sup_command_duration_seconds%v %v\n", formatLabels(cmdLabels), m.cmdEnd[cmd].Sub(m.cmdStart[cmd]).Seconds())
+		}
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// Push pushes the metrics to Prometheus Pushgateway, replacing metrics
+// of the same job and network label, so the runs of several networks
+// don't replace each other's.
+func (m *Metrics) Push(pushgateway, job string) error {
+	if job == "" {
+		job = "sup"
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	u := strings.TrimSuffix(pushgateway, "/") + "/metrics/job/" + url.PathEscape(job)
+	if network := m.labels["network"]; network != "" {
+		u += "/network/" + url.PathEscape(network)
+	}
+	req, err := http.NewRequest(http.MethodPut, u, &buf)
+	if err != nil {
+		return errors.Wrap(err, "pushing metrics failed")
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "pushing metrics failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("pushing metrics failed: %v: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// WriteFile writes the metrics to a file in node_exporter textfile
+// collector format. The file is replaced atomically, so the collector
+// never reads a partial file.
+func (m *Metrics) WriteFile(path string) error {
+	return WriteMetricsFile(path, m)
+}
+
+// WriteMetricsFile writes the metrics of the runs, ie. of the networks
+// run by -parallel-networks, to a single file, see Metrics.WriteFile.
+func WriteMetricsFile(path string, runs ...*Metrics) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "writing metrics failed")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := writeMetrics(tmp, runs); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing metrics failed")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "writing metrics failed")
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return errors.Wrap(err, "writing metrics failed")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "writing metrics failed")
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + `="` + replacer.Replace(labels[k]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,124 @@
+package sup_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+const metricsSupfile = `
+version: 0.5
+networks:
+  staging:
+    hosts: [stg1]
+  production:
+    hosts: [web1, web2]
+  canary:
+    hosts: [canary1]
+commands:
+  deploy:
+    run: ./deploy.sh
+`
+
+// TestParallelNetworksMetrics runs the networks at once, as by
+// -parallel-networks, and checks none of them overwrites the metrics of
+// the others, pushed or written to a single file.
+func TestParallelNetworksMetrics(t *testing.T) {
+	conf, err := sup.NewSupfile([]byte(metricsSupfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fakes := map[string]*suptest.FakeNetwork{
+		"staging": suptest.NewFakeNetwork(suptest.FakeHost{Host: "stg1"}),
+		"production": suptest.NewFakeNetwork(
+			suptest.FakeHost{Host: "web1"},
+			suptest.FakeHost{Host: "web2", Responses: []suptest.Response{{Match: "deploy", Exit: 1}}},
+		),
+		"canary": suptest.NewFakeNetwork(suptest.FakeHost{Host: "canary1"}),
+	}
+
+	var mu sync.Mutex
+	pushed := map[string]string{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		pushed[r.URL.Path] = string(body)
+	}))
+	defer gateway.Close()
+
+	cmd, _ := conf.Commands.Get("deploy")
+	cmd.Name = "deploy"
+	var runs []*sup.Metrics
+	var wg sync.WaitGroup
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
+		if network.Hosts, err = fakes[name].Hosts(); err != nil {
+			t.Fatal(err)
+		}
+		app, err := sup.New(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.Output(io.Discard, io.Discard)
+		app.Dial(fakes[name].Dial)
+		metrics := sup.NewMetrics(map[string]string{"network": name, "target": "deploy"})
+		app.OnEvent(metrics.Handle)
+		runs = append(runs, metrics)
+
+		wg.Add(1)
+		go func(network sup.Network, cmd sup.Command) {
+			defer wg.Done()
+			app.Run(&network, nil, &cmd)
+			if err := metrics.Push(gateway.URL, "deploys"); err != nil {
+				t.Error(err)
+			}
+		}(network, cmd)
+	}
+	wg.Wait()
+
+	var paths []string
+	for path := range pushed {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	want := []string{"/metrics/job/deploys/network/canary", "/metrics/job/deploys/network/production", "/metrics/job/deploys/network/staging"}
+	if strings.Join(paths, " ") != strings.Join(want, " ") {
+		t.Errorf("pushed to %v, want %v", paths, want)
+	}
+
+	file := filepath.Join(t.TempDir(), "sup.prom")
+	if err := sup.WriteMetricsFile(file, runs...); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(data)
+	for _, family := range []string{"sup_run_duration_seconds", "sup_hosts_total", "sup_hosts_failed", "sup_command_duration_seconds"} {
+		if n := strings.Count(text, "# TYPE "+family+" "); n != 1 {
+			t.Errorf("%v has %v TYPE lines, want 1", family, n)
+		}
+	}
+	for _, line := range []string{
+		`sup_hosts_total{network="staging",target="deploy"} 1`,
+		`sup_hosts_total{network="production",target="deploy"} 2`,
+		`sup_hosts_total{network="canary",target="deploy"} 1`,
+		`sup_hosts_failed{network="production",target="deploy"} 1`,
+		`sup_hosts_failed{network="canary",target="deploy"} 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics file lacks %v:\n%v", line, text)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OpenSSHClient runs commands through the local ssh binary instead of the
+// native Go client, so it reuses ControlMaster sockets, GSSAPI auth, PKCS#11
+// tokens and everything else configured in ~/.ssh/config.
+type OpenSSHClient struct {
+	cmd      *exec.Cmd
+	host     *Host
+	bastion  string   // Passed to ssh as -J
+	hostName string   // Resolved address, passed to ssh as -o HostName
+	options  []string // Passed to ssh as -o
+	gssapi   bool
+	timeout  time.Duration // Network's connect_timeout, passed to ssh as -o ConnectTimeout
+	stdin    io.WriteCloser
+	stdout   io.Reader
+	stderr   io.Reader
+	running  bool
+	env      string //export FOO="bar"; export BAR="baz";
+	color    string
+}
+
+// ErrOpenSSHExit is returned by OpenSSHClient.Wait when the remote command
+// (or ssh itself, with status 255) exits with non-zero status.
+type ErrOpenSSHExit struct {
+	Status int
+}
+
+func (e ErrOpenSSHExit) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.Status)
+}
+
+// ExitStatus returns the exit status of the remote command.
+func (e ErrOpenSSHExit) ExitStatus() int {
+	return e.Status
+}
+
+// args returns ssh arguments for connecting to c.host.
+func (c *OpenSSHClient) args(tty bool) []string {
+	args := []string{"-o", "BatchMode=yes"}
+	for _, opt := range c.options {
+		args = append(args, "-o", opt)
+	}
+	if c.host.User != "" {
+		args = append(args, "-l", c.host.User)
+	}
+	if c.host.Port != "" {
+		args = append(args, "-p", c.host.Port)
+	}
+	if c.host.IdentityFile != "" {
+		args = append(args, "-i", c.host.IdentityFile)
+	}
+	if c.host.identityKey != nil && c.host.identityKey.file != "" {
+		args = append(args, "-i", c.host.identityKey.file)
+	}
+	if c.hostName != "" {
+		// known_hosts entries are still looked up by the host name.
+		args = append(args, "-o", "HostName="+c.hostName, "-o", "HostKeyAlias="+c.host.Address)
+	}
+	if c.bastion != "" {
+		args = append(args, "-J", c.bastion)
+	}
+	if tty {
+		args = append(args, "-tt")
+	} else {
+		args = append(args, "-T")
+	}
+	// The alias of Supfile or inventory only names the host in the output,
+	// unlike the Host of SSH config, which ssh resolves itself.
+	if c.host.alias != "" {
+		return append(args, c.host.Address)
+	}
+	return append(args, c.host.GetHostname())
+}
+
+// Connect checks that the host is reachable with the current ssh setup.
+func (c *OpenSSHClient) Connect() error {
+	cmd := exec.Command("ssh", append(c.args(false), "--", "true")...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if c.timeout > 0 && strings.Contains(string(out), "timed out") {
+			return ErrConnectTimeout{c.host.User, c.host.GetHost(), c.timeout}
+		}
+		connErr := ErrConnect{c.host.User, c.host.GetHost(), fmt.Sprintf("%v: %s", err, out)}
+		if c.gssapi {
+			return gssapiConnectError(connErr, c.host)
+		}
+		return connErr
+	}
+	return nil
+}
+
+// Run runs the task.Run command remotely on c.host.
+func (c *OpenSSHClient) Run(task *Task) error {
+	var err error
+
+	if c.running {
+		return fmt.Errorf("session already running")
+	}
+
+	// The remote command is passed as a single argument, so it's interpreted
+	// by the remote shell exactly the same way as with the native client.
+	run := c.host.remoteCommand(task, c.env, task.TTY)
+	if task.TTY {
+		// Match the native client, which disables echoing on the pty.
+		run = "stty -echo 2>/dev/null;" + run
+	}
+	cmd := exec.Command("ssh", append(c.args(task.TTY), "--", run)...)
+	c.cmd = cmd
+
+	c.stdout, err = cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	c.stderr, err = cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	c.stdin, err = cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return ErrTask{task, err.Error()}
+	}
+
+	c.running = true
+	return nil
+}
+
+// Wait waits until the remote command finishes and exits.
+func (c *OpenSSHClient) Wait() error {
+	if !c.running {
+		return fmt.Errorf("trying to wait on stopped session")
+	}
+	err := c.cmd.Wait()
+	c.running = false
+	if e, ok := err.(*exec.ExitError); ok {
+		return ErrOpenSSHExit{e.ExitCode()}
+	}
+	return err
+}
+
+// Close kills the ssh process, if it's still running.
+func (c *OpenSSHClient) Close() error {
+	if c.running && c.cmd.Process != nil {
+		return errors.Wrap(c.cmd.Process.Kill(), "killing ssh failed")
+	}
+	return nil
+}
+
+func (c *OpenSSHClient) Stdin() io.WriteCloser {
+	return c.stdin
+}
+
+func (c *OpenSSHClient) Stderr() io.Reader {
+	return c.stderr
+}
+
+func (c *OpenSSHClient) Stdout() io.Reader {
+	return c.stdout
+}
+
+// Host returns the host the client is connected to.
+func (c *OpenSSHClient) Host() *Host {
+	return c.host
+}
+
+func (c *OpenSSHClient) Prefix() (string, int) {
+	host := c.host.GetPrefixText()
+	return colorize(c.color, host), len(host)
+}
+
+func (c *OpenSSHClient) Write(p []byte) (n int, err error) {
+	return c.stdin.Write(p)
+}
+
+func (c *OpenSSHClient) WriteClose() error {
+	return c.stdin.Close()
+}
+
+func (c *OpenSSHClient) Signal(sig os.Signal) error {
+	if !c.running {
+		return fmt.Errorf("session is not open")
+	}
+
+	switch sig {
+	case os.Interrupt:
+		// Same as the native client, send ^C through the remote pty.
+		_, err := c.stdin.Write([]byte("\x03"))
+		return err
+	default:
+		return fmt.Errorf("%v not supported", sig)
+	}
+}
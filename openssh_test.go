@@ -0,0 +1,39 @@
+package sup
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenSSHDestination(t *testing.T) {
+	r, err := NewResolver(filepath.Join("testdata", "ssh_config", "match"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		host string
+		want string // Destination passed to ssh.
+		name string // Host name in the output.
+	}{
+		{"deploy@10.0.0.5", "10.0.0.5", "10.0.0.5"},
+		{"deploy@10.0.0.5 as web1", "10.0.0.5", "web1"},
+		{"deploy@10.0.0.5:2222 as web1", "10.0.0.5", "web1"},
+		// ssh resolves the Host of SSH config itself.
+		{"bastion", "bastion", "bastion"},
+		{"bastion as jump", "10.0.0.1", "jump"},
+	} {
+		t.Run(tt.host, func(t *testing.T) {
+			host, err := r.NewHost(tt.host, HostDefaults{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			args := (&OpenSSHClient{host: host}).args(false)
+			if got := args[len(args)-1]; got != tt.want {
+				t.Errorf("ssh destination %v, want %v (args %q)", got, tt.want, args)
+			}
+			if got := host.GetHostname(); got != tt.name {
+				t.Errorf("host name %v, want %v", got, tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package sup
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Output modes of Command.Output.
+const (
+	OutputFull    = "full"    // All lines, the default.
+	OutputSummary = "summary" // Last summaryLines of each host and its exit status.
+	OutputQuiet   = "quiet"   // Last summaryLines of the failed hosts only.
+)
+
+// summaryLines is how many of the last lines of each host are shown by
+// the summary and quiet output modes.
+const summaryLines = 20
+
+// checkOutput returns error of unknown output mode.
+func checkOutput(mode string) error {
+	switch mode {
+	case "", OutputFull, OutputSummary, OutputQuiet:
+		return nil
+	}
+	return fmt.Errorf("unknown output %q, expected %v, %v or %v", mode, OutputFull, OutputSummary, OutputQuiet)
+}
+
+// MaxOutputBytes limits the output of each host shown by the text output
+// to n bytes per command, 0 for no limit. The lines past the limit are
+// dropped, while the command's output is still read to its end.
+func (sup *Stackup) MaxOutputBytes(n int64) {
+	sup.maxOutputBytes = n
+}
+
+// hostOutput filters the lines of a host's command written to the text
+// output by its output mode and MaxOutputBytes. The events of all lines
+// are still delivered to the handlers.
+type hostOutput struct {
+	sup  *Stackup
+	mode string
+	max  int64
+
+	mu      sync.Mutex
+	written int64   // Bytes of lines written, without prefixes.
+	dropped int64   // Bytes of lines dropped by max, since last flush.
+	hidden  int     // Lines hidden, not being in tail, since last flush.
+	tail    []Event // Last summaryLines, held until flush.
+}
+
+// hostOutput returns the output filter of a host running cmd, or nil if
+// all output is written as is.
+func (sup *Stackup) hostOutput(cmd *Command) *hostOutput {
+	if (cmd.Output == "" || cmd.Output == OutputFull) && sup.maxOutputBytes <= 0 {
+		return nil
+	}
+	return &hostOutput{sup: sup, mode: cmd.Output, max: sup.maxOutputBytes}
+}
+
+// line hides the line of e from the text output, unless it's written
+// right away.
+func (o *hostOutput) line(e *Event) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e.hidden = true
+	if o.mode == OutputSummary || o.mode == OutputQuiet {
+		o.tail = append(o.tail, *e)
+		if len(o.tail) > summaryLines {
+			o.tail = o.tail[1:]
+			o.hidden++
+		}
+		return
+	}
+	if e, ok := o.fit(*e); ok {
+		o.sup.writeText(e)
+	}
+}
+
+// fit returns e with as much of its line as fits into max, and reports
+// whether any of it does. Caller holds o.mu.
+func (o *hostOutput) fit(e Event) (Event, bool) {
+	size := int64(len(e.Line)) + 1
+	if o.max <= 0 || o.written+size <= o.max {
+		o.written += size
+		return e, true
+	}
+	left := o.max - o.written
+	o.dropped += size - left
+	o.written = o.max
+	if left <= 1 {
+		return e, false
+	}
+	e.Line = e.Line[:left-1]
+	return e, true
+}
+
+// flush writes the held lines of the finished task, if its output mode
+// shows them, followed by markers of the lines hidden or dropped, and by
+// the exit status in summary mode.
+func (o *hostOutput) flush(prefix string, task *Task, err error) {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// The lines of the host are written at once, not interleaved by the
+	// other hosts' ones.
+	sup := o.sup
+	sup.eventsMu.Lock()
+	defer sup.eventsMu.Unlock()
+	note := func(format string, args ...interface{}) {
+		if sup.stderr != nil {
+			fmt.Fprintf(sup.stderr, prefix+format+"\n", args...)
+		}
+	}
+	if o.mode == OutputSummary || (o.mode == OutputQuiet && err != nil) {
+		if o.hidden > 0 {
+			note("… %d lines hidden", o.hidden)
+		}
+		for _, e := range o.tail {
+			if e, ok := o.fit(e); ok {
+				sup.writeOutput(e)
+			}
+		}
+	}
+	if o.dropped > 0 {
+		note("… truncated (%d bytes dropped)", o.dropped)
+	}
+	if o.mode == OutputSummary && err == nil && (task.Kind == TaskRun || task.Kind == TaskScript) {
+		note("exit status 0")
+	}
+	o.tail, o.hidden, o.dropped = nil, 0, 0
+}
@@ -0,0 +1,214 @@
+package sup
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInterrupted is returned by Run when Ctrl-C interrupts a serial_delay
+// or rate wait.
+var ErrInterrupted = errors.New("interrupted")
+
+// Pacing spaces out the hosts of a command, so they don't hit shared
+// services, ie. a cache layer, all at once.
+type Pacing struct {
+	SerialDelay string `yaml:"serial_delay,omitempty"` // Sleep between "serial" groups, ie. "30s".
+	Rate        string `yaml:"rate,omitempty"`         // Max hosts started per period, ie. "10/1m".
+	Splay       string `yaml:"splay,omitempty"`        // Random delay of each host before the command, ie. "30s".
+}
+
+// check validates the pacing.
+func (p Pacing) check() error {
+	if _, err := p.splay(); err != nil {
+		return err
+	}
+	_, _, _, err := p.parse()
+	return err
+}
+
+// splay returns the splay, 0 if it isn't set.
+func (p Pacing) splay() (time.Duration, error) {
+	splay, err := parseDuration(p.Splay, 0)
+	if err != nil {
+		return 0, fmt.Errorf("splay: %v", err)
+	}
+	return splay, nil
+}
+
+// parse returns the serial_delay and the rate as count of hosts per period.
+func (p Pacing) parse() (delay time.Duration, count int, period time.Duration, err error) {
+	if p.SerialDelay != "" {
+		if delay, err = parseDuration(p.SerialDelay, 0); err != nil {
+			return 0, 0, 0, fmt.Errorf("serial_delay: %v", err)
+		}
+	}
+	if p.Rate != "" {
+		if count, period, err = parseRate(p.Rate); err != nil {
+			return 0, 0, 0, fmt.Errorf("rate: invalid value %q, expected hosts per period, ie. \"10/1m\"", p.Rate)
+		}
+	}
+	return delay, count, period, nil
+}
+
+// parseRate parses rate of count per period, ie. "10/1m". The period
+// may leave out 1, so "10/m" reads as "10/1m".
+func parseRate(rate string) (count int, period time.Duration, err error) {
+	invalid := fmt.Errorf("invalid rate %q", rate)
+	n, per, ok := strings.Cut(rate, "/")
+	if !ok {
+		return 0, 0, invalid
+	}
+	if count, err = strconv.Atoi(strings.TrimSpace(n)); err != nil || count <= 0 {
+		return 0, 0, invalid
+	}
+	per = strings.TrimSpace(per)
+	if per != "" && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	if period, err = parseDuration(per, 0); err != nil || period <= 0 {
+		return 0, 0, invalid
+	}
+	return count, period, nil
+}
+
+// Estimate returns how long pacing alone stretches the command over the
+// groups of hosts, running steps tasks each (ie. an upload and a run),
+// not counting the time the tasks themselves take.
+func (p Pacing) Estimate(groups []int, steps int) time.Duration {
+	delay, count, period, err := p.parse()
+	if err != nil || steps == 0 {
+		return 0
+	}
+	var t time.Duration
+	var starts []time.Duration
+	for step := 0; step < steps; step++ {
+		for i, hosts := range groups {
+			if i > 0 {
+				t += delay
+			}
+			if step > 0 || count == 0 {
+				continue
+			}
+			for h := 0; h < hosts; h++ {
+				if k := len(starts) - count; k >= 0 && starts[k]+period > t {
+					t = starts[k] + period
+				}
+				starts = append(starts, t)
+			}
+		}
+	}
+	return t
+}
+
+// pacer enforces the pacing of a command's tasks, see Stackup.Run.
+type pacer struct {
+	delay  time.Duration
+	count  int
+	period time.Duration
+
+	batch   int             // Batch of the last task.
+	starts  []time.Time     // Start times of the hosts, in order.
+	started map[Client]bool // Hosts counted in starts already.
+
+	splay   time.Duration
+	seed    int64
+	command string
+	splayed map[Client]bool // Hosts which got their splay already.
+}
+
+// newPacer returns pacer of cmd run on the number of hosts, or nil if it
+// isn't paced. Splay is skipped for a single host and by runs of Dial,
+// which rehearse the run.
+func (sup *Stackup) newPacer(cmd *Command, hosts int) (*pacer, error) {
+	delay, count, period, err := cmd.Pacing.parse()
+	if err != nil {
+		return nil, err
+	}
+	splay, err := cmd.Pacing.splay()
+	if err != nil {
+		return nil, err
+	}
+	if hosts < 2 || sup.dial != nil {
+		splay = 0
+	}
+	if delay == 0 && count == 0 && splay == 0 {
+		return nil, nil
+	}
+	if sup.seed == nil {
+		seed := time.Now().UnixNano()
+		sup.seed = &seed
+	}
+	return &pacer{delay: delay, count: count, period: period, started: map[Client]bool{}, splay: splay, seed: *sup.seed, command: cmd.Name, splayed: map[Client]bool{}}, nil
+}
+
+// splayOf returns the random delay of client c, in [0, splay). Each host
+// is delayed once per command, before its first task. The delay depends
+// on the seed, the command and the host only, not on the order in which
+// the hosts connected.
+func (p *pacer) splayOf(c Client) time.Duration {
+	if p.splay == 0 || p.splayed[c] {
+		return 0
+	}
+	p.splayed[c] = true
+	h := fnv.New64a()
+	io.WriteString(h, p.command+"\x00"+clientHostname(c))
+	r := rand.New(rand.NewSource(p.seed ^ int64(h.Sum64())))
+	return time.Duration(r.Int63n(int64(p.splay)))
+}
+
+// next returns serial_delay to sleep before the task, if it starts the next
+// "serial" group.
+func (p *pacer) next(task *Task) time.Duration {
+	batch := p.batch
+	p.batch = task.Batch
+	if task.Batch > 0 && task.Batch != batch {
+		return p.delay
+	}
+	return 0
+}
+
+// start returns how long to wait before client c is started, so the rate
+// isn't exceeded. Each host is counted once per command, by its first task.
+func (p *pacer) start(c Client) time.Duration {
+	if p.count == 0 || p.started[c] {
+		return 0
+	}
+	var d time.Duration
+	if k := len(p.starts) - p.count; k >= 0 {
+		d = time.Until(p.starts[k].Add(p.period))
+	}
+	if d < 0 {
+		d = 0
+	}
+	p.started[c] = true
+	p.starts = append(p.starts, time.Now().Add(d))
+	return d
+}
+
+// sleep sleeps for d, or returns ErrInterrupted right away on Ctrl-C.
+func sleep(d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	defer signal.Stop(trap)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-trap:
+		return ErrInterrupted
+	}
+}
@@ -0,0 +1,104 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PathsSupfileRelative is the `paths:` value resolving relative paths
+// against the directory containing Supfile. It's the default since
+// Supfile v0.6.
+const PathsSupfileRelative = "supfile-relative"
+
+// WarnPathResolution is a warning code of relative paths that would be
+// resolved differently with `paths: supfile-relative`.
+const WarnPathResolution = "path-resolution"
+
+// supfileRelative reports whether relative paths (script, upload.src,
+// build, inventory) are resolved against Supfile directory instead of CWD.
+func (s *Supfile) supfileRelative() bool {
+	return s.Paths == PathsSupfileRelative || versionAtLeast(s.Version, "0.6")
+}
+
+// versionAtLeast reports whether the Supfile version, ie. "0.6", is min or
+// later, comparing its dot-separated numbers. Versions which aren't
+// numbers are never at least min.
+func versionAtLeast(version, min string) bool {
+	v, m := strings.Split(version, "."), strings.Split(min, ".")
+	for i := range m {
+		if i >= len(v) {
+			return false
+		}
+		a, err := strconv.Atoi(v[i])
+		if err != nil {
+			return false
+		}
+		b, _ := strconv.Atoi(m[i])
+		if a != b {
+			return a > b
+		}
+	}
+	for _, part := range v[len(m):] {
+		if _, err := strconv.Atoi(part); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// BaseDir returns the directory relative paths are resolved against.
+// It's Workdir, if set, Supfile directory for `paths: supfile-relative`
+// (or Supfile v0.6+) and CWD otherwise.
+func (s *Supfile) BaseDir() (string, error) {
+	if s.Workdir != "" {
+		return filepath.Abs(ResolvePath(s.Workdir))
+	}
+	if s.supfileRelative() && s.Dir != "" {
+		return s.Dir, nil
+	}
+	return os.Getwd()
+}
+
+// PathWarnings returns warnings for relative paths of commands, which
+// would be resolved differently if `paths: supfile-relative` was set.
+func (s *Supfile) PathWarnings(commands []*Command) []Warning {
+	if s.supfileRelative() || s.Workdir != "" || s.Dir == "" {
+		return nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil || cwd == s.Dir {
+		return nil
+	}
+
+	var warnings []Warning
+	warn := func(cmd *Command, key, path string) {
+		if path == "" || filepath.IsAbs(path) || path[0] == '~' || path[0] == '$' {
+			return
+		}
+		warnings = append(warnings, Warning{
+			Code: WarnPathResolution,
+			Message: fmt.Sprintf("commands.%v.%v %q is resolved against CWD %v, not against Supfile directory %v (see `paths: %v`)",
+				cmd.Name, key, path, cwd, s.Dir, PathsSupfileRelative),
+			Line: findLine(s.data, "commands", cmd.Name, key),
+		})
+	}
+	for _, cmd := range commands {
+		warn(cmd, "script", cmd.Script)
+		warn(cmd, "scripts_dir", cmd.ScriptsDir)
+		for _, upload := range cmd.Upload {
+			warn(cmd, "src", upload.Src)
+		}
+	}
+	return warnings
+}
+
+// resolve returns path relative to base directory, unless it's absolute.
+func resolve(base, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(base, path)
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package sup
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+)
+
+// checkPeerCred returns error if the daemon can't check its peers.
+func checkPeerCred() error {
+	return fmt.Errorf("sup daemon is not supported on %v", runtime.GOOS)
+}
+
+// peerUID returns user ID of the process at the other end of conn.
+func peerUID(conn *net.UnixConn) (int, error) {
+	return -1, checkPeerCred()
+}
+
+// detach makes cmd outlive the terminal session starting it.
+func detach(cmd *exec.Cmd) {}
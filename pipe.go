@@ -0,0 +1,297 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Pipe is a target piping STDOUT of a command on a host into STDIN of
+// another command, run locally or on another host, ie.
+//
+//	targets:
+//	  backup-pipeline:
+//	    from: {command: dump-db, host: db-primary}
+//	    to: {command: restore-db, local: true}
+//
+// The stream isn't stored anywhere: the source is read only as fast as
+// the destination reads its input. The pipe fails if either of the
+// commands fails, which interrupts the other one.
+type Pipe struct {
+	From PipeEnd `yaml:"from"`
+	To   PipeEnd `yaml:"to"`
+}
+
+// PipeEnd is a command of Pipe and where it's run.
+type PipeEnd struct {
+	Command string `yaml:"command"`
+	Host    string `yaml:"host,omitempty"`  // Host of the network by its name, see Host.GetHostname; the only host of the network if empty.
+	Local   bool   `yaml:"local,omitempty"` // Run the command locally instead.
+}
+
+// check validates the pipe target name of the Supfile.
+func (p *Pipe) check(s *Supfile, name string) error {
+	for _, end := range []struct {
+		key string
+		end PipeEnd
+	}{{"from", p.From}, {"to", p.To}} {
+		switch {
+		case end.end.Command == "":
+			return s.errorAt(fmt.Sprintf("target %v: %v: command is required", name, end.key), "targets", name, end.key)
+		case end.end.Local && end.end.Host != "":
+			return s.errorAt(fmt.Sprintf("target %v: %v: local and host are mutually exclusive", name, end.key), "targets", name, end.key)
+		}
+		if _, ok := s.Commands.Get(end.end.Command); !ok {
+			return s.errorAt(fmt.Sprintf("target %v: %v: unknown command %v", name, end.key, end.end.Command), "targets", name, end.key)
+		}
+	}
+	if p.From.Local && p.To.Local {
+		return s.errorAt(fmt.Sprintf("target %v: from and to can't both be local, pipe them by the shell", name), "targets", name)
+	}
+	return nil
+}
+
+// String returns the pipe as "dump-db@db-primary | restore-db@local".
+func (p *Pipe) String() string {
+	return p.From.String() + " | " + p.To.String()
+}
+
+func (e PipeEnd) String() string {
+	switch {
+	case e.Local:
+		return e.Command + "@local"
+	case e.Host != "":
+		return e.Command + "@" + e.Host
+	}
+	return e.Command
+}
+
+// host returns the host of the network the end is run on, or by, if it's
+// local: the host of the other end, as the local commands are run by the
+// hosts of the network.
+func (e PipeEnd) host(network *Network, other PipeEnd) (*Host, error) {
+	name := e.Host
+	if e.Local {
+		name = other.Host
+	}
+	if name == "" {
+		if len(network.Hosts) != 1 {
+			return nil, fmt.Errorf("%v: host is required, the network has %d hosts", e.Command, len(network.Hosts))
+		}
+		return network.Hosts[0], nil
+	}
+	for _, host := range network.Hosts {
+		if host.GetHostname() == name {
+			return host, nil
+		}
+	}
+	return nil, fmt.Errorf("%v: host %v is not a host of the network", e.Command, name)
+}
+
+// pipeStream is the stream of Pipe, from STDOUT of the source's run
+// tasks into STDIN of the destination's, see Stackup.pipeOut and pipeIn.
+type pipeStream struct {
+	r     *io.PipeReader
+	w     *io.PipeWriter
+	bytes int64 // Piped so far, accessed atomically.
+
+	mu      sync.Mutex
+	clients [2]Client // Running source and destination, if any.
+	failed  [2]bool   // The source or destination failed, the other one is interrupted.
+	cause   int       // End which failed first, -1 if none.
+}
+
+// Ends of pipeStream.
+const (
+	pipeFrom = 0
+	pipeTo   = 1
+)
+
+func newPipeStream() *pipeStream {
+	r, w := io.Pipe()
+	return &pipeStream{r: r, w: w, cause: -1}
+}
+
+// attach records the client running the end, interrupting it right away if
+// the other end failed already.
+func (p *pipeStream) attach(end int, c Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clients[end] = c
+	if p.failed[1-end] {
+		c.Signal(os.Interrupt)
+	}
+}
+
+// done closes the stream of the end, which finished by err. The source
+// finishing closes the destination's STDIN, by EOF if it succeeded. The
+// end failing interrupts the other one first, so the destination doesn't
+// take the rest of a failed source's output for the end of its input.
+func (p *pipeStream) done(end int, err error) {
+	if err != nil {
+		p.mu.Lock()
+		if p.cause < 0 {
+			p.cause = end
+		}
+		p.failed[end] = true
+		if c := p.clients[1-end]; c != nil {
+			c.Signal(os.Interrupt)
+		}
+		p.mu.Unlock()
+	}
+	if end == pipeFrom {
+		p.w.CloseWithError(err)
+	} else {
+		p.r.CloseWithError(errors.New("pipe destination is done"))
+	}
+}
+
+// copyFrom copies STDOUT r of the source's client into the stream,
+// emitting PipeProgress events. Once the destination stops reading, the
+// rest of r is discarded, so the source isn't blocked before it's
+// interrupted.
+func (p *pipeStream) copyFrom(sup *Stackup, c Client, r io.Reader, event Event) error {
+	p.attach(pipeFrom, c)
+	event.Type = PipeProgress
+	w := &progressWriter{w: countingWriter{p.w, &p.bytes}, sup: sup, event: event}
+	_, err := io.Copy(w, r)
+	if err != nil {
+		io.Copy(io.Discard, r)
+	}
+	return err
+}
+
+// countingWriter adds the bytes written to w to n, atomically.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// Pipe runs the pipe target on the network, see Pipe. Both commands are
+// started at once, each by its own run of the host, the destination's
+// STDIN being the stream the source's STDOUT is copied into. Its error is
+// the one of the end failing first, not of the other one it interrupted.
+// The events of both runs are passed to the handlers of the Stackup,
+// followed by a single RunFinished.
+func (sup *Stackup) Pipe(network *Network, envVars EnvList, p *Pipe) (err error) {
+	defer func() {
+		sup.emit(Event{Type: RunFinished, Err: err})
+	}()
+
+	var runs [2]struct {
+		app     *Stackup
+		network Network
+		cmd     Command
+		err     error
+	}
+	stream := newPipeStream()
+	for end, e := range [2]PipeEnd{p.From, p.To} {
+		other := p.To
+		if end == pipeTo {
+			other = p.From
+		}
+		cmd, ok := sup.conf.Commands.Get(e.Command)
+		if !ok {
+			return fmt.Errorf("pipe %v: unknown command %v", p, e.Command)
+		}
+		host, err := e.host(network, other)
+		if err != nil {
+			return errors.Wrapf(err, "pipe %v", p)
+		}
+		cmd.Name = e.Command
+		if e.Local {
+			cmd.Local, cmd.LocalAlso = true, false
+		}
+		run := &runs[end]
+		run.app, run.cmd = sup.pipeRun(), cmd
+		run.network = *network
+		run.network.Hosts = []*Host{host}
+		// Each run would hold its tunnels until a line is read, while the
+		// destination waits for the source to finish.
+		if sup.keepTunnels != nil && run.network.Tunneled([]*Command{&run.cmd}) {
+			return fmt.Errorf("pipe %v: tunnels can't be kept open by pipe targets", p)
+		}
+		if end == pipeFrom {
+			run.app.pipeOut = stream
+		} else {
+			run.app.pipeIn = stream
+			run.cmd.Stdin = true
+		}
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for end := range runs {
+		wg.Add(1)
+		go func(end int) {
+			defer wg.Done()
+			run := &runs[end]
+			// Each run sets its SUP_* vars in place.
+			var env EnvList
+			for _, v := range envVars {
+				env.set(v.Key, v.Value, v.Literal)
+			}
+			run.err = run.app.Run(&run.network, env, &run.cmd)
+			stream.done(end, run.err)
+		}(end)
+	}
+	wg.Wait()
+
+	bytes := atomic.LoadInt64(&stream.bytes)
+	sup.errorf("pipe %v: %v in %v\n", p, formatSize(bytes), time.Since(start).Round(time.Millisecond))
+	switch stream.cause {
+	case pipeFrom:
+		return errors.Wrapf(runs[pipeFrom].err, "pipe %v: %v", p, p.From)
+	case pipeTo:
+		return errors.Wrapf(runs[pipeTo].err, "pipe %v: %v", p, p.To)
+	}
+	return nil
+}
+
+// pipeRun returns Stackup running an end of Pipe with the settings of sup,
+// its events passed to the handlers of sup. It's a copy of sup, with the
+// fields set by Run reset and its own snapshot of Sync, which is scanned
+// by each run.
+func (sup *Stackup) pipeRun() *Stackup {
+	run := &Stackup{}
+	*run = *sup
+	run.release, run.relay, run.network, run.bastion = Release{}, nil, "", ""
+	run.uploadFiles, run.fanouts, run.localAlso, run.banner = nil, nil, nil, nil
+	run.pipeOut, run.pipeIn = nil, nil
+	if sup.sync != nil {
+		snapshot := *sup.sync
+		run.sync = &snapshot
+	}
+	run.handlers, run.eventsMu = nil, &sync.Mutex{}
+	run.OnEvent(func(e Event) {
+		if e.Type == RunFinished {
+			return
+		}
+		sup.eventsMu.Lock()
+		defer sup.eventsMu.Unlock()
+		for _, handler := range sup.handlers {
+			handler(e)
+		}
+	})
+	return run
+}
+
+// input returns STDIN of the tasks of Stdin commands: the stream of Pipe
+// for its destination, os.Stdin otherwise.
+func (sup *Stackup) input() io.Reader {
+	if sup.pipeIn != nil {
+		return sup.pipeIn.r
+	}
+	return os.Stdin
+}
@@ -0,0 +1,282 @@
+package sup_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+const pipeSupfile = `
+version: 0.5
+networks:
+  production:
+    hosts: [db1, db2]
+commands:
+  dump:
+    run: pg_dump shop
+  restore:
+    run: psql shop
+targets:
+  copy-db:
+    from: {command: dump, host: db1}
+    to: {command: restore, host: db2}
+`
+
+// pipeClient runs the tasks of a host of the pipe tests by its function,
+// which reads STDIN and writes STDOUT at its own pace, unlike the fake
+// hosts of suptest.
+type pipeClient struct {
+	host *sup.Host
+	run  func(c *pipeClient) int // Runs the task, returns its exit status.
+
+	stdin   *io.PipeReader
+	stdinW  *io.PipeWriter
+	stdout  *io.PipeReader
+	stdoutW *io.PipeWriter
+	stderr  *io.PipeReader
+	stderrW *io.PipeWriter
+	done    chan int
+
+	interrupt chan struct{} // Closed by Signal.
+	once      sync.Once
+}
+
+func (c *pipeClient) Connect() error  { return nil }
+func (c *pipeClient) Host() *sup.Host { return c.host }
+
+func (c *pipeClient) Run(task *sup.Task) error {
+	c.stdin, c.stdinW = io.Pipe()
+	c.stdout, c.stdoutW = io.Pipe()
+	c.stderr, c.stderrW = io.Pipe()
+	c.done = make(chan int, 1)
+	go func() {
+		status := c.run(c)
+		c.stdin.Close()
+		c.stdoutW.Close()
+		c.stderrW.Close()
+		c.done <- status
+	}()
+	return nil
+}
+
+func (c *pipeClient) Wait() error {
+	if status := <-c.done; status != 0 {
+		return suptest.ExitError{Status: status}
+	}
+	return nil
+}
+
+func (c *pipeClient) Close() error { return c.Signal(os.Interrupt) }
+
+func (c *pipeClient) Prefix() (string, int) {
+	prefix := c.host.GetPrefixText()
+	return prefix, len(prefix)
+}
+
+func (c *pipeClient) Write(p []byte) (int, error) { return c.stdinW.Write(p) }
+func (c *pipeClient) WriteClose() error           { return c.stdinW.Close() }
+func (c *pipeClient) Stdin() io.WriteCloser       { return c.stdinW }
+func (c *pipeClient) Stderr() io.Reader           { return c.stderr }
+func (c *pipeClient) Stdout() io.Reader           { return c.stdout }
+
+func (c *pipeClient) Signal(os.Signal) error {
+	c.once.Do(func() { close(c.interrupt) })
+	return nil
+}
+
+func (c *pipeClient) interrupted() bool {
+	select {
+	case <-c.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// pipeEnds are the source and destination of a pipe test, counting the
+// bytes written and read.
+type pipeEnds struct {
+	written int64 // Accessed atomically.
+	read    int64 // Accessed atomically.
+	maxLag  int64 // Max bytes written ahead of the read ones, accessed atomically.
+
+	sum    [sha256.Size]byte // Checksum of the bytes read.
+	status [2]int            // Exit status of the source and destination.
+}
+
+// source writes size bytes in chunks, or until interrupted if size is
+// negative, and exits with exit.
+func (p *pipeEnds) source(size int64, exit int) func(c *pipeClient) int {
+	return func(c *pipeClient) int {
+		chunk := bytes.Repeat([]byte("0123456789abcdef"), 2048)
+		for size < 0 || atomic.LoadInt64(&p.written) < size {
+			if c.interrupted() {
+				p.status[0] = 130
+				return 130
+			}
+			b := chunk
+			if size >= 0 && size-p.written < int64(len(b)) {
+				b = b[:size-p.written]
+			}
+			if _, err := c.stdoutW.Write(b); err != nil {
+				break
+			}
+			written := atomic.AddInt64(&p.written, int64(len(b)))
+			if lag := written - atomic.LoadInt64(&p.read); lag > atomic.LoadInt64(&p.maxLag) {
+				atomic.StoreInt64(&p.maxLag, lag)
+			}
+		}
+		p.status[0] = exit
+		return exit
+	}
+}
+
+// destination reads STDIN to EOF, sleeping delay before each read, and
+// exits with exit, or as soon as it read failAfter bytes, if it's positive.
+func (p *pipeEnds) destination(delay time.Duration, failAfter int64, exit int) func(c *pipeClient) int {
+	return func(c *pipeClient) int {
+		h := sha256.New()
+		buf := make([]byte, 16*1024)
+		status := exit
+		for {
+			if c.interrupted() {
+				status = 130
+				break
+			}
+			time.Sleep(delay)
+			n, err := c.stdin.Read(buf)
+			h.Write(buf[:n])
+			read := atomic.AddInt64(&p.read, int64(n))
+			if failAfter > 0 && read >= failAfter {
+				break
+			}
+			if err != nil {
+				// The interrupt of a failed source comes before the end
+				// of its output.
+				if c.interrupted() {
+					status = 130
+				}
+				break
+			}
+		}
+		copy(p.sum[:], h.Sum(nil))
+		p.status[1] = status
+		return status
+	}
+}
+
+func TestPipe(t *testing.T) {
+	const size = 4 << 20
+	for _, tt := range []struct {
+		name   string
+		from   func(p *pipeEnds) func(c *pipeClient) int
+		to     func(p *pipeEnds) func(c *pipeClient) int
+		err    string // Error of the pipe, "" if it succeeds.
+		status [2]int // Exit status of the source and destination.
+		all    bool   // The destination reads all the bytes.
+	}{
+		{
+			name: "slow reader",
+			from: func(p *pipeEnds) func(c *pipeClient) int { return p.source(size, 0) },
+			to:   func(p *pipeEnds) func(c *pipeClient) int { return p.destination(time.Millisecond/4, 0, 0) },
+			all:  true,
+		},
+		{
+			name:   "destination fails",
+			from:   func(p *pipeEnds) func(c *pipeClient) int { return p.source(-1, 0) },
+			to:     func(p *pipeEnds) func(c *pipeClient) int { return p.destination(0, 1<<20, 1) },
+			err:    "pipe dump@db1 | restore@db2: restore@db2: exit status 1",
+			status: [2]int{130, 1},
+		},
+		{
+			name:   "source fails",
+			from:   func(p *pipeEnds) func(c *pipeClient) int { return p.source(1<<20, 2) },
+			to:     func(p *pipeEnds) func(c *pipeClient) int { return p.destination(0, 0, 0) },
+			err:    "pipe dump@db1 | restore@db2: dump@db1: exit status 2",
+			status: [2]int{2, 130},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pipeEnds{}
+			runs := map[string]func(c *pipeClient) int{"db1": tt.from(p), "db2": tt.to(p)}
+			progress, err := runPipe(t, func(host *sup.Host, env string) (sup.Client, error) {
+				return &pipeClient{host: host, run: runs[host.GetHostname()], interrupt: make(chan struct{})}, nil
+			})
+
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("pipe failed: %v", err)
+			case tt.err != "" && (err == nil || err.Error() != tt.err):
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if p.status != tt.status {
+				t.Errorf("got exit status %v of the source and destination, want %v", p.status, tt.status)
+			}
+			if !tt.all {
+				return
+			}
+			if want := sha256.Sum256(bytes.Repeat([]byte("0123456789abcdef"), size/16)); p.read != size || p.sum != want {
+				t.Errorf("destination read %v bytes of checksum %x, want %v bytes of %x", p.read, p.sum, size, want)
+			}
+			if progress != size {
+				t.Errorf("got %v bytes piped by the progress events, want %v", progress, size)
+			}
+			// The source is read only as fast as the destination reads, by
+			// the few buffers between them.
+			if p.maxLag > 256<<10 {
+				t.Errorf("source wrote %v bytes ahead of the destination, want backpressure", p.maxLag)
+			}
+		})
+	}
+}
+
+// runPipe runs the copy-db pipe target of pipeSupfile on clients of dial,
+// failing the test if it doesn't finish in time. It returns the bytes of
+// the last PipeProgress event.
+func runPipe(t *testing.T, dial sup.ClientFunc) (int64, error) {
+	t.Helper()
+	conf, err := sup.NewSupfile([]byte(pipeSupfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, _ := conf.Networks.Get("production")
+	if err := network.ResolveHosts(nil); err != nil {
+		t.Fatal(err)
+	}
+	pipe, _ := conf.Targets.Pipe("copy-db")
+
+	app, err := sup.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	app.Output(io.Discard, &stderr)
+	app.Dial(dial)
+	var progress int64
+	app.OnEvent(func(e sup.Event) {
+		if e.Type == sup.PipeProgress {
+			atomic.StoreInt64(&progress, e.Bytes)
+		}
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Pipe(&network, nil, pipe)
+	}()
+	select {
+	case err := <-done:
+		return atomic.LoadInt64(&progress), err
+	case <-time.After(20 * time.Second):
+		t.Fatalf("pipe didn't finish, output:\n%v", stderr.String())
+	}
+	return 0, nil
+}
@@ -0,0 +1,447 @@
+package sup
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pipelineStages splits the tasks of a command into stages, consecutive
+// tasks of the same clients and "serial" group. The stages run one after
+// another, while each host goes through the tasks of a stage on its own,
+// ie. from its upload right to its run, not waiting for the slower hosts.
+// Commands attached to the local STDIN keep all hosts in lockstep, one
+// task per stage.
+func pipelineStages(cmd *Command, tasks []*Task) [][]*Task {
+	var stages [][]*Task
+	for _, task := range tasks {
+		if n := len(stages); n > 0 && !cmd.Stdin {
+			last := stages[n-1][0]
+			if last.Batch == task.Batch && sameClients(last.Clients, task.Clients) {
+				stages[n-1] = append(stages[n-1], task)
+				continue
+			}
+		}
+		stages = append(stages, []*Task{task})
+	}
+	return stages
+}
+
+// sameClients reports whether a and b are the same clients, in order.
+func sameClients(a, b []Client) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// stage runs tasks of a command on its clients, see pipelineStages.
+type stage struct {
+	sup      *Stackup
+	cmd      *Command
+	tasks    []*Task
+	failures *failureTracker
+	maxLen   int
+
+	mu      sync.Mutex
+	running map[Client]bool
+	err     error // First error, stops the hosts before their next task.
+}
+
+// runStage runs the tasks of the stage. A host failing a task doesn't run
+// the rest of them, and the other hosts stop before their next task, unless
+// the command has max_failures.
+func (sup *Stackup) runStage(cmd *Command, tasks []*Task, failures *failureTracker, pacer *pacer, maxLen int) error {
+	s := &stage{sup: sup, cmd: cmd, tasks: tasks, failures: failures, maxLen: maxLen, running: map[Client]bool{}}
+	clients := tasks[0].Clients
+	if failures != nil {
+		if err := failures.err(false); err != nil {
+			return err
+		}
+	}
+	if pacer != nil {
+		if d := pacer.next(tasks[0]); d > 0 {
+			sup.errorf("%v: waiting %v before the next serial group\n", cmd.Name, d)
+			if err := sleep(d); err != nil {
+				return errors.Wrap(err, cmd.Name)
+			}
+		}
+	}
+
+	// Shared input is read once, each host reading it at its own pace.
+	inputs := make([][]io.Reader, len(tasks))
+	for i, task := range tasks {
+		inputs[i] = make([]io.Reader, len(clients))
+		if task.Input == nil {
+			continue
+		}
+		if len(clients) == 1 {
+			inputs[i][0] = task.Input
+			continue
+		}
+		f, ok := task.Input.(*fanoutReader)
+		if !ok {
+			var err error
+			if f, err = sup.fanout(task.Input); err != nil {
+				return errors.Wrap(err, cmd.Name)
+			}
+		}
+		for j := range clients {
+			inputs[i][j] = f.f.reader()
+		}
+	}
+
+	// Catch OS signals and pass them to all active clients.
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	defer func() {
+		signal.Stop(trap)
+		close(trap)
+	}()
+	go func() {
+		for sig := range trap {
+			s.mu.Lock()
+			for c := range s.running {
+				if err := c.Signal(sig); err != nil {
+					sup.errorf("%v", errors.Wrap(err, "sending signal failed"))
+				}
+			}
+			s.mu.Unlock()
+		}
+	}()
+
+	total, idle, err := cmd.Timeouts.durations()
+	if err != nil {
+		return errors.Wrap(err, cmd.Name)
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		if pacer != nil {
+			if d := pacer.start(c); d > 0 {
+				if d >= time.Second {
+					sup.errorf("%v: rate %v, waiting %v before %v\n", cmd.Name, cmd.Rate, d.Round(time.Second), clientHostname(c))
+				}
+				if err := sleep(d); err != nil {
+					s.fail(errors.Wrap(err, cmd.Name))
+					break
+				}
+			}
+		}
+		var splay time.Duration
+		if pacer != nil {
+			splay = pacer.splayOf(c)
+		}
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			if splay > 0 {
+				rounded := splay.Round(time.Second)
+				if rounded == 0 {
+					rounded = splay.Round(time.Millisecond)
+				}
+				sup.errorf("%swaiting %v splay\n", sup.paddedPrefix(c, cmd.Name, time.Now(), maxLen), rounded)
+				if err := sleep(splay); err != nil {
+					s.fail(errors.Wrap(err, cmd.Name))
+					return
+				}
+			}
+			deadline := time.Now().Add(total)
+			out := sup.hostOutput(cmd)
+			for j, task := range tasks {
+				if !s.start(c) {
+					return
+				}
+				watch := newWatchdog(c, task, total, deadline, idle)
+				if !s.runTask(task, c, inputs[j][i], watch, out) {
+					return
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+	return s.err
+}
+
+// start reports whether the client is to run its next task, and marks it
+// as running if so.
+func (s *stage) start(c Client) bool {
+	if s.failures != nil && (s.failures.err(false) != nil || len(s.failures.start([]Client{c})) == 0) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false
+	}
+	s.running[c] = true
+	return true
+}
+
+// fail records err of the stage, unless there's one already.
+func (s *stage) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// runTask runs the task on the client, with the input piped into its STDIN,
+// and reports whether the host is to go on with its next task. The task is
+// killed by the watchdog, if any, see Timeouts. Its output is filtered by
+// out, if any, see Command.Output.
+func (s *stage) runTask(task *Task, c Client, input io.Reader, watch *watchdog, out *hostOutput) bool {
+	sup, cmd := s.sup, s.cmd
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, c)
+		s.mu.Unlock()
+	}()
+
+	prefix := sup.paddedPrefix(c, cmd.Name, time.Now(), s.maxLen)
+	event := Event{Host: clientHostname(c), Command: cmd.Name, Task: task.Kind}
+	started := event
+	started.Type = CommandStarted
+	sup.emit(started)
+
+	ran, err := s.execTask(task, c, input, watch, out, event)
+	if err != nil && ran && task.retry != nil && watch.fired() == nil && isTransportError(err) {
+		err = s.retryUpload(task, c, watch, out, event, err)
+	}
+	if !ran {
+		watch.stop()
+		finished := event
+		finished.Type, finished.Err = CommandFinished, err
+		sup.emit(finished)
+		if s.failures != nil {
+			s.failures.finish(c, err)
+		}
+		s.fail(errors.Wrap(err, prefix+"task failed"))
+		return false
+	}
+
+	if timeout := watch.stop(); timeout != nil {
+		err = timeout
+	} else if err != nil && (cmd.allowsExitStatus(exitStatus(err)) || cmd.ExpectDisconnect && isDisconnect(err)) {
+		err = nil
+	}
+	ignored := err != nil && cmd.IgnoreErrors
+	out.flush(sup.paddedPrefix(c, cmd.Name, time.Now(), s.maxLen), task, err)
+	sup.emit(Event{Type: CommandFinished, Host: clientHostname(c), Command: cmd.Name, Task: task.Kind, Err: err, Ignored: ignored})
+	if s.failures != nil {
+		if ignored {
+			s.failures.finish(c, nil)
+		} else {
+			s.failures.finish(c, err)
+		}
+	}
+	if err == nil {
+		return true
+	}
+	prefix = sup.paddedPrefix(c, cmd.Name, time.Now(), s.maxLen)
+	if ignored {
+		sup.errorf("%s%v (ignored)\n", prefix, err)
+		return true
+	}
+	sup.errorf("%s%v\n", prefix, err)
+	if s.failures != nil {
+		return false
+	}
+
+	// Keep the first exit status, the rest is only printed.
+	status := exitStatus(err)
+	if status == 15 {
+		status = 1
+	}
+	s.fail(ErrExitStatus{status})
+	return false
+}
+
+// execTask runs the task on the client once, copying its output and
+// input, and returns the error of its exit. ran is false if the task
+// couldn't be started.
+func (s *stage) execTask(task *Task, c Client, input io.Reader, watch *watchdog, out *hostOutput, event Event) (ran bool, err error) {
+	sup, cmd := s.sup, s.cmd
+	tape := sup.tape(c, cmd.Name, task)
+	if err := c.Run(task); err != nil {
+		return false, err
+	}
+	prefix := sup.paddedPrefix(c, cmd.Name, time.Now(), s.maxLen)
+
+	var wg sync.WaitGroup
+
+	// Copy over tasks's STDOUT, into the stream of Pipe for its source.
+	wg.Add(1)
+	if pipe := sup.pipeOut; pipe != nil && (task.Kind == TaskRun || task.Kind == TaskScript) {
+		go func() {
+			defer wg.Done()
+			if err := pipe.copyFrom(sup, c, watch.reader(c.Stdout()), event); err != nil {
+				sup.errorf("%v\n", errors.Wrap(err, prefix+"piping STDOUT failed"))
+			}
+		}()
+	} else {
+		go func(e Event) {
+			defer wg.Done()
+			e.Stream, e.Prefix = Stdout, prefix
+			if err := sup.emitLines(watch.reader(tape.reader(Stdout, c.Stdout())), e, sup.linePrefix(c, cmd.Name, s.maxLen), out); err != nil {
+				sup.errorf("%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
+			}
+		}(event)
+	}
+
+	// Copy over tasks's STDERR.
+	wg.Add(1)
+	go func(e Event) {
+		defer wg.Done()
+		e.Stream, e.Prefix = Stderr, prefix
+		if err := sup.emitLines(watch.reader(tape.reader(Stderr, c.Stderr())), e, sup.linePrefix(c, cmd.Name, s.maxLen), out); err != nil {
+			sup.errorf("%v", errors.Wrap(err, prefix+"reading STDERR failed"))
+		}
+	}(event)
+
+	// Copy over task's STDIN.
+	if input != nil && sup.pipeIn != nil {
+		sup.pipeIn.attach(pipeTo, c)
+	}
+	if input != nil {
+		var w io.Writer = c.Stdin()
+		if task.Kind == TaskUpload {
+			progress := event
+			progress.Type, progress.Total = UploadProgress, task.Size
+			w = &progressWriter{w: c.Stdin(), sup: sup, event: progress}
+		}
+		go func() {
+			_, err := io.Copy(w, input)
+			// Failure of the source of Pipe is reported by its own run.
+			if err != nil && err != io.EOF && sup.pipeIn == nil {
+				sup.errorf("%v", errors.Wrap(err, prefix+"copying STDIN failed"))
+			}
+			c.WriteClose()
+		}()
+	}
+
+	// Wait for all I/O operations first.
+	watch.wait(&wg)
+	err = c.Wait()
+	tape.finish(err)
+	return true, err
+}
+
+// fanout spools input into a temp file, so the input is read only once,
+// while each host reads it at its own pace, instead of all of them at the
+// pace of the slowest one.
+type fanout struct {
+	file *os.File
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	size   int64
+	done   bool
+	closed bool
+	err    error
+}
+
+// fanout returns reader of input spooled into a temp file, see fanout.
+// The temp files are removed by closeFanouts.
+func (sup *Stackup) fanout(input io.Reader) (*fanoutReader, error) {
+	file, err := os.CreateTemp("", "sup-input-")
+	if err != nil {
+		return nil, err
+	}
+	f := &fanout{file: file}
+	f.cond = sync.NewCond(&f.mu)
+	go f.spool(input)
+	sup.fanouts = append(sup.fanouts, f)
+	return f.reader(), nil
+}
+
+// closeFanouts removes the temp files of the spooled inputs.
+func (sup *Stackup) closeFanouts() {
+	for _, f := range sup.fanouts {
+		f.Close()
+	}
+	sup.fanouts = nil
+}
+
+// spool copies input into the temp file, waking up the readers.
+func (f *fanout) spool(input io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			if _, werr := f.file.WriteAt(buf[:n], f.size); werr != nil && err == nil {
+				err = werr
+			}
+			f.mu.Lock()
+			f.size += int64(n)
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		}
+		if err != nil {
+			f.mu.Lock()
+			f.done = true
+			if err != io.EOF {
+				f.err = err
+			}
+			f.cond.Broadcast()
+			f.mu.Unlock()
+			return
+		}
+	}
+}
+
+// reader returns reader of the input from its start.
+func (f *fanout) reader() *fanoutReader {
+	return &fanoutReader{f: f}
+}
+
+// Close removes the temp file, the readers get io.EOF.
+func (f *fanout) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	f.file.Close()
+	return os.Remove(f.file.Name())
+}
+
+type fanoutReader struct {
+	f   *fanout
+	off int64
+}
+
+func (r *fanoutReader) Read(p []byte) (int, error) {
+	f := r.f
+	f.mu.Lock()
+	for r.off >= f.size && !f.done && !f.closed {
+		f.cond.Wait()
+	}
+	size, closed, err := f.size, f.closed, f.err
+	f.mu.Unlock()
+
+	if r.off >= size || closed {
+		if err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > size-r.off {
+		p = p[:size-r.off]
+	}
+	n, err := f.file.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package sup_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pressly/sup"
+)
+
+// slowClient runs the tasks in the local shell, starting the ones
+// matching slow after delay.
+type slowClient struct {
+	*sup.LocalhostClient
+	slow  string
+	delay time.Duration
+	tasks *int64 // Tasks run, accessed atomically.
+}
+
+func (c *slowClient) Run(task *sup.Task) error {
+	atomic.AddInt64(c.tasks, 1)
+	if c.slow != "" && strings.Contains(task.Run, c.slow) {
+		time.Sleep(c.delay)
+	}
+	return c.LocalhostClient.Run(task)
+}
+
+// TestPipelineLatency runs a command uploading a file on hosts of
+// different latencies, each slow at either the upload or the run. Each
+// host runs as soon as its own upload is done, so the run takes as long as
+// the slowest host, not as the slowest upload plus the slowest run.
+func TestPipelineLatency(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "app.tgz")
+	if err := os.WriteFile(src, []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := sup.NewSupfile([]byte(`
+version: 0.5
+networks:
+  production:
+    hosts: [slowlink, busy, fast]
+commands:
+  deploy:
+    upload:
+      - src: ` + src + `
+        dst: ` + filepath.Join(dir, "$SUP_HOST") + `
+    run: echo installed
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, _ := conf.Networks.Get("production")
+	cmd, _ := conf.Commands.Get("deploy")
+	cmd.Name = "deploy"
+
+	const delay = 300 * time.Millisecond
+	slow := map[string]string{"slowlink": "tar", "busy": "installed"}
+	var tasks int64
+	app, err := sup.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	app.Output(io.Discard, &stderr)
+	app.Dial(func(host *sup.Host, env string) (sup.Client, error) {
+		return &slowClient{sup.NewLocalhostClient(host, env), slow[host.GetHostname()], delay, &tasks}, nil
+	})
+
+	start := time.Now()
+	if err := app.Run(&network, nil, &cmd); err != nil {
+		t.Fatalf("run failed: %v\n%v", err, stderr.String())
+	}
+	elapsed := time.Since(start)
+	if tasks != 6 {
+		t.Fatalf("%v tasks run, want an upload and a run on each of 3 hosts", tasks)
+	}
+	// The hosts take a delay each, max(host). Gating the runs on all the
+	// uploads takes two, as does sum(host).
+	if elapsed >= delay*3/2 {
+		t.Errorf("run took %v, want close to %v of the slowest host", elapsed, delay)
+	}
+}
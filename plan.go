@@ -0,0 +1,708 @@
+package sup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PlanVersion is the version of the Plan JSON schema. It's incremented
+// on any backward incompatible change.
+const PlanVersion = 1
+
+// Plan is the fully resolved description of a run, as returned by
+// Stackup.Plan. It's meant to be checked by policy tools before the
+// run, see `sup -plan -output json`.
+type Plan struct {
+	PlanVersion int           `json:"plan_version"`
+	Network     string        `json:"network"`
+	Hosts       []PlanHost    `json:"hosts"`
+	Env         []PlanEnv     `json:"env"`
+	Commands    []PlanCommand `json:"commands"`
+
+	InventorySkew *InventorySkew `json:"inventory_skew,omitempty"` // Of networks with both hosts: and inventory.
+
+	Tunnels []PlanTunnel `json:"tunnels,omitempty"` // Opened for local commands only, instead of connecting to the hosts.
+
+	ConnectRate     string `json:"connect_rate,omitempty"`
+	ConnectTimeout  string `json:"connect_timeout,omitempty"`
+	ConnectEstimate string `json:"connect_estimate,omitempty"` // Time connect_rate stretches dialing of the hosts and bastions by.
+
+	Warnings []Warning `json:"warnings,omitempty"` // Suspicious upload destinations, see WarnUploadDst.
+
+	EmbedContext bool `json:"embed_context,omitempty"` // Remote commands start by a comment describing the run.
+
+	Defaults []string `json:"defaults,omitempty"` // "key: value" fields of defaults: network the network doesn't set.
+}
+
+// PlanHost is a host of the network.
+type PlanHost struct {
+	Name    string            `json:"name"`
+	User    string            `json:"user"`
+	Address string            `json:"address"`
+	Port    string            `json:"port"`
+	Bastion string            `json:"bastion,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+
+	Container   string `json:"container,omitempty"`    // Docker container (or container of Pod) the tasks are run in.
+	Pod         string `json:"pod,omitempty"`          // Kubernetes pod the tasks are run in, as <namespace>/<pod>.
+	KubeContext string `json:"kube_context,omitempty"` // Kubeconfig context of Pod, if not the current one.
+
+	Resolved        *PlanAddress `json:"resolved,omitempty"`         // Set by host_overrides or the network resolver.
+	BastionResolved *PlanAddress `json:"bastion_resolved,omitempty"` // Ditto for the bastion.
+
+	Key *PlanKey `json:"key,omitempty"` // Key offered first, nil if only ssh-agent and ~/.ssh/id_* keys are.
+}
+
+// PlanKey is the private key source of a host. The key itself is never
+// part of the plan.
+type PlanKey struct {
+	Source      string `json:"source"`                // "identity_key_env $DEPLOY_KEY", "identity_key_file <path>" or "identity_file <path>".
+	Fingerprint string `json:"fingerprint,omitempty"` // SHA256 fingerprint of identity_key_env and identity_key_file keys.
+}
+
+// PlanTunnel is a tunnel of the network, see Tunnel.
+type PlanTunnel struct {
+	Name   string `json:"name"`
+	Env    string `json:"env"`   // Env var of the local port.
+	Local  int    `json:"local"` // 0 if picked by the run.
+	Remote string `json:"remote"`
+	Via    string `json:"via"`
+}
+
+// PlanAddress is an address a host name was resolved to.
+type PlanAddress struct {
+	Address string `json:"address"`
+	By      string `json:"by"` // "host_overrides" or "resolver <ip:port>".
+}
+
+// PlanEnv is an env var exported before each command. Secret values
+// are masked.
+type PlanEnv struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PlanCommand is a command to be run.
+type PlanCommand struct {
+	Name       string   `json:"name"`
+	Desc       string   `json:"desc,omitempty"`
+	Local      bool     `json:"local,omitempty"`
+	LocalAlso  bool     `json:"local_also,omitempty"` // Groups start with the "local" pseudo-host.
+	Bastion    bool     `json:"bastion,omitempty"`
+	Once       bool     `json:"once,omitempty"`
+	Serial     int      `json:"serial,omitempty"`
+	RunOn      string   `json:"run_on,omitempty"` // Host label selector.
+	Build      string   `json:"build,omitempty"`  // Local build command.
+	Script     string   `json:"script,omitempty"` // Path of the script file.
+	ScriptArgs []string `json:"script_args,omitempty"`
+	ScriptsDir string   `json:"scripts_dir,omitempty"`
+	Scripts    []string `json:"scripts,omitempty"`  // Paths of the scripts_dir scripts, in order.
+	Use        []string `json:"use,omitempty"`      // Fragments prepended to run, the script and the scripts.
+	Run        string   `json:"run,omitempty"`      // Command text, or the script contents, along with the fragments.
+	Steps      []string `json:"steps,omitempty"`    // Steps of run: list.
+	Template   bool     `json:"template,omitempty"` // Run and Steps are rendered for each host, see TemplateData.
+
+	StepsContinueOnError bool         `json:"steps_continue_on_error,omitempty"`
+	Service              string       `json:"service,omitempty"` // Generated service action command.
+	Guards               []string     `json:"guards,omitempty"`  // Checks skipping the command per host, ie. "creates: /opt/app/.installed".
+	Env                  []PlanEnv    `json:"env,omitempty"`     // Command level pass_env vars.
+	CleanEnv             bool         `json:"clean_env,omitempty"`
+	Umask                string       `json:"umask,omitempty"`
+	Nice                 int          `json:"nice,omitempty"`
+	IONice               string       `json:"ionice,omitempty"`
+	CPULimit             string       `json:"cpu_limit,omitempty"`
+	Uploads              []PlanUpload `json:"uploads,omitempty"`
+	Groups               [][]string   `json:"groups"` // Host names processing the command at once, in order.
+
+	SerialDelay string `json:"serial_delay,omitempty"`
+	Splay       string `json:"splay,omitempty"`
+	Rate        string `json:"rate,omitempty"`
+	Estimate    string `json:"estimate,omitempty"` // Minimum duration by serial_delay and rate, ie. "4m30s".
+
+	Timeout     string `json:"timeout,omitempty"`
+	IdleTimeout string `json:"idle_timeout,omitempty"`
+	Output      string `json:"output,omitempty"` // Output mode, see Command.Output.
+
+	ChangedPaths []string `json:"changed_paths,omitempty"`
+	Changes      string   `json:"changes,omitempty"`     // Outcome of changed_paths, ie. "no changes to changed_paths since v1.4.0".
+	Skipped      bool     `json:"skipped,omitempty"`     // None of changed_paths changed or skipped by the user, the command isn't run.
+	SkipReason   string   `json:"skip_reason,omitempty"` // SkippedByUser, if skipped by Stackup.SkipCommands.
+
+	Defaults []string `json:"defaults,omitempty"` // "key: value" fields of defaults: command the command doesn't set.
+}
+
+// PlanUpload is a file copy operation of a command.
+type PlanUpload struct {
+	Src     string `json:"src"`
+	Dst     string `json:"dst"`
+	Exclude string `json:"exclude,omitempty"`
+	Atomic  string `json:"atomic,omitempty"` // "file" or "symlink".
+	Stamp   bool   `json:"stamp,omitempty"`  // Release metadata written into Dst.
+	Via     string `json:"via,omitempty"`    // Bastion relaying the upload to the hosts behind it.
+	Method  string `json:"method,omitempty"` // "scp", if not uploaded as TAR stream.
+	Verify  string `json:"verify,omitempty"` // "sha256", if the uploaded files are checked on the hosts.
+
+	GitTracked bool  `json:"git_tracked,omitempty"` // Only the files listed by git are uploaded.
+	Files      int   `json:"files,omitempty"`       // Number of the git_tracked files.
+	Size       int64 `json:"size,omitempty"`        // Total size of the git_tracked files, in bytes.
+}
+
+// secretNames are substrings of env var names, whose values are masked.
+var secretNames = []string{"PASSWORD", "PASSWD", "SECRET", "TOKEN", "API_KEY", "PRIVATE_KEY", "CREDENTIAL"}
+
+const mask = "****"
+
+// secrets collects values of secret env vars to be masked.
+type secrets []string
+
+func (s *secrets) add(env EnvList) {
+	for _, v := range env {
+		name := strings.ToUpper(v.Key)
+		for _, secret := range secretNames {
+			if strings.Contains(name, secret) && len(v.Value) >= 4 {
+				*s = append(*s, v.Value)
+				break
+			}
+		}
+	}
+}
+
+func (s secrets) mask(text string) string {
+	for _, value := range s {
+		text = strings.ReplaceAll(text, value, mask)
+	}
+	return text
+}
+
+func (s secrets) env(env EnvList) []PlanEnv {
+	vars := []PlanEnv{}
+	for _, v := range env {
+		vars = append(vars, PlanEnv{Name: v.Key, Value: s.mask(v.Value)})
+	}
+	return vars
+}
+
+// Plan returns the plan of running the commands on the network, without
+// connecting to any host. Values of env vars named like secrets, ie.
+// *PASSWORD* or *TOKEN*, are masked.
+func (sup *Stackup) Plan(name string, network *Network, envVars EnvList, commands ...*Command) (*Plan, error) {
+	cwd, err := sup.conf.BaseDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "resolving CWD failed")
+	}
+	env := envVars.AsExport()
+	release := newRelease(envVars)
+
+	var masked secrets
+	masked.add(envVars)
+
+	if err := network.checkHostsResolved(); err != nil {
+		return nil, err
+	}
+	if err := network.DNS.check(); err != nil {
+		return nil, err
+	}
+	if err := network.ExpandPods(context.Background()); err != nil {
+		return nil, err
+	}
+	warnings, err := sup.checkUploadDsts(network, envVars, commands)
+	if err != nil {
+		return nil, err
+	}
+	if err := sup.loadIdentityKeys(network); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		PlanVersion: PlanVersion,
+		Network:     name,
+		Hosts:       []PlanHost{},
+		Env:         masked.env(envVars),
+		Commands:    []PlanCommand{},
+
+		InventorySkew:  network.InventorySkew,
+		ConnectTimeout: network.ConnectTimeout,
+		Warnings:       warnings,
+		EmbedContext:   sup.conf.EmbedContext,
+		Defaults:       network.defaults,
+	}
+
+	var clients []Client
+	var bastions []string
+	hosts := network.Hosts
+	tunneled := network.Tunneled(commands)
+	if tunneled {
+		hosts = nil
+		for _, t := range network.Tunnels {
+			plan.Tunnels = append(plan.Tunnels, PlanTunnel{Name: t.Name, Env: t.EnvKey(), Local: t.Local, Remote: t.Remote, Via: t.via(network.Bastion)})
+			bastions = append(bastions, t.via(network.Bastion))
+		}
+		clients = append(clients, &LocalhostClient{host: &Host{Address: "localhost", KnownAs: LocalHostname}})
+	}
+	for _, host := range hosts {
+		bastion := host.jumpHost(network.Bastion)
+		if bastion != "" {
+			bastions = append(bastions, bastion)
+		}
+		planHost := PlanHost{
+			Name:    host.GetHostname(),
+			User:    host.User,
+			Address: host.Address,
+			Port:    host.Port,
+			Bastion: bastion,
+			Labels:  host.Labels,
+
+			Container:   host.Container,
+			KubeContext: host.KubeContext,
+		}
+		if host.Pod != "" {
+			planHost.Pod = host.Namespace + "/" + host.Pod
+		}
+		switch {
+		case host.identityKey != nil:
+			planHost.Key = &PlanKey{Source: host.identityKey.source, Fingerprint: host.identityKey.fingerprint()}
+		case host.IdentityFile != "":
+			planHost.Key = &PlanKey{Source: "identity_file " + host.IdentityFile}
+		}
+		if host.Address != "localhost" {
+			planHost.Resolved, err = network.DNS.planAddress(host.Address, bastion == "")
+			if err != nil {
+				return nil, errors.Wrap(err, host.GetHostname())
+			}
+		}
+		if bastion != "" {
+			bastionHost, err := sup.conf.resolver.NewHost(bastion, HostDefaults{})
+			if err != nil {
+				return nil, err
+			}
+			planHost.BastionResolved, err = network.DNS.planAddress(bastionHost.Address, true)
+			if err != nil {
+				return nil, errors.Wrap(err, "bastion "+bastion)
+			}
+		}
+		plan.Hosts = append(plan.Hosts, planHost)
+		clients = append(clients, &LocalhostClient{host: host})
+	}
+	var bastionClients []Client
+	for _, bastion := range removeDuplicates(bastions) {
+		bastionClients = append(bastionClients, &LocalhostClient{host: &Host{KnownAs: bastion}})
+	}
+	if network.ConnectRate != "" {
+		dials := len(bastionClients)
+		for _, host := range hosts {
+			if host.Address != "localhost" {
+				dials++
+			}
+		}
+		estimate, err := network.ConnectEstimate(dials)
+		if err != nil {
+			return nil, err
+		}
+		plan.ConnectRate, plan.ConnectEstimate = network.ConnectRate, estimate.String()
+	}
+
+	for _, cmd := range commands {
+		if err := cmd.parseRunOn(); err != nil {
+			return nil, err
+		}
+		passEnv, err := PassEnv(cmd.PassEnv, cmd.PassEnvRequired)
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		cmdMasked := append(secrets{}, masked...)
+		cmdMasked.add(passEnv)
+
+		c := PlanCommand{
+			Name:      cmd.Name,
+			Desc:      cmd.Desc,
+			Local:     cmd.Local,
+			LocalAlso: cmd.LocalAlso,
+			Bastion:   cmd.Bastion,
+			Once:      cmd.Once,
+			Serial:    cmd.Serial,
+			RunOn:     cmd.RunOn,
+			Use:       cmd.Use,
+			Guards:    cmd.Guards.Reasons(),
+			Groups:    [][]string{},
+
+			ChangedPaths: cmd.ChangedPaths,
+			Defaults:     cmd.defaults,
+		}
+		check, err := sup.checkChanged(cmd, name)
+		if err != nil {
+			return nil, err
+		}
+		c.Changes, c.Skipped = check.note, check.skip
+		if sup.skipped[cmd.Name] {
+			c.Skipped, c.SkipReason = true, SkippedByUser
+		}
+		if cmd.Local {
+			// Ignored, see Supfile.checkScheduling.
+			c.Once, c.Serial = false, 0
+		}
+		if cmd.Run != "" {
+			run, err := sup.conf.useScript(cmd, cmd.Run)
+			if err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+			c.Run = cmdMasked.mask(run)
+		}
+		for _, step := range cmd.Steps {
+			c.Steps = append(c.Steps, cmdMasked.mask(step))
+		}
+		c.StepsContinueOnError = cmd.StepsContinueOnError
+		c.Template = cmd.Template
+		if !cmd.Local {
+			sanitize := network.Sanitize.Override(cmd.Sanitize)
+			c.CleanEnv, c.Umask = sanitize.cleanEnv(), sanitize.Umask
+			if err := cmd.Limits.check(); err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+			c.Nice, c.IONice, c.CPULimit = cmd.Nice, cmd.IONice, cmd.CPULimit
+		}
+		if len(passEnv) > 0 {
+			c.Env = cmdMasked.env(passEnv)
+		}
+		if cmd.Build != nil {
+			c.Build = cmdMasked.mask(cmd.Build.Run)
+		}
+		if cmd.Script != "" {
+			c.Script = resolve(cwd, cmd.Script)
+			data, err := os.ReadFile(c.Script)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't read script")
+			}
+			script, err := sup.conf.useScript(cmd, string(data))
+			if err != nil {
+				return nil, errors.Wrapf(err, "script %v", cmd.Script)
+			}
+			c.Run = cmdMasked.mask(script)
+			args, err := release.scriptArgs(cmd)
+			if err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+			for _, arg := range args {
+				c.ScriptArgs = append(c.ScriptArgs, cmdMasked.mask(arg))
+			}
+		}
+		if cmd.Service != nil {
+			script, err := cmd.Service.Script()
+			if err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+			c.Service = script
+		}
+		if cmd.ScriptsDir != "" {
+			c.ScriptsDir = cmd.ScriptsDir
+			c.Scripts, err = cmd.scriptsDirFiles(cwd)
+			if err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+		}
+		for _, upload := range cmd.Upload {
+			src, err := ResolveLocalPath(cwd, upload.Src, env)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			if err := upload.checkAtomic(); err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			dst, err := release.expand("dst", upload.Dst)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			planUpload := PlanUpload{Src: resolve(cwd, src), Dst: dst, Exclude: upload.Exc, Atomic: upload.AtomicDir, Stamp: upload.Stamp, Verify: upload.Verify}
+			if upload.Atomic {
+				planUpload.Atomic = "file"
+			}
+			if upload.Via == UploadViaBastion {
+				planUpload.Via = network.Bastion
+			}
+			if upload.Method == UploadMethodSCP {
+				planUpload.Method = upload.Method
+			}
+			if cmd.gitTracked(upload) {
+				files, err := gitFiles(cwd, src, upload.IncludeUntracked, upload.Exc)
+				if err != nil {
+					return nil, errors.Wrap(err, "upload: "+upload.Src)
+				}
+				planUpload.GitTracked, planUpload.Files, planUpload.Size = true, len(files), filesSize(cwd, src, files)
+			}
+			c.Uploads = append(c.Uploads, planUpload)
+		}
+
+		cmdClients := clients
+		if cmd.Bastion {
+			cmdClients = bastionClients
+		}
+		if cmd.LocalAlso {
+			c.Groups = append(c.Groups, []string{LocalHostname})
+		}
+		if len(cmdClients) > 0 {
+			for _, group := range clientGroups(cmd, cmdClients) {
+				var names []string
+				for _, client := range group {
+					names = append(names, clientHostname(client))
+				}
+				c.Groups = append(c.Groups, names)
+			}
+		}
+		c.Splay = cmd.Splay
+		c.Timeout, c.IdleTimeout = cmd.Timeout, cmd.IdleTimeout
+		c.Output = cmd.Output
+		if cmd.SerialDelay != "" || cmd.Rate != "" {
+			if err := cmd.Pacing.check(); err != nil {
+				return nil, errors.Wrap(err, cmd.Name)
+			}
+			c.SerialDelay, c.Rate = cmd.SerialDelay, cmd.Rate
+			groups := make([]int, len(c.Groups))
+			for i, group := range c.Groups {
+				groups[i] = len(group)
+			}
+			c.Estimate = cmd.Pacing.Estimate(groups, c.steps(cmd)).String()
+		}
+		plan.Commands = append(plan.Commands, c)
+	}
+
+	return plan, nil
+}
+
+// steps returns the number of tasks each group of hosts runs in turn:
+// the uploads, the scripts and the run.
+func (c PlanCommand) steps(cmd *Command) int {
+	steps := len(c.Uploads)
+	if cmd.Build != nil && len(cmd.Build.Artifacts) > 0 {
+		steps++ // Upload of the build artifacts.
+	}
+	if c.Script != "" {
+		steps++
+	}
+	if len(c.Scripts) > 0 {
+		steps++
+	}
+	if (c.Run != "" && c.Script == "") || len(c.Steps) > 0 || c.Service != "" {
+		steps++
+	}
+	return steps
+}
+
+// WriteText writes the plan in human readable form.
+func (p *Plan) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Network: %v\n", p.Network)
+	fmt.Fprintf(&b, "Hosts:\n")
+	for _, host := range p.Hosts {
+		if host.Pod != "" {
+			fmt.Fprintf(&b, "- %v (pod %v", host.Name, host.Pod)
+		} else {
+			fmt.Fprintf(&b, "- %v (%v@%v:%v", host.Name, host.User, host.Address, host.Port)
+		}
+		if host.Resolved != nil {
+			fmt.Fprintf(&b, " = %v by %v", host.Resolved.Address, host.Resolved.By)
+		}
+		if host.Container != "" {
+			fmt.Fprintf(&b, " container %v", host.Container)
+		}
+		if host.KubeContext != "" {
+			fmt.Fprintf(&b, " context %v", host.KubeContext)
+		}
+		if host.Bastion != "" {
+			fmt.Fprintf(&b, " via %v", host.Bastion)
+			if host.BastionResolved != nil {
+				fmt.Fprintf(&b, " = %v by %v", host.BastionResolved.Address, host.BastionResolved.By)
+			}
+		}
+		if host.Key != nil {
+			fmt.Fprintf(&b, " key %v", host.Key.Source)
+			if host.Key.Fingerprint != "" {
+				fmt.Fprintf(&b, " %v", host.Key.Fingerprint)
+			}
+		}
+		fmt.Fprintf(&b, ")\n")
+	}
+	if len(p.Tunnels) > 0 {
+		fmt.Fprintf(&b, "Tunnels:\n")
+		for _, t := range p.Tunnels {
+			local := "127.0.0.1:<free port>"
+			if t.Local != 0 {
+				local = fmt.Sprintf("127.0.0.1:%d", t.Local)
+			}
+			fmt.Fprintf(&b, "- %v %v -> %v via %v ($%v)\n", t.Name, local, t.Remote, t.Via, t.Env)
+		}
+	}
+	if p.ConnectRate != "" {
+		fmt.Fprintf(&b, "Connect rate: %v, estimated %v\n", p.ConnectRate, p.ConnectEstimate)
+	}
+	if p.ConnectTimeout != "" {
+		fmt.Fprintf(&b, "Connect timeout: %v\n", p.ConnectTimeout)
+	}
+	if !p.InventorySkew.Empty() {
+		fmt.Fprintf(&b, "Inventory skew (- hosts: only, + inventory only):\n")
+		for _, host := range p.InventorySkew.StaticOnly {
+			fmt.Fprintf(&b, "- %v\n", host)
+		}
+		for _, host := range p.InventorySkew.InventoryOnly {
+			fmt.Fprintf(&b, "+ %v\n", host)
+		}
+	}
+	if len(p.Defaults) > 0 {
+		fmt.Fprintf(&b, "Network defaults: %v\n", strings.Join(p.Defaults, ", "))
+	}
+	if p.EmbedContext {
+		fmt.Fprintf(&b, "Embed context: run ID, version, network, command, user, host, time and Supfile SHA256\n")
+	}
+	for _, w := range p.Warnings {
+		fmt.Fprintf(&b, "%v\n", w)
+	}
+	fmt.Fprintf(&b, "Commands:\n")
+	for _, cmd := range p.Commands {
+		fmt.Fprintf(&b, "- %v\n", cmd.Name)
+		if cmd.SkipReason != "" {
+			fmt.Fprintf(&b, "    skipped (%v)\n", cmd.SkipReason)
+		}
+		if len(cmd.Defaults) > 0 {
+			fmt.Fprintf(&b, "    defaults: %v\n", strings.Join(cmd.Defaults, ", "))
+		}
+		if len(cmd.ChangedPaths) > 0 {
+			status := "runs"
+			if cmd.Skipped && cmd.SkipReason == "" {
+				status = "skipped"
+			}
+			fmt.Fprintf(&b, "    changed_paths: %v (%v, %v)\n", strings.Join(cmd.ChangedPaths, ", "), status, cmd.Changes)
+		}
+		if cmd.Build != "" {
+			fmt.Fprintf(&b, "    build: %v\n", cmd.Build)
+		}
+		for _, upload := range cmd.Uploads {
+			fmt.Fprintf(&b, "    upload: %v -> %v", upload.Src, upload.Dst)
+			if upload.Atomic != "" {
+				fmt.Fprintf(&b, " (atomic %v)", upload.Atomic)
+			}
+			if upload.Stamp {
+				fmt.Fprintf(&b, " (stamp)")
+			}
+			if upload.Via != "" {
+				fmt.Fprintf(&b, " (via %v)", upload.Via)
+			}
+			if upload.Method != "" {
+				fmt.Fprintf(&b, " (%v)", upload.Method)
+			}
+			if upload.Verify != "" {
+				fmt.Fprintf(&b, " (verify %v)", upload.Verify)
+			}
+			if upload.GitTracked {
+				fmt.Fprintf(&b, " (git tracked: %d files, %v)", upload.Files, formatSize(upload.Size))
+			}
+			fmt.Fprintf(&b, "\n")
+		}
+		if cmd.ScriptsDir != "" && len(cmd.Scripts) == 0 {
+			fmt.Fprintf(&b, "    scripts_dir: %v has no scripts\n", cmd.ScriptsDir)
+		}
+		for _, script := range cmd.Scripts {
+			fmt.Fprintf(&b, "    script: %v\n", script)
+		}
+		if len(cmd.Use) > 0 {
+			fmt.Fprintf(&b, "    use: %v\n", strings.Join(cmd.Use, ", "))
+		}
+		if len(cmd.ScriptArgs) > 0 {
+			args := make([]string, len(cmd.ScriptArgs))
+			for i, arg := range cmd.ScriptArgs {
+				args[i] = quoteScriptArg(arg)
+			}
+			fmt.Fprintf(&b, "    script_args: %v\n", strings.Join(args, " "))
+		}
+		if cmd.Run != "" || len(cmd.Steps) > 0 {
+			kind := "run"
+			if cmd.Local {
+				kind = "local"
+			}
+			if cmd.CleanEnv {
+				fmt.Fprintf(&b, "    clean_env: true\n")
+			}
+			if cmd.Umask != "" {
+				fmt.Fprintf(&b, "    umask: %v\n", cmd.Umask)
+			}
+			if cmd.Template {
+				fmt.Fprintf(&b, "    template: rendered for each host\n")
+			}
+			var limits []string
+			if cmd.Nice != 0 {
+				limits = append(limits, fmt.Sprintf("nice %v", cmd.Nice))
+			}
+			if cmd.IONice != "" {
+				limits = append(limits, "ionice "+cmd.IONice)
+			}
+			if cmd.CPULimit != "" {
+				limits = append(limits, "cpu_limit "+cmd.CPULimit)
+			}
+			if len(limits) > 0 {
+				fmt.Fprintf(&b, "    limits: %v\n", strings.Join(limits, ", "))
+			}
+			if cmd.Run != "" {
+				fmt.Fprintf(&b, "    %v: %v\n", kind, strings.ReplaceAll(strings.TrimSpace(cmd.Run), "\n", "\n        "))
+			}
+			for i, step := range cmd.Steps {
+				fmt.Fprintf(&b, "    %v step %v/%v: %v\n", kind, i+1, len(cmd.Steps), strings.ReplaceAll(strings.TrimSpace(step), "\n", "\n        "))
+			}
+			if cmd.StepsContinueOnError {
+				fmt.Fprintf(&b, "    steps_continue_on_error: true\n")
+			}
+		}
+		if cmd.Service != "" {
+			fmt.Fprintf(&b, "    service: %v\n", strings.ReplaceAll(cmd.Service, "\n", "\n        "))
+		}
+		if cmd.RunOn != "" {
+			fmt.Fprintf(&b, "    run_on: %v\n", cmd.RunOn)
+		}
+		for _, guard := range cmd.Guards {
+			fmt.Fprintf(&b, "    guard: %v\n", guard)
+		}
+		if cmd.Splay != "" {
+			fmt.Fprintf(&b, "    splay: %v\n", cmd.Splay)
+		}
+		if cmd.Timeout != "" {
+			fmt.Fprintf(&b, "    timeout: %v\n", cmd.Timeout)
+		}
+		if cmd.IdleTimeout != "" {
+			fmt.Fprintf(&b, "    idle_timeout: %v\n", cmd.IdleTimeout)
+		}
+		if cmd.Output != "" {
+			fmt.Fprintf(&b, "    output: %v\n", cmd.Output)
+		}
+		if cmd.Estimate != "" {
+			var pacing []string
+			if cmd.SerialDelay != "" {
+				pacing = append(pacing, "serial_delay "+cmd.SerialDelay)
+			}
+			if cmd.Rate != "" {
+				pacing = append(pacing, "rate "+cmd.Rate)
+			}
+			fmt.Fprintf(&b, "    pacing: %v, estimated %v\n", strings.Join(pacing, ", "), cmd.Estimate)
+		}
+		if len(cmd.Groups) == 0 {
+			fmt.Fprintf(&b, "    hosts: none, skipped\n")
+		}
+		for i, group := range cmd.Groups {
+			fmt.Fprintf(&b, "    %v. %v\n", i+1, strings.Join(group, ", "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// formatSize returns the size in bytes in a human readable unit, ie. "1.5 MiB".
+func formatSize(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, unit := float64(size)/1024, 0
+	for value >= 1024 && unit < 3 {
+		value, unit = value/1024, unit+1
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGT"[unit])
+}
@@ -0,0 +1,128 @@
+package sup
+
+import (
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PrefixData is the data of prefix_format templates, ie.
+// `{{.Time "15:04:05"}} {{.Host}} | `.
+type PrefixData struct {
+	Host    string // Host as specified in Supfile, or its alias.
+	Address string
+	User    string
+	Network string
+	Command string
+
+	time time.Time
+}
+
+// Time formats the time of the output line by layout, see time.Format.
+func (d PrefixData) Time(layout string) string {
+	return d.time.Format(layout)
+}
+
+// parsePrefixFormat parses prefix_format template, rendering it once so
+// unknown fields fail before any output.
+func parsePrefixFormat(format string) (*template.Template, error) {
+	t, err := template.New("prefix_format").Parse(format)
+	if err != nil {
+		return nil, errors.Wrap(err, "prefix_format")
+	}
+	if err := t.Execute(io.Discard, PrefixData{}); err != nil {
+		return nil, errors.Wrap(err, "prefix_format")
+	}
+	return t, nil
+}
+
+// PrefixFormat sets template of the output prefixes, see PrefixData. An
+// empty format disables the prefixes.
+func (sup *Stackup) PrefixFormat(format string) error {
+	t, err := parsePrefixFormat(format)
+	if err != nil {
+		return err
+	}
+	sup.prefixFormat = t
+	if format == "" {
+		sup.prefixFormat = nil
+	}
+	sup.prefixFormatSet = true
+	return nil
+}
+
+// clientPrefix returns the client's prefix of the command's output at
+// time t, colored, and its length without the colors.
+func (sup *Stackup) clientPrefix(c Client, command string, t time.Time) (string, int) {
+	if !sup.prefixFormatSet {
+		return c.Prefix()
+	}
+	if sup.prefixFormat == nil {
+		return "", 0
+	}
+	data := PrefixData{Network: sup.network, Command: command, time: t}
+	if host := clientHost(c); host != nil {
+		data.Host, data.Address, data.User = host.GetHostname(), host.Address, host.User
+	}
+	var b strings.Builder
+	if err := sup.prefixFormat.Execute(&b, data); err != nil {
+		return c.Prefix()
+	}
+	return colorize(clientColor(c), b.String()), b.Len()
+}
+
+// paddedPrefix returns the client's prefix of the command's output at time
+// t, left padded to width, or empty string if the prefixes are disabled.
+func (sup *Stackup) paddedPrefix(c Client, command string, t time.Time, width int) string {
+	if !sup.prefix {
+		return ""
+	}
+	prefix, prefixLen := sup.clientPrefix(c, command, t)
+	if prefixLen == 0 {
+		return ""
+	}
+	if prefixLen < width {
+		prefix = strings.Repeat(" ", width-prefixLen) + prefix
+	}
+	return prefix
+}
+
+// linePrefix returns function rendering the client's prefix of each line
+// of the command's output, so {{.Time}} is the time of the line, or nil if
+// prefix_format isn't set.
+func (sup *Stackup) linePrefix(c Client, command string, width int) func(time.Time) string {
+	if !sup.prefix || sup.prefixFormat == nil {
+		return nil
+	}
+	return func(t time.Time) string {
+		return sup.paddedPrefix(c, command, t, width)
+	}
+}
+
+// prefixWidth returns the longest prefix of the client's output of the
+// commands.
+func (sup *Stackup) prefixWidth(c Client, commands []*Command) int {
+	width := 0
+	for _, cmd := range commands {
+		if _, prefixLen := sup.clientPrefix(c, cmd.Name, time.Now()); prefixLen > width {
+			width = prefixLen
+		}
+	}
+	return width
+}
+
+// clientColor returns color of the client's prefix.
+func clientColor(c Client) string {
+	switch c := c.(type) {
+	case *SSHClient:
+		return c.color
+	case *OpenSSHClient:
+		return c.color
+	case *LocalhostClient:
+		return c.color
+	}
+	return ""
+}
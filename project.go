@@ -0,0 +1,121 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SupfileSet is a set of projects defined as YAML documents separated
+// by "---" in a single Supfile. A single-document Supfile is a set of
+// one project, which doesn't need to be named.
+type SupfileSet struct {
+	Projects []*Supfile
+}
+
+// ErrUnknownProject is returned by SupfileSet.Get, if there's no project
+// with the given name, or no name was given for a multi-project Supfile.
+type ErrUnknownProject struct {
+	Name     string
+	Projects []string
+}
+
+func (e ErrUnknownProject) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("Supfile defines multiple projects, select one with -p: %v", strings.Join(e.Projects, ", "))
+	}
+	return fmt.Sprintf("unknown project %q, available projects: %v", e.Name, strings.Join(e.Projects, ", "))
+}
+
+// NewSupfileSet parses Supfile containing one or more YAML documents,
+// each of them parsed by NewSupfile. Documents of a multi-document
+// Supfile need unique name: keys.
+func NewSupfileSet(data []byte) (*SupfileSet, error) {
+	return NewSupfileSetWithOptions(data, ParseOptions{})
+}
+
+// NewSupfileSetWithOptions is like NewSupfileSet, but parses the documents
+// by NewSupfileWithOptions.
+func NewSupfileSetWithOptions(data []byte, opts ParseOptions) (*SupfileSet, error) {
+	docs, offsets := splitDocuments(data)
+	if len(docs) <= 1 || detectFormat(data, opts.Format) != FormatYAML {
+		conf, err := NewSupfileWithOptions(data, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &SupfileSet{Projects: []*Supfile{conf}}, nil
+	}
+
+	set := &SupfileSet{}
+	seen := map[string]int{}
+	for i, doc := range docs {
+		conf, err := NewSupfileWithOptions(doc, opts)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", offsets[i]+1, err)
+		}
+		if conf.Name == "" {
+			return nil, fmt.Errorf("line %v: project is missing name field", offsets[i]+1)
+		}
+		if line, ok := seen[conf.Name]; ok {
+			return nil, fmt.Errorf("line %v: project %q is already defined on line %v", offsets[i]+1, conf.Name, line)
+		}
+		seen[conf.Name] = offsets[i] + 1
+
+		// Make the warnings point to lines of the whole Supfile.
+		for j := range conf.Warnings {
+			if conf.Warnings[j].Line > 0 {
+				conf.Warnings[j].Line += offsets[i]
+			}
+		}
+		set.Projects = append(set.Projects, conf)
+	}
+	return set, nil
+}
+
+// Names returns names of the projects.
+func (s *SupfileSet) Names() []string {
+	var names []string
+	for _, conf := range s.Projects {
+		names = append(names, conf.Name)
+	}
+	return names
+}
+
+// Get returns the project by name. Name may be empty for single-project
+// Supfile.
+func (s *SupfileSet) Get(name string) (*Supfile, error) {
+	if name == "" && len(s.Projects) == 1 {
+		return s.Projects[0], nil
+	}
+	for _, conf := range s.Projects {
+		if name != "" && conf.Name == name {
+			return conf, nil
+		}
+	}
+	return nil, ErrUnknownProject{name, s.Names()}
+}
+
+// splitDocuments splits YAML data by "---" document separators and returns
+// the non-empty documents along with their line offsets in data.
+func splitDocuments(data []byte) (docs [][]byte, offsets []int) {
+	lines := strings.SplitAfter(string(data), "\n")
+	start := 0
+	flush := func(end int) {
+		doc := strings.Join(lines[start:end], "")
+		for _, line := range lines[start:end] {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				docs = append(docs, []byte(doc))
+				offsets = append(offsets, start)
+				return
+			}
+		}
+	}
+	for i, line := range lines {
+		if strings.TrimRight(line, " \t\r\n") == "---" {
+			flush(i)
+			start = i + 1
+		}
+	}
+	flush(len(lines))
+	return docs, offsets
+}
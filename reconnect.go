@@ -0,0 +1,139 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Reconnect configures how hosts of an expect_disconnect command
+// are waited for to come back, ie. after a reboot.
+type Reconnect struct {
+	Timeout  string `yaml:"timeout,omitempty"`  // Default 5m.
+	Interval string `yaml:"interval,omitempty"` // Default 10s.
+}
+
+// ErrNotReturned is returned when a host disconnected by an
+// expect_disconnect command couldn't be reconnected in time.
+type ErrNotReturned struct {
+	Host    string
+	Timeout time.Duration
+	Reason  error
+}
+
+func (e ErrNotReturned) Error() string {
+	return fmt.Sprintf("%v did not return after reboot within %v: %v", e.Host, e.Timeout, e.Reason)
+}
+
+// reconnecter is implemented by clients which can re-dial their host.
+type reconnecter interface {
+	Reconnect() error
+}
+
+// isDisconnect reports whether the command failed because the connection
+// was closed, rather than exiting with non-zero status.
+func isDisconnect(err error) bool {
+	switch e := err.(type) {
+	case *ssh.ExitMissingError:
+		return true
+	case *ssh.ExitError:
+		return e.Signal() != ""
+	case ErrOpenSSHExit:
+		return e.Status == 255
+	}
+	return err == io.EOF
+}
+
+// reconnect waits for the clients to come back after an expect_disconnect
+// command. Clients are reconnected in parallel, polling every interval.
+func (sup *Stackup) reconnect(cmd *Command, clients []Client, maxLen int) error {
+	var conf Reconnect
+	if cmd.Reconnect != nil {
+		conf = *cmd.Reconnect
+	}
+	timeout, err := parseDuration(conf.Timeout, 5*time.Minute)
+	if err != nil {
+		return fmt.Errorf("%v: reconnect.timeout: %v", cmd.Name, err)
+	}
+	interval, err := parseDuration(conf.Interval, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("%v: reconnect.interval: %v", cmd.Name, err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed bool
+	for _, c := range clients {
+		r, ok := c.(reconnecter)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(c Client, r reconnecter) {
+			defer wg.Done()
+
+			host := clientHostname(c)
+			sup.emit(Event{Type: HostConnecting, Host: host})
+			deadline := time.Now().Add(timeout)
+			var err error
+			for {
+				// Give the host some time to go down first.
+				time.Sleep(interval)
+				if err = r.Reconnect(); err == nil || time.Now().After(deadline) {
+					break
+				}
+			}
+			if err != nil {
+				err = ErrNotReturned{host, timeout, err}
+			}
+			sup.emit(Event{Type: HostConnected, Host: host, Err: err})
+			if err == nil {
+				return
+			}
+
+			prefix := sup.paddedPrefix(c, cmd.Name, time.Now(), maxLen)
+			sup.errorf("%s%v\n", prefix, err)
+			mu.Lock()
+			failed = true
+			mu.Unlock()
+		}(c, r)
+	}
+	wg.Wait()
+
+	if failed {
+		return ErrExitStatus{1}
+	}
+	return nil
+}
+
+// taskClients returns distinct clients of the tasks.
+func taskClients(tasks []*Task) []Client {
+	seen := map[Client]bool{}
+	var clients []Client
+	for _, task := range tasks {
+		for _, c := range task.Clients {
+			if !seen[c] {
+				seen[c] = true
+				clients = append(clients, c)
+			}
+		}
+	}
+	return clients
+}
+
+// Reconnect closes the connection and dials the host again.
+func (c *SSHClient) Reconnect() error {
+	if c.connOpened {
+		c.Close()
+	}
+	return c.ConnectWith(c.dialer)
+}
+
+// Reconnect checks the host is reachable again.
+func (c *OpenSSHClient) Reconnect() error {
+	c.running = false
+	return c.Connect()
+}
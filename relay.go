@@ -0,0 +1,175 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// UploadViaBastion is the Upload.Via value relaying the upload through the
+// network bastion.
+const UploadViaBastion = "bastion"
+
+// checkVia validates the via option.
+func (u Upload) checkVia() error {
+	if u.Via != "" && u.Via != UploadViaBastion {
+		return fmt.Errorf("unknown via %q, expected %q", u.Via, UploadViaBastion)
+	}
+	return nil
+}
+
+// relaysUploads reports whether any upload of the commands is via bastion.
+func relaysUploads(commands []*Command) bool {
+	for _, cmd := range commands {
+		for _, upload := range cmd.Upload {
+			if upload.Via == UploadViaBastion {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// relay is the network bastion relaying Upload.Via uploads: the TAR file
+// is uploaded to the bastion once and copied from there to each host by
+// scp, so it crosses the link to the bastion only once. The bastion must
+// be able to ssh into the hosts, ie. by ForwardAgent of the openssh
+// transport, and know their host keys.
+type relay struct {
+	client  Client
+	bastion string
+	dns     DNS
+
+	local  []string // Local TAR files.
+	remote []string // Copies on the bastion.
+}
+
+// relayed splits the groups into the hosts behind the relay bastion and
+// the rest, which are uploaded to directly. Both keep the group indexes.
+func (r *relay) relayed(groups [][]Client) (relayed, direct [][]Client) {
+	relayed = make([][]Client, len(groups))
+	direct = make([][]Client, len(groups))
+	for i, group := range groups {
+		for _, c := range group {
+			// Containers are uploaded to directly, the relayed TAR file
+			// is on their host, out of their reach.
+			if host := clientHost(c); host != nil && host.Container == "" && host.jumpHost(r.bastion) == r.bastion {
+				relayed[i] = append(relayed[i], c)
+			} else {
+				direct[i] = append(direct[i], c)
+			}
+		}
+	}
+	return relayed, direct
+}
+
+// tasks returns tasks uploading the TAR of src to the bastion, copying it
+// to the hosts of groups and extracting it on each host by run, once its
+// checksum is verified. A host missing its copy fails on its own.
+func (r *relay) tasks(groups [][]Client, cwd, src, exclude string, files []string, run string) ([]*Task, error) {
+	var hosts []*Host
+	for _, group := range groups {
+		for _, c := range group {
+			hosts = append(hosts, clientHost(c))
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	file, err := r.tar(cwd, src, exclude, files)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := fileSHA256(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "via bastion")
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "via bastion")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "via bastion")
+	}
+	tmp := "/tmp/" + filepath.Base(file)
+	r.remote = append(r.remote, tmp)
+
+	// Copies to the hosts run in parallel. Failures are only reported,
+	// the hosts fail on the checksum instead.
+	var fanOut strings.Builder
+	for _, host := range hosts {
+		addr, _, err := r.dns.resolve(host.Address, false)
+		if err != nil {
+			return nil, errors.Wrap(err, host.GetHostname())
+		}
+		if strings.Contains(addr, ":") {
+			addr = "[" + addr + "]"
+		}
+		if host.User != "" {
+			addr = host.User + "@" + addr
+		}
+		fmt.Fprintf(&fanOut, "{ scp -q -o BatchMode=yes -P %s %s %s || echo %s >&2; } & ",
+			ShellQuote(host.Port), tmp, ShellQuote(addr+":"+tmp), ShellQuote("via bastion: copy to "+host.GetHostname()+" failed"))
+	}
+	fanOut.WriteString("wait")
+
+	extract := fmt.Sprintf(`sup_relay=%s; trap 'rm -f "$sup_relay"' EXIT; `+
+		`sup_sum=$(sha256sum "$sup_relay" 2>/dev/null || shasum -a 256 "$sup_relay" 2>/dev/null); `+
+		`if [ "${sup_sum%%%% *}" != %s ]; then echo %s >&2; exit 1; fi; { %s; } < "$sup_relay"`,
+		tmp, sum, ShellQuote("via bastion: "+tmp+" is missing or its checksum doesn't match"), run)
+
+	tasks := []*Task{
+		{Run: "cat > " + tmp, Input: f, Clients: []Client{r.client}, Kind: TaskUpload, Size: info.Size()},
+		{Run: fanOut.String(), Clients: []Client{r.client}, Kind: TaskUpload},
+	}
+	for i, group := range groups {
+		if len(group) > 0 {
+			tasks = append(tasks, &Task{Run: extract, Clients: group, Kind: TaskUpload, Batch: i})
+		}
+	}
+	return tasks, nil
+}
+
+// tar creates a local TAR file of src, as uploaded by newTarStreamReader.
+func (r *relay) tar(cwd, src, exclude string, files []string) (string, error) {
+	f, err := os.CreateTemp("", "sup-relay-*.tar.gz")
+	if err != nil {
+		return "", errors.Wrap(err, "tar: creating temp file failed")
+	}
+	defer f.Close()
+	r.local = append(r.local, f.Name())
+
+	cmd := localTarCmd(cwd, src, exclude, files)
+	cmd.Stdout = f
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrap(err, "tar: creating temp file failed")
+	}
+	return f.Name(), nil
+}
+
+// cleanup removes the local TAR files and their copies on the bastion.
+func (r *relay) cleanup() error {
+	for _, file := range r.local {
+		os.Remove(file)
+	}
+	if len(r.remote) == 0 {
+		return nil
+	}
+	task := &Task{Run: "rm -f " + strings.Join(r.remote, " "), Kind: TaskUpload}
+	if err := r.client.Run(task); err != nil {
+		return errors.Wrap(err, "via bastion: removing "+strings.Join(r.remote, ", ")+" failed")
+	}
+	go io.Copy(io.Discard, r.client.Stdout())
+	go io.Copy(io.Discard, r.client.Stderr())
+	if err := r.client.Wait(); err != nil {
+		return errors.Wrap(err, "via bastion: removing "+strings.Join(r.remote, ", ")+" failed")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package sup_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+// TestScheduling runs a command of each scheduling on five fake hosts,
+// checking how many hosts it's started on and run by at once. The hosts
+// are scheduled in the order they connect in, so which ones isn't checked.
+func TestScheduling(t *testing.T) {
+	hosts := []string{"web1", "web2", "web3", "web4", "web5"}
+	for _, tt := range []struct {
+		name     string
+		command  string // Fields of the deploy command.
+		fail     string // Host failing the command, if any.
+		started  int    // Hosts the command is started on, 0 if it stops after the failure.
+		parallel int    // Max hosts running the command at once.
+		err      bool
+	}{
+		{name: "all at once", started: 5, parallel: 5},
+		{name: "serial", command: "serial: 2", started: 5, parallel: 2},
+		{name: "serial 1", command: "serial: 1", started: 5, parallel: 1},
+		{name: "once", command: "once: true", started: 1, parallel: 1},
+		{name: "serial failure", command: "serial: 2", fail: "web2", parallel: 2, err: true},
+		{name: "serial 1 failure", command: "serial: 1", fail: "web2", parallel: 1, err: true},
+		{
+			name:     "serial max_failures",
+			command:  "serial: 2\n    max_failures: 1",
+			fail:     "web2",
+			started:  5,
+			parallel: 2,
+			err:      true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := sup.NewSupfile([]byte(fmt.Sprintf(`
+version: 0.5
+networks:
+  production:
+    hosts: [web1, web2, web3, web4, web5]
+commands:
+  deploy:
+    run: ./deploy.sh
+    %v
+`, tt.command)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fakes []suptest.FakeHost
+			for _, host := range hosts {
+				response := suptest.Response{Delay: 20 * time.Millisecond}
+				if host == tt.fail {
+					response.Exit = 1
+				}
+				fakes = append(fakes, suptest.FakeHost{Host: host, Responses: []suptest.Response{response}})
+			}
+			report, err := suptest.Run(conf, "production", suptest.NewFakeNetwork(fakes...), "deploy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != (report.Err != nil) {
+				t.Fatalf("got error %v, want error %v\n%v", report.Err, tt.err, report.Stderr)
+			}
+
+			started, running, parallel := 0, 0, 0
+			var failed []string
+			for _, e := range report.Events {
+				switch e.Type {
+				case sup.CommandStarted:
+					if len(failed) > 0 && tt.started == 0 {
+						t.Errorf("%v started after %v failed", e.Host, failed)
+					}
+					started++
+					if running++; running > parallel {
+						parallel = running
+					}
+				case sup.CommandFinished:
+					if e.Err != nil {
+						failed = append(failed, e.Host)
+					}
+					running--
+				}
+			}
+			if tt.started != 0 && started != tt.started {
+				t.Errorf("started on %v hosts, want %v", started, tt.started)
+			}
+			if tt.fail != "" && fmt.Sprint(failed) != fmt.Sprint([]string{tt.fail}) {
+				t.Errorf("failed on %v, want %v", failed, tt.fail)
+			}
+			if parallel != tt.parallel {
+				t.Errorf("%v hosts ran at once, want %v", parallel, tt.parallel)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Upload methods.
+const (
+	UploadMethodTar = "tar" // TAR stream extracted by the remote tar, the default.
+	UploadMethodSCP = "scp" // scp protocol received by the remote scp -t, for hosts without tar.
+)
+
+// checkMethod validates the upload method.
+func (u Upload) checkMethod() error {
+	switch u.Method {
+	case "", UploadMethodTar:
+		return nil
+	case UploadMethodSCP:
+		switch {
+		case u.Atomic || u.AtomicDir != "":
+			return fmt.Errorf("method %v doesn't support atomic uploads", u.Method)
+		case u.Via != "":
+			return fmt.Errorf("method %v can't be used with via", u.Method)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown method %q, expected %q or %q", u.Method, UploadMethodTar, UploadMethodSCP)
+}
+
+// RemoteSCPCommand returns command to be run on remote SSH host to receive
+// the scp stream into dir, see NewSCPStreamReader. Missing directories are
+// created as by RemoteUntarCommand. The acknowledgements of scp -t are
+// dropped and its errors are printed to STDERR.
+func RemoteSCPCommand(dir, dirMode string) (string, error) {
+	mkdir, err := remoteMkdir(`"$sup_dst"`, dirMode)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`sup_dst=%s; `+
+		`if [ -e "$sup_dst" ] && [ ! -d "$sup_dst" ]; then echo "upload: $sup_dst exists and is not a directory" >&2; exit 1; fi; `+
+		`%s && sup_scp=$( { { scp -r -p -t "$sup_dst"; echo $? >&3; } | tr -d '\000\001\002' >&2; } 3>&1 ) && [ "$sup_scp" = 0 ]`, remotePath(dir), mkdir), nil
+}
+
+// scpRecord is a record of the scp source protocol: the header lines of
+// a file followed by its contents, a directory or the end of directory.
+type scpRecord struct {
+	header string
+	file   string // Local file, if the record is a file.
+	size   int64
+}
+
+// NewSCPStreamReader returns the scp source protocol stream (as sent by
+// scp -r -p) of the local path relative to cwd, along with its size. The
+// files are laid out the same as by NewTarStreamReader, within the path's
+// directories, and files matching exclude patterns are left out. Symlinks
+// to files are followed, other special files are skipped.
+func NewSCPStreamReader(cwd, path, exclude string) (io.Reader, int64, error) {
+	return newSCPStreamReader(cwd, path, exclude, nil)
+}
+
+// newSCPStreamReader is NewSCPStreamReader of the listed files of path
+// only, unless files is nil.
+func newSCPStreamReader(cwd, path, exclude string, files []string) (io.Reader, int64, error) {
+	records, err := scpRecords(cwd, path, exclude, files)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "scp")
+	}
+	var size int64
+	for _, r := range records {
+		size += int64(len(r.header))
+		if r.file != "" {
+			size += r.size + 1
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeSCPRecords(pw, records))
+	}()
+	return pr, size, nil
+}
+
+// scpRecords returns the records of path, starting with its directories.
+func scpRecords(cwd, path, exclude string, files []string) ([]scpRecord, error) {
+	// The directories of path, as stored by tar, which strips leading
+	// "/" and "../".
+	var dirs []string
+	for _, dir := range strings.Split(filepath.ToSlash(filepath.Clean(path)), "/") {
+		if dir != "" && dir != "." && dir != ".." {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("can't upload %v", path)
+	}
+
+	// Local directories of dirs, ie. "../a" and "../a/b" of "../a/b/c".
+	parents := make([]string, len(dirs)-1)
+	parent := filepath.Clean(path)
+	for i := len(parents) - 1; i >= 0; i-- {
+		parent = filepath.Dir(parent)
+		parents[i] = parent
+	}
+	var records []scpRecord
+	for i, parent := range parents {
+		info, err := os.Stat(resolve(cwd, parent))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, scpRecord{header: scpHeader("D", info, 0, dirs[i])})
+	}
+
+	excluded := uploadFilter(exclude, files)
+	var walk func(file, name, rel string) error
+	walk = func(file, name, rel string) error {
+		if rel != "." && excluded(rel) {
+			return nil
+		}
+		if strings.Contains(name, "\n") {
+			return fmt.Errorf("%q: file names with newlines aren't supported", file)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.Mode().IsRegular():
+			records = append(records, scpRecord{header: scpHeader("C", info, info.Size(), name), file: file, size: info.Size()})
+		case info.IsDir():
+			if rel != "." {
+				// Directory symlinks are skipped, as by tar.
+				if link, err := os.Lstat(file); err != nil || link.Mode()&os.ModeSymlink != 0 {
+					return err
+				}
+			}
+			entries, err := os.ReadDir(file)
+			if err != nil {
+				return err
+			}
+			records = append(records, scpRecord{header: scpHeader("D", info, 0, name)})
+			for _, entry := range entries {
+				if err := walk(filepath.Join(file, entry.Name()), entry.Name(), filepath.Join(rel, entry.Name())); err != nil {
+					return err
+				}
+			}
+			records = append(records, scpRecord{header: "E\n"})
+		}
+		return nil
+	}
+	if err := walk(resolve(cwd, path), dirs[len(dirs)-1], "."); err != nil {
+		return nil, err
+	}
+	for range parents {
+		records = append(records, scpRecord{header: "E\n"})
+	}
+	return records, nil
+}
+
+// scpHeader returns the "T" line with the modification time followed by
+// the "C" (file) or "D" (directory) line of the scp protocol.
+func scpHeader(kind string, info os.FileInfo, size int64, name string) string {
+	mtime := info.ModTime().Unix()
+	return fmt.Sprintf("T%d 0 %d 0\n%s%04o %d %s\n", mtime, mtime, kind, info.Mode().Perm(), size, name)
+}
+
+// writeSCPRecords writes the records to w, each file followed by a zero
+// byte. The files must not change in size since they were walked.
+func writeSCPRecords(w io.Writer, records []scpRecord) error {
+	for _, r := range records {
+		if _, err := io.WriteString(w, r.header); err != nil {
+			return err
+		}
+		if r.file == "" {
+			continue
+		}
+		f, err := os.Open(r.file)
+		if err != nil {
+			return errors.Wrap(err, "scp")
+		}
+		_, err = io.CopyN(w, f, r.size)
+		f.Close()
+		if err == io.EOF {
+			err = fmt.Errorf("%v: file changed during upload", r.file)
+		}
+		if err != nil {
+			return errors.Wrap(err, "scp")
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scpFile is a file of the tree uploaded by the scp tests, a directory if
+// its name ends with "/".
+type scpFile struct {
+	name string
+	mode os.FileMode
+	data string
+}
+
+func TestSCPStream(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	T := fmt.Sprintf("T%d 0 %d 0\n", mtime.Unix(), mtime.Unix())
+	_, scpErr := exec.LookPath("scp")
+
+	for _, tt := range []struct {
+		name    string
+		files   []scpFile
+		path    string // Uploaded path.
+		exclude string
+		want    string // The scp stream.
+		err     string
+	}{
+		{
+			name:  "file",
+			files: []scpFile{{"app.conf", 0640, "x=1\n"}},
+			path:  "app.conf",
+			want:  T + "C0640 4 app.conf\nx=1\n\x00",
+		},
+		{
+			name:  "empty file",
+			files: []scpFile{{"empty", 0644, ""}},
+			path:  "empty",
+			want:  T + "C0644 0 empty\n\x00",
+		},
+		{
+			name: "names with spaces",
+			files: []scpFile{
+				{"my dir/", 0755, ""},
+				{"my dir/a file.txt", 0644, "a"},
+				{"my dir/ lead and trail ", 0600, "b"},
+			},
+			path: "my dir",
+			want: T + "D0755 0 my dir\n" +
+				T + "C0600 1  lead and trail \nb\x00" +
+				T + "C0644 1 a file.txt\na\x00" +
+				"E\n",
+		},
+		{
+			name: "deep nesting",
+			files: []scpFile{
+				{"a/", 0755, ""},
+				{"a/b/", 0750, ""},
+				{"a/b/c/", 0700, ""},
+				{"a/b/c/d/", 0755, ""},
+				{"a/b/c/d/e/", 0755, ""},
+				{"a/b/c/d/e/f.txt", 0644, "deep"},
+				{"a/b/c/top", 0644, ""},
+			},
+			path: "a/b/c",
+			// The directories of the path come first, as in the TAR
+			// stream.
+			want: T + "D0755 0 a\n" +
+				T + "D0750 0 b\n" +
+				T + "D0700 0 c\n" +
+				T + "D0755 0 d\n" +
+				T + "D0755 0 e\n" +
+				T + "C0644 4 f.txt\ndeep\x00" +
+				"E\nE\n" +
+				T + "C0644 0 top\n\x00" +
+				"E\nE\nE\n",
+		},
+		{
+			name: "exclude",
+			files: []scpFile{
+				{"src/", 0755, ""},
+				{"src/main.go", 0644, "package main\n"},
+				{"src/main_test.go", 0644, "package main\n"},
+				{"src/.git/", 0755, ""},
+				{"src/.git/HEAD", 0644, "ref\n"},
+			},
+			path:    "src",
+			exclude: "*_test.go, .git",
+			want:    T + "D0755 0 src\n" + T + "C0644 13 main.go\npackage main\n\x00" + "E\n",
+		},
+		{
+			name:  "newline",
+			files: []scpFile{{"dir/", 0755, ""}, {"dir/a\nb", 0644, ""}},
+			path:  "dir",
+			err:   "file names with newlines aren't supported",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tt.files {
+				file := filepath.Join(dir, f.name)
+				var err error
+				if strings.HasSuffix(f.name, "/") {
+					err = os.Mkdir(file, 0700)
+				} else {
+					err = os.WriteFile(file, []byte(f.data), 0600)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Modes and times are set once the directories are filled.
+			for i := len(tt.files) - 1; i >= 0; i-- {
+				file := filepath.Join(dir, tt.files[i].name)
+				if err := os.Chmod(file, tt.files[i].mode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(file, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r, size, err := NewSCPStreamReader(dir, tt.path, tt.exclude)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stream) != tt.want {
+				t.Errorf("got stream\n%q\nwant\n%q", stream, tt.want)
+			}
+			if size != int64(len(stream)) {
+				t.Errorf("got size %v, want %v", size, len(stream))
+			}
+
+			// scp -t receives the stream into the same tree, but the files
+			// excluded.
+			if scpErr != nil || tt.exclude != "" {
+				return
+			}
+			dst := t.TempDir()
+			cmd := exec.Command("scp", "-r", "-p", "-t", dst)
+			cmd.Stdin = bytes.NewReader(stream)
+			var stderr bytes.Buffer
+			cmd.Stderr = &stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("scp -t: %v\n%s", err, stderr.Bytes())
+			}
+			if got, want := scpTree(t, dst), scpTree(t, dir); got != want {
+				t.Errorf("scp -t received\n%v\nwant\n%v", got, want)
+			}
+		})
+	}
+}
+
+// scpTree lists the files of dir, as uploaded of the tests' paths.
+func scpTree(t *testing.T, dir string) string {
+	var lines []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || file == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, file)
+		line := fmt.Sprintf("%q %v %v", filepath.ToSlash(rel), info.Mode(), info.ModTime().Unix())
+		if info.Mode().IsRegular() {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			line += fmt.Sprintf(" %q", data)
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// TestRemoteSCPCommand receives a stream by the command in the local
+// shell, into a directory of spaces which doesn't exist yet.
+func TestRemoteSCPCommand(t *testing.T) {
+	if _, err := exec.LookPath("scp"); err != nil {
+		t.Skip("scp is not installed")
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "a file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := NewSCPStreamReader(src, "a file", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "new dir", "sub dir")
+	command, err := RemoteSCPCommand(dst, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %v\n%s", command, err, out)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "a file")); err != nil || string(data) != "data" {
+		t.Errorf("received %q, %v, want data", data, err)
+	}
+}
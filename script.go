@@ -0,0 +1,115 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// WarnScriptShebang is a warning code of script: files without #! line,
+// which are run by sh.
+const WarnScriptShebang = "script-shebang"
+
+// scriptInterpreter returns the command of the script's #! line, ie.
+// "/usr/bin/env python3", or "sh" if it has none.
+func scriptInterpreter(script string) (string, bool) {
+	line, _, _ := strings.Cut(script, "\n")
+	if !strings.HasPrefix(line, "#!") {
+		return "sh", false
+	}
+	return strings.TrimSpace(line[2:]), true
+}
+
+// isShell reports whether the interpreter is a POSIX-like shell, which
+// traces the script with set -x.
+func isShell(interpreter string) bool {
+	fields := strings.Fields(interpreter)
+	if len(fields) > 1 && path.Base(fields[0]) == "env" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	switch path.Base(fields[0]) {
+	case "sh", "bash", "dash", "ksh", "zsh", "ash":
+		return true
+	}
+	return false
+}
+
+// scriptRun returns command running the script with the args. The script
+// is written to a temp file on the host, removed once it exits, and run by
+// the interpreter of its #! line, or by sh, so it sees the args as $1..$n
+// and reads the STDIN of the command. Shell scripts are traced if trace
+// is set.
+func scriptRun(script string, args []string, trace bool) string {
+	interpreter, _ := scriptInterpreter(script)
+	if trace && isShell(interpreter) {
+		script = insertAfterShebang(script, "set -x\n")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, `sup_script=$(mktemp) || exit 1; trap 'rm -f "$sup_script"' EXIT; printf '%%s' %v > "$sup_script" && %v "$sup_script"`, ShellQuote(script), interpreter)
+	for _, arg := range args {
+		b.WriteString(" " + quoteScriptArg(arg))
+	}
+	return b.String()
+}
+
+// insertAfterShebang returns script with text inserted after its #! line,
+// or at the start if it has none.
+func insertAfterShebang(script, text string) string {
+	if _, ok := scriptInterpreter(script); !ok {
+		return text + script
+	}
+	line, rest, _ := strings.Cut(script, "\n")
+	return line + "\n" + text + rest
+}
+
+// quoteScriptArg returns arg in double quotes, so $VARs of the env are
+// expanded on the host, while spaces and quotes are kept as they are, and
+// commands of backticks and $(...) aren't run.
+func quoteScriptArg(arg string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", "$(", `\$(`).Replace(arg) + `"`
+}
+
+// scriptArgs returns the script_args of the command, with the templates
+// of the release expanded.
+func (r Release) scriptArgs(cmd *Command) ([]string, error) {
+	args := make([]string, len(cmd.ScriptArgs))
+	for i, arg := range cmd.ScriptArgs {
+		var err error
+		if args[i], err = r.expand("script_args", arg); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// ScriptWarnings returns warnings for script: files of the commands
+// without #! line, which are run by sh.
+func (s *Supfile) ScriptWarnings(commands []*Command) []Warning {
+	base, err := s.BaseDir()
+	if err != nil {
+		return nil
+	}
+	var warnings []Warning
+	for _, cmd := range commands {
+		if cmd.Script == "" {
+			continue
+		}
+		data, err := os.ReadFile(resolve(base, cmd.Script))
+		if err != nil {
+			continue // Errors are reported by the run.
+		}
+		if _, ok := scriptInterpreter(string(data)); ok {
+			continue
+		}
+		warnings = append(warnings, Warning{
+			Code:    WarnScriptShebang,
+			Message: fmt.Sprintf("commands.%v.script %q has no #! line, it's run by sh", cmd.Name, cmd.Script),
+			Line:    findLine(s.data, "commands", cmd.Name, "script"),
+		})
+	}
+	return warnings
+}
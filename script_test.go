@@ -0,0 +1,47 @@
+package sup
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestScriptArgsQuoting(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	script := "#!/bin/sh\nfor arg in \"$@\"; do printf '[%s]\\n' \"$arg\"; done\n"
+	for _, tt := range []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{"none", nil, nil},
+		{"plain", []string{"deploy", "--force"}, []string{"deploy", "--force"}},
+		{"spaces", []string{"two words", "  padded  "}, []string{"two words", "  padded  "}},
+		{"empty", []string{""}, []string{""}},
+		{"single quotes", []string{"it's", "'quoted'"}, []string{"it's", "'quoted'"}},
+		{"double quotes", []string{`say "hi"`, `"`}, []string{`say "hi"`, `"`}},
+		{"backslashes", []string{`C:\path\`, `a\"b`}, []string{`C:\path\`, `a\"b`}},
+		{"commands", []string{"`id`", "$(id)", "$((1 + 2))"}, []string{"`id`", "$(id)", "$((1 + 2))"}},
+		{"env vars", []string{"$SUP_TEST_ARG", "${SUP_TEST_ARG}-2"}, []string{"value with spaces", "value with spaces-2"}},
+		{"newline", []string{"line 1\nline 2"}, []string{"line 1\nline 2"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", scriptRun(script, tt.args, false))
+			cmd.Env = append(os.Environ(), "SUP_TEST_ARG=value with spaces")
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+			var want strings.Builder
+			for _, arg := range tt.want {
+				want.WriteString("[" + arg + "]\n")
+			}
+			if string(out) != want.String() {
+				t.Errorf("script got args\n%s\nwant\n%s", out, want.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// WarnEmptyScriptsDir is a warning code of scripts_dir matching no scripts.
+const WarnEmptyScriptsDir = "empty-scripts-dir"
+
+// scriptsDirFiles returns the scripts of cmd.ScriptsDir matching
+// cmd.ScriptsGlob ("*" by default), sorted lexicographically.
+func (cmd *Command) scriptsDirFiles(base string) ([]string, error) {
+	dir := resolve(base, cmd.ScriptsDir)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("scripts_dir: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("scripts_dir: %v is not a directory", dir)
+	}
+	pattern := cmd.ScriptsGlob
+	if pattern == "" {
+		pattern = "*"
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return nil, fmt.Errorf("scripts_glob: %v", err)
+	}
+
+	var files []string
+	for _, file := range matches {
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// scriptsDirRun returns a shell program running the scripts one after
+// another, each in a subshell along with the fragments of its # sup:use
+// directive. Exit status of each script is printed and a failing script
+// stops the sequence.
+func (s *Supfile) scriptsDirRun(files []string) (string, error) {
+	var b strings.Builder
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("scripts_dir: %v", err)
+		}
+		use, err := s.fragments(scriptUse(string(data)))
+		if err != nil {
+			return "", fmt.Errorf("scripts_dir: %v: %v", filepath.Base(file), err)
+		}
+		name := ShellQuote("scripts_dir: " + filepath.Base(file))
+		fmt.Fprintf(&b, "(\n%s%s\n)\n", use, strings.TrimRight(string(data), "\n"))
+		fmt.Fprintf(&b, "sup_status=$?; echo %v\" exited with status $sup_status\"; [ $sup_status -eq 0 ] || exit $sup_status\n", name)
+	}
+	return b.String(), nil
+}
+
+// ScriptsDirWarnings returns warnings for scripts_dir of commands
+// matching no scripts, which would make the commands no-ops.
+func (s *Supfile) ScriptsDirWarnings(commands []*Command) []Warning {
+	base, err := s.BaseDir()
+	if err != nil {
+		return nil
+	}
+	var warnings []Warning
+	for _, cmd := range commands {
+		if cmd.ScriptsDir == "" {
+			continue
+		}
+		files, err := cmd.scriptsDirFiles(base)
+		if err != nil || len(files) > 0 {
+			continue // Errors are reported by the run.
+		}
+		msg := fmt.Sprintf("commands.%v.scripts_dir %q has no scripts", cmd.Name, cmd.ScriptsDir)
+		if cmd.ScriptsGlob != "" {
+			msg = fmt.Sprintf("commands.%v.scripts_dir %q has no scripts matching %q", cmd.Name, cmd.ScriptsDir, cmd.ScriptsGlob)
+		}
+		warnings = append(warnings, Warning{
+			Code:    WarnEmptyScriptsDir,
+			Message: msg,
+			Line:    findLine(s.data, "commands", cmd.Name, "scripts_dir"),
+		})
+	}
+	return warnings
+}
@@ -0,0 +1,205 @@
+package sup
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	labelKeyRe   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_./-]*[A-Za-z0-9])?$`)
+	labelValueRe = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?)?$`)
+
+	selectorExistsRe = regexp.MustCompile(`^(!?)\s*([^\s!=()]+)$`)
+	selectorEqualRe  = regexp.MustCompile(`^([^\s!=()]+)\s*(==|=|!=)\s*([^\s!=()]*)$`)
+	selectorSetRe    = regexp.MustCompile(`^([^\s!=()]+)\s+(in|notin)\s*\(([^()]*)\)$`)
+)
+
+// Selector is a label selector, ie. "role=web,az!=eu-west-1a", selecting
+// hosts by their labels. All of its requirements need to match.
+type Selector []SelectorRequirement
+
+// SelectorRequirement is a single comma separated part of Selector.
+type SelectorRequirement struct {
+	Key      string
+	Operator string   // "=", "!=", "in", "notin", "exists" or "!exists".
+	Values   []string // One value for "=" and "!=".
+}
+
+// ParseSelector parses Kubernetes style label selector. It supports
+// equality (key=value, key==value, key!=value), set-based
+// (key in (a,b), key notin (a,b)) and existence (key, !key) requirements.
+func ParseSelector(s string) (Selector, error) {
+	var selector Selector
+	for _, part := range splitSelector(s) {
+		part = strings.TrimSpace(part)
+		req, err := parseSelectorRequirement(part)
+		if err != nil {
+			return nil, fmt.Errorf("selector %q: %v", s, err)
+		}
+		selector = append(selector, req)
+	}
+	return selector, nil
+}
+
+// splitSelector splits s by commas outside of parentheses.
+func splitSelector(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func parseSelectorRequirement(part string) (SelectorRequirement, error) {
+	if m := selectorSetRe.FindStringSubmatch(part); m != nil {
+		req := SelectorRequirement{Key: m[1], Operator: m[2]}
+		for _, value := range strings.Split(m[3], ",") {
+			value = strings.TrimSpace(value)
+			if !labelValueRe.MatchString(value) {
+				return req, fmt.Errorf("invalid label value %q in %q", value, part)
+			}
+			req.Values = append(req.Values, value)
+		}
+		return req, checkLabelKey(req.Key, part)
+	}
+	if m := selectorEqualRe.FindStringSubmatch(part); m != nil {
+		req := SelectorRequirement{Key: m[1], Operator: strings.TrimPrefix(m[2], "="), Values: []string{m[3]}}
+		if req.Operator == "" {
+			req.Operator = "="
+		}
+		if !labelValueRe.MatchString(m[3]) {
+			return req, fmt.Errorf("invalid label value %q in %q", m[3], part)
+		}
+		return req, checkLabelKey(req.Key, part)
+	}
+	if m := selectorExistsRe.FindStringSubmatch(part); m != nil {
+		req := SelectorRequirement{Key: m[2], Operator: m[1] + "exists"}
+		return req, checkLabelKey(req.Key, part)
+	}
+	return SelectorRequirement{}, fmt.Errorf("invalid requirement %q", part)
+}
+
+func checkLabelKey(key, part string) error {
+	if !labelKeyRe.MatchString(key) {
+		return fmt.Errorf("invalid label key %q in %q", key, part)
+	}
+	return nil
+}
+
+// Matches reports whether labels satisfy all of the requirements.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, ok := labels[req.Key]
+		var match bool
+		switch req.Operator {
+		case "=":
+			match = ok && value == req.Values[0]
+		case "!=":
+			match = !ok || value != req.Values[0]
+		case "in":
+			match = ok && containsString(req.Values, value)
+		case "notin":
+			match = !ok || !containsString(req.Values, value)
+		case "exists":
+			match = ok
+		case "!exists":
+			match = !ok
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLabel parses key=value inventory token into a label.
+func parseLabel(token string) (key, value string, err error) {
+	key, value, _ = strings.Cut(token, "=")
+	if !labelKeyRe.MatchString(key) {
+		return "", "", fmt.Errorf("invalid label key %q", key)
+	}
+	if !labelValueRe.MatchString(value) {
+		return "", "", fmt.Errorf("invalid label %v value %q", key, value)
+	}
+	return key, value, nil
+}
+
+// LabelEnv returns the host labels as SUP_LABEL_<KEY> env vars, sorted by
+// key. Key characters other than letters and digits are replaced by "_".
+func (h *Host) LabelEnv() EnvList {
+	keys := make([]string, 0, len(h.Labels))
+	for key := range h.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var env EnvList
+	for _, key := range keys {
+		name := strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' {
+				return r - 'a' + 'A'
+			}
+			if r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, key)
+		env.Set("SUP_LABEL_"+name, h.Labels[key])
+	}
+	return env
+}
+
+// parseRunOn parses cmd.RunOn selector, unless it was parsed already.
+func (cmd *Command) parseRunOn() error {
+	if cmd.RunOn == "" || cmd.runOn != nil {
+		return nil
+	}
+	selector, err := ParseSelector(cmd.RunOn)
+	if err != nil {
+		return errors.Wrap(err, cmd.Name+": run_on")
+	}
+	cmd.runOn = selector
+	return nil
+}
+
+// selectClients returns the clients of hosts matching cmd.RunOn selector.
+// Clients without a host, ie. bastions, don't match any selector.
+func selectClients(cmd *Command, clients []Client) []Client {
+	if cmd.runOn == nil {
+		return clients
+	}
+	var selected []Client
+	for _, c := range clients {
+		if h, ok := c.(interface{ Host() *Host }); ok && cmd.runOn.Matches(h.Host().Labels) {
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
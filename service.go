@@ -0,0 +1,91 @@
+package sup
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Service managers.
+const (
+	ManagerSystemd = "systemd"
+	ManagerOpenRC  = "openrc"
+)
+
+// DefaultServiceWait is how long verify_active waits for the service.
+const DefaultServiceWait = 30 * time.Second
+
+// serviceActions are the supported service actions.
+var serviceActions = []string{"start", "stop", "restart", "reload"}
+
+// Service is a service action run on each host after the command's run,
+// ie. {name: myapp, action: restart, verify_active: true}.
+type Service struct {
+	Name         string `yaml:"name,omitempty"`
+	Action       string `yaml:"action,omitempty"`        // start, stop, restart (default) or reload.
+	Manager      string `yaml:"manager,omitempty"`       // systemd (default) or openrc.
+	Sudo         bool   `yaml:"sudo,omitempty"`          // Run the action with sudo.
+	DaemonReload bool   `yaml:"daemon_reload,omitempty"` // Reload systemd units first.
+	VerifyActive bool   `yaml:"verify_active,omitempty"` // Fail the host unless the service becomes active.
+	Wait         string `yaml:"wait,omitempty"`          // How long verify_active waits, 30s by default.
+}
+
+// Script returns the remote shell script running the service action.
+func (s *Service) Script() (string, error) {
+	if s.Name == "" {
+		return "", fmt.Errorf("service: name is required")
+	}
+	action := s.Action
+	if action == "" {
+		action = "restart"
+	}
+	if !containsString(serviceActions, action) {
+		return "", fmt.Errorf("service: unknown action %q, supported actions: %v", action, strings.Join(serviceActions, ", "))
+	}
+	if s.VerifyActive && action == "stop" {
+		return "", fmt.Errorf("service: verify_active can't be used with action stop")
+	}
+	wait, err := parseDuration(s.Wait, DefaultServiceWait)
+	if err != nil {
+		return "", fmt.Errorf("service.wait: %v", err)
+	}
+	sudo := ""
+	if s.Sudo {
+		sudo = "sudo "
+	}
+	name := ShellQuote(s.Name)
+
+	var cmds []string
+	var isActive, status string
+	switch s.Manager {
+	case "", ManagerSystemd:
+		if s.DaemonReload {
+			cmds = append(cmds, sudo+"systemctl daemon-reload")
+		}
+		cmds = append(cmds, fmt.Sprintf("%vsystemctl %v %v", sudo, action, name))
+		isActive = "systemctl is-active --quiet " + name
+		status = "systemctl status --no-pager " + name
+	case ManagerOpenRC:
+		if s.DaemonReload {
+			return "", fmt.Errorf("service: daemon_reload is supported by %v only", ManagerSystemd)
+		}
+		cmds = append(cmds, fmt.Sprintf("%vrc-service %v %v", sudo, name, action))
+		isActive = fmt.Sprintf("%vrc-service %v status >/dev/null 2>&1", sudo, name)
+		status = fmt.Sprintf("%vrc-service %v status", sudo, name)
+	default:
+		return "", fmt.Errorf("service: unknown manager %q, supported managers: %v, %v", s.Manager, ManagerSystemd, ManagerOpenRC)
+	}
+	script := strings.Join(cmds, " && ")
+	if !s.VerifyActive {
+		return script, nil
+	}
+
+	seconds := int(wait.Seconds())
+	msg := ShellQuote(fmt.Sprintf("service: %v is not active after %vs", s.Name, seconds))
+	return fmt.Sprintf(`%s || exit $?
+sup_wait_start=$(date +%%s);
+until %s; do
+  if [ $(( $(date +%%s) - sup_wait_start )) -ge %d ]; then echo %s >&2; %s >&2; exit 1; fi;
+  sleep 1;
+done`, script, isActive, seconds, msg, status), nil
+}
@@ -0,0 +1,159 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// WarnInventorySkew is a warning code of networks whose hosts: differ from
+// their inventory, see Network.CheckInventory.
+const WarnInventorySkew = "inventory-skew"
+
+// InventorySkew lists the hosts of the network's hosts: missing from its
+// inventory, ie. stale entries of decommissioned machines, and the other
+// way around. Hosts are given as "name (address:port)".
+type InventorySkew struct {
+	StaticOnly    []string `json:"static_only"`    // In hosts: only.
+	InventoryOnly []string `json:"inventory_only"` // In the inventory only.
+}
+
+// Empty reports whether hosts: and the inventory are in sync.
+func (s *InventorySkew) Empty() bool {
+	return s == nil || len(s.StaticOnly) == 0 && len(s.InventoryOnly) == 0
+}
+
+// WriteText writes the skew as a diff of the two lists, hosts: only with
+// "-" and the inventory only with "+".
+func (s *InventorySkew) WriteText(w io.Writer, network string) error {
+	var b strings.Builder
+	if s.Empty() {
+		fmt.Fprintf(&b, "Network %v: hosts: and inventory are in sync\n", network)
+	} else {
+		fmt.Fprintf(&b, "Network %v: hosts: (-) and inventory (+) differ\n", network)
+		for _, host := range s.StaticOnly {
+			fmt.Fprintf(&b, "- %v\n", host)
+		}
+		for _, host := range s.InventoryOnly {
+			fmt.Fprintf(&b, "+ %v\n", host)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ErrInventorySkew is returned for networks with inventory_strict whose
+// hosts: differ from their inventory.
+type ErrInventorySkew struct {
+	Network string
+	Skew    *InventorySkew
+}
+
+func (e ErrInventorySkew) Error() string {
+	return fmt.Sprintf("network %v: %v host(s) of hosts: not in inventory, %v inventory host(s) not in hosts: (inventory_strict)",
+		e.Network, len(e.Skew.StaticOnly), len(e.Skew.InventoryOnly))
+}
+
+// CheckInventory compares hosts: of the network with the hosts of its
+// inventory, see ParseInventory, or returns nil unless the network has
+// both. Hosts are the same if they're connected to at the same address and
+// port, after SSH config, host_overrides and the network resolver, so
+// names, aliases and users don't matter.
+func (n Network) CheckInventory(inventory []*Host) (*InventorySkew, error) {
+	if len(n.Hosts) == 0 || n.Inventory == "" && n.InventoryHTTP == nil {
+		return nil, nil
+	}
+	static, err := n.hostKeys(n.Hosts)
+	if err != nil {
+		return nil, err
+	}
+	live, err := n.hostKeys(inventory)
+	if err != nil {
+		return nil, err
+	}
+	skew := &InventorySkew{StaticOnly: []string{}, InventoryOnly: []string{}}
+	for i, host := range n.Hosts {
+		if !live.has(static.keys[i]) {
+			skew.StaticOnly = append(skew.StaticOnly, skewEntry(host, static.keys[i]))
+		}
+	}
+	for i, host := range inventory {
+		if !static.has(live.keys[i]) {
+			skew.InventoryOnly = append(skew.InventoryOnly, skewEntry(host, live.keys[i]))
+		}
+	}
+	return skew, nil
+}
+
+// hostKeys are the identities of hosts compared by CheckInventory: the
+// address:port as given and as resolved, of each host in order.
+type hostKeys struct {
+	keys [][]string
+	all  map[string]bool
+}
+
+func (k hostKeys) has(keys []string) bool {
+	for _, key := range keys {
+		if k.all[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func (n Network) hostKeys(hosts []*Host) (hostKeys, error) {
+	k := hostKeys{all: map[string]bool{}}
+	for _, host := range hosts {
+		// Containers and pods are told apart by their name.
+		suffix := ""
+		if host.Pod != "" || host.podSelector != "" {
+			suffix = "/" + host.Namespace + "/" + host.Pod + host.podSelector
+		}
+		if host.Container != "" {
+			suffix += "/" + host.Container
+		}
+		keys := []string{net.JoinHostPort(host.Address, host.Port) + suffix}
+		addr, by, err := n.DNS.resolve(host.Address, host.jumpHost(n.Bastion) == "")
+		if err != nil {
+			return k, err
+		}
+		if by != "" {
+			keys = append(keys, net.JoinHostPort(addr, host.Port)+suffix)
+		}
+		for _, key := range keys {
+			k.all[key] = true
+		}
+		k.keys = append(k.keys, keys)
+	}
+	return k, nil
+}
+
+// skewEntry returns host of the skew as "name (address:port)".
+func skewEntry(host *Host, keys []string) string {
+	key := keys[len(keys)-1]
+	if name := host.GetHostname(); name != key && name != host.Address {
+		return fmt.Sprintf("%v (%v)", name, key)
+	}
+	return key
+}
+
+// InventorySkewWarnings returns warning of the network's skew, unless it's
+// empty.
+func (s *Supfile) InventorySkewWarnings(name string, skew *InventorySkew) []Warning {
+	if skew.Empty() {
+		return nil
+	}
+	var parts []string
+	if len(skew.StaticOnly) > 0 {
+		parts = append(parts, "not in inventory: "+strings.Join(skew.StaticOnly, ", "))
+	}
+	if len(skew.InventoryOnly) > 0 {
+		parts = append(parts, "not in hosts: "+strings.Join(skew.InventoryOnly, ", "))
+	}
+	return []Warning{{
+		Code:    WarnInventorySkew,
+		Message: fmt.Sprintf("network %v: %v (see -check-inventory)", name, strings.Join(parts, "; ")),
+		Line:    findLine(s.data, "networks", name, "hosts"),
+	}}
+}
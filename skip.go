@@ -0,0 +1,29 @@
+package sup
+
+// SkippedByUser is the Reason of CommandSkipped events of the commands
+// skipped by SkipCommands.
+const SkippedByUser = "user"
+
+// SkipCommands makes Run skip the commands of names, ie. the ones left out
+// by sup -skip-commands or -only-commands. Plan reports them as skipped.
+func (sup *Stackup) SkipCommands(names ...string) {
+	sup.skipped = map[string]bool{}
+	for _, name := range names {
+		sup.skipped[name] = true
+	}
+}
+
+// skipByUser returns the commands not skipped by SkipCommands, reporting
+// the skipped ones.
+func (sup *Stackup) skipByUser(commands []*Command) []*Command {
+	var run []*Command
+	for _, cmd := range commands {
+		if sup.skipped[cmd.Name] {
+			sup.errorf("%v: skipped (%v)\n", cmd.Name, SkippedByUser)
+			sup.emit(Event{Type: CommandSkipped, Command: cmd.Name, Reason: SkippedByUser})
+			continue
+		}
+		run = append(run, cmd)
+	}
+	return run
+}
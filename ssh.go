@@ -8,6 +8,9 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -26,6 +29,11 @@ type SSHClient struct {
 	running      bool
 	env          string //export FOO="bar"; export BAR="baz";
 	color        string
+	algorithms   SSHAlgorithms
+	dialer       SSHDialFunc   // Used by Reconnect.
+	batch        bool          // Security keys fail instead of waiting for a touch.
+	timeout      time.Duration // Network's connect_timeout, 0 if unlimited.
+	preferKey    string        // Agent key tried first, see Stackup.PreferKey.
 }
 
 type ErrConnect struct {
@@ -39,17 +47,19 @@ func (e ErrConnect) Error() string {
 }
 
 var initAuthMethodOnce sync.Once
-var authMethod ssh.AuthMethod
+var signers []ssh.Signer
+var signersErr error
+var agentKeys []*agent.Key // Keys of the first signers, nil if ssh-agent isn't running.
 
 // initAuthMethod initiates SSH authentication method.
 func initAuthMethod() {
-	var signers []ssh.Signer
-
 	// If there's a running SSH Agent, try to use its Private keys.
 	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
 	if err == nil {
-		agent := agent.NewClient(sock)
-		signers, _ = agent.Signers()
+		agentKeys, signers, signersErr = agentSigners(agent.NewClient(sock))
+		if agentKeys == nil {
+			agentKeys = []*agent.Key{}
+		}
 	}
 
 	// Try to read user's SSH private keys form the standard paths.
@@ -66,10 +76,67 @@ func initAuthMethod() {
 		if err != nil {
 			continue
 		}
-		signers = append(signers, signer)
+		signers = append(signers, preferSHA2(signer))
+
+	}
+}
+
+// identitySigner reads the host specific private key. Both OpenSSH
+// and PEM (PKCS#1, PKCS#8, SEC 1) formats are supported.
+func identitySigner(file string) (ssh.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading identity file failed")
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("identity file %v is encrypted, add it to ssh-agent instead", file)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing identity file %v failed", file)
+	}
+	return preferSHA2(signer), nil
+}
+
+// rsaSignatureAlgorithms are offered for RSA keys, most preferred first.
+// OpenSSH 8.8+ servers refuse SHA-1 ssh-rsa signatures, which are kept
+// for legacy servers only.
+var rsaSignatureAlgorithms = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+
+// preferSHA2 makes RSA signer offer rsa-sha2-512 and rsa-sha2-256
+// signatures before ssh-rsa. The algorithm is picked by the server's
+// server-sig-algs, servers without it get ssh-rsa.
+func preferSHA2(signer ssh.Signer) ssh.Signer {
+	as, ok := signer.(ssh.AlgorithmSigner)
+	if !ok || signer.PublicKey().Type() != ssh.KeyAlgoRSA {
+		return signer
+	}
+	if _, ok := signer.(ssh.MultiAlgorithmSigner); ok {
+		return signer
+	}
+	multi, err := ssh.NewSignerWithAlgorithms(as, rsaSignatureAlgorithms)
+	if err != nil {
+		return signer
+	}
+	return multi
+}
 
+// describeSigners lists type, fingerprint and signature algorithms
+// of the keys offered to the server, ie. for auth failure errors.
+func describeSigners(signers []ssh.Signer) string {
+	if len(signers) == 0 {
+		return "none"
+	}
+	var keys []string
+	for _, signer := range signers {
+		key := signer.PublicKey()
+		desc := key.Type() + " " + ssh.FingerprintSHA256(key)
+		if multi, ok := signer.(ssh.MultiAlgorithmSigner); ok {
+			desc += " (" + strings.Join(multi.Algorithms(), ", ") + ")"
+		}
+		keys = append(keys, desc)
 	}
-	authMethod = ssh.PublicKeys(signers...)
+	return strings.Join(keys, "; ")
 }
 
 // SSHDialFunc can dial an ssh server and return a client
@@ -81,28 +148,74 @@ func (c *SSHClient) Connect() error {
 	return c.ConnectWith(ssh.Dial)
 }
 
+// signers returns the signers of the user's keys, the agent key of
+// preferKey first.
+func (c *SSHClient) signers() ([]ssh.Signer, error) {
+	initAuthMethodOnce.Do(initAuthMethod)
+	if signersErr != nil {
+		return nil, signersErr
+	}
+	if c.preferKey == "" {
+		return signers, nil
+	}
+	if agentKeys == nil {
+		return nil, fmt.Errorf("--prefer-key %q: ssh-agent is not running", c.preferKey)
+	}
+	return preferSigner(agentKeys, signers, c.preferKey)
+}
+
 // ConnectWith creates a SSH connection to a specified host. It will use dialer to establish the
 // connection.
-// TODO: Split Signers to its own method.
 func (c *SSHClient) ConnectWith(dialer SSHDialFunc) error {
 	if c.connOpened {
 		return fmt.Errorf("already connected")
 	}
 
-	initAuthMethodOnce.Do(initAuthMethod)
+	userSigners, err := c.signers()
+	if err != nil {
+		return ErrConnect{c.host.User, c.host.GetHost(), err.Error()}
+	}
+
+	hostSigners := hostSigners(userSigners, c.host, c.batch)
+	if c.host.IdentityFile != "" {
+		signer, err := identitySigner(c.host.IdentityFile)
+		if err != nil {
+			return ErrConnect{c.host.User, c.host.GetHost(), err.Error()}
+		}
+		hostSigners = append([]ssh.Signer{signer}, hostSigners...)
+	}
+	if c.host.identityKey != nil {
+		hostSigners = append([]ssh.Signer{c.host.identityKey.signer}, hostSigners...)
+	}
 
 	config := &ssh.ClientConfig{
 		User: c.host.User,
 		Auth: []ssh.AuthMethod{
-			authMethod,
+			ssh.PublicKeys(hostSigners...),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
+	algorithms := c.algorithms.Override(c.host.Algorithms)
+	algorithms.Apply(config)
 
-	var err error
+	c.dialer = dialer
+	if c.timeout > 0 {
+		config.Timeout = c.timeout
+		dialer = dialWithin(dialer, c.timeout)
+	}
 	c.conn, err = dialer("tcp", c.host.GetHost(), config)
+	if err == errDialTimeout {
+		return ErrConnectTimeout{c.host.User, c.host.GetHost(), c.timeout}
+	}
 	if err != nil {
-		return ErrConnect{c.host.User, c.host.GetHost(), err.Error()}
+		reason := err.Error()
+		if strings.Contains(reason, "unable to authenticate") {
+			reason += "; offered keys: " + describeSigners(hostSigners) +
+				"; check the server accepts the key types and signature algorithms (PubkeyAcceptedAlgorithms)"
+		} else if strings.Contains(reason, "handshake failed") && !strings.Contains(reason, "server offered") {
+			reason += "; client offered " + algorithms.String()
+		}
+		return ErrConnect{c.host.User, c.host.GetHost(), reason}
 	}
 	c.connOpened = true
 
@@ -152,7 +265,7 @@ func (c *SSHClient) Run(task *Task) error {
 	}
 
 	// Start the remote command.
-	if err := sess.Start(c.env + task.Run); err != nil {
+	if err := sess.Start(c.host.remoteCommand(task, c.env, task.TTY)); err != nil {
 		return ErrTask{task, err.Error()}
 	}
 
@@ -220,9 +333,14 @@ func (c *SSHClient) Stdout() io.Reader {
 	return c.remoteStdout
 }
 
+// Host returns the host the client is connected to.
+func (c *SSHClient) Host() *Host {
+	return c.host
+}
+
 func (c *SSHClient) Prefix() (string, int) {
 	host := c.host.GetPrefixText()
-	return c.color + host + ResetColor, len(host)
+	return colorize(c.color, host), len(host)
 }
 
 func (c *SSHClient) Write(p []byte) (n int, err error) {
@@ -253,16 +371,24 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 }
 
 func ConvertClientToLocal(client Client) *LocalhostClient {
-	if remote, ok := client.(*SSHClient); ok {
-		host := Host{
-			Address: "localhost",
-			KnownAs: remote.host.GetHostname() + " (local)",
-		}
-		return &LocalhostClient{
-			env:   remote.env,
-			host:  &host,
-			color: remote.color,
-		}
+	switch remote := client.(type) {
+	case *SSHClient:
+		return newLocalFromRemote(remote.host, remote.env, remote.color)
+	case *OpenSSHClient:
+		return newLocalFromRemote(remote.host, remote.env, remote.color)
 	}
 	return client.(*LocalhostClient)
 }
+
+func newLocalFromRemote(remote *Host, env, color string) *LocalhostClient {
+	host := Host{
+		Address: "localhost",
+		KnownAs: remote.GetHostname() + " (local)",
+		Group:   remote.Group,
+	}
+	return &LocalhostClient{
+		env:   env,
+		host:  &host,
+		color: color,
+	}
+}
@@ -0,0 +1,121 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// touchHintDelay is how long a security key signature may be pending
+// before the "touch your security key" hint is printed.
+const touchHintDelay = time.Second
+
+// PreferKey makes the agent key matching the given comment or fingerprint
+// (SHA256:... or legacy MD5) to be tried first. This avoids hitting per-host
+// auth attempt limits when there are many keys in the agent.
+func (sup *Stackup) PreferKey(key string) {
+	sup.preferKey = key
+}
+
+// agentSigners returns the keys in the agent and their signers, including
+// sk- (FIDO2) keys, in the same order.
+func agentSigners(client agent.ExtendedAgent) ([]*agent.Key, []ssh.Signer, error) {
+	keys, err := client.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	signers, err := client.Signers()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, signer := range signers {
+		signers[i] = preferSHA2(signer)
+	}
+	return keys, signers, nil
+}
+
+// preferSigner returns signers with the one of the agent key matching
+// preferred first. The first signers are the ones of keys.
+func preferSigner(keys []*agent.Key, signers []ssh.Signer, preferred string) ([]ssh.Signer, error) {
+	for i, key := range keys {
+		if i >= len(signers) || !matchesKey(key, preferred) {
+			continue
+		}
+		ordered := append([]ssh.Signer{signers[i]}, signers[:i]...)
+		return append(ordered, signers[i+1:]...), nil
+	}
+	return nil, fmt.Errorf("--prefer-key %q: no such key in ssh-agent", preferred)
+}
+
+func matchesKey(key *agent.Key, pattern string) bool {
+	return key.Comment == pattern ||
+		ssh.FingerprintSHA256(key) == pattern ||
+		ssh.FingerprintLegacyMD5(key) == strings.TrimPrefix(pattern, "MD5:")
+}
+
+// isSecurityKey reports whether the key lives on a hardware security key.
+func isSecurityKey(key ssh.PublicKey) bool {
+	return strings.HasPrefix(key.Type(), "sk-")
+}
+
+// touchHintSigner prints a hint for the given host when the signature
+// request to a security key takes longer than touchHintDelay, which
+// usually means the key is waiting to be touched.
+type touchHintSigner struct {
+	ssh.Signer
+	host  *Host
+	batch bool // Fail with ErrInteractive instead.
+}
+
+func (s touchHintSigner) hint() (stop func()) {
+	timer := time.AfterFunc(touchHintDelay, func() {
+		fmt.Fprintf(os.Stderr, "%vConfirm user presence for key %v (touch your security key)\n", s.host.GetPrefixText(), ssh.FingerprintSHA256(s.PublicKey()))
+	})
+	return func() { timer.Stop() }
+}
+
+// errTouch returns ErrInteractive in batch mode.
+func (s touchHintSigner) errTouch() error {
+	if !s.batch {
+		return nil
+	}
+	return ErrInteractive{Host: s.host.GetHostname(), Input: "touch of security key " + ssh.FingerprintSHA256(s.PublicKey()), Hint: "use a key without user presence requirement"}
+}
+
+func (s touchHintSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if err := s.errTouch(); err != nil {
+		return nil, err
+	}
+	defer s.hint()()
+	return s.Signer.Sign(rand, data)
+}
+
+func (s touchHintSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if err := s.errTouch(); err != nil {
+		return nil, err
+	}
+	defer s.hint()()
+	if signer, ok := s.Signer.(ssh.AlgorithmSigner); ok {
+		return signer.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return s.Signer.Sign(rand, data)
+}
+
+// hostSigners wraps security key signers to print touch hints for host,
+// or to fail in batch mode.
+func hostSigners(signers []ssh.Signer, host *Host, batch bool) []ssh.Signer {
+	wrapped := make([]ssh.Signer, len(signers))
+	for i, signer := range signers {
+		if isSecurityKey(signer.PublicKey()) {
+			wrapped[i] = touchHintSigner{signer, host, batch}
+			continue
+		}
+		wrapped[i] = signer
+	}
+	return wrapped
+}
@@ -0,0 +1,79 @@
+package sup
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// TestPreferKey checks each client orders the agent keys by its own
+// preferred key, leaving the signers shared by the clients as they are.
+func TestPreferKey(t *testing.T) {
+	initAuthMethodOnce.Do(func() {})
+	defer func(s []ssh.Signer, keys []*agent.Key) { signers, agentKeys = s, keys }(signers, agentKeys)
+	signers, agentKeys = nil, nil
+	for _, comment := range []string{"work", "personal", "deploy"} {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers = append(signers, signer)
+		agentKeys = append(agentKeys, &agent.Key{Format: signer.PublicKey().Type(), Blob: signer.PublicKey().Marshal(), Comment: comment})
+	}
+	comments := func(ordered []ssh.Signer) []string {
+		var names []string
+		for _, signer := range ordered {
+			for _, key := range agentKeys {
+				if string(key.Blob) == string(signer.PublicKey().Marshal()) {
+					names = append(names, key.Comment)
+				}
+			}
+		}
+		return names
+	}
+
+	for _, tt := range []struct {
+		preferKey string
+		want      []string
+		err       string
+	}{
+		{"", []string{"work", "personal", "deploy"}, ""},
+		{"deploy", []string{"deploy", "work", "personal"}, ""},
+		{"personal", []string{"personal", "work", "deploy"}, ""},
+		{ssh.FingerprintSHA256(signers[2].PublicKey()), []string{"deploy", "work", "personal"}, ""},
+		{"MD5:" + ssh.FingerprintLegacyMD5(signers[1].PublicKey()), []string{"personal", "work", "deploy"}, ""},
+		{"missing", nil, `--prefer-key "missing": no such key in ssh-agent`},
+	} {
+		t.Run(tt.preferKey, func(t *testing.T) {
+			got, err := (&SSHClient{preferKey: tt.preferKey}).signers()
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(comments(got)) != fmt.Sprint(tt.want) {
+				t.Errorf("got keys %v, want %v", comments(got), tt.want)
+			}
+		})
+	}
+	if got := comments(signers); fmt.Sprint(got) != "[work personal deploy]" {
+		t.Errorf("shared signers reordered to %v", got)
+	}
+
+	agentKeys = nil
+	if _, err := (&SSHClient{preferKey: "work"}).signers(); err == nil || err.Error() != `--prefer-key "work": ssh-agent is not running` {
+		t.Errorf("got error %v without ssh-agent, want ssh-agent is not running", err)
+	}
+}
@@ -1,28 +1,99 @@
 package sup
 
 import (
-	"github.com/jsnjack/sshconfig"
+	"strings"
+	"sync"
 )
 
-var extractedHostSSHConfig map[string]*sshconfig.SSHHost
+// SSHConfig is a parsed ssh_config file, see LoadSSHConfig.
+type SSHConfig struct {
+	lines []sshConfigLine
+}
 
-func ParseAndLoadSSHConfig(sshConfig string) (map[string]*sshconfig.SSHHost, error) {
-	if sshConfig != "" {
-		confHosts, err := sshconfig.ParseSSHConfig(ResolvePath(sshConfig))
-		if err != nil {
-			return nil, err
-		}
+// LoadSSHConfig reads ssh_config file, along with the files included by
+// its Include directives.
+func LoadSSHConfig(path string) (*SSHConfig, error) {
+	lines, err := loadSSHConfigLines(ResolvePath(path), 0)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHConfig{lines: lines}, nil
+}
 
-		extractedHostSSHConfig = make(map[string]*sshconfig.SSHHost)
+// Lookup evaluates Host and Match blocks for host, the same way as
+// `ssh -G host` does, and returns the obtained hostname, user, port,
+// identity file and proxy jump. Alias is set to host, if the hostname
+// differs. Match exec criteria never match. It reports whether any
+// option applies to host.
+func (c *SSHConfig) Lookup(host string) (HostConfig, bool) {
+	r := &Resolver{Config: c}
+	values := r.configFor(host, "", false)
+	if len(values) == 0 {
+		return HostConfig{}, false
+	}
+	first := func(keyword string) string {
+		if v := values[keyword]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
 
-		// flatten Host -> *SSHHost, not the prettiest
-		// but will do
-		for _, conf := range confHosts {
-			for _, host := range conf.Host {
-				extractedHostSSHConfig[host] = conf
-			}
+	conf := HostConfig{Host: host, User: first("user"), Port: first("port")}
+	if v := first("hostname"); v != "" {
+		conf.Host = strings.ReplaceAll(v, "%h", host)
+		if conf.Host != host {
+			conf.Alias = host
 		}
-		return extractedHostSSHConfig, nil
 	}
-	return nil, nil
+	if v := first("identityfile"); v != "" && !strings.EqualFold(v, "none") {
+		conf.IdentityFile = ResolvePath(v)
+	}
+	if v := first("proxyjump"); strings.EqualFold(v, BastionNone) {
+		conf.Bastion = BastionNone
+	} else if v != "" {
+		conf.Bastion = v
+	}
+	return conf, true
+}
+
+// Resolver resolves hosts by ssh_config, see Resolver.NewHost. It's safe
+// for concurrent use. A nil Resolver, or one without Config, resolves
+// hosts without any ssh_config.
+type Resolver struct {
+	Config    *SSHConfig
+	AllowExec bool // Evaluate "Match exec" criteria, which run local commands.
+
+	execWarning sync.Once
+}
+
+// NewResolver loads ssh_config file, if given. allowExec enables evaluation
+// of "Match exec" criteria; they never match otherwise.
+func NewResolver(sshConfig string, allowExec bool) (*Resolver, error) {
+	r := &Resolver{AllowExec: allowExec}
+	if sshConfig == "" {
+		return r, nil
+	}
+	conf, err := LoadSSHConfig(sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	r.Config = conf
+	return r, nil
+}
+
+// defaultResolver is used by NewHost, NewHostWithDefaults, NewHostFromConfig
+// and NewSupfile, see ParseAndLoadSSHConfig.
+var defaultResolver *Resolver
+
+// ParseAndLoadSSHConfig loads ssh_config file used by NewHost and NewSupfile
+// to resolve hosts. It's not safe to call it concurrently with them.
+//
+// Deprecated: Use NewResolver and ParseOptions.Resolver instead.
+func ParseAndLoadSSHConfig(sshConfig string) error {
+	r, err := NewResolver(sshConfig, false)
+	if err != nil {
+		return err
+	}
+	defaultResolver = r
+	return nil
 }
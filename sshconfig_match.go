@@ -0,0 +1,294 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfigLine is a single "Keyword arguments" line of ssh_config.
+type sshConfigLine struct {
+	keyword string // Lower case.
+	args    []string
+	include []sshConfigLine // Lines of the files included by Include.
+}
+
+// loadSSHConfigLines reads ssh_config file, along with the files referenced
+// by Include directives.
+func loadSSHConfigLines(file string, depth int) ([]sshConfigLine, error) {
+	if depth > 16 {
+		return nil, fmt.Errorf("%v: too many nested Include directives", file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []sshConfigLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		keyword, rest := text, ""
+		if i := strings.IndexAny(text, " \t="); i >= 0 {
+			keyword, rest = text[:i], strings.TrimLeft(text[i:], " \t")
+			rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+		}
+		line := sshConfigLine{keyword: strings.ToLower(keyword), args: splitSSHConfigArgs(rest)}
+
+		if line.keyword != "include" {
+			lines = append(lines, line)
+			continue
+		}
+		for _, pattern := range line.args {
+			// Relative paths are in ~/.ssh, the same as for user's config.
+			pattern = ResolvePath(pattern)
+			if !filepath.IsAbs(pattern) {
+				home, _ := os.UserHomeDir()
+				pattern = filepath.Join(home, ".ssh", pattern)
+			}
+			files, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, included := range files {
+				includedLines, err := loadSSHConfigLines(included, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				line.include = append(line.include, includedLines...)
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// splitSSHConfigArgs splits arguments by whitespace, honoring double quotes.
+func splitSSHConfigArgs(s string) []string {
+	var args []string
+	var arg strings.Builder
+	quoted, inArg := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// configFor evaluates Host and Match blocks of the loaded ssh_config
+// for host and remote user, in order, keeping the first obtained value
+// of each keyword, the same way as ssh does. An explicit user, as in
+// <user>@<host>, takes precedence over User of the blocks, also for
+// Match user criteria.
+func (r *Resolver) configFor(host, remoteUser string, explicitUser bool) map[string][]string {
+	values := map[string][]string{}
+	if explicitUser {
+		values["user"] = []string{remoteUser}
+	}
+	var lines []sshConfigLine
+	if r.Config != nil {
+		lines = r.Config.lines
+	}
+	r.eval(lines, true, false, host, remoteUser, values)
+	return values
+}
+
+// eval evaluates lines into values. Blocks of files included from
+// inactive blocks never match, and included files don't change whether
+// the including block is active.
+func (r *Resolver) eval(lines []sshConfigLine, active, neverMatch bool, host, remoteUser string, values map[string][]string) {
+	for _, line := range lines {
+		switch line.keyword {
+		case "host":
+			active = !neverMatch && matchPatternList(host, line.args)
+		case "match":
+			active = !neverMatch && r.matchCriteria(line.args, host, remoteUser, values)
+		case "include":
+			r.eval(line.include, active, neverMatch || !active, host, remoteUser, values)
+		default:
+			if _, ok := values[line.keyword]; active && !ok {
+				values[line.keyword] = line.args
+			}
+		}
+	}
+}
+
+// matchCriteria evaluates criteria of a Match line. All of them need
+// to match. canonical never matches, since there's no hostname
+// canonicalization, while final always does.
+func (r *Resolver) matchCriteria(args []string, host, remoteUser string, values map[string][]string) bool {
+	hostname := host
+	if v, ok := values["hostname"]; ok && len(v) > 0 {
+		hostname = strings.ReplaceAll(v[0], "%h", host)
+	}
+	if v, ok := values["user"]; ok && len(v) > 0 {
+		remoteUser = v[0]
+	}
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	for i := 0; i < len(args); i++ {
+		criteria := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criteria, "!")
+		criteria = strings.TrimPrefix(criteria, "!")
+
+		var match bool
+		switch criteria {
+		case "all", "final":
+			match = true
+		case "canonical":
+			match = false
+		default:
+			if i+1 >= len(args) {
+				return false // Missing argument.
+			}
+			i++
+			arg := args[i]
+			switch criteria {
+			case "host":
+				match = matchPatternList(hostname, strings.Split(arg, ","))
+			case "originalhost":
+				match = matchPatternList(host, strings.Split(arg, ","))
+			case "user":
+				match = matchPatternList(remoteUser, strings.Split(arg, ","))
+			case "localuser":
+				match = matchPatternList(localUser, strings.Split(arg, ","))
+			case "exec":
+				if !r.AllowExec {
+					r.execWarning.Do(func() {
+						fmt.Fprintln(os.Stderr, "Warning: ssh_config Match exec is ignored, enable it with -sshconfig-exec")
+					})
+					return false
+				}
+				tokens := strings.NewReplacer("%%", "%", "%h", hostname, "%n", host, "%r", remoteUser, "%u", localUser)
+				match = exec.Command("/bin/sh", "-c", tokens.Replace(arg)).Run() == nil
+			default:
+				return false // Unsupported criteria, ie. localnetwork.
+			}
+		}
+		if match == negate {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPatternList matches name against ssh_config patterns. A matching
+// negated pattern (!pattern) makes the whole list not match.
+func matchPatternList(name string, patterns []string) bool {
+	match := false
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(name, pattern[1:]) {
+				return false
+			}
+			continue
+		}
+		if matchPattern(name, pattern) {
+			match = true
+		}
+	}
+	return match
+}
+
+// matchPattern matches name against pattern with * and ? wildcards.
+func matchPattern(name, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchPattern(name[i:], pattern[1:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || !strings.EqualFold(name[:1], pattern[:1]) {
+				return false
+			}
+		}
+		name, pattern = name[1:], pattern[1:]
+	}
+	return len(name) == 0
+}
+
+// apply sets host fields obtained from the loaded ssh_config. User and
+// port given explicitly in <user>@<host>:<port> take precedence, as in
+// ssh.
+func (r *Resolver) apply(host *Host, explicitUser, explicitPort bool) {
+	if r == nil || r.Config == nil {
+		return
+	}
+	alias := host.Address
+	values := r.configFor(alias, host.User, explicitUser)
+	first := func(keyword string) string {
+		if v := values[keyword]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	if v := first("hostname"); v != "" {
+		host.Address = strings.ReplaceAll(v, "%h", alias)
+		if host.Address != alias {
+			host.KnownAs = alias
+		}
+	}
+	if v := first("user"); v != "" && !explicitUser {
+		host.User = v
+	}
+	if v := first("port"); v != "" && !explicitPort {
+		host.Port = v
+	}
+	if v := first("identityfile"); v != "" && !strings.EqualFold(v, "none") {
+		home, _ := os.UserHomeDir()
+		tokens := strings.NewReplacer("%%", "%", "%d", home, "%h", host.Address, "%n", alias, "%r", host.User)
+		host.IdentityFile = ResolvePath(tokens.Replace(v))
+	}
+	if v := first("proxyjump"); strings.EqualFold(v, BastionNone) {
+		host.Bastion = BastionNone
+	} else if v != "" {
+		host.Bastion = v
+	}
+	if v := values["ciphers"]; len(v) > 0 {
+		host.Algorithms.Ciphers = sshConfigAlgorithms(DefaultSSHAlgorithms.Ciphers, v)
+	}
+	if v := values["macs"]; len(v) > 0 {
+		host.Algorithms.MACs = sshConfigAlgorithms(DefaultSSHAlgorithms.MACs, v)
+	}
+	if v := values["kexalgorithms"]; len(v) > 0 {
+		host.Algorithms.KeyExchanges = sshConfigAlgorithms(DefaultSSHAlgorithms.KeyExchanges, v)
+	}
+	if v := values["hostkeyalgorithms"]; len(v) > 0 {
+		host.Algorithms.HostKeyAlgorithms = sshConfigAlgorithms(DefaultSSHAlgorithms.HostKeyAlgorithms, v)
+	}
+}
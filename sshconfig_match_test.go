@@ -0,0 +1,70 @@
+package sup
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestSSHConfigMatch resolves hosts by testdata/ssh_config/match and
+// compares them with the output of `ssh -G`. The wanted lines were taken
+// from OpenSSH; if ssh is installed, they're checked against it again.
+func TestSSHConfigMatch(t *testing.T) {
+	const config = "testdata/ssh_config/match"
+	r, err := NewResolver(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sshErr := exec.LookPath("ssh")
+
+	for _, tt := range []struct {
+		host string
+		want []string // Lines of `ssh -G host`.
+	}{
+		{"bastion", []string{"user jump", "hostname 10.0.0.1", "port 22"}},
+		{"web1", []string{"user app", "hostname web1.prod.internal", "port 2222"}},
+		{"deploy@web1", []string{"user deploy", "hostname web1.prod.internal", "port 2222", "identityfile /keys/deploy", "proxyjump bastion"}},
+		{"api2", []string{"user app", "hostname api2.prod.internal", "port 2222"}},
+		{"db1", []string{"user postgres", "hostname db1", "port 5432", "proxyjump none"}},
+		{"root@db1", []string{"user root", "hostname db1", "port 5433"}},
+		{"builder", []string{"user ci", "hostname 10.0.0.9", "port 22"}},
+		{"other", []string{"user ops", "hostname other", "port 22"}},
+		{"deploy@other", []string{"user deploy", "hostname other", "port 22"}},
+	} {
+		t.Run(tt.host, func(t *testing.T) {
+			host, err := r.NewHost(tt.host, HostDefaults{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{"user " + host.User, "hostname " + host.Address, "port " + host.Port}
+			if host.IdentityFile != "" {
+				got = append(got, "identityfile "+host.IdentityFile)
+			}
+			if host.Bastion != "" {
+				got = append(got, "proxyjump "+host.Bastion)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+
+			if sshErr != nil {
+				return
+			}
+			out, err := exec.Command("ssh", "-G", "-F", config, tt.host).Output()
+			if err != nil {
+				t.Fatalf("ssh -G: %v", err)
+			}
+			lines := map[string]bool{}
+			for _, line := range strings.Split(string(out), "\n") {
+				lines[line] = true
+			}
+			for _, line := range tt.want {
+				// ssh -G doesn't print ProxyJump none.
+				if !lines[line] && line != "proxyjump none" {
+					t.Errorf("ssh -G %v doesn't print %q", tt.host, line)
+				}
+			}
+		})
+	}
+}
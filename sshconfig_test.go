@@ -0,0 +1,49 @@
+package sup_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+// TestSSHConfigLookup looks up hosts in ~/.ssh/config of the home
+// directory testdata/ssh_config/home, which includes more files by
+// wildcards. Run with SUPTEST_UPDATE=1 to update the golden file.
+func TestSSHConfigLookup(t *testing.T) {
+	home, err := filepath.Abs("testdata/ssh_config/home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	conf, err := sup.LoadSSHConfig(filepath.Join(home, ".ssh", "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	for _, host := range []string{
+		"web1", "web3", "api-1", "db-main", "db-replica1", "db-replica10",
+		"app.staging", "svc.internal", "legacy.internal", "unknown",
+	} {
+		c, ok := conf.Lookup(host)
+		fmt.Fprintf(&b, "== %v\nfound: %v\n", host, ok)
+		for _, field := range []struct{ name, value string }{
+			{"host", c.Host},
+			{"alias", c.Alias},
+			{"user", c.User},
+			{"port", c.Port},
+			{"identity_file", strings.Replace(c.IdentityFile, sup.ResolvePath("~"), "~", 1)},
+			{"bastion", c.Bastion},
+		} {
+			if field.value != "" {
+				fmt.Fprintf(&b, "%v: %v\n", field.name, filepath.ToSlash(field.value))
+			}
+		}
+	}
+	suptest.Golden(t, "testdata/ssh_config/lookup.golden", b.String())
+}
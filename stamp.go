@@ -0,0 +1,146 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ReleaseStampFile is the release metadata written by Upload.Stamp.
+const ReleaseStampFile = ".sup-release.json"
+
+// releaseTimestamp is the layout of Release.Timestamp.
+const releaseTimestamp = "20060102150405"
+
+// Release identifies the run on all its hosts. It names the atomic_dir
+// releases, expands the Upload.Dst templates and is written by Upload.Stamp.
+type Release struct {
+	RunID     string // $SUP_RUN_ID.
+	User      string // $SUP_USER.
+	Timestamp string // $SUP_TIME as 20060102150405, ie. "20240131120000".
+
+	gitSHA string // $SUP_GIT_SHA.
+}
+
+// newRelease returns the release of the run by its env vars. The time
+// falls back to now if $SUP_TIME is not set or isn't RFC 3339.
+func newRelease(env EnvList) Release {
+	t, err := time.Parse(time.RFC3339, env.Get("SUP_TIME"))
+	if err != nil {
+		t = time.Now()
+	}
+	return Release{
+		RunID:     env.Get("SUP_RUN_ID"),
+		User:      env.Get("SUP_USER"),
+		Timestamp: t.UTC().Format(releaseTimestamp),
+		gitSHA:    env.Get("SUP_GIT_SHA"),
+	}
+}
+
+// expand returns value of the key (ie. dst) with {{.RunID}} and
+// {{.Timestamp}} templates expanded.
+func (r Release) expand(key, value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", key, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, struct{ RunID, Timestamp string }{r.RunID, r.Timestamp}); err != nil {
+		return "", fmt.Errorf("%v: %v", key, err)
+	}
+	return b.String(), nil
+}
+
+// stamp returns the release metadata of upload of the local src, resolved
+// against cwd, or of its listed files only, unless files is nil.
+func (r Release) stamp(cwd, src, exclude string, files []string) ([]byte, error) {
+	sum, err := sourceSHA256(resolve(cwd, src), exclude, files)
+	if err != nil {
+		return nil, fmt.Errorf("stamp: %v", err)
+	}
+	return json.Marshal(struct {
+		RunID        string `json:"run_id"`
+		User         string `json:"user"`
+		GitCommit    string `json:"git_commit,omitempty"`
+		Timestamp    string `json:"timestamp"`
+		Source       string `json:"source"`
+		SourceSHA256 string `json:"source_sha256"`
+	}{r.RunID, r.User, r.gitCommit(cwd), r.Timestamp, src, sum})
+}
+
+// gitCommit returns $SUP_GIT_SHA of the Supfile or the local env, or HEAD
+// of the git repository of dir. It's empty outside of a repository.
+func (r Release) gitCommit(dir string) string {
+	if r.gitSHA != "" {
+		return r.gitSHA
+	}
+	if sha := os.Getenv("SUP_GIT_SHA"); sha != "" {
+		return sha
+	}
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return string(bytes.TrimSpace(out))
+}
+
+// sourceSHA256 returns checksum of the files of path, a file or a directory,
+// over their relative paths and contents. Files matching exclude patterns
+// (comma separated, by name or relative path) are left out, as by tar,
+// and so are the files not listed, unless files is nil.
+func sourceSHA256(path, exclude string, files []string) (string, error) {
+	excluded := uploadFilter(exclude, files)
+	h := sha256.New()
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		if rel != "." && excluded(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(h, "%s\x00", filepath.ToSlash(rel))
+		_, err = io.Copy(h, f)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// stampCommand returns command writing the stamp into dir, a path to be
+// expanded by the remote shell within double quotes, ie. $sup_dst. The
+// stamp is renamed into place, so it's never seen partially written.
+func stampCommand(stamp []byte, dir string) string {
+	file := dir + "/" + ReleaseStampFile
+	return fmt.Sprintf(`printf '%%s\n' %s > "%s.tmp" && mv -f "%s.tmp" "%s"`, ShellQuote(string(stamp)), file, file, file)
+}
@@ -0,0 +1,104 @@
+package sup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stepMarker starts the lines the steps script prints before each step,
+// see stepsScript. They're consumed by emitLines.
+const stepMarker = "\x1esup-step "
+
+// runValue is the run: value, a string or a list of steps.
+type runValue struct {
+	run   string
+	steps []string
+}
+
+func (r *runValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*r = runValue{} // The last of duplicate run: keys wins.
+	if err := unmarshal(&r.steps); err == nil {
+		if r.steps == nil {
+			r.steps = []string{}
+		}
+		return nil
+	}
+	return unmarshal(&r.run)
+}
+
+// checkSteps validates the steps options.
+func (cmd *Command) checkSteps() error {
+	switch {
+	case cmd.Steps != nil && len(cmd.Steps) == 0:
+		return fmt.Errorf("run has no steps")
+	case cmd.StepsContinueOnError && len(cmd.Steps) == 0:
+		return fmt.Errorf("steps_continue_on_error requires run: to be a list of steps")
+	}
+	return nil
+}
+
+// runScript returns the run: of the command, the steps script if it's
+// a list of steps.
+func (cmd *Command) runScript() string {
+	if len(cmd.Steps) == 0 {
+		return cmd.Run
+	}
+	return stepsScript(cmd.Steps, cmd.StepsContinueOnError)
+}
+
+// stepsScript returns script running the steps in one shell, so they share
+// the working directory and variables. Each step is preceded by a marker
+// line on both STDOUT and STDERR, which attributes the lines to the step,
+// and its failure is reported with the step index and text. The script
+// stops at the first failed step, unless continueOnError is set, and
+// exits with the status of the first failed step.
+func stepsScript(steps []string, continueOnError bool) string {
+	var b strings.Builder
+	b.WriteString("sup_steps_status=0; sup_steps_failed=\n")
+	for i, step := range steps {
+		n := fmt.Sprintf("%d/%d", i+1, len(steps))
+		fmt.Fprintf(&b, "printf '%%s\\n' %s; printf '%%s\\n' %s >&2\n",
+			ShellQuote(stepMarker+n+" "+stepTitle(step)), ShellQuote(stepMarker+strconv.Itoa(i+1)))
+		fmt.Fprintf(&b, "%s\n", strings.TrimRight(step, "\n"))
+		fmt.Fprintf(&b, "sup_status=$?; if [ $sup_status -ne 0 ]; then echo %s\"$sup_status: \"%s >&2; ",
+			ShellQuote("step "+n+" failed with exit status "), ShellQuote(stepTitle(step)))
+		if continueOnError {
+			fmt.Fprintf(&b, "[ $sup_steps_status -ne 0 ] || sup_steps_status=$sup_status; sup_steps_failed=\"$sup_steps_failed %d\"; fi\n", i+1)
+		} else {
+			b.WriteString("exit $sup_status; fi\n")
+		}
+	}
+	if continueOnError {
+		fmt.Fprintf(&b, "if [ $sup_steps_status -ne 0 ]; then echo \"steps failed:$sup_steps_failed of %d\" >&2; exit $sup_steps_status; fi\n", len(steps))
+	}
+	return b.String()
+}
+
+// stepTitle returns the first line of the step, marked as shortened if
+// the step has more lines.
+func stepTitle(step string) string {
+	step = strings.TrimSpace(step)
+	if i := strings.IndexByte(step, '\n'); i >= 0 {
+		return step[:i] + " ..."
+	}
+	return step
+}
+
+// parseStepMarker returns the step of the marker line and the title line
+// shown instead of it, if any, or 0 if the line isn't a marker.
+func parseStepMarker(line string) (step int, title string) {
+	if !strings.HasPrefix(line, stepMarker) {
+		return 0, ""
+	}
+	counter, text, _ := strings.Cut(strings.TrimPrefix(line, stepMarker), " ")
+	n, _, _ := strings.Cut(counter, "/")
+	step, err := strconv.Atoi(n)
+	if err != nil || step <= 0 {
+		return 0, ""
+	}
+	if text != "" {
+		title = "step " + counter + ": " + text
+	}
+	return step, title
+}
@@ -1,14 +1,16 @@
 package sup
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"os"
-	"os/signal"
-	"strings"
+	"os/exec"
 	"sync"
+	"text/template"
+	"time"
 
-	"github.com/goware/prefixer"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 )
@@ -16,61 +18,292 @@ import (
 const VERSION = "0.5"
 
 type Stackup struct {
-	conf   *Supfile
-	debug  bool
-	prefix bool
+	conf           *Supfile
+	debug          bool
+	prefix         bool
+	stripANSI      bool
+	batch          bool
+	maxOutputBytes int64   // Of each host's command in the text output, see MaxOutputBytes.
+	noBanners      bool    // See Banners.
+	daemon         string  // Socket of sup daemon, see Daemon.
+	preferKey      string  // Agent key tried first, see PreferKey.
+	release        Release // Set by Run.
+	relay          *relay  // Network bastion relaying uploads, set by Run.
+	network        string  // Name of the network, set by Run.
+	bastion        string  // Bastion of the network, set by Run.
+
+	prefixFormat    *template.Template // Nil with prefixFormatSet disables the prefixes.
+	prefixFormatSet bool
+
+	uploadFiles map[*Upload][]string // Files of git_tracked uploads, set by Run.
+	fanouts     []*fanout            // Inputs shared by hosts, spooled by Run.
+	sync        *syncSnapshot        // Directory synced to the hosts, see Sync.
+	localAlso   *LocalhostClient     // Pseudo-host of local: also commands, set by Run.
+	banner      *commandBanner       // Command being run, guarded by eventsMu.
+	seed        *int64               // Of the splay of the hosts, see Seed.
+	since       string               // Baseline of changed_paths, see ChangedSince.
+	deployed    *Deployed            // Commits the commands were last run at, see Deployed.
+	keepTunnels io.Reader            // See KeepTunnels.
+	pipeOut     *pipeStream          // Stream STDOUT of the run tasks goes to, of the source of Pipe.
+	pipeIn      *pipeStream          // Stream STDIN of the Stdin tasks is read from, of the destination of Pipe.
+	recorder    *Recorder            // Records the tasks run, see Record.
+	skipped     map[string]bool      // Names of the commands skipped, see SkipCommands.
+	dial        ClientFunc
+
+	stdout   io.Writer
+	stderr   io.Writer
+	handlers []func(Event)
+	eventsMu *sync.Mutex
 }
 
 func New(conf *Supfile) (*Stackup, error) {
-	return &Stackup{
-		conf: conf,
-	}, nil
+	sup := &Stackup{
+		conf:     conf,
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+		eventsMu: &sync.Mutex{},
+	}
+	if conf.PrefixFormat != nil {
+		if err := sup.PrefixFormat(*conf.PrefixFormat); err != nil {
+			return nil, err
+		}
+	}
+	return sup, nil
 }
 
 // Run runs set of commands on multiple hosts defined by network sequentially.
 // TODO: This megamoth method needs a big refactor and should be split
 //
 //	to multiple smaller methods.
-func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) error {
+func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command) (err error) {
+	defer func() {
+		sup.endCommand(err)
+		sup.emit(Event{Type: RunFinished, Err: err})
+	}()
+
 	if len(commands) == 0 {
 		return errors.New("no commands to be run")
 	}
+	if err := network.checkHostsResolved(); err != nil {
+		return err
+	}
+
+	for _, cmd := range commands {
+		if err := cmd.parseRunOn(); err != nil {
+			return err
+		}
+	}
 
+	if err := sup.checkBatch(commands); err != nil {
+		return err
+	}
+
+	// Runs of local commands only open the network's tunnels, their ports
+	// exported to the commands, instead of connecting to the hosts.
+	var tunnels []*openTunnel
+	if network.Tunneled(commands) {
+		if sup.dial != nil {
+			return errors.New("tunnels can't be opened by the hosts of Dial")
+		}
+		if tunnels, err = listenTunnels(network, &envVars); err != nil {
+			return err
+		}
+		defer closeTunnels(tunnels)
+	} else if len(network.Hosts) == 0 && len(network.Tunnels) > 0 {
+		return errors.New("network has no hosts, its tunnels are for local commands only")
+	}
+
+	if sup.sync != nil {
+		envVars.Set("SUP_SYNC_DIR", sup.sync.syncDir(network))
+	}
 	env := envVars.AsExport()
+	if sup.recorder != nil {
+		sup.recorder.mask(envVars)
+	}
+	sup.release = newRelease(envVars)
+	sup.network = envVars.Get("SUP_NETWORK")
+	sup.bastion = network.Bastion
+
+	// Commands skipped by the user or whose changed_paths didn't change are
+	// skipped, builds included.
+	commands = sup.skipByUser(commands)
+	if commands, err = sup.skipUnchanged(commands, sup.network); err != nil {
+		return err
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+
+	// Keys of identity_key_env and identity_key_file are checked before
+	// any build. Hosts of Dial don't connect by SSH.
+	if sup.dial == nil {
+		if err := sup.loadIdentityKeys(network); err != nil {
+			return err
+		}
+	}
+
+	// Run local builds first, so a failing build prevents any remote activity.
+	for _, cmd := range commands {
+		if cmd.Build == nil {
+			continue
+		}
+		if err := sup.build(cmd, env); err != nil {
+			return errors.Wrap(err, cmd.Name)
+		}
+		if cmd.artifactsTar != "" {
+			defer os.Remove(cmd.artifactsTar)
+		}
+	}
+
+	// List the files of git_tracked uploads once, including the build
+	// outputs, before any remote activity.
+	if err := sup.listGitFiles(commands, env); err != nil {
+		return err
+	}
+
+	var openSSH bool
+	switch network.Transport {
+	case "", TransportNative:
+	case TransportOpenSSH:
+		openSSH = true
+	default:
+		return fmt.Errorf("unknown transport %q", network.Transport)
+	}
+	if tunnels != nil && (openSSH || network.Auth != "") {
+		return fmt.Errorf("tunnels require the %v transport", TransportNative)
+	}
+
+	// GSSAPI auth isn't supported by the native client, use the openssh
+	// transport instead.
+	var sshOptions []string
+	switch network.Auth {
+	case "":
+	case AuthGSSAPI:
+		if network.Transport == TransportNative {
+			return fmt.Errorf("auth: gssapi requires the %v transport", TransportOpenSSH)
+		}
+		if err := checkKerberosTicket(); err != nil {
+			return err
+		}
+		openSSH = true
+		sshOptions = gssapiOptions(network.GSSAPIDelegate)
+	default:
+		return fmt.Errorf("unknown auth %q", network.Auth)
+	}
+	if sup.batch {
+		// Unknown hosts fail instead of being prompted for.
+		sshOptions = append(sshOptions, "StrictHostKeyChecking=yes")
+	}
+	if err := network.DNS.check(); err != nil {
+		return err
+	}
+	if err := network.ExpandPods(context.Background()); err != nil {
+		return err
+	}
+	warnings, err := sup.checkUploadDsts(network, envVars, commands)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		sup.errorf("%v\n", w)
+	}
+	limiter, err := newConnectLimiter(network)
+	if err != nil {
+		return err
+	}
+	connectTimeout, err := parseDuration(network.ConnectTimeout, 0)
+	if err != nil {
+		return errors.Wrap(err, "connect_timeout")
+	}
+	if connectTimeout > 0 && openSSH {
+		// ssh waits for the TCP connection and the banner at most
+		// ConnectTimeout seconds each.
+		sshOptions = append(sshOptions, fmt.Sprintf("ConnectTimeout=%d", int(math.Ceil(connectTimeout.Seconds()))))
+	}
+	connectStart := time.Now()
 
-	// Collect list of all bastions
+	// Collect list of all bastions the hosts are connected through. Hosts
+	// with bastion: none are connected to directly. Commands with bastion:
+	// true run on the network bastion, even if no host uses it.
+	hosts := network.Hosts
 	bastions := make([]string, 0)
-	for _, host := range network.Hosts {
-		if host.Bastion != "" {
-			bastions = append(bastions, host.Bastion)
+	if tunnels != nil {
+		// The hosts forwarding the tunnels only.
+		hosts, bastions = nil, tunnelVias(tunnels)
+	}
+	for _, host := range hosts {
+		if bastion := host.jumpHost(network.Bastion); bastion != "" {
+			bastions = append(bastions, bastion)
 		}
 	}
-	if network.Bastion != "" {
-		bastions = append(bastions, network.Bastion)
+	for _, cmd := range commands {
+		if cmd.Bastion && network.Bastion != "" {
+			bastions = append(bastions, network.Bastion)
+			break
+		}
 	}
 	// Pre-connect to all bastions, so we can use them as jump hosts. If hosts
 	// are using the same bastion, we don't want to connect to it multiple times.
-	connectedBastions, err := connectToBastions(bastions)
-	if err != nil {
-		return err
+	// The openssh transport lets ssh handle the jump hosts by itself.
+	connectedBastions := make(map[string]*SSHClient)
+	if !openSSH && sup.dial == nil {
+		var err error
+		connectedBastions, err = sup.connectToBastions(network.DNS, bastions, network.SSHAlgorithms, limiter, connectTimeout)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range tunnels {
+		t.serve(connectedBastions[t.via], sup.errorf)
 	}
+	defer sup.holdTunnels(tunnels)
 
 	var wg sync.WaitGroup
-	clientCh := make(chan Client, len(network.Hosts))
-	errCh := make(chan error, len(network.Hosts))
+	clientCh := make(chan Client, len(hosts))
+	errCh := make(chan error, len(hosts))
 
-	for i, host := range network.Hosts {
+	for i, host := range hosts {
 		wg.Add(1)
 		go func(i int, host *Host) {
 			defer wg.Done()
 
-			// Localhost client.
+			sup.emit(Event{Type: HostConnecting, Host: host.GetHostname()})
+			var err error
+			var addr, resolvedBy string
+			defer func() {
+				event := Event{Type: HostConnected, Host: host.GetHostname(), Err: err}
+				if resolvedBy != "" {
+					event.Addr = addr
+				}
+				sup.emit(event)
+			}()
+
+			hostEnv := host.exports(env)
+
+			// Client of Dial.
+			if sup.dial != nil {
+				var client Client
+				if client, err = sup.dial(host, hostEnv); err != nil {
+					errCh <- errors.Wrapf(err, "connecting to %v failed", host.GetHostname())
+					return
+				}
+				clientCh <- client
+				return
+			}
+
+			// Localhost client, running kubectl exec for pods.
 			if host.Address == "localhost" {
+				if host.Pod != "" {
+					if err = checkPodExec(host); err != nil {
+						errCh <- errors.Wrap(err, host.GetHostname())
+						return
+					}
+				}
 				local := &LocalhostClient{
-					env:  env + `export SUP_HOST="` + host.GetHostname() + `";`,
+					env:  hostEnv,
 					host: host,
 				}
-				if err := local.Connect(); err != nil {
+				if err = local.Connect(); err != nil {
 					errCh <- errors.Wrap(err, "connecting to localhost failed")
 					return
 				}
@@ -78,26 +311,78 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 				return
 			}
 
+			// Hosts are connected to by addresses from host_overrides or the
+			// network resolver, if any.
+			bastion := host.jumpHost(network.Bastion)
+			route := "directly"
+			if bastion != "" {
+				route = "through bastion " + bastion
+			}
+			addr, resolvedBy, err = network.DNS.resolve(host.Address, bastion == "")
+			if err != nil {
+				errCh <- errors.Wrap(err, host.GetHostname())
+				return
+			}
+
+			sup.waitConnect(limiter, host.GetHostname())
+
+			// OpenSSH client.
+			if openSSH {
+				remote := &OpenSSHClient{
+					env:     hostEnv,
+					host:    host,
+					options: append(network.SSHAlgorithms.Override(host.Algorithms).OpenSSHOptions(), sshOptions...),
+					gssapi:  network.Auth == AuthGSSAPI,
+					color:   sup.color(i),
+					timeout: connectTimeout,
+				}
+				if resolvedBy != "" {
+					remote.hostName = addr
+				}
+				if host.Bastion == BastionNone {
+					// Nor by ProxyJump of the user's SSH config.
+					remote.options = append(remote.options, "ProxyJump=none")
+				}
+				if bastion != "" {
+					if remote.bastion, err = network.DNS.jumpSpec(sup.conf.resolver, bastion); err != nil {
+						errCh <- errors.Wrap(err, "bastion "+bastion)
+						return
+					}
+				}
+				if err = remote.Connect(); err != nil {
+					errCh <- errors.Wrap(err, "connecting to remote host "+route+" failed")
+					return
+				}
+				clientCh <- remote
+				return
+			}
+
 			// SSH client.
 			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host.GetHostname() + `";`,
-				host:  host,
-				color: Colors[i%len(Colors)],
+				env:        hostEnv,
+				host:       host,
+				color:      sup.color(i),
+				algorithms: network.SSHAlgorithms,
+				batch:      sup.batch,
+				timeout:    connectTimeout,
+				preferKey:  sup.preferKey,
 			}
 
-			if host.Bastion != "" {
-				if err := remote.ConnectWith(connectedBastions[host.Bastion].DialThrough); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
-					return
+			if bastion != "" {
+				dial := connectedBastions[bastion].DialThrough
+				if resolvedBy != "" {
+					dial = dialer(addr, dial)
 				}
-			} else if network.Bastion != "" {
-				if err := remote.ConnectWith(connectedBastions[network.Bastion].DialThrough); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
+				if err = remote.ConnectWith(dial); err != nil {
+					errCh <- errors.Wrap(err, "connecting to remote host "+route+" failed")
 					return
 				}
 			} else {
-				if err := remote.Connect(); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host failed")
+				if resolvedBy == "" {
+					addr = ""
+				}
+				if err = remote.ConnectWith(remote.directDialer(addr, sup.daemon)); err != nil {
+					errCh <- errors.Wrap(err, "connecting to remote host "+route+" failed")
 					return
 				}
 			}
@@ -107,15 +392,24 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 	wg.Wait()
 	close(clientCh)
 	close(errCh)
+	if limiter != nil {
+		sup.errorf("Connected to %v host(s) in %v, connect_rate %v\n", len(hosts), time.Since(connectStart).Round(time.Millisecond), limiter.rate)
+	}
 
 	maxLen := 0
 	var clients []Client
 	for client := range clientCh {
-		if remote, ok := client.(*SSHClient); ok {
+		switch remote := client.(type) {
+		case *SSHClient:
+			defer remote.Close()
+		case *OpenSSHClient:
 			defer remote.Close()
+		default:
+			if sup.dial != nil {
+				defer client.Close()
+			}
 		}
-		_, prefixLen := client.Prefix()
-		if prefixLen > maxLen {
+		if prefixLen := sup.prefixWidth(client, commands); prefixLen > maxLen {
 			maxLen = prefixLen
 		}
 		clients = append(clients, client)
@@ -124,135 +418,203 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 		return errors.Wrap(err, "connecting to clients failed")
 	}
 
-	// Run command or run multiple commands defined by target sequentially.
+	// Tunneled commands run once, on the "local" pseudo-host.
+	if tunnels != nil {
+		local := &LocalhostClient{
+			env:  env + `export SUP_HOST="` + LocalHostname + `";`,
+			host: &Host{Address: "localhost", KnownAs: LocalHostname},
+		}
+		maxLen = sup.prefixWidth(local, commands)
+		clients = []Client{local}
+	}
+
+	// Commands with local: also run on the "local" pseudo-host too, with
+	// the env of the network.
+	sup.localAlso = nil
+	for _, cmd := range commands {
+		if cmd.LocalAlso {
+			sup.localAlso = &LocalhostClient{
+				env:   env + `export SUP_HOST="` + LocalHostname + `";`,
+				host:  &Host{Address: "localhost", KnownAs: LocalHostname},
+				color: sup.color(len(network.Hosts)),
+			}
+			if prefixLen := sup.prefixWidth(sup.localAlso, commands); prefixLen > maxLen {
+				maxLen = prefixLen
+			}
+			break
+		}
+	}
+
+	// Commands with bastion: true run on the bastions instead of the hosts.
+	var bastionHosts []Client
 	for _, cmd := range commands {
+		if cmd.Bastion {
+			bastionHosts, err = sup.bastionClients(network.DNS, bastions, connectedBastions, openSSH, append(network.SSHAlgorithms.OpenSSHOptions(), sshOptions...), network.Auth == AuthGSSAPI, env)
+			if err != nil {
+				return err
+			}
+			for _, client := range bastionHosts {
+				if prefixLen := sup.prefixWidth(client, commands); prefixLen > maxLen {
+					maxLen = prefixLen
+				}
+				if sup.dial != nil {
+					defer client.Close()
+				}
+			}
+			break
+		}
+	}
+
+	// Uploads via: bastion are relayed by the network bastion, if any.
+	sup.relay = nil
+	if network.Bastion != "" && containsString(bastions, network.Bastion) && relaysUploads(commands) {
+		relays, err := sup.bastionClients(network.DNS, []string{network.Bastion}, connectedBastions, openSSH, append(network.SSHAlgorithms.OpenSSHOptions(), sshOptions...), network.Auth == AuthGSSAPI, env)
+		if err != nil {
+			return err
+		}
+		sup.relay = &relay{client: relays[0], bastion: network.Bastion, dns: network.DNS}
+		if prefixLen := sup.prefixWidth(relays[0], commands); prefixLen > maxLen {
+			maxLen = prefixLen
+		}
+		if _, ok := relays[0].(*OpenSSHClient); ok || sup.dial != nil {
+			defer relays[0].Close()
+		}
+		defer func() {
+			if err := sup.relay.cleanup(); err != nil {
+				sup.errorf("%v\n", err)
+			}
+		}()
+	}
+
+	// Sync the --sync directory before any of the commands.
+	defer sup.closeFanouts()
+	if sup.sync != nil && !(len(commands) == 1 && commands[0].syncClean) {
+		if err := sup.syncClients(clients, maxLen); err != nil {
+			return err
+		}
+		sup.closeFanouts()
+	}
+
+	// Run command or run multiple commands defined by target sequentially.
+	for i, cmd := range commands {
+		clients := clients
+		if cmd.Bastion {
+			if len(bastionHosts) == 0 {
+				sup.errorf("%v: skipped, network has no bastion\n", cmd.Name)
+				continue
+			}
+			clients = bastionHosts
+		}
+
 		// Translate command into task(s).
 		tasks, err := sup.createTasks(cmd, clients, env)
 		if err != nil {
 			return errors.Wrap(err, "creating task failed")
 		}
+		sup.conf.Audit.Override(network.Audit).apply(cmd, tasks)
+		if err := cmd.Limits.apply(cmd, tasks); err != nil {
+			return err
+		}
+		if err := network.Sanitize.Override(cmd.Sanitize).apply(cmd, tasks); err != nil {
+			return err
+		}
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var writers []io.Writer
-			var wg sync.WaitGroup
+		// Banner of the command, ended once it's run by endCommand.
+		if err := sup.beginCommand(cmd, i, len(commands), len(taskClients(tasks)), envVars); err != nil {
+			return err
+		}
+		if cmd.OncePerGroup {
+			representatives, groups := groupRepresentatives(cmd, clients)
+			for i, group := range groups {
+				sup.errorf("%v: group %v represented by %v\n", cmd.Name, group, clientHostname(representatives[i]))
+			}
+		}
 
-			// Run tasks on the provided clients.
-			for _, c := range task.Clients {
-				var prefix string
-				var prefixLen int
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
-				}
+		// Hosts which don't need the command, by its guards, skip it.
+		if len(cmd.Guards.list()) > 0 {
+			if tasks, err = sup.guard(cmd, tasks, maxLen); err != nil {
+				return err
+			}
+		}
 
-				err := c.Run(task)
-				if err != nil {
-					return errors.Wrap(err, prefix+"task failed")
-				}
+		// Commands with max_failures keep going when some hosts fail.
+		var failures *failureTracker
+		if cmd.MaxFailures != "" {
+			hosts := len(clients)
+			if cmd.LocalAlso {
+				hosts++
+			}
+			failures, err = newFailureTracker(cmd, hosts)
+			if err != nil {
+				return errors.Wrap(err, cmd.Name)
+			}
+		}
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
-					}
-				}(c)
-
-				// Copy over tasks's STDERR.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
-					}
-				}(c)
+		// Commands with serial_delay or rate space out their hosts.
+		pacer, err := sup.newPacer(cmd, len(taskClients(tasks)))
+		if err != nil {
+			return errors.Wrap(err, cmd.Name)
+		}
 
-				writers = append(writers, c.Stdin())
+		// Run the stages sequentially, see pipelineStages.
+		for _, stage := range pipelineStages(cmd, tasks) {
+			if err := sup.runStage(cmd, stage, failures, pacer, maxLen); err != nil {
+				return err
 			}
+		}
+		sup.closeFanouts()
 
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
-					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
-					for _, c := range clients {
-						c.WriteClose()
-					}
-				}()
+		if failures != nil {
+			if err := failures.err(true); err != nil {
+				return err
 			}
+		}
 
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
-			signal.Notify(trap, os.Interrupt)
-			go func() {
-				for {
-					select {
-					case sig, ok := <-trap:
-						if !ok {
-							return
-						}
-						for _, c := range task.Clients {
-							err := c.Signal(sig)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
-							}
-						}
-					}
-				}
-			}()
-
-			// Wait for all I/O operations first.
-			wg.Wait()
-
-			// Make sure each client finishes the task, return on failure.
-			for _, c := range task.Clients {
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					if err := c.Wait(); err != nil {
-						var prefix string
-						if sup.prefix {
-							var prefixLen int
-							prefix, prefixLen = c.Prefix()
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
-
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
-					}
-				}(c)
+		// Wait for the hosts to come back, ie. after a reboot.
+		if cmd.ExpectDisconnect && !cmd.Local {
+			if err := sup.reconnect(cmd, taskClients(tasks), maxLen); err != nil {
+				return err
 			}
+		}
+		sup.endCommand(nil)
+	}
+
+	return nil
+}
 
-			// Wait for all commands to finish.
-			wg.Wait()
+// ErrExitStatus is returned by Run when a task failed on a host. The error
+// of each failed host was already printed with the host prefix.
+type ErrExitStatus struct {
+	Status int
+}
+
+func (e ErrExitStatus) Error() string {
+	return fmt.Sprintf("exit status %v", e.Status)
+}
 
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
+// exitStatus returns the exit status of the failed command. Commands
+// which ended without an exit status, ie. due to a dropped connection,
+// return 255 the same way ssh does.
+func exitStatus(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case interface{ ExitStatus() int }:
+		return e.ExitStatus()
+	case *exec.ExitError:
+		if e.ExitCode() >= 0 {
+			return e.ExitCode()
 		}
+	case *ssh.ExitMissingError:
+		return 255
 	}
+	return 1
+}
 
-	return nil
+// Seed seeds the random splay of the hosts, so each host gets the same
+// splay in runs of the same seed.
+func (sup *Stackup) Seed(seed int64) {
+	sup.seed = &seed
 }
 
 func (sup *Stackup) Debug(value bool) {
@@ -263,18 +625,26 @@ func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
 
-func connectToBastions(bastions []string) (map[string]*SSHClient, error) {
+func (sup *Stackup) connectToBastions(dns DNS, bastions []string, algorithms SSHAlgorithms, limiter *connectLimiter, timeout time.Duration) (map[string]*SSHClient, error) {
 	bastionConnections := make(map[string]*SSHClient)
 	bastions = removeDuplicates(bastions)
 	for _, bastion := range bastions {
-		bastionClient := &SSHClient{}
-		bastionHost, err := NewHost(bastion)
+		bastionClient := &SSHClient{algorithms: algorithms, batch: sup.batch, timeout: timeout, preferKey: sup.preferKey}
+		bastionHost, err := sup.conf.resolver.NewHost(bastion, HostDefaults{})
 		bastionClient.host = bastionHost
 		if err != nil {
 			return nil, err
 		}
-		if err := bastionClient.Connect(); err != nil {
-			return nil, errors.Wrap(err, "connecting to bastion failed")
+		addr, resolvedBy, err := dns.resolve(bastionHost.Address, true)
+		if err != nil {
+			return nil, errors.Wrap(err, "bastion "+bastion)
+		}
+		if resolvedBy == "" {
+			addr = ""
+		}
+		sup.waitConnect(limiter, bastion)
+		if err := bastionClient.ConnectWith(bastionClient.directDialer(addr, sup.daemon)); err != nil {
+			return nil, errors.Wrapf(err, "connecting to bastion %v failed", bastion)
 		}
 		bastionConnections[bastion] = bastionClient
 	}
@@ -2,44 +2,163 @@ package sup
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
 )
 
 // Supfile represents the Stack Up configuration YAML file.
+// The fields are in the order they're written by Marshal.
 type Supfile struct {
-	Networks Networks `yaml:"networks"`
-	Commands Commands `yaml:"commands"`
-	Targets  Targets  `yaml:"targets"`
-	Env      EnvList  `yaml:"env"`
-	Version  string   `yaml:"version"`
+	Name            string        `yaml:"name,omitempty"` // Project name in multi-document Supfile
+	Version         string        `yaml:"version,omitempty"`
+	Paths           string        `yaml:"paths,omitempty"`  // "supfile-relative" resolves paths against Dir
+	Prefer          string        `yaml:"prefer,omitempty"` // "target" runs the target of a name shared with a command
+	Env             EnvList       `yaml:"env,omitempty"`
+	PassEnv         []string      `yaml:"pass_env,omitempty"`          // Local env vars (or globs) passed to all hosts
+	PassEnvRequired bool          `yaml:"pass_env_required,omitempty"` // Fail if a pass_env var is not set locally
+	KnownEnv        []string      `yaml:"known_env,omitempty"`         // Env vars (or globs) expected on the hosts, see EnvWarnings
+	PrefixFormat    *string       `yaml:"prefix_format,omitempty"`     // Template of the output prefixes, see PrefixData; empty disables them
+	Metrics         MetricsConfig `yaml:"metrics,omitempty"`
+	Audit           `yaml:",inline"`
+	EmbedContext    bool              `yaml:"embed_context,omitempty"` // Start the remote commands and scripts by a comment describing the run.
+	Fragments       map[string]string `yaml:"fragments,omitempty"`     // Named shell snippets, see Command.Use.
+	Defaults        *Defaults         `yaml:"defaults,omitempty"`      // Fields of the commands and networks which don't set them.
+	Networks        Networks          `yaml:"networks,omitempty"`
+	Commands        Commands          `yaml:"commands,omitempty"`
+	Targets         Targets           `yaml:"targets,omitempty"`
+
+	// Dir is the directory containing Supfile, set by the caller.
+	// Relative paths are resolved against it since Supfile v0.6.
+	Dir string `yaml:"-"`
+
+	// Workdir overrides the directory relative paths are resolved against.
+	Workdir string `yaml:"-"`
+
+	// Warnings found while parsing, ie. usage of deprecated constructs.
+	// It's up to the caller how (and whether) to render them.
+	Warnings []Warning `yaml:"-"`
+
+	data     []byte
+	resolver *Resolver // Resolves the hosts by SSH config.
 }
 
+// PreferTarget is the Supfile.Prefer value running the target of a name
+// shared by a command and a target.
+const PreferTarget = "target"
+
+// Supported network transports.
+const (
+	TransportNative  = "native"
+	TransportOpenSSH = "openssh"
+)
+
 // Network is group of hosts with extra custom env vars.
 type Network struct {
-	Env             EnvList  `yaml:"env"`
-	Inventory       string   `yaml:"inventory"`
-	Hosts           []*Host  `yaml:"-"`
-	HostsFromConfig []string `yaml:"hosts"`
-	Bastion         string   `yaml:"bastion"` // Jump host for the environment
+	Env              EnvList         `yaml:"env,omitempty"`
+	Inventory        string          `yaml:"inventory,omitempty"`
+	InventoryTimeout string          `yaml:"inventory_timeout,omitempty"` // Default 30s
+	InventoryCache   *InventoryCache `yaml:"inventory_cache,omitempty"`   // Cache of the inventory output for consecutive runs.
+	InventoryHTTP    *InventoryHTTP  `yaml:"inventory_http,omitempty"`    // JSON endpoint listing hosts, along with or instead of inventory.
+	RefreshInventory bool            `yaml:"-"`                           // Run the inventory even if it's cached.
+	NoInventoryCache bool            `yaml:"-"`                           // Neither read nor write the inventory cache.
+	InventoryStrict  bool            `yaml:"inventory_strict,omitempty"`  // Fail runs whose hosts: differ from the inventory.
+	InventorySkew    *InventorySkew  `yaml:"-"`                           // Set by CheckInventory's caller, shown by the plan.
+	Hosts            []*Host         `yaml:"-"`
+	HostsFromConfig  []string        `yaml:"-"`                   // Hosts as specified in Supfile, see HostConfig.String()
+	Bastion          string          `yaml:"bastion,omitempty"`   // Jump host for the environment
+	Tunnels          []Tunnel        `yaml:"tunnels,omitempty"`   // Ports forwarded for runs of local commands only, see Tunnel.
+	Transport        string          `yaml:"transport,omitempty"` // "native" (default) or "openssh"
+	Workdir          string          `yaml:"-"`                   // Directory the inventory command is run in
+	Auth             string          `yaml:"auth,omitempty"`      // "gssapi" for Kerberos auth
+	GSSAPIDelegate   bool            `yaml:"gssapi_delegate,omitempty"`
+	SSHAlgorithms    `yaml:",inline"`
+	PassEnv          []string `yaml:"pass_env,omitempty"`
+	PassEnvRequired  bool     `yaml:"pass_env_required,omitempty"`
+	User             string   `yaml:"user,omitempty"`              // Default user for hosts without one
+	Port             string   `yaml:"port,omitempty"`              // Default port for hosts without one
+	IdentityFile     string   `yaml:"identity_file,omitempty"`     // Default identity file for hosts without one
+	IdentityKeyEnv   string   `yaml:"identity_key_env,omitempty"`  // Default env var holding private key, see Host.IdentityKeyEnv
+	IdentityKeyFile  string   `yaml:"identity_key_file,omitempty"` // Default private key file, see Host.IdentityKeyFile
+	Audit            `yaml:",inline"`
+	Protected        bool `yaml:"protected,omitempty"` // Runs need to be confirmed by typing the network name
+	Sanitize         `yaml:",inline"`
+	DNS              `yaml:",inline"` // resolver and host_overrides
+	KubeContext      string           `yaml:"kube_context,omitempty"`    // Kubeconfig context of the k8s:// hosts
+	SyncDir          string           `yaml:"sync_dir,omitempty"`        // Directory of the --sync snapshots, DefaultSyncDir if empty.
+	ConnectRate      string           `yaml:"connect_rate,omitempty"`    // Max new SSH connections per period, ie. "10/s", unlimited if empty.
+	ConnectTimeout   string           `yaml:"connect_timeout,omitempty"` // Max time to connect to each host, including the SSH handshake.
+
+	name        string         // Key in networks:, set by Networks.
+	hostConfigs []HostConfig   // Entries of hosts:
+	hostVars    bool           // Entries referencing env vars, left to ResolveHosts.
+	resolver    *Resolver      // Resolves the hosts by SSH config.
+	inventory   *inventoryMemo // Shared by the copies of the network, see ParseInventory.
+	defaults    []string       // "key: value" fields of defaults: network, see Defaults.
+}
+
+// HostDefaults are applied to hosts which didn't specify their own values.
+type HostDefaults struct {
+	User            string
+	Port            string
+	IdentityFile    string
+	IdentityKeyEnv  string
+	IdentityKeyFile string
+}
+
+// HostDefaults returns the network's user, port, identity_file and
+// identity_key_* defaults.
+func (n Network) HostDefaults() HostDefaults {
+	return HostDefaults{User: n.User, Port: n.Port, IdentityFile: n.IdentityFile, IdentityKeyEnv: n.IdentityKeyEnv, IdentityKeyFile: n.IdentityKeyFile}
 }
 
 func (n *Network) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// Hosts can be either plain strings or HostConfig maps. They're decoded
+	// along with the other fields, so strict parsing sees all of them.
 	type NewNetwork Network
-	if err := unmarshal((*NewNetwork)(n)); err != nil {
+	var network struct {
+		NewNetwork `yaml:",inline"`
+		Hosts      []HostConfig `yaml:"hosts"`
+	}
+	if err := unmarshal(&network); err != nil {
 		return err
 	}
-	for _, item := range n.HostsFromConfig {
-		host, err := NewHost(item)
+	*n = Network(network.NewNetwork)
+	n.hostConfigs = network.Hosts
+	n.inventory = &inventoryMemo{}
+	for _, item := range network.Hosts {
+		n.HostsFromConfig = append(n.HostsFromConfig, item.String())
+	}
+	return n.resolveHosts(defaultResolver)
+}
+
+// resolveHosts creates the hosts of hosts: entries, resolved by r.
+// The inventory hosts are resolved by r later, see ParseInventory.
+// Entries referencing env vars are resolved with empty env, so Hosts has
+// all the entries for code reading it directly, and by the env of the run
+// by ResolveHosts, required before the network is run.
+func (n *Network) resolveHosts(r *Resolver) error {
+	n.resolver = r
+	n.Hosts = nil
+	n.hostVars = false
+	for _, item := range n.hostConfigs {
+		if item.hasVars() {
+			n.hostVars = true
+			item, _ = item.expand(nil)
+		}
+		host, err := r.NewHostFromConfig(item, n.HostDefaults())
 		if err != nil {
 			return err
 		}
@@ -48,14 +167,181 @@ func (n *Network) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// checkAliases checks the host aliases are unique.
+func checkAliases(hosts []*Host) error {
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if host.alias == "" {
+			continue
+		}
+		if seen[host.alias] {
+			return fmt.Errorf("host alias %q is used more than once", host.alias)
+		}
+		seen[host.alias] = true
+	}
+	return nil
+}
+
+// HostConfig is a structured hosts: entry, ie.
+// {host: 10.0.0.5, user: deploy, port: 2222, identity_file: ~/.ssh/deploy_ed25519}.
+// Plain string entries are unmarshalled into Host and Alias fields.
+type HostConfig struct {
+	Host            string            `yaml:"host,omitempty"`
+	Alias           string            `yaml:"alias,omitempty"` // Name used in output and by --only, see Host.KnownAs.
+	User            string            `yaml:"user,omitempty"`
+	Port            string            `yaml:"port,omitempty"`
+	IdentityFile    string            `yaml:"identity_file,omitempty"`
+	IdentityKeyEnv  string            `yaml:"identity_key_env,omitempty"`
+	IdentityKeyFile string            `yaml:"identity_key_file,omitempty"`
+	Bastion         string            `yaml:"bastion,omitempty"`
+	Group           string            `yaml:"group,omitempty"`
+	Env             EnvList           `yaml:"env,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty"` // Labels matched by run_on and --selector.
+}
+
+func (h *HostConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err == nil {
+		host, alias := splitAlias(str)
+		*h = HostConfig{Host: host, Alias: alias}
+		return nil
+	}
+
+	type NewHostConfig HostConfig
+	if err := unmarshal((*NewHostConfig)(h)); err != nil {
+		return err
+	}
+	if h.Host == "" {
+		return fmt.Errorf("host entry is missing host field")
+	}
+	if err := checkIdentityKey(h.IdentityKeyEnv, h.IdentityKeyFile); err != nil {
+		return fmt.Errorf("host %v: %v", h.Host, err)
+	}
+	for key, value := range h.Labels {
+		if _, _, err := parseLabel(key + "=" + value); err != nil {
+			return fmt.Errorf("host %v: %v", h.Host, err)
+		}
+	}
+	return nil
+}
+
+// String returns the host in <user>@<host:port> form, or as is, if it's
+// a docker container or a Kubernetes pod.
+func (h HostConfig) String() string {
+	if strings.HasPrefix(h.Host, DockerScheme) || strings.HasPrefix(h.Host, KubeScheme) {
+		if h.Alias != "" {
+			return h.Host + " as " + h.Alias
+		}
+		return h.Host
+	}
+	user, hostPort := splitUser(h.Host)
+	if user == "" && h.User != "" {
+		user = h.User
+	}
+	if _, _, err := net.SplitHostPort(hostPort); err != nil && h.Port != "" {
+		hostPort = net.JoinHostPort(hostPort, h.Port)
+	}
+	if user != "" {
+		hostPort = user + "@" + hostPort
+	}
+	if h.Alias != "" {
+		return hostPort + " as " + h.Alias
+	}
+	return hostPort
+}
+
+// splitAlias splits "<host> as <alias>" string.
+func splitAlias(hostStr string) (host, alias string) {
+	host, alias, _ = strings.Cut(hostStr, " as ")
+	return strings.TrimSpace(host), strings.TrimSpace(alias)
+}
+
+// splitUser splits [ssh://][<user>@]<host:port> string by the last "@",
+// since there may be an "@" in the username.
+func splitUser(hostStr string) (user, hostPort string) {
+	hostStr = strings.TrimPrefix(hostStr, "ssh://")
+	if at := strings.LastIndex(hostStr, "@"); at != -1 {
+		return hostStr[:at], hostStr[at+1:]
+	}
+	return "", hostStr
+}
+
+// NewHostFromConfig creates Host instance from a structured hosts: entry,
+// see Resolver.NewHostFromConfig. Hosts are resolved by SSH config loaded
+// by ParseAndLoadSSHConfig, if any.
+func NewHostFromConfig(conf HostConfig, defaults HostDefaults) (*Host, error) {
+	return defaultResolver.NewHostFromConfig(conf, defaults)
+}
+
+// NewHostFromConfig creates Host instance from a structured hosts: entry.
+// User and port follow the same precedence rules as in NewHost, while
+// identity_file and bastion take precedence over SSH config.
+func (r *Resolver) NewHostFromConfig(conf HostConfig, defaults HostDefaults) (*Host, error) {
+	user, hostPort := splitUser(conf.Host)
+	if conf.User != "" && user != "" && user != conf.User {
+		return nil, fmt.Errorf("host %v: user %q conflicts with user field %q", conf.Host, user, conf.User)
+	}
+	if _, port, err := net.SplitHostPort(hostPort); err == nil && conf.Port != "" && port != conf.Port {
+		return nil, fmt.Errorf("host %v: port %q conflicts with port field %q", conf.Host, port, conf.Port)
+	}
+
+	host, err := r.NewHost(conf.String(), defaults)
+	if err != nil {
+		return nil, err
+	}
+	if conf.IdentityFile != "" {
+		host.IdentityFile = ResolvePath(conf.IdentityFile)
+	}
+	if conf.IdentityKeyEnv != "" || conf.IdentityKeyFile != "" {
+		host.IdentityKeyEnv, host.IdentityKeyFile = conf.IdentityKeyEnv, ResolvePath(conf.IdentityKeyFile)
+	}
+	if conf.Bastion != "" {
+		host.Bastion = conf.Bastion
+	}
+	host.Env = conf.Env
+	host.Group = conf.Group
+	host.Labels = conf.Labels
+	return host, nil
+}
+
 // Host describes how to connect to a host
 type Host struct {
-	Address      string
-	Port         string
-	User         string
-	IdentityFile string
-	KnownAs      string // The first Host value in SSH config, if -sshconfig flag is used
-	Bastion      string // ProxyJump host for the environment
+	Address         string
+	Port            string
+	User            string
+	IdentityFile    string
+	IdentityKeyEnv  string            // Local env var holding the private key (PEM or OpenSSH format), offered before IdentityFile
+	IdentityKeyFile string            // Private key file, read by sup itself, ie. of a secrets mount, offered before IdentityFile
+	KnownAs         string            // Host alias, or the first Host value in SSH config, if -sshconfig flag is used
+	Bastion         string            // ProxyJump host for the environment, or BastionNone
+	Algorithms      SSHAlgorithms     // Ciphers, MACs and HostKeyAlgorithms from SSH config
+	Env             EnvList           // Extra env vars for this host only
+	Group           string            // Host group, see Command.OncePerGroup
+	Labels          map[string]string // Labels matched by Command.RunOn selector
+	Container       string            // Docker container (or container of Pod) the tasks are run in, see DockerScheme
+	Namespace       string            // Kubernetes namespace of Pod, see KubeScheme
+	Pod             string            // Kubernetes pod the tasks are run in
+	KubeContext     string            // Kubeconfig context of Pod, set by Network.ExpandPods
+
+	alias       string       // Alias given in Supfile or inventory, unique within network.
+	podSelector string       // Labels of the pods the host stands for, see Network.ExpandPods.
+	identityKey *identityKey // Key of IdentityKeyEnv or IdentityKeyFile, set by Run.
+}
+
+// BastionNone is the host bastion connecting to the host directly, even
+// if its network has a bastion.
+const BastionNone = "none"
+
+// jumpHost returns the bastion the host is connected through, its own or
+// the network bastion, or "" if it's connected to directly.
+func (h *Host) jumpHost(networkBastion string) string {
+	switch h.Bastion {
+	case BastionNone:
+		return ""
+	case "":
+		return networkBastion
+	}
+	return h.Bastion
 }
 
 // GetHost returns address:port. It is passed to ssh dialer function
@@ -83,9 +369,35 @@ func (h *Host) GetPrefixText() string {
 }
 
 // NewHost parses and normalizes <user>@<host:port> from a given string and
-// creates Host instance.
+// creates Host instance, resolved by SSH config loaded by ParseAndLoadSSHConfig,
+// if any. Use Resolver.NewHost to resolve it by a given SSH config.
 func NewHost(hostStr string) (*Host, error) {
+	return NewHostWithDefaults(hostStr, HostDefaults{})
+}
+
+// NewHostWithDefaults is like NewHost, but falls back to defaults for user,
+// port and identity file not set in hostStr.
+func NewHostWithDefaults(hostStr string, defaults HostDefaults) (*Host, error) {
+	return defaultResolver.NewHost(hostStr, defaults)
+}
+
+// NewHost parses and normalizes <user>@<host:port> [as <alias>] from a given
+// string and creates Host instance resolved by SSH config. It falls back
+// to defaults for user, port and identity file not set in hostStr. Values
+// from SSH config still take precedence over the defaults. The alias only
+// changes how the host is named, not where it's connected to.
+func (r *Resolver) NewHost(hostStr string, defaults HostDefaults) (*Host, error) {
 	host := Host{}
+	hostStr, host.alias = splitAlias(hostStr)
+	if strings.ContainsAny(host.alias, " \t") {
+		return nil, fmt.Errorf("host %q: invalid alias %q", hostStr, host.alias)
+	}
+	if strings.HasPrefix(hostStr, DockerScheme) {
+		return r.newContainerHost(hostStr, host.alias, defaults)
+	}
+	if strings.HasPrefix(hostStr, KubeScheme) {
+		return r.newPodHost(hostStr, host.alias)
+	}
 	// Remove extra "ssh://" schema
 	if len(hostStr) > 6 && hostStr[:6] == "ssh://" {
 		hostStr = hostStr[6:]
@@ -96,8 +408,12 @@ func NewHost(hostStr string) (*Host, error) {
 		host.User = hostStr[:at]
 		hostStr = hostStr[at+1:]
 	}
+	explicitUser := host.User != ""
 
 	// Add default user, if not set
+	if host.User == "" {
+		host.User = defaults.User
+	}
 	if host.User == "" {
 		u, err := user.Current()
 		if err != nil {
@@ -112,7 +428,11 @@ func NewHost(hostStr string) (*Host, error) {
 
 	// Add default port, if not set
 	port := "22"
-	if strings.Contains(hostStr, ":") {
+	if defaults.Port != "" {
+		port = defaults.Port
+	}
+	explicitPort := strings.Contains(hostStr, ":")
+	if explicitPort {
 		var err error
 		hostStr, port, err = net.SplitHostPort(hostStr)
 		if err != nil {
@@ -122,14 +442,13 @@ func NewHost(hostStr string) (*Host, error) {
 	host.Address = hostStr
 	host.Port = port
 	// Check if we can retrieve detailed information from ssh config
-	conf, found := extractedHostSSHConfig[host.Address]
-	if found {
-		host.User = conf.User
-		host.IdentityFile = ResolvePath(conf.IdentityFile)
-		host.Address = conf.HostName
-		host.Port = fmt.Sprintf("%d", conf.Port)
-		host.KnownAs = conf.Host[0]
-		host.Bastion = conf.ProxyJump
+	r.apply(&host, explicitUser, explicitPort)
+	if host.IdentityFile == "" && defaults.IdentityFile != "" {
+		host.IdentityFile = ResolvePath(defaults.IdentityFile)
+	}
+	host.IdentityKeyEnv, host.IdentityKeyFile = defaults.IdentityKeyEnv, ResolvePath(defaults.IdentityKeyFile)
+	if host.alias != "" {
+		host.KnownAs = host.alias
 	}
 	return &host, nil
 }
@@ -141,20 +460,24 @@ type Networks struct {
 }
 
 func (n *Networks) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	err := unmarshal(&n.nets)
-	if err != nil {
+	var items map[string]Network
+	if err := unmarshal(&items); err != nil {
 		return err
 	}
 
-	var items yaml.MapSlice
-	err = unmarshal(&items)
-	if err != nil {
-		return err
+	// Sorted until Supfile.orderItems puts them in order of the document.
+	n.Names = make([]string, 0, len(items))
+	for name := range items {
+		n.Names = append(n.Names, name)
 	}
-
-	n.Names = make([]string, len(items))
-	for i, item := range items {
-		n.Names[i] = item.Key.(string)
+	sort.Strings(n.Names)
+	n.nets = make(map[string]Network, len(items))
+	for name, network := range items {
+		network.name = name
+		if err := checkAliases(network.Hosts); err != nil {
+			return fmt.Errorf("network %v: %v", name, err)
+		}
+		n.nets[name] = network
 	}
 
 	return nil
@@ -166,24 +489,137 @@ func (n *Networks) Get(name string) (Network, bool) {
 }
 
 func (n *Networks) Set(name string, network *Network) {
+	if n.nets == nil {
+		n.nets = map[string]Network{}
+	}
+	if _, ok := n.nets[name]; !ok {
+		n.Names = append(n.Names, name)
+	}
+	if network.inventory == nil {
+		network.inventory = &inventoryMemo{}
+	}
+	network.name = name
 	n.nets[name] = *network
-	n.Names = append(n.Names, name)
 }
 
 // Command represents command(s) to be run remotely.
 type Command struct {
-	Name   string   `yaml:"-"`      // Command name.
-	Desc   string   `yaml:"desc"`   // Command description.
-	Local  bool     `yaml:"local"`  // Run command locally
-	Run    string   `yaml:"run"`    // Command(s) to be run remotelly.
-	Script string   `yaml:"script"` // Load command(s) from script and run it remotelly.
-	Upload []Upload `yaml:"upload"` // See Upload struct.
-	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
-	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
-	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
+	Name   string `yaml:"-"`                // Command name.
+	Desc   string `yaml:"desc,omitempty"`   // Command description.
+	Local  bool   `yaml:"-"`                // Run command locally
+	Run    string `yaml:"-"`                // Command(s) to be run remotelly.
+	Script string `yaml:"script,omitempty"` // Load command(s) from script and run it remotelly.
+
+	ScriptArgs []string `yaml:"script_args,omitempty"` // Arguments of the script, $VARs expanded on the host.
+
+	Steps                []string `yaml:"-"`                                 // Steps of run: list, run instead of Run.
+	StepsContinueOnError bool     `yaml:"steps_continue_on_error,omitempty"` // Run the remaining steps after a failed one.
+
+	Template bool `yaml:"template,omitempty"` // Render run and steps as Go templates for each host, see TemplateData.
+
+	Use []string `yaml:"use,omitempty"` // Fragments prepended to run and the scripts, in order.
+
+	ScriptsDir  string `yaml:"scripts_dir,omitempty"`  // Run each script of the directory, in lexicographic order.
+	ScriptsGlob string `yaml:"scripts_glob,omitempty"` // Scripts of scripts_dir to run, "*" by default.
+
+	LocalAlso       bool `yaml:"-"`                           // local: also, run on localhost in addition to the hosts.
+	UploadLocalSkip bool `yaml:"upload_local_skip,omitempty"` // Uploads of local: also command go to the hosts only.
+
+	Upload []Upload `yaml:"upload,omitempty"` // See Upload struct.
+
+	AllowDangerousPaths bool `yaml:"allow_dangerous_paths,omitempty"` // Allow upload dst of /, /etc, /usr, /bin or /var.
+
+	Stdin bool `yaml:"stdin,omitempty"` // Attach localhost STDOUT to remote commands' STDIN?
+	Once  bool `yaml:"once,omitempty"`  // The command should be run "once" (on one host only).
+
+	GitTracked bool `yaml:"git_tracked,omitempty"` // Upload only the files tracked by git, as if each Upload.GitTracked.
+
+	ChangedPaths []string `yaml:"changed_paths,omitempty"` // Globs of files, skip the command unless any changed since the baseline, see ChangedSince.
+
+	OncePerGroup       bool `yaml:"once_per_group,omitempty"`        // Run on one host of each host group.
+	OncePerGroupStrict bool `yaml:"once_per_group_strict,omitempty"` // Skip hosts without group, instead of grouping them as "default".
+	Serial             int  `yaml:"serial,omitempty"`                // Max number of clients processing a task in parallel.
+
+	Bastion bool   `yaml:"bastion,omitempty"` // Run on each distinct bastion of the network instead of its hosts.
+	RunOn   string `yaml:"run_on,omitempty"`  // Label selector of the hosts to run on, ie. "role in (web,api)".
+
+	WaitFor *WaitFor `yaml:"wait_for,omitempty"` // Health check polled after the command finishes.
+	Service *Service `yaml:"service,omitempty"`  // Service action run after the command's run.
+	Build   *Build   `yaml:"build,omitempty"`    // Local build run once before any host work.
+
+	MaxFailures string `yaml:"max_failures,omitempty"` // Failed hosts tolerated, count or percentage, ie. "20%".
+	HardStop    bool   `yaml:"hard_stop,omitempty"`    // Interrupt running hosts once max_failures is exceeded.
+
+	AllowedExitCodes []int `yaml:"allowed_exit_codes,omitempty"` // Exit codes counted as success, ie. [0, 1] for grep.
+	IgnoreErrors     bool  `yaml:"ignore_errors,omitempty"`      // Report failures as warnings, don't fail the host.
+
+	ExpectDisconnect bool       `yaml:"expect_disconnect,omitempty"` // Connection closed by the command (ie. reboot) is a success.
+	Reconnect        *Reconnect `yaml:"reconnect,omitempty"`         // How to wait for the hosts to come back.
+
+	LintIgnore []string `yaml:"lint_ignore,omitempty"` // Lint finding codes to suppress, ie. [undefined-variable].
+
+	Output string `yaml:"output,omitempty"` // Lines shown of each host: "full" (default), "summary" or "quiet", see OutputFull.
+
+	Sanitize `yaml:",inline"` // clean_env and umask, overriding the network ones.
+	Limits   `yaml:",inline"` // nice, ionice and cpu_limit of the remote command.
+	Pacing   `yaml:",inline"` // serial_delay and rate of the hosts.
+	Timeouts `yaml:",inline"` // timeout and idle_timeout of the command on each host.
+	Guards   `yaml:",inline"` // creates, removes, unless and only_if checks skipping the command.
+
+	PassEnv         []string `yaml:"pass_env,omitempty"`          // Local env vars (or globs) passed to the command.
+	PassEnvRequired bool     `yaml:"pass_env_required,omitempty"` // Fail if a pass_env var is not set locally.
 
 	// API backward compatibility. Will be deprecated in v1.0.
-	RunOnce bool `yaml:"run_once"` // The command should be run once only.
+	RunOnce bool `yaml:"run_once,omitempty"` // The command should be run once only.
+
+	runOn        Selector   // Parsed RunOn.
+	artifacts    []Artifact // Files produced by Build.
+	artifactsTar string     // Temp tar file of the artifacts.
+	syncClean    bool       // Removes the --sync snapshot, see SyncCleanCommand.
+	defaults     []string   // "key: value" fields of defaults: command, see Defaults.
+}
+
+// UnmarshalYAML reads run: as Run string or list of Steps.
+func (cmd *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type NewCommand Command
+	var command struct {
+		NewCommand `yaml:",inline"`
+		Run        runValue   `yaml:"run"`
+		Local      localValue `yaml:"local"`
+	}
+	if err := unmarshal(&command); err != nil {
+		return err
+	}
+	*cmd = Command(command.NewCommand)
+	cmd.Run, cmd.Steps = command.Run.run, command.Run.steps
+	cmd.Local, cmd.LocalAlso = command.Local.local, command.Local.also
+	return nil
+}
+
+// LocalAlso is the local: value of commands run on localhost in addition
+// to the hosts of the network.
+const LocalAlso = "also"
+
+// localValue is the local: value, a bool or LocalAlso.
+type localValue struct {
+	local bool
+	also  bool
+}
+
+func (l *localValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*l = localValue{} // The last of duplicate local: keys wins.
+	if err := unmarshal(&l.local); err == nil {
+		return nil
+	}
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	if value != LocalAlso {
+		return fmt.Errorf("local: %q is not true, false nor %q", value, LocalAlso)
+	}
+	l.also = true
+	return nil
 }
 
 // Commands is a list of user-defined commands
@@ -193,20 +629,20 @@ type Commands struct {
 }
 
 func (c *Commands) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	err := unmarshal(&c.cmds)
-	if err != nil {
+	var items map[string]Command
+	if err := unmarshal(&items); err != nil {
 		return err
 	}
 
-	var items yaml.MapSlice
-	err = unmarshal(&items)
-	if err != nil {
-		return err
+	// Sorted until Supfile.orderItems puts them in order of the document.
+	c.Names = make([]string, 0, len(items))
+	for name := range items {
+		c.Names = append(c.Names, name)
 	}
-
-	c.Names = make([]string, len(items))
-	for i, item := range items {
-		c.Names[i] = item.Key.(string)
+	sort.Strings(c.Names)
+	c.cmds = make(map[string]Command, len(items))
+	for name, cmd := range items {
+		c.cmds[name] = cmd
 	}
 
 	return nil
@@ -217,49 +653,173 @@ func (c *Commands) Get(name string) (Command, bool) {
 	return cmd, ok
 }
 
+// Set adds the command, or replaces the one of the same name.
+func (c *Commands) Set(name string, cmd *Command) {
+	if c.cmds == nil {
+		c.cmds = map[string]Command{}
+	}
+	if _, ok := c.cmds[name]; !ok {
+		c.Names = append(c.Names, name)
+	}
+	c.cmds[name] = *cmd
+}
+
 // Targets is a list of user-defined targets
 type Targets struct {
 	Names   []string
 	targets map[string][]string
+	pipes   map[string]*Pipe // Targets of from: and to: commands, see Pipe.
 }
 
-func (t *Targets) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	err := unmarshal(&t.targets)
-	if err != nil {
-		return err
+// targetValue is a target, a list of commands or a Pipe.
+type targetValue struct {
+	cmds []string
+	pipe *Pipe
+}
+
+func (v *targetValue) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&v.cmds); err == nil {
+		return nil
 	}
+	v.pipe = &Pipe{}
+	return unmarshal(v.pipe)
+}
 
-	var items yaml.MapSlice
-	err = unmarshal(&items)
-	if err != nil {
+func (t *Targets) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var items map[string]targetValue
+	if err := unmarshal(&items); err != nil {
 		return err
 	}
 
-	t.Names = make([]string, len(items))
-	for i, item := range items {
-		t.Names[i] = item.Key.(string)
+	// Sorted until Supfile.orderItems puts them in order of the document.
+	t.Names = make([]string, 0, len(items))
+	for name := range items {
+		t.Names = append(t.Names, name)
+	}
+	sort.Strings(t.Names)
+	t.targets = make(map[string][]string, len(items))
+	t.pipes = map[string]*Pipe{}
+	for name, item := range items {
+		if item.pipe != nil {
+			t.pipes[name] = item.pipe
+			t.targets[name] = []string{item.pipe.From.Command, item.pipe.To.Command}
+			continue
+		}
+		t.targets[name] = item.cmds
 	}
 
 	return nil
 }
 
+// Get returns the commands of the target, the from: and to: ones of pipe
+// targets, see Pipe.
 func (t *Targets) Get(name string) ([]string, bool) {
 	cmds, ok := t.targets[name]
 	return cmds, ok
 }
 
+// Pipe returns the pipe of the target, if it's a pipe target.
+func (t *Targets) Pipe(name string) (*Pipe, bool) {
+	pipe, ok := t.pipes[name]
+	return pipe, ok
+}
+
+// Set adds the target, or replaces the one of the same name.
+func (t *Targets) Set(name string, cmds []string) {
+	if t.targets == nil {
+		t.targets = map[string][]string{}
+	}
+	if _, ok := t.targets[name]; !ok {
+		t.Names = append(t.Names, name)
+	}
+	t.targets[name] = cmds
+	delete(t.pipes, name)
+}
+
 // Upload represents file copy operation from localhost Src path to Dst
 // path of every host in a given Network.
 type Upload struct {
-	Src string `yaml:"src"`
-	Dst string `yaml:"dst"`
-	Exc string `yaml:"exclude"`
+	Src string `yaml:"src,omitempty"`
+	Dst string `yaml:"dst,omitempty"`
+	Exc string `yaml:"-"` // Comma separated list of patterns
+
+	DirMode string `yaml:"-"` // Permissions of created directories, ie. "0755"
+
+	Atomic       bool   `yaml:"-"` // Replace each file by rename of a fully uploaded temp file.
+	AtomicDir    string `yaml:"-"` // "symlink" to upload into releases/<timestamp> and flip current symlink.
+	KeepReleases int    `yaml:"-"` // Number of releases kept by AtomicDir "symlink", 0 keeps all.
+
+	Stamp bool `yaml:"-"` // Write release metadata into Dst/.sup-release.json.
+
+	Via    string `yaml:"-"` // "bastion" to upload once to the network bastion and copy to the hosts from there.
+	Method string `yaml:"-"` // "tar" (default) or "scp" for hosts without tar.
+
+	GitTracked       bool `yaml:"-"` // Upload only the files of Src listed by git ls-files.
+	IncludeUntracked bool `yaml:"-"` // Upload also the untracked files of GitTracked Src, which aren't ignored.
+
+	Verify string `yaml:"-"` // "sha256" to check the checksums of the uploaded files on the host.
+
+	excString bool // Exc was set as a single string
+}
+
+func (u *Upload) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var upload struct {
+		Src          string `yaml:"src"`
+		Dst          string `yaml:"dst"`
+		Exc          string `yaml:"exclude"`
+		DirMode      string `yaml:"dir_mode"`
+		Atomic       bool   `yaml:"atomic"`
+		AtomicDir    string `yaml:"atomic_dir"`
+		KeepReleases int    `yaml:"keep_releases"`
+		Stamp        bool   `yaml:"stamp"`
+		Via          string `yaml:"via"`
+		Method       string `yaml:"method"`
+		GitTracked   bool   `yaml:"git_tracked"`
+		Untracked    bool   `yaml:"include_untracked"`
+		Verify       string `yaml:"verify"`
+	}
+	if err := unmarshal(&upload); err == nil {
+		u.Src, u.Dst, u.Exc, u.DirMode = upload.Src, upload.Dst, upload.Exc, upload.DirMode
+		u.Atomic, u.AtomicDir, u.KeepReleases = upload.Atomic, upload.AtomicDir, upload.KeepReleases
+		u.Stamp, u.Via, u.Method = upload.Stamp, upload.Via, upload.Method
+		u.GitTracked, u.IncludeUntracked, u.Verify = upload.GitTracked, upload.Untracked, upload.Verify
+		u.excString = upload.Exc != ""
+		return nil
+	}
+
+	var uploadList struct {
+		Src          string   `yaml:"src"`
+		Dst          string   `yaml:"dst"`
+		Exc          []string `yaml:"exclude"`
+		DirMode      string   `yaml:"dir_mode"`
+		Atomic       bool     `yaml:"atomic"`
+		AtomicDir    string   `yaml:"atomic_dir"`
+		KeepReleases int      `yaml:"keep_releases"`
+		Stamp        bool     `yaml:"stamp"`
+		Via          string   `yaml:"via"`
+		Method       string   `yaml:"method"`
+		GitTracked   bool     `yaml:"git_tracked"`
+		Untracked    bool     `yaml:"include_untracked"`
+		Verify       string   `yaml:"verify"`
+	}
+	if err := unmarshal(&uploadList); err != nil {
+		return err
+	}
+	u.Src, u.Dst, u.Exc, u.DirMode = uploadList.Src, uploadList.Dst, strings.Join(uploadList.Exc, ","), uploadList.DirMode
+	u.Atomic, u.AtomicDir, u.KeepReleases = uploadList.Atomic, uploadList.AtomicDir, uploadList.KeepReleases
+	u.Stamp, u.Via, u.Method = uploadList.Stamp, uploadList.Via, uploadList.Method
+	u.GitTracked, u.IncludeUntracked, u.Verify = uploadList.GitTracked, uploadList.Untracked, uploadList.Verify
+	return nil
 }
 
 // EnvVar represents an environment variable
 type EnvVar struct {
 	Key   string
 	Value string
+
+	// Literal value is exported as is, instead of being expanded by the
+	// shell of the host, ie. pass_env values taken from the local env.
+	Literal bool
 }
 
 func (e EnvVar) String() string {
@@ -268,6 +828,9 @@ func (e EnvVar) String() string {
 
 // AsExport returns the environment variable as a bash export statement
 func (e EnvVar) AsExport() string {
+	if e.Literal {
+		return `export ` + e.Key + `=` + ShellQuote(e.Value) + `;`
+	}
 	return `export ` + e.Key + `="` + e.Value + `";`
 }
 
@@ -302,43 +865,63 @@ func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 // Set key to be equal value in this list.
 func (e *EnvList) Set(key, value string) {
+	e.set(key, value, false)
+}
+
+// SetLiteral sets key to value exported as is, see EnvVar.Literal.
+func (e *EnvList) SetLiteral(key, value string) {
+	e.set(key, value, true)
+}
+
+func (e *EnvList) set(key, value string, literal bool) {
 	for i, v := range *e {
 		if v.Key == key {
-			(*e)[i].Value = value
+			(*e)[i].Value, (*e)[i].Literal = value, literal
 			return
 		}
 	}
 
 	*e = append(*e, &EnvVar{
-		Key:   key,
-		Value: value,
+		Key:     key,
+		Value:   value,
+		Literal: literal,
 	})
 }
 
-func (e *EnvList) ResolveValues() error {
-	if len(*e) == 0 {
-		return nil
+// Get returns value of key, or "" if it's not in this list.
+func (e EnvList) Get(key string) string {
+	for _, v := range e {
+		if v.Key == key {
+			return v.Value
+		}
 	}
+	return ""
+}
 
+// ResolveValues evaluates the values by local shell, ie. $(cmd) or $VAR
+// referencing an earlier variable, and returns the resolved list. The
+// list itself is left intact.
+func (e EnvList) ResolveValues() (EnvList, error) {
+	resolved := make(EnvList, 0, len(e))
 	exports := ""
-	for i, v := range *e {
+	for _, v := range e {
 		exports += v.AsExport()
 
 		cmd := exec.Command("bash", "-c", exports+"echo -n "+v.Value+";")
 		cwd, err := os.Getwd()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		cmd.Dir = cwd
 		resolvedValue, err := cmd.Output()
 		if err != nil {
-			return errors.Wrapf(err, "resolving env var %v failed", v.Key)
+			return nil, errors.Wrapf(err, "resolving env var %v failed", v.Key)
 		}
 
-		(*e)[i].Value = string(resolvedValue)
+		resolved = append(resolved, &EnvVar{Key: v.Key, Value: string(resolvedValue)})
 	}
 
-	return nil
+	return resolved, nil
 }
 
 func (e *EnvList) AsExport() string {
@@ -351,6 +934,47 @@ func (e *EnvList) AsExport() string {
 	return exports
 }
 
+// PassEnv returns the current local values of the environment variables
+// named by patterns. Patterns may contain globs, ie. "CI_*". Variables that
+// are not set locally are skipped, unless required is true. The values are
+// Literal, so they're passed as is.
+func PassEnv(patterns []string, required bool) (EnvList, error) {
+	var envs EnvList
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "pass_env: invalid pattern %q", pattern)
+		}
+
+		if !strings.ContainsAny(pattern, "*?[") {
+			value, ok := os.LookupEnv(pattern)
+			if !ok {
+				if required {
+					return nil, fmt.Errorf("pass_env: %v is not set", pattern)
+				}
+				continue
+			}
+			envs.SetLiteral(pattern, value)
+			continue
+		}
+
+		found := false
+		for _, kv := range os.Environ() {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				continue
+			}
+			if ok, _ := path.Match(pattern, kv[:i]); ok {
+				envs.SetLiteral(kv[:i], kv[i+1:])
+				found = true
+			}
+		}
+		if !found && required {
+			return nil, fmt.Errorf("pass_env: no env vars match %v", pattern)
+		}
+	}
+	return envs, nil
+}
+
 type ErrMustUpdate struct {
 	Msg string
 }
@@ -364,21 +988,227 @@ func (e ErrMustUpdate) Error() string {
 }
 
 func (e ErrUnsupportedSupfileVersion) Error() string {
-	return fmt.Sprintf("%v\n\nCheck your Supfile version (available latest version: v0.5)", e.Msg)
+	return fmt.Sprintf("%v\n\nCheck your Supfile version (available latest version: v0.6)", e.Msg)
+}
+
+// ParseOptions control parsing of Supfile by NewSupfileWithOptions.
+// The zero value is the default behavior of NewSupfile.
+type ParseOptions struct {
+	// Strict fails on unknown or duplicate fields, ie. typos like "serail".
+	Strict bool
+
+	// Version overrides the version field of Supfile.
+	Version string
+
+	// NoCompat disables the backward compatibility fixups, ie. deprecated
+	// run_once is no longer treated as once. Warnings are still reported.
+	NoCompat bool
+
+	// Dir is the directory relative paths are resolved against, see Supfile.Dir.
+	Dir string
+
+	// Resolver resolves the hosts of networks and bastions by SSH config,
+	// the one loaded by ParseAndLoadSSHConfig by default.
+	Resolver *Resolver
+
+	// Format is FormatYAML, FormatJSON or FormatTOML. It's detected from
+	// the data by default, see FormatFromPath for detection by file name.
+	Format string
 }
 
 // NewSupfile parses configuration file and returns Supfile or error.
+// It's NewSupfileWithOptions with default options.
 func NewSupfile(data []byte) (*Supfile, error) {
+	return NewSupfileWithOptions(data, ParseOptions{})
+}
+
+// NewSupfileWithOptions parses configuration file according to opts and
+// returns Supfile or error. It has no side effects, ie. the warnings are
+// collected in Supfile.Warnings instead of being printed.
+func NewSupfileWithOptions(data []byte, opts ParseOptions) (*Supfile, error) {
 	var conf Supfile
 
-	if err := yaml.Unmarshal(data, &conf); err != nil {
+	// JSON and TOML are converted to YAML first, so all the formats are
+	// parsed and validated the same way.
+	source, format := data, detectFormat(data, opts.Format)
+	if format != FormatYAML {
+		var err error
+		if data, err = toYAML(data, format); err != nil {
+			return nil, err
+		}
+	}
+
+	// The document is parsed to nodes for the order of the items and for
+	// the fields of defaults:, which are copied to the commands and
+	// networks before they're decoded.
+	doc := &yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, doc); err != nil {
+		doc = nil
+	}
+	order, err := itemOrder(doc)
+	if err != nil {
+		return nil, err
+	}
+	data, cmdDefaults, netDefaults, err := applyDefaults(data, doc)
+	if err != nil {
 		return nil, err
 	}
 
+	unmarshal := yaml.Unmarshal
+	if opts.Strict {
+		unmarshal = yaml.UnmarshalStrict
+	}
+	if err := unmarshal(data, &conf); err != nil {
+		return nil, err
+	}
+	conf.orderItems(order)
+	for name, fields := range cmdDefaults {
+		if cmd, ok := conf.Commands.cmds[name]; ok {
+			cmd.defaults = fields
+			conf.Commands.cmds[name] = cmd
+		}
+	}
+	for name, fields := range netDefaults {
+		if network, ok := conf.Networks.nets[name]; ok {
+			network.defaults = fields
+			conf.Networks.nets[name] = network
+		}
+	}
+	// Warnings are located by "key:" lines, which are the same in JSON.
+	// TOML warnings have no lines.
+	if format != FormatTOML {
+		conf.data = source
+	}
+	conf.Dir = opts.Dir
+	conf.resolver = defaultResolver
+	if opts.Resolver != nil {
+		conf.resolver = opts.Resolver
+		for name, network := range conf.Networks.nets {
+			if err := network.resolveHosts(opts.Resolver); err != nil {
+				return nil, err
+			}
+			conf.Networks.nets[name] = network
+		}
+	}
+	if opts.Version != "" {
+		conf.Version = opts.Version
+	}
+
+	// Service, limits, pacing, steps, upload and selector errors are reported before any connection is made.
+	for key, cmd := range conf.Commands.cmds {
+		if cmd.Service != nil {
+			if _, err := cmd.Service.Script(); err != nil {
+				return nil, errors.Wrapf(err, "command %v", key)
+			}
+		}
+		if err := cmd.Limits.check(); err != nil {
+			return nil, errors.Wrapf(err, "command %v", key)
+		}
+		if err := cmd.Pacing.check(); err != nil {
+			return nil, errors.Wrapf(err, "command %v", key)
+		}
+		if _, _, err := cmd.Timeouts.durations(); err != nil {
+			return nil, errors.Wrapf(err, "command %v", key)
+		}
+		if err := cmd.checkSteps(); err != nil {
+			return nil, errors.Wrapf(err, "command %v", key)
+		}
+		for _, upload := range cmd.Upload {
+			if err := upload.checkVia(); err != nil {
+				return nil, errors.Wrapf(err, "command %v: upload %v", key, upload.Src)
+			}
+			if err := upload.checkMethod(); err != nil {
+				return nil, errors.Wrapf(err, "command %v: upload %v", key, upload.Src)
+			}
+			if err := upload.checkVerify(); err != nil {
+				return nil, errors.Wrapf(err, "command %v: upload %v", key, upload.Src)
+			}
+			if upload.IncludeUntracked && !cmd.gitTracked(upload) {
+				return nil, errors.Errorf("command %v: upload %v: include_untracked requires git_tracked", key, upload.Src)
+			}
+		}
+		if len(cmd.ScriptArgs) > 0 && cmd.Script == "" {
+			return nil, conf.errorAt(fmt.Sprintf("command %v: script_args requires script", key), "commands", key, "script_args")
+		}
+		if err := conf.checkFragments(cmd.Use); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("command %v: use: %v", key, err), "commands", key, "use")
+		}
+		if err := checkOutput(cmd.Output); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("command %v: %v", key, err), "commands", key, "output")
+		}
+		if err := checkChangedPaths(cmd.ChangedPaths); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("command %v: %v", key, err), "commands", key, "changed_paths")
+		}
+		if err := cmd.checkTemplate(); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("command %v: %v", key, err), "commands", key, "run")
+		}
+		if cmd.SerialDelay != "" && cmd.Serial == 0 {
+			return nil, errors.Errorf("command %v: serial_delay requires serial", key)
+		}
+		if cmd.RunOn == "" {
+			continue
+		}
+		selector, err := ParseSelector(cmd.RunOn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "command %v: run_on", key)
+		}
+		cmd.runOn = selector
+		conf.Commands.cmds[key] = cmd
+	}
+
+	for _, name := range conf.Targets.Names {
+		if pipe, ok := conf.Targets.Pipe(name); ok {
+			if err := pipe.check(&conf, name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, name := range conf.Networks.Names {
+		network := conf.Networks.nets[name]
+		if _, err := newConnectLimiter(&network); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("network %v: %v", name, err), "networks", name, "connect_rate")
+		}
+		if _, err := parseDuration(network.ConnectTimeout, 0); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("network %v: connect_timeout: %v", name, err), "networks", name, "connect_timeout")
+		}
+		if err := checkIdentityKey(network.IdentityKeyEnv, network.IdentityKeyFile); err != nil {
+			return nil, conf.errorAt(fmt.Sprintf("network %v: %v", name, err), "networks", name, "identity_key_file")
+		}
+		if err := conf.checkTunnels(name, &network); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.Paths != "" && conf.Paths != PathsSupfileRelative {
+		return nil, fmt.Errorf("unknown paths %q, expected %q", conf.Paths, PathsSupfileRelative)
+	}
+
+	if conf.PrefixFormat != nil {
+		if _, err := parsePrefixFormat(*conf.PrefixFormat); err != nil {
+			return nil, conf.errorAt(err.Error(), "prefix_format")
+		}
+	}
+
+	// Names shared by a command and a target are ambiguous, unless the
+	// Supfile prefers the targets.
+	if conf.Prefer != "" && conf.Prefer != PreferTarget {
+		return nil, fmt.Errorf("unknown prefer %q, expected %q", conf.Prefer, PreferTarget)
+	}
+	for _, name := range conf.Targets.Names {
+		if len(conf.Targets.targets[name]) == 0 {
+			return nil, fmt.Errorf("target %v has no commands", name)
+		}
+		if _, ok := conf.Commands.cmds[name]; ok && conf.Prefer != PreferTarget {
+			return nil, fmt.Errorf("%v is both a command and a target, rename one of them or set prefer: %v", name, PreferTarget)
+		}
+	}
+
 	// API backward compatibility. Will be deprecated in v1.0.
 	switch conf.Version {
 	case "":
 		conf.Version = "0.1"
+		conf.warn(WarnMissingVersion, "version is not set, assuming Supfile v"+conf.Version)
 		fallthrough
 
 	case "0.1":
@@ -394,7 +1224,7 @@ func NewSupfile(data []byte) (*Supfile, error) {
 			if cmd.Once {
 				return nil, ErrMustUpdate{"command.once is not supported in Supfile v" + conf.Version}
 			}
-			if cmd.Local {
+			if cmd.Local || cmd.LocalAlso {
 				return nil, ErrMustUpdate{"command.local is not supported in Supfile v" + conf.Version}
 			}
 			if cmd.Serial != 0 {
@@ -409,21 +1239,27 @@ func NewSupfile(data []byte) (*Supfile, error) {
 		fallthrough
 
 	case "0.3":
-		var warning string
+		fallthrough
+
+	case "0.4", "0.5", "0.6":
 		for key, cmd := range conf.Commands.cmds {
 			if cmd.RunOnce {
-				warning = "Warning: command.run_once was deprecated by command.once in Supfile v" + conf.Version + "\n"
-				cmd.Once = true
-				conf.Commands.cmds[key] = cmd
+				conf.warn(WarnDeprecatedRunOnce, "command.run_once was deprecated by command.once in Supfile v"+conf.Version, "commands", key, "run_once")
+				if !opts.NoCompat {
+					cmd.Once = true
+					conf.Commands.cmds[key] = cmd
+				}
+			}
+			for _, upload := range cmd.Upload {
+				if upload.excString {
+					conf.warn(WarnStringExclude, "command.upload.exclude string was deprecated by a list of patterns", "commands", key, "exclude")
+				}
+			}
+			if err := conf.checkScheduling(key, cmd); err != nil {
+				return nil, err
 			}
 		}
-		if warning != "" {
-			fmt.Fprintln(os.Stderr, warning)
-		}
-
-		fallthrough
-
-	case "0.4", "0.5":
+		conf.sortWarnings()
 
 	default:
 		return nil, ErrUnsupportedSupfileVersion{"unsupported Supfile version " + conf.Version}
@@ -432,40 +1268,186 @@ func NewSupfile(data []byte) (*Supfile, error) {
 	return &conf, nil
 }
 
+// checkScheduling validates the combinations of local, once and serial of
+// the command. Local commands run on localhost for each host, all at once,
+// so once and serial are ignored with a warning. Once with serial is an
+// error, and so is local with upload, which has no host to upload to.
+// Uploads of local: also commands, to the paths of the hosts, require
+// upload_local_skip.
+func (s *Supfile) checkScheduling(key string, cmd Command) error {
+	once := "once"
+	if cmd.RunOnce && findLine(s.data, "commands", key, once) == 0 {
+		once = "run_once"
+	}
+	switch {
+	case cmd.Once && cmd.Serial != 0:
+		return s.errorAt(fmt.Sprintf("command %v: %v and serial can't be combined, once runs on a single host", key, once), "commands", key, "serial")
+	case cmd.Local && len(cmd.Upload) > 0:
+		return s.errorAt(fmt.Sprintf("command %v: local and upload can't be combined, there's no host to upload to", key), "commands", key, "upload")
+	case cmd.LocalAlso && (len(cmd.Upload) > 0 || cmd.Build != nil && cmd.Build.Dst != "") && !cmd.UploadLocalSkip:
+		return s.errorAt(fmt.Sprintf("command %v: local: also can't upload to localhost, set upload_local_skip: true to upload to the hosts only", key), "commands", key, "local")
+	case cmd.UploadLocalSkip && !cmd.LocalAlso:
+		s.warn(WarnLocalScheduling, fmt.Sprintf("commands.%v.upload_local_skip is ignored without local: also", key), "commands", key, "upload_local_skip")
+	}
+	if !cmd.Local {
+		return nil
+	}
+	if cmd.Once {
+		s.warn(WarnLocalScheduling, fmt.Sprintf("commands.%v.%v is ignored by local command, which runs on localhost for each host", key, once), "commands", key, once)
+	}
+	if cmd.Serial != 0 {
+		s.warn(WarnLocalScheduling, fmt.Sprintf("commands.%v.serial is ignored by local command, which runs on localhost for all hosts at once", key), "commands", key, "serial")
+	}
+	return nil
+}
+
+// DefaultInventoryTimeout is how long the inventory command may run,
+// unless the network sets inventory_timeout.
+const DefaultInventoryTimeout = 30 * time.Second
+
+// inventoryStderrLines is how many trailing lines of the inventory
+// command's stderr are included in the error.
+const inventoryStderrLines = 5
+
 // ParseInventory runs the inventory command, if provided, and appends
 // the command's output lines to the manually defined list of hosts.
+// Lines may name the hosts, ie. "web1=deploy@10.0.0.5". The hosts of
+// InventoryHTTP follow. The inventory is run once per network parsed from
+// Supfile (or set by Networks.Set), later calls return the same hosts.
+// See InventoryCache for consecutive runs.
 func (n Network) ParseInventory() ([]*Host, error) {
-	if n.Inventory == "" {
+	return n.ParseInventoryContext(context.Background())
+}
+
+// ParseInventoryContext is ParseInventory, which kills the inventory
+// command once ctx is done or the inventory timeout elapses.
+func (n Network) ParseInventoryContext(ctx context.Context) ([]*Host, error) {
+	if n.Inventory == "" && n.InventoryHTTP == nil {
 		return nil, nil
 	}
-
-	cmd := exec.Command("/bin/sh", "-c", n.Inventory)
-	cmd.Env = os.Environ()
-	cmd.Env = append(cmd.Env, n.Env.Slice()...)
-	cmd.Stderr = os.Stderr
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
+	if n.inventory == nil {
+		return n.parseInventory(ctx)
 	}
+	n.inventory.once.Do(func() {
+		n.inventory.hosts, n.inventory.err = n.parseInventory(ctx)
+	})
+	return append([]*Host(nil), n.inventory.hosts...), n.inventory.err
+}
 
-	var hosts []*Host
-	buf := bytes.NewBuffer(output)
-	for {
-		host, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+// parseInventory returns the hosts of the inventory output, cached or not,
+// and of the HTTP inventory.
+func (n Network) parseInventory(ctx context.Context) ([]*Host, error) {
+	var output string
+	if n.Inventory != "" {
+		var err error
+		if output, err = n.inventoryOutput(ctx); err != nil {
 			return nil, err
 		}
+	}
 
+	var hosts []*Host
+	for _, host := range strings.Split(output, "\n") {
 		host = strings.TrimSpace(host)
 		// skip empty lines and comments
 		if host == "" || host[:1] == "#" {
 			continue
 		}
 
-		hosts = append(hosts, &Host{Address: host})
+		// Trailing key=value tokens are labels, ie. "10.0.0.5 role=web".
+		fields := strings.Fields(host)
+		labels := map[string]string{}
+		for len(fields) > 1 && strings.Contains(fields[len(fields)-1], "=") {
+			key, value, err := parseLabel(fields[len(fields)-1])
+			if err != nil {
+				return nil, fmt.Errorf("inventory line %q: %v", host, err)
+			}
+			if _, ok := labels[key]; !ok {
+				labels[key] = value
+			}
+			fields = fields[:len(fields)-1]
+		}
+		host = strings.Join(fields, " ")
+
+		if i := strings.Index(host, "="); i > 0 && !strings.ContainsAny(host[:i], "@:/ ") {
+			host = host[i+1:] + " as " + host[:i]
+		}
+
+		supHost, err := n.resolver.NewHost(host, n.HostDefaults())
+		if err != nil {
+			return nil, err
+		}
+		if len(labels) > 0 {
+			supHost.Labels = labels
+		}
+		hosts = append(hosts, supHost)
+	}
+	if n.InventoryHTTP != nil {
+		httpHosts, err := n.inventoryHTTP(ctx)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, httpHosts...)
+	}
+	if err := checkAliases(append(append([]*Host{}, n.Hosts...), hosts...)); err != nil {
+		return nil, errors.Wrap(err, "inventory")
 	}
 	return hosts, nil
 }
+
+// runInventory returns output of the inventory command.
+func (n Network) runInventory(ctx context.Context) (string, error) {
+	timeout, err := parseDuration(n.InventoryTimeout, DefaultInventoryTimeout)
+	if err != nil {
+		return "", errors.Wrap(err, "inventory_timeout")
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", n.Inventory)
+	cmd.Dir = n.Workdir
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, n.Env.Slice()...)
+	cmd.Stderr = &stderr
+	// Don't wait for background processes holding the pipes open.
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return "", fmt.Errorf("inventory timed out after %v", timeout)
+		case ctx.Err() != nil:
+			return "", errors.Wrap(ctx.Err(), "inventory")
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("inventory failed with exit code %v", exitErr.ExitCode())
+		} else {
+			err = errors.Wrap(err, "inventory")
+		}
+		if tail := lastLines(stderr.String(), inventoryStderrLines); tail != "" {
+			err = fmt.Errorf("%v:\n%v", err, tail)
+		}
+		return "", err
+	}
+	return string(output), nil
+}
+
+// allowsExitStatus reports whether the exit status is listed
+// in allowed_exit_codes.
+func (cmd *Command) allowsExitStatus(status int) bool {
+	for _, code := range cmd.AllowedExitCodes {
+		if code == status {
+			return true
+		}
+	}
+	return false
+}
+
+// lastLines returns up to n trailing non-empty lines of s.
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(s, "\r\n", "\n"), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,243 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckScheduling(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		command  string // Fields of the command, at line 6.
+		err      string
+		warnings []string
+	}{
+		{name: "serial", command: "serial: 2"},
+		{name: "once", command: "once: true"},
+		{name: "upload", command: "upload:\n      - src: app\n        dst: /tmp"},
+		{name: "local", command: "local: true"},
+		{
+			name:     "local once",
+			command:  "local: true\n    once: true",
+			warnings: []string{"Warning: line 7: commands.deploy.once is ignored by local command, which runs on localhost for each host"},
+		},
+		{
+			name:     "local run_once",
+			command:  "local: true\n    run_once: true",
+			warnings: []string{"Warning: line 7: commands.deploy.run_once is ignored by local command, which runs on localhost for each host"},
+		},
+		{
+			name:     "local serial",
+			command:  "local: true\n    serial: 5",
+			warnings: []string{"Warning: line 7: commands.deploy.serial is ignored by local command, which runs on localhost for all hosts at once"},
+		},
+		{
+			name:    "once serial",
+			command: "once: true\n    serial: 2",
+			err:     "line 7: command deploy: once and serial can't be combined, once runs on a single host",
+		},
+		{
+			name:    "local upload",
+			command: "local: true\n    upload:\n      - src: app\n        dst: /tmp",
+			err:     "line 7: command deploy: local and upload can't be combined, there's no host to upload to",
+		},
+		{
+			name:    "local also upload",
+			command: "local: also\n    upload:\n      - src: app\n        dst: /tmp",
+			err:     "line 6: command deploy: local: also can't upload to localhost, set upload_local_skip: true to upload to the hosts only",
+		},
+		{name: "local also upload_local_skip", command: "local: also\n    upload_local_skip: true\n    upload:\n      - src: app\n        dst: /tmp"},
+		{
+			name:     "upload_local_skip",
+			command:  "upload_local_skip: true",
+			warnings: []string{"Warning: line 6: commands.deploy.upload_local_skip is ignored without local: also"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := NewSupfile([]byte("version: 0.5\ncommands:\n  deploy:\n    run: ./deploy.sh\n    desc: Deploy\n    " + tt.command + "\n"))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var warnings []string
+			for _, w := range conf.Warnings {
+				if w.Code == WarnLocalScheduling {
+					warnings = append(warnings, w.String())
+				}
+			}
+			if strings.Join(warnings, "\n") != strings.Join(tt.warnings, "\n") {
+				t.Errorf("got warnings %q, want %q", warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestClientGroupsScheduling(t *testing.T) {
+	var clients []Client
+	for _, name := range []string{"web1", "web2", "web3"} {
+		clients = append(clients, NewLocalhostClient(&Host{Address: name}, ""))
+	}
+	for _, tt := range []struct {
+		name   string
+		cmd    Command
+		groups []int // Sizes of the groups run one after another.
+	}{
+		{"all at once", Command{}, []int{3}},
+		{"serial", Command{Serial: 2}, []int{2, 1}},
+		{"once", Command{Once: true}, []int{1}},
+		{"local", Command{Local: true}, []int{3}},
+		{"local once", Command{Local: true, Once: true}, []int{3}},
+		{"local serial", Command{Local: true, Serial: 1}, []int{3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var sizes []int
+			for _, group := range clientGroups(&tt.cmd, clients) {
+				sizes = append(sizes, len(group))
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(tt.groups) {
+				t.Errorf("got groups of %v hosts, want %v", sizes, tt.groups)
+			}
+		})
+	}
+}
+
+// TestNewSupfileNoStderr checks that parsing, with warnings or errors,
+// doesn't write to os.Stderr under default options, so that Supfiles
+// can be parsed by other programs.
+func TestNewSupfileNoStderr(t *testing.T) {
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(f *os.File) { os.Stderr = f }(os.Stderr)
+	os.Stderr = stderr
+
+	for _, tt := range []struct {
+		name     string
+		supfile  string
+		warnings int
+		err      bool
+	}{
+		{name: "missing version", supfile: "commands:\n  ping:\n    run: echo ping\n", warnings: 1},
+		{name: "run_once", supfile: "version: 0.4\ncommands:\n  migrate:\n    run: ./migrate\n    run_once: true\n", warnings: 1},
+		{name: "exclude string", supfile: "version: 0.5\ncommands:\n  upload:\n    upload:\n      - src: .\n        dst: /tmp\n        exclude: .git\n", warnings: 1},
+		{name: "local serial", supfile: "version: 0.5\ncommands:\n  build:\n    local: true\n    serial: 2\n    run: make\n", warnings: 1},
+		{name: "networks", supfile: "version: 0.5\nnetworks:\n  dev:\n    hosts: [deploy@web1, web2:2222]\n"},
+		{name: "unknown field", supfile: "version: 0.5\ncommands:\n  ping:\n    serail: 1\n    run: echo ping\n"},
+		{name: "unsupported version", supfile: "version: 9.9\n", err: true},
+		{name: "invalid yaml", supfile: "commands: [\n", err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := NewSupfile([]byte(tt.supfile))
+			if tt.err != (err != nil) {
+				t.Fatalf("got error %v, want error %v", err, tt.err)
+			}
+			if err == nil && len(conf.Warnings) != tt.warnings {
+				t.Errorf("got warnings %v, want %v", conf.Warnings, tt.warnings)
+			}
+		})
+	}
+
+	out, err := os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 0 {
+		t.Errorf("got stderr %q, want none", out)
+	}
+}
+
+// TestPassEnvQuoting runs the exports of hostile pass_env values by the
+// shell, which must neither run their commands nor expand them.
+func TestPassEnvQuoting(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	conf, err := NewSupfile([]byte("version: 0.5\nnetworks:\n  ci:\n    pass_env: [SUP_TEST_CI_*]\n    hosts: [localhost]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		value string
+	}{
+		{"double quotes", `fix "quoting" of "args"`},
+		{"single quotes", `it's 'done'`},
+		{"commands", "run `touch pwned` and $(touch pwned)"},
+		{"vars", `$HOME ${PATH} $1`},
+		{"backslashes", `C:\path\ and \"`},
+		{"newlines", "Merge branch 'x'\n\nSigned-off-by: $(touch pwned)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SUP_TEST_CI_MESSAGE", tt.value)
+			passEnv, err := PassEnv([]string{"SUP_TEST_CI_*"}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			networkEnv, err := conf.NetworkEnv("ci", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, env := range []EnvList{passEnv, networkEnv} {
+				dir := t.TempDir()
+				cmd := exec.Command("sh", "-c", env.AsExport()+`printf %s "$SUP_TEST_CI_MESSAGE"`)
+				cmd.Dir = dir
+				out, err := cmd.CombinedOutput()
+				if err != nil {
+					t.Fatalf("%v: %s", err, out)
+				}
+				if string(out) != tt.value {
+					t.Errorf("got %q, want %q", out, tt.value)
+				}
+				if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+					t.Errorf("command of the value was run")
+				}
+			}
+		})
+	}
+}
+
+// TestHostDefaults checks the precedence of the host's user, port and
+// identity_file: values of the host win over SSH config matches, which
+// win over the network defaults.
+func TestHostDefaults(t *testing.T) {
+	r, err := NewResolver("testdata/ssh_config/defaults", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network := HostDefaults{User: "deploy", Port: "2222", IdentityFile: "/keys/net"}
+	for _, tt := range []struct {
+		name     string
+		host     HostConfig
+		defaults HostDefaults
+		want     string // user@address:port identity_file
+	}{
+		{name: "network defaults", host: HostConfig{Host: "web1"}, defaults: network, want: "deploy@web1:2222 /keys/net"},
+		{name: "host string", host: HostConfig{Host: "admin@web1:22"}, defaults: network, want: "admin@web1:22 /keys/net"},
+		{name: "host fields", host: HostConfig{Host: "web1", User: "admin", Port: "22", IdentityFile: "/keys/host"}, defaults: network, want: "admin@web1:22 /keys/host"},
+		{name: "ssh config", host: HostConfig{Host: "configured"}, defaults: network, want: "cfg@configured:2200 /keys/cfg"},
+		{name: "ssh config no defaults", host: HostConfig{Host: "configured"}, want: "cfg@configured:2200 /keys/cfg"},
+		{name: "host string over ssh config", host: HostConfig{Host: "admin@configured:22"}, defaults: network, want: "admin@configured:22 /keys/cfg"},
+		{name: "host fields over ssh config", host: HostConfig{Host: "configured", User: "admin", Port: "22", IdentityFile: "/keys/host"}, defaults: network, want: "admin@configured:22 /keys/host"},
+		{name: "partial defaults", host: HostConfig{Host: "web1"}, defaults: HostDefaults{User: "deploy"}, want: "deploy@web1:22 "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			host, err := r.NewHostFromConfig(tt.host, tt.defaults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%v@%v:%v %v", host.User, host.Address, host.Port, host.IdentityFile); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
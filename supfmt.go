@@ -0,0 +1,211 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// commandKeyOrder is the canonical order of command keys. Other keys
+// follow in their original order.
+var commandKeyOrder = []string{"desc", "local", "once", "serial", "env", "upload", "run", "script"}
+
+// foldRunLength is the length of run: strings, over which they're written
+// as literal block scalars.
+const foldRunLength = 80
+
+// FormatSupfile returns the YAML Supfile data in the canonical style of
+// `sup fmt`: two-space indent, command keys in the commandKeyOrder, long
+// and multiline run: strings as literal block scalars and the values of
+// env maps aligned. Comments are kept. Data that doesn't parse as Supfile
+// is an error, as is formatting which would change the parsed Supfile.
+func FormatSupfile(data []byte) ([]byte, error) {
+	if detectFormat(data, "") != FormatYAML {
+		return nil, fmt.Errorf("fmt supports YAML Supfiles only")
+	}
+	before, err := NewSupfileSet(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []*yamlv3.Node
+	dec := yamlv3.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yamlv3.Node
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		formatDocument(&doc)
+		docs = append(docs, &doc)
+	}
+
+	var b bytes.Buffer
+	enc := yamlv3.NewEncoder(&b)
+	enc.SetIndent(2)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	out, err := alignEnv(b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// The formatted Supfile must be the same Supfile.
+	after, err := NewSupfileSet(out)
+	if err != nil {
+		return nil, fmt.Errorf("formatted Supfile doesn't parse: %v", err)
+	}
+	if !sameSupfiles(before, after) {
+		return nil, fmt.Errorf("formatting would change the Supfile")
+	}
+	return out, nil
+}
+
+// formatDocument reorders the command keys and sets the style of run:
+// strings in the document.
+func formatDocument(doc *yamlv3.Node) {
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 {
+		return
+	}
+	commands := mappingValue(doc.Content[0], "commands")
+	if commands == nil || commands.Kind != yamlv3.MappingNode {
+		return
+	}
+	for i := 1; i < len(commands.Content); i += 2 {
+		cmd := commands.Content[i]
+		if cmd.Kind != yamlv3.MappingNode {
+			continue
+		}
+		sortKeys(cmd, commandKeyOrder)
+		if run := mappingValue(cmd, "run"); run != nil && run.Kind == yamlv3.ScalarNode && run.Tag == "!!str" {
+			if strings.Contains(run.Value, "\n") || len(run.Value) > foldRunLength {
+				run.Style = yamlv3.LiteralStyle
+			}
+		}
+	}
+}
+
+// mappingValue returns value of key in the mapping node, or nil, ie. of
+// nil node.
+func mappingValue(node *yamlv3.Node, key string) *yamlv3.Node {
+	if node == nil || node.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sortKeys moves the keys of the mapping node listed in order to the front,
+// in that order. The order of the other keys is kept.
+func sortKeys(node *yamlv3.Node, order []string) {
+	var sorted, rest []*yamlv3.Node
+	for _, key := range order {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				sorted = append(sorted, node.Content[i], node.Content[i+1])
+			}
+		}
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if !containsString(order, node.Content[i].Value) {
+			rest = append(rest, node.Content[i], node.Content[i+1])
+		}
+	}
+	node.Content = append(sorted, rest...)
+}
+
+// alignEnv pads the keys of env: maps in the YAML data, so their values
+// start in the same column. Maps with any value not on its key's line,
+// ie. a block scalar, are left as they are.
+func alignEnv(data []byte) ([]byte, error) {
+	var docs []*yamlv3.Node
+	dec := yamlv3.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc yamlv3.Node
+		if err := dec.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		docs = append(docs, &doc)
+	}
+
+	// Padding of lines, by their 1-based number, and the column it goes to.
+	type pad struct{ column, width int }
+	pads := map[int]pad{}
+	var walk func(node *yamlv3.Node)
+	walk = func(node *yamlv3.Node) {
+		if node.Kind == yamlv3.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if key, value := node.Content[i], node.Content[i+1]; key.Value == "env" && value.Kind == yamlv3.MappingNode && value.Style&yamlv3.FlowStyle == 0 {
+					aligned := map[int]pad{}
+					end := 0
+					for j := 0; j+1 < len(value.Content); j += 2 {
+						k, v := value.Content[j], value.Content[j+1]
+						if v.Kind != yamlv3.ScalarNode || v.Line != k.Line || v.Style&(yamlv3.LiteralStyle|yamlv3.FoldedStyle) != 0 {
+							aligned = nil
+							break
+						}
+						aligned[v.Line] = pad{column: v.Column}
+						if v.Column > end {
+							end = v.Column
+						}
+					}
+					for line, p := range aligned {
+						pads[line] = pad{column: p.column, width: end - p.column}
+					}
+				}
+			}
+		}
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+	for _, doc := range docs {
+		walk(doc)
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for n, p := range pads {
+		line := lines[n-1]
+		// Columns count runes.
+		at := 0
+		for i := 1; i < p.column && at < len(line); i++ {
+			_, size := utf8.DecodeRuneInString(line[at:])
+			at += size
+		}
+		lines[n-1] = line[:at] + strings.Repeat(" ", p.width) + line[at:]
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// sameSupfiles reports whether the sets have the same projects, as
+// written by Marshal.
+func sameSupfiles(a, b *SupfileSet) bool {
+	if len(a.Projects) != len(b.Projects) {
+		return false
+	}
+	for i := range a.Projects {
+		x, errX := a.Projects[i].Marshal()
+		y, errY := b.Projects[i].Marshal()
+		if errX != nil || errY != nil || !bytes.Equal(x, y) {
+			return false
+		}
+	}
+	return true
+}
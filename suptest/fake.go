@@ -0,0 +1,291 @@
+// Package suptest runs Supfile commands on fake hosts, so Supfiles can be
+// tested without any host to connect to:
+//
+//	network := suptest.NewFakeNetwork(
+//		suptest.FakeHost{Host: "web1", Responses: []suptest.Response{
+//			{Match: "migrate", Stderr: "migration failed\n", Exit: 1},
+//		}},
+//		suptest.FakeHost{Host: "web2"},
+//	)
+//	report, err := suptest.Run(conf, "production", network, "deploy")
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	if report.Started("web1", "restart") {
+//		t.Error("restart is run after failed migrate")
+//	}
+//
+// The fake hosts are plugged into Stackup.Dial, so the commands go through
+// the same tasks, scheduling (serial, once, max_failures, timeouts...) and
+// output as on the real hosts.
+package suptest
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pressly/sup"
+)
+
+// FakeHost is a host of FakeNetwork, answering the tasks run on it by its
+// Responses.
+type FakeHost struct {
+	Host       string     // Host as in hosts:, ie. "deploy@10.0.0.5" or "10.0.0.5 as web1".
+	ConnectErr error      // Error of connecting to the host, nil if it connects.
+	Responses  []Response // Answers of the tasks, see Response.Match.
+}
+
+// Response is answer of a fake host to the tasks of matching command.
+// Tasks matching no response succeed without output.
+type Response struct {
+	Match  string        // Substring of the task's command (sup's own of uploads), "" matches all tasks.
+	Stdout string        // Output of the task.
+	Chunks []Chunk       // Output of the task written after Stdout, a chunk at a time.
+	Stderr string        // Error output of the task, written after Stdout.
+	Exit   int           // Exit status of the task.
+	Delay  time.Duration // Time before the output is written, ie. to trigger idle_timeout.
+}
+
+// Chunk is a write of the output of a task, ie. of a partial line
+// finished by a later chunk.
+type Chunk struct {
+	Delay  time.Duration // Time since the previous write.
+	Stdout string
+}
+
+// FakeTask is a task run on a fake host.
+type FakeTask struct {
+	Host  string // Name of the host, see Host.GetHostname.
+	Kind  string // Kind of the task, see sup.Task.
+	Run   string // Command of the task, without the host's env exports.
+	Local bool   // Command is local:, see FakeNetwork.
+	Exit  int    // Exit status answered, 130 if interrupted.
+}
+
+// FakeNetwork is network of fake hosts. Commands with local: are run on
+// the fake hosts too, with FakeTask.Local set.
+type FakeNetwork struct {
+	Env sup.EnvList // Env vars of Run, as set by sup -e.
+
+	hosts []FakeHost
+
+	mu    sync.Mutex
+	tasks []FakeTask
+}
+
+// NewFakeNetwork returns network of the fake hosts.
+func NewFakeNetwork(hosts ...FakeHost) *FakeNetwork {
+	return &FakeNetwork{hosts: hosts}
+}
+
+// Hosts returns the hosts of the network, to be run on by Stackup.Run.
+func (n *FakeNetwork) Hosts() ([]*sup.Host, error) {
+	var hosts []*sup.Host
+	for _, fake := range n.hosts {
+		host, err := sup.NewHost(fake.Host)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// Dial is the sup.ClientFunc of the fake hosts, see Stackup.Dial.
+func (n *FakeNetwork) Dial(host *sup.Host, env string) (sup.Client, error) {
+	for i := range n.hosts {
+		fake := &n.hosts[i]
+		h, err := sup.NewHost(fake.Host)
+		if err != nil || h.GetHostname() != host.GetHostname() {
+			continue
+		}
+		if fake.ConnectErr != nil {
+			return nil, fake.ConnectErr
+		}
+		return &fakeClient{network: n, fake: fake, host: host}, nil
+	}
+	return nil, fmt.Errorf("%v is not a host of the fake network", host.GetHostname())
+}
+
+// Tasks returns the tasks run on the fake hosts so far, in order they were
+// started.
+func (n *FakeNetwork) Tasks() []FakeTask {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]FakeTask{}, n.tasks...)
+}
+
+// record appends the task and returns its index.
+func (n *FakeNetwork) record(task FakeTask) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tasks = append(n.tasks, task)
+	return len(n.tasks) - 1
+}
+
+// exited sets the exit status of the recorded task.
+func (n *FakeNetwork) exited(i, status int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.tasks[i].Exit = status
+}
+
+// ExitError is the error of a task answered by non-zero exit status.
+type ExitError struct {
+	Status int
+}
+
+func (e ExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.Status)
+}
+
+// ExitStatus returns the exit status of the task.
+func (e ExitError) ExitStatus() int {
+	return e.Status
+}
+
+// fakeClient runs the tasks of a fake host, one at a time.
+type fakeClient struct {
+	network *FakeNetwork
+	fake    *FakeHost
+	host    *sup.Host
+
+	stdout *io.PipeReader
+	stderr *io.PipeReader
+	stdin  *io.PipeWriter
+	done   chan int // Exit status of the running task.
+
+	mu          sync.Mutex
+	interrupt   chan struct{} // Closed by Signal or Close.
+	interrupted bool
+}
+
+func (c *fakeClient) Connect() error {
+	return nil
+}
+
+func (c *fakeClient) Host() *sup.Host {
+	return c.host
+}
+
+// Run starts the task, answered by the first response matching its
+// command. Its input, if any, is read to the end before it exits.
+func (c *fakeClient) Run(task *sup.Task) error {
+	task = task.ForHost(c.host)
+	var response Response
+	for _, r := range c.fake.Responses {
+		if strings.Contains(task.Run, r.Match) {
+			response = r
+			break
+		}
+	}
+	i := c.network.record(FakeTask{Host: c.host.GetHostname(), Kind: task.Kind, Run: task.Run, Local: task.Local})
+
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	stdinR, stdin := io.Pipe()
+	c.stdout, c.stderr, c.stdin = stdout, stderr, stdin
+	c.done = make(chan int, 1)
+	c.mu.Lock()
+	c.interrupt, c.interrupted = make(chan struct{}), false
+	c.mu.Unlock()
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, stdinR)
+		close(drained)
+	}()
+
+	go func(interrupt chan struct{}, done chan int) {
+		status := response.Exit
+		select {
+		case <-time.After(response.Delay):
+			io.WriteString(stdoutW, response.Stdout)
+			if !writeChunks(stdoutW, response.Chunks, interrupt) {
+				status = 130
+				break
+			}
+			io.WriteString(stderrW, response.Stderr)
+			if task.Input != nil {
+				select {
+				case <-drained:
+				case <-interrupt:
+					status = 130
+				}
+			}
+		case <-interrupt:
+			status = 130
+		}
+		stdinR.Close()
+		stdoutW.Close()
+		stderrW.Close()
+		c.network.exited(i, status)
+		done <- status
+	}(c.interrupt, c.done)
+	return nil
+}
+
+// writeChunks writes the chunks to w, each after its delay. It returns
+// false if interrupted first.
+func writeChunks(w io.Writer, chunks []Chunk, interrupt chan struct{}) bool {
+	for _, chunk := range chunks {
+		select {
+		case <-time.After(chunk.Delay):
+			io.WriteString(w, chunk.Stdout)
+		case <-interrupt:
+			return false
+		}
+	}
+	return true
+}
+
+func (c *fakeClient) Wait() error {
+	if status := <-c.done; status != 0 {
+		return ExitError{status}
+	}
+	return nil
+}
+
+// Close interrupts the running task, if any.
+func (c *fakeClient) Close() error {
+	return c.Signal(os.Interrupt)
+}
+
+func (c *fakeClient) Prefix() (string, int) {
+	prefix := c.host.GetPrefixText()
+	return prefix, len(prefix)
+}
+
+func (c *fakeClient) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *fakeClient) WriteClose() error {
+	return c.stdin.Close()
+}
+
+func (c *fakeClient) Stdin() io.WriteCloser {
+	return c.stdin
+}
+
+func (c *fakeClient) Stderr() io.Reader {
+	return c.stderr
+}
+
+func (c *fakeClient) Stdout() io.Reader {
+	return c.stdout
+}
+
+// Signal interrupts the running task, which exits with status 130.
+func (c *fakeClient) Signal(os.Signal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.interrupt != nil && !c.interrupted {
+		close(c.interrupt)
+		c.interrupted = true
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package suptest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pressly/sup"
+)
+
+// Report is the outcome of Run, for assertions.
+type Report struct {
+	Err    error       // Error of Stackup.Run, nil if the run succeeded.
+	Events []sup.Event // Events of the run, in order.
+	Stdout string      // Text output of the run, as printed by sup -batch.
+	Stderr string      // Text error output of the run, ie. failures.
+	Tasks  []FakeTask  // Tasks run on the fake hosts, see FakeNetwork.Tasks.
+}
+
+// Run runs the commands and targets names of the Supfile on the fake
+// network, as `sup -batch <network> <names...>` does with the Supfile
+// network's hosts replaced by the fake ones, a pipe target by
+// Stackup.Pipe. The Supfile and network env is resolved by the local shell
+// and overridden by FakeNetwork.Env, see Supfile.NetworkEnv. The env vars of the network's hosts: need to be set,
+// as in real runs. The error is returned for names or network unknown by
+// the Supfile, failures of the run are in Report.Err.
+func Run(conf *sup.Supfile, network string, fake *FakeNetwork, names ...string) (*Report, error) {
+	net, ok := conf.Networks.Get(network)
+	if !ok {
+		return nil, fmt.Errorf("unknown network %v", network)
+	}
+	commands, err := commands(conf, names)
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := conf.NetworkEnv(network, fake.Env)
+	if err != nil {
+		return nil, err
+	}
+	env.Set("SUP_RUN_ID", "suptest")
+	env.Set("SUP_USER", "suptest")
+	if err := net.ResolveHosts(env); err != nil {
+		return nil, err
+	}
+	if net.Hosts, err = fake.Hosts(); err != nil {
+		return nil, err
+	}
+
+	app, err := sup.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr bytes.Buffer
+	app.Output(&stdout, &stderr)
+	app.Prefix(true)
+	app.Batch(true)
+	app.Dial(fake.Dial)
+
+	report := &Report{}
+	app.OnEvent(func(e sup.Event) {
+		report.Events = append(report.Events, e)
+	})
+	if pipe, ok := pipeTarget(conf, names); ok {
+		report.Err = app.Pipe(&net, env, pipe)
+	} else {
+		report.Err = app.Run(&net, env, commands...)
+	}
+	report.Stdout, report.Stderr = stdout.String(), stderr.String()
+	report.Tasks = fake.Tasks()
+	return report, nil
+}
+
+// commands returns the commands of names, targets expanded to their
+// commands, as by the sup CLI.
+func commands(conf *sup.Supfile, names []string) ([]*sup.Command, error) {
+	var commands []*sup.Command
+	for _, name := range names {
+		targetCommands, ok := conf.Targets.Get(name)
+		if !ok {
+			targetCommands = []string{name}
+		}
+		for _, name := range targetCommands {
+			cmd, ok := conf.Commands.Get(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown command %v", name)
+			}
+			cmd.Name = name
+			commands = append(commands, &cmd)
+		}
+	}
+	if len(commands) == 0 {
+		return nil, fmt.Errorf("no commands to be run")
+	}
+	return commands, nil
+}
+
+// pipeTarget returns the pipe of names being a single pipe target, run
+// by Stackup.Pipe as by the sup CLI.
+func pipeTarget(conf *sup.Supfile, names []string) (*sup.Pipe, bool) {
+	if len(names) != 1 {
+		return nil, false
+	}
+	return conf.Targets.Pipe(names[0])
+}
+
+// Started reports whether the command was started on the host.
+func (r *Report) Started(host, command string) bool {
+	for _, e := range r.Events {
+		if e.Type == sup.CommandStarted && e.Host == host && e.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Failed returns the hosts failing the command, ignored failures
+// included.
+func (r *Report) Failed(command string) []string {
+	var hosts []string
+	for _, e := range r.Events {
+		if e.Type == sup.CommandFinished && e.Command == command && e.Err != nil {
+			hosts = append(hosts, e.Host)
+		}
+	}
+	return hosts
+}
+
+// Output returns the lines of output of the command on the host, STDOUT
+// and STDERR ones in order they were read.
+func (r *Report) Output(host, command string) []string {
+	var lines []string
+	for _, e := range r.Events {
+		if e.Type == sup.OutputLine && e.Host == host && e.Command == command {
+			lines = append(lines, e.Line)
+		}
+	}
+	return lines
+}
+
+// Transcript returns the output lines of the run, grouped by host in
+// order of the fake network and by command in order they were run, each
+// prefixed by "<host> <command>: ". Unlike Stdout, it doesn't depend on
+// how the parallel hosts interleave, so it can be compared to a Golden
+// file.
+func (r *Report) Transcript(fake *FakeNetwork) string {
+	var b strings.Builder
+	hosts, _ := fake.Hosts()
+	for _, host := range hosts {
+		for _, e := range r.Events {
+			if e.Type == sup.OutputLine && e.Host == host.GetHostname() {
+				fmt.Fprintf(&b, "%v %v: %v\n", e.Host, e.Command, e.Line)
+			}
+		}
+	}
+	return b.String()
+}
+
+// Golden fails the test if got differs from the contents of file, ie.
+// testdata/deploy.golden. With SUPTEST_UPDATE=1 set, file is written with
+// got instead.
+func Golden(t testing.TB, file, got string) {
+	t.Helper()
+	if os.Getenv("SUPTEST_UPDATE") == "1" {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("%v (run with SUPTEST_UPDATE=1 to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("output differs from %v (run with SUPTEST_UPDATE=1 to update it):\n--- got\n%v--- want\n%v", file, got, want)
+	}
+}
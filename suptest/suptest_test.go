@@ -0,0 +1,102 @@
+package suptest_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+const deploySupfile = `
+version: 0.5
+networks:
+  production:
+    hosts: [web1, web2]
+commands:
+  pull:
+    run: docker pull shop:$VERSION
+  migrate:
+    run: ./migrate.sh
+  restart:
+    run: systemctl restart shop
+targets:
+  deploy:
+    - pull
+    - migrate
+    - restart
+`
+
+func TestRunDeploy(t *testing.T) {
+	conf, err := sup.NewSupfile([]byte(deploySupfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pulled := suptest.Response{Match: "docker pull", Stdout: "Status: Downloaded newer image\n"}
+
+	for _, tt := range []struct {
+		name      string
+		hosts     []suptest.FakeHost
+		err       bool
+		restarted []string // Hosts restart is started on.
+		failed    []string // Hosts failing migrate.
+		golden    string   // Transcript of the run, in testdata.
+	}{
+		{
+			name: "deployed",
+			hosts: []suptest.FakeHost{
+				{Host: "web1", Responses: []suptest.Response{pulled, {Match: "migrate", Stdout: "2 migrations applied\n"}}},
+				{Host: "web2", Responses: []suptest.Response{pulled}},
+			},
+			restarted: []string{"web1", "web2"},
+			golden:    "testdata/deployed.golden",
+		},
+		{
+			name: "failing migrate",
+			hosts: []suptest.FakeHost{
+				{Host: "web1", Responses: []suptest.Response{pulled, {Match: "migrate", Stderr: "migration 0042 failed\n", Exit: 1}}},
+				{Host: "web2", Responses: []suptest.Response{pulled}},
+			},
+			err:    true,
+			failed: []string{"web1"},
+			golden: "testdata/failing-migrate.golden",
+		},
+		{
+			name: "unreachable host",
+			hosts: []suptest.FakeHost{
+				{Host: "web1", Responses: []suptest.Response{pulled}},
+				{Host: "web2", ConnectErr: errors.New("connection refused")},
+			},
+			err: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := suptest.NewFakeNetwork(tt.hosts...)
+			fake.Env.Set("VERSION", "1.2.3")
+			report, err := suptest.Run(conf, "production", fake, "deploy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != (report.Err != nil) {
+				t.Fatalf("got error %v, want error %v\n%v", report.Err, tt.err, report.Stderr)
+			}
+
+			var restarted []string
+			for _, host := range []string{"web1", "web2"} {
+				if report.Started(host, "restart") {
+					restarted = append(restarted, host)
+				}
+			}
+			if fmt.Sprint(restarted) != fmt.Sprint(tt.restarted) {
+				t.Errorf("restart started on %v, want %v", restarted, tt.restarted)
+			}
+			if failed := report.Failed("migrate"); fmt.Sprint(failed) != fmt.Sprint(tt.failed) {
+				t.Errorf("migrate failed on %v, want %v", failed, tt.failed)
+			}
+			if tt.golden != "" {
+				suptest.Golden(t, tt.golden, report.Transcript(fake))
+			}
+		})
+	}
+}
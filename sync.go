@@ -0,0 +1,442 @@
+package sup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultSyncDir is the directory of the --sync snapshots on the hosts,
+// relative to the remote user's home directory, see Network.SyncDir.
+const DefaultSyncDir = ".cache/sup/sync"
+
+// SyncIgnoreFile lists patterns of the files left out of the snapshot,
+// one per line, matched as upload exclude patterns.
+const SyncIgnoreFile = ".supignore"
+
+// syncManifestFile is the manifest of the snapshot on the host, read by the
+// next sync to upload the changed files only.
+const syncManifestFile = ".sup-sync.json"
+
+// syncSnapshot is the local directory synced to the hosts before the
+// commands, see Stackup.Sync.
+type syncSnapshot struct {
+	dir      string            // Absolute local directory.
+	project  string            // Directory of the snapshot within the sync dir.
+	manifest map[string]string // Relative slash path to "<mode>:<sha256>".
+}
+
+// Sync makes Run upload the local dir to the hosts before the commands,
+// into a directory of the local user and the project in the network's
+// sync_dir, exported as $SUP_SYNC_DIR. The commands run in that directory.
+// Only the files changed since the previous sync of the host are
+// uploaded. Files of git work trees are the ones tracked by git or not
+// ignored by it, minus the .supignore patterns.
+func (sup *Stackup) Sync(dir string) error {
+	abs, err := filepath.Abs(ResolvePath(dir))
+	if err != nil {
+		return errors.Wrap(err, "sync")
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return errors.Wrap(err, "sync")
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("sync: %v is not a directory", dir)
+	}
+	sup.sync = &syncSnapshot{dir: abs, project: syncProject(abs)}
+	return nil
+}
+
+var unsafeSyncName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// syncProject returns directory of the snapshot of dir within the sync
+// dir: <local user>/<dir name>-<hash of dir path>, so snapshots of the
+// same host account don't collide.
+func syncProject(dir string) string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	name = unsafeSyncName.ReplaceAllString(name, "_")
+	if name == "" {
+		name = "user"
+	}
+	sum := sha256.Sum256([]byte(dir))
+	base := unsafeSyncName.ReplaceAllString(filepath.Base(dir), "_")
+	return name + "/" + base + "-" + hex.EncodeToString(sum[:4])
+}
+
+// syncDir returns $SUP_SYNC_DIR of the snapshot in the network's sync_dir,
+// expanded by the remote shell.
+func (s *syncSnapshot) syncDir(network *Network) string {
+	dir := network.SyncDir
+	if dir == "" {
+		dir = DefaultSyncDir
+	}
+	dir = path.Join(dir, s.project)
+	switch {
+	case path.IsAbs(dir):
+		return dir
+	case strings.HasPrefix(dir, "~/"):
+		return "$HOME/" + dir[2:]
+	}
+	return "$HOME/" + dir
+}
+
+// syncChdir returns the command changing to $SUP_SYNC_DIR, prepended to
+// the commands while syncing.
+func (sup *Stackup) syncChdir(cmd *Command) string {
+	if sup.sync == nil || cmd.Local || cmd.syncClean {
+		return ""
+	}
+	return syncChdirCommand
+}
+
+// syncChdirCommand changes to the synced directory, see Stackup.syncChdir.
+const syncChdirCommand = `cd "$SUP_SYNC_DIR" || exit 1; `
+
+// SyncCleanCommand returns command removing the --sync snapshot of the
+// directory given to Stackup.Sync from the hosts.
+func SyncCleanCommand() *Command {
+	return &Command{
+		Name:      "sync-clean",
+		Desc:      "Remove the --sync snapshot from the hosts",
+		Run:       `rm -rf "$SUP_SYNC_DIR" && echo "removed $SUP_SYNC_DIR"`,
+		syncClean: true,
+	}
+}
+
+// syncFiles lists the files of the snapshot, relative to its directory.
+func (s *syncSnapshot) syncFiles() ([]string, error) {
+	var files []string
+	if out, err := exec.Command("git", "-C", s.dir, "rev-parse", "--is-inside-work-tree").Output(); err == nil && strings.TrimSpace(string(out)) == "true" {
+		var err error
+		if files, err = gitFiles(s.dir, ".", true, ""); err != nil {
+			return nil, errors.Wrap(err, "sync")
+		}
+	} else {
+		err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, err := filepath.Rel(s.dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, rel)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "sync")
+		}
+	}
+
+	patterns, err := syncIgnorePatterns(filepath.Join(s.dir, SyncIgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+	excluded := excludeFunc(strings.Join(patterns, ","))
+	var synced []string
+	for _, file := range files {
+		if file == syncManifestFile || excludedPath(excluded, file) {
+			continue
+		}
+		synced = append(synced, file)
+	}
+	return synced, nil
+}
+
+// syncIgnorePatterns reads the patterns of .supignore, if any.
+func syncIgnorePatterns(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "sync")
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, ",") {
+			return nil, fmt.Errorf("sync: %v: pattern %q contains a comma", SyncIgnoreFile, line)
+		}
+		patterns = append(patterns, strings.TrimSuffix(strings.TrimPrefix(line, "/"), "/"))
+	}
+	return patterns, nil
+}
+
+// scan computes the manifest of the files of the snapshot.
+func (s *syncSnapshot) scan() error {
+	files, err := s.syncFiles()
+	if err != nil {
+		return err
+	}
+	s.manifest = map[string]string{}
+	for _, file := range files {
+		info, err := os.Lstat(filepath.Join(s.dir, file))
+		if err != nil {
+			return errors.Wrap(err, "sync")
+		}
+		h := sha256.New()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filepath.Join(s.dir, file))
+			if err != nil {
+				return errors.Wrap(err, "sync")
+			}
+			io.WriteString(h, target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(filepath.Join(s.dir, file))
+			if err != nil {
+				return errors.Wrap(err, "sync")
+			}
+			_, err = io.Copy(h, f)
+			f.Close()
+			if err != nil {
+				return errors.Wrap(err, "sync")
+			}
+		default:
+			continue
+		}
+		s.manifest[filepath.ToSlash(file)] = fmt.Sprintf("%v:%x", info.Mode(), h.Sum(nil))
+	}
+	return nil
+}
+
+// syncDiff is what a host lacks of the snapshot.
+type syncDiff struct {
+	changed   []string // Files to upload, new or modified.
+	removed   []string // Files to remove, not in the snapshot anymore.
+	unchanged int
+}
+
+func (d syncDiff) key() string {
+	return strings.Join(d.changed, "\x00") + "\x01" + strings.Join(d.removed, "\x00")
+}
+
+// diff compares the snapshot with the manifest of the host.
+func (s *syncSnapshot) diff(remote map[string]string) syncDiff {
+	var d syncDiff
+	for file, sum := range s.manifest {
+		if remote[file] == sum {
+			d.unchanged++
+		} else {
+			d.changed = append(d.changed, file)
+		}
+	}
+	for file := range remote {
+		if _, ok := s.manifest[file]; !ok {
+			d.removed = append(d.removed, file)
+		}
+	}
+	sort.Strings(d.changed)
+	sort.Strings(d.removed)
+	return d
+}
+
+// tarFile writes TAR of the changed files along with the manifest into a
+// temp file, returning its name and size. It's up to the caller to remove
+// the file.
+func (s *syncSnapshot) tarFile(changed []string) (string, int64, error) {
+	f, err := os.CreateTemp("", "sup-sync-*.tar.gz")
+	if err != nil {
+		return "", 0, errors.Wrap(err, "sync")
+	}
+	defer f.Close()
+	fail := func(err error) (string, int64, error) {
+		os.Remove(f.Name())
+		return "", 0, errors.Wrap(err, "sync")
+	}
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range changed {
+		local := filepath.Join(s.dir, filepath.FromSlash(file))
+		info, err := os.Lstat(local)
+		if err != nil {
+			return fail(err)
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(local); err != nil {
+				return fail(err)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fail(err)
+		}
+		header.Name = file
+		header.Uname, header.Gname, header.Uid, header.Gid = "", "", 0, 0
+		// USTAR rounds to the nearest second, which may be in the future.
+		header.ModTime = header.ModTime.Truncate(time.Second)
+		if err := tw.WriteHeader(header); err != nil {
+			return fail(err)
+		}
+		if info.Mode().IsRegular() {
+			src, err := os.Open(local)
+			if err != nil {
+				return fail(err)
+			}
+			_, err = io.Copy(tw, src)
+			src.Close()
+			if err != nil {
+				return fail(err)
+			}
+		}
+	}
+	manifest, err := json.Marshal(s.manifest)
+	if err != nil {
+		return fail(err)
+	}
+	header := &tar.Header{Name: syncManifestFile, Mode: 0644, Size: int64(len(manifest)), ModTime: time.Unix(0, 0), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(header); err != nil {
+		return fail(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return fail(err)
+	}
+	if err := tw.Close(); err != nil {
+		return fail(err)
+	}
+	if err := gz.Close(); err != nil {
+		return fail(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	return f.Name(), info.Size(), nil
+}
+
+// syncUntarCommand returns command removing the files and extracting the
+// TAR of syncSnapshot.tarFile into $SUP_SYNC_DIR.
+func syncUntarCommand(removed []string) string {
+	run := `mkdir -p "$SUP_SYNC_DIR" && cd "$SUP_SYNC_DIR" && `
+	if len(removed) > 0 {
+		var quoted []string
+		for _, file := range removed {
+			quoted = append(quoted, ShellQuote(file))
+		}
+		run += "rm -f -- " + strings.Join(quoted, " ") + " && "
+	}
+	return run + "tar -xzf -"
+}
+
+// syncClients uploads what each client lacks of the snapshot. Clients
+// lacking the same files share the TAR.
+func (sup *Stackup) syncClients(clients []Client, maxLen int) error {
+	s := sup.sync
+	if err := s.scan(); err != nil {
+		return err
+	}
+
+	// Read the manifests of the previous syncs.
+	check := &Task{Run: `cat "$SUP_SYNC_DIR/` + syncManifestFile + `" 2>/dev/null || true`, Kind: TaskSync}
+	diffs := make([]syncDiff, len(clients))
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			prefix := sup.paddedPrefix(c, "sync", time.Now(), maxLen)
+			out, err := sup.runCheck(c, "sync", check)
+			if err != nil {
+				errs[i] = errors.Wrap(err, prefix+"sync failed")
+				return
+			}
+			remote := map[string]string{}
+			if out != "" {
+				if err := json.Unmarshal([]byte(out), &remote); err != nil {
+					// A broken manifest syncs all the files again.
+					remote = map[string]string{}
+				}
+			}
+			diffs[i] = s.diff(remote)
+		}(i, c)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	var keys []string
+	groups := map[string][]Client{}
+	groupDiffs := map[string]syncDiff{}
+	for i, c := range clients {
+		d := diffs[i]
+		sup.errorf("%ssync: %d changed, %d removed, %d unchanged\n", sup.paddedPrefix(c, "sync", time.Now(), maxLen), len(d.changed), len(d.removed), d.unchanged)
+		key := d.key()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			groupDiffs[key] = d
+		}
+		groups[key] = append(groups[key], c)
+	}
+
+	cmd := &Command{Name: "sync"}
+	for _, key := range keys {
+		d := groupDiffs[key]
+		if len(d.changed) == 0 && len(d.removed) == 0 {
+			continue
+		}
+		name, size, err := s.tarFile(d.changed)
+		if err != nil {
+			return err
+		}
+		err = sup.syncGroup(cmd, groups[key], name, size, d.removed, maxLen)
+		os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncGroup uploads the TAR file to the clients.
+func (sup *Stackup) syncGroup(cmd *Command, clients []Client, name string, size int64, removed []string, maxLen int) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "sync")
+	}
+	defer f.Close()
+	task := &Task{
+		Run:     syncUntarCommand(removed),
+		Input:   f,
+		Clients: clients,
+		Kind:    TaskUpload,
+		Size:    size,
+	}
+	return sup.runStage(cmd, []*Task{task}, nil, nil, maxLen)
+}
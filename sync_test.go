@@ -0,0 +1,168 @@
+package sup_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pressly/sup"
+)
+
+// teeClient runs the tasks in the local shell, keeping the last upload
+// and the TAR stream written to it.
+type teeClient struct {
+	*sup.LocalhostClient
+	upload *sup.Task
+	input  bytes.Buffer
+}
+
+func (c *teeClient) Run(task *sup.Task) error {
+	if task.Kind == sup.TaskUpload {
+		c.upload = task
+		c.input.Reset()
+	}
+	return c.LocalhostClient.Run(task)
+}
+
+func (c *teeClient) Stdin() io.WriteCloser {
+	return teeWriteCloser{io.MultiWriter(c.LocalhostClient.Stdin(), &c.input), c.LocalhostClient.Stdin()}
+}
+
+type teeWriteCloser struct {
+	io.Writer
+	io.Closer
+}
+
+// syncRun syncs dir to a local host keeping the snapshots in syncDir, and
+// returns the client holding the sync upload, if any.
+func syncRun(t *testing.T, dir, syncDir string) *teeClient {
+	t.Helper()
+	conf, err := sup.NewSupfile([]byte("version: 0.5\nnetworks:\n  dev:\n    hosts: [localhost]\n    sync_dir: " + syncDir + "\ncommands:\n  test:\n    run: ls\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	network, _ := conf.Networks.Get("dev")
+	cmd, _ := conf.Commands.Get("test")
+	cmd.Name = "test"
+
+	app, err := sup.New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	app.Output(io.Discard, &stderr)
+	client := &teeClient{}
+	app.Dial(func(host *sup.Host, env string) (sup.Client, error) {
+		client.LocalhostClient = sup.NewLocalhostClient(host, env)
+		return client, nil
+	})
+	if err := app.Sync(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Run(&network, nil, &cmd); err != nil {
+		t.Fatalf("run failed: %v\n%v", err, stderr.String())
+	}
+	return client
+}
+
+// untar returns the names of the files of the TAR stream of the sync,
+// minus the manifest it's sent along with.
+func untar(t *testing.T, data []byte) (names []string) {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Name != ".sup-sync.json" {
+			names = append(names, header.Name)
+		}
+	}
+}
+
+func TestSyncIncremental(t *testing.T) {
+	dir := t.TempDir()
+	syncDir := t.TempDir()
+	write := func(name, content string) {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.go", "package main\n")
+	write("README.md", "# app\n")
+	write("lib/util.go", "package lib\n")
+
+	for _, tt := range []struct {
+		name    string
+		change  func()
+		files   []string // Files transferred, sorted.
+		removed string   // Files removed on the host, as quoted by the command.
+	}{
+		{name: "first run", files: []string{"README.md", "lib/util.go", "main.go"}},
+		{
+			name: "changed files",
+			change: func() {
+				write("main.go", "package main\n\nfunc main() {}\n")
+				write("lib/new.go", "package lib\n")
+				if err := os.Remove(filepath.Join(dir, "README.md")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			files:   []string{"lib/new.go", "main.go"},
+			removed: "rm -f -- 'README.md' && ",
+		},
+		{name: "unchanged"},
+	} {
+		if tt.change != nil {
+			tt.change()
+		}
+		client := syncRun(t, dir, syncDir)
+		if tt.files == nil {
+			if client.upload != nil {
+				t.Errorf("%v: synced %q, want nothing", tt.name, client.upload.Run)
+			}
+			continue
+		}
+		if client.upload == nil {
+			t.Fatalf("%v: nothing synced, want %v", tt.name, tt.files)
+		}
+		files := untar(t, client.input.Bytes())
+		if strings.Join(files, " ") != strings.Join(tt.files, " ") {
+			t.Errorf("%v: synced %v, want %v", tt.name, files, tt.files)
+		}
+		if tt.removed != "" && !strings.Contains(client.upload.Run, tt.removed) {
+			t.Errorf("%v: sync %q doesn't remove README.md", tt.name, client.upload.Run)
+		}
+	}
+
+	// The snapshot on the host matches the directory.
+	var synced []string
+	filepath.Walk(syncDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && info.Name() != ".sup-sync.json" {
+			synced = append(synced, info.Name())
+		}
+		return err
+	})
+	sort.Strings(synced)
+	if got := strings.Join(synced, " "); got != "main.go new.go util.go" {
+		t.Errorf("host holds %v, want main.go new.go util.go", got)
+	}
+}
@@ -1,9 +1,13 @@
 package sup
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -14,9 +18,55 @@ import (
 
 // RemoteTarCommand returns command to be run on remote SSH host
 // to properly receive the created TAR stream.
-// TODO: Check for relative directory.
 func RemoteTarCommand(dir string) string {
-	return fmt.Sprintf("tar -C \"%s\" -xzf -", dir)
+	cmd, _ := RemoteUntarCommand(dir, "")
+	return cmd
+}
+
+// RemoteUntarCommand returns command to be run on remote SSH host
+// to receive the created TAR stream into dir. Leading ~ or ~user is
+// expanded by the remote shell and missing directories are created
+// with dirMode permissions (ie. "0755"), or per remote umask if empty.
+// Relative dir is relative to the remote user's home directory.
+func RemoteUntarCommand(dir, dirMode string) (string, error) {
+	mkdir, err := remoteMkdir(`"$sup_dst"`, dirMode)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`sup_dst=%s; `+
+		`if [ -e "$sup_dst" ] && [ ! -d "$sup_dst" ]; then echo "upload: $sup_dst exists and is not a directory" >&2; exit 1; fi; `+
+		`%s && tar -C "$sup_dst" -xzf -`, remotePath(dir), mkdir), nil
+}
+
+// remoteMkdir returns command creating the dir (a shell word) along with
+// missing parents, with dirMode permissions or per remote umask if empty.
+func remoteMkdir(dir, dirMode string) (string, error) {
+	mkdir := "mkdir -p " + dir
+	if dirMode != "" {
+		mode, err := strconv.ParseUint(dirMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return "", fmt.Errorf("invalid dir_mode %q", dirMode)
+		}
+		mkdir = fmt.Sprintf("(umask %03o && %s)", 0777&^mode, mkdir)
+	}
+	return mkdir, nil
+}
+
+// remotePath quotes path for the remote shell, leaving leading ~ or ~user
+// unquoted, so it's expanded by the remote shell.
+func remotePath(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return `"` + path + `"`
+	}
+	tilde, rest := path, ""
+	if i := strings.Index(path, "/"); i != -1 {
+		tilde, rest = path[:i+1], path[i+1:]
+	}
+	if rest == "" {
+		return tilde
+	}
+	return tilde + `"` + rest + `"`
 }
 
 func LocalTarCmdArgs(path, exclude string) []string {
@@ -35,11 +85,38 @@ func LocalTarCmdArgs(path, exclude string) []string {
 	return args
 }
 
+// excludeFunc returns function reporting whether the relative path matches
+// any of the exclude patterns (comma separated), by name or by the path.
+func excludeFunc(exclude string) func(rel string) bool {
+	var patterns []string
+	for _, pattern := range strings.Split(exclude, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return func(rel string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, filepath.Base(rel)); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(pattern, rel); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // NewTarStreamReader creates a tar stream reader from a local path.
 // TODO: Refactor. Use "archive/tar" instead.
 func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
-	cmd := exec.Command("tar", LocalTarCmdArgs(path, exclude)...)
-	cmd.Dir = cwd
+	return newTarStreamReader(cwd, path, exclude, nil)
+}
+
+// newTarStreamReader creates a tar stream reader from a local path, of
+// the listed files of path only, unless files is nil.
+func newTarStreamReader(cwd, path, exclude string, files []string) (io.Reader, error) {
+	cmd := localTarCmd(cwd, path, exclude, files)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, errors.Wrap(err, "tar: stdout pipe failed")
@@ -51,3 +128,49 @@ func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
 
 	return stdout, nil
 }
+
+// localTarCmd returns tar command writing TAR stream of the local path to
+// STDOUT. If the files of path are listed (see gitFiles), only they are
+// archived, fed to tar on STDIN instead of walking path.
+func localTarCmd(cwd, path, exclude string, files []string) *exec.Cmd {
+	if files == nil {
+		cmd := exec.Command("tar", LocalTarCmdArgs(path, exclude)...)
+		cmd.Dir = cwd
+		return cmd
+	}
+
+	var list bytes.Buffer
+	for _, file := range files {
+		file = filepath.Join(path, file)
+		if strings.HasPrefix(file, "-") {
+			file = "./" + file
+		}
+		list.WriteString(file)
+		list.WriteByte(0)
+	}
+	cmd := exec.Command("tar", "-C", ".", "--null", "--no-recursion", "-T", "-", "-czf", "-")
+	cmd.Dir = cwd
+	cmd.Stdin = &list
+	return cmd
+}
+
+// NewTarFile creates a temporary tar file of local paths, so it can be
+// uploaded to multiple hosts without re-reading the paths. It's up to
+// the caller to remove the file.
+func NewTarFile(cwd string, paths []string) (string, error) {
+	f, err := os.CreateTemp("", "sup-*.tar.gz")
+	if err != nil {
+		return "", errors.Wrap(err, "tar: creating temp file failed")
+	}
+	defer f.Close()
+
+	cmd := exec.Command("tar", append([]string{"-C", ".", "-czf", "-", "--"}, paths...)...)
+	cmd.Dir = cwd
+	cmd.Stdout = f
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrap(err, "tar: creating temp file failed")
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,86 @@
+package sup
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRemoteUntarCommand runs the command receiving uploads by the local
+// shell, in the home directory as by ssh, and checks where the uploaded
+// file lands.
+func TestRemoteUntarCommand(t *testing.T) {
+	cwd := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(cwd, "dist"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cwd, "dist", "app"), []byte("app"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		dst     string // Dst of the upload, {root} replaced by a temp dir.
+		dirMode string
+		file    string // Path of the uploaded file, {home} and {root} replaced by temp dirs.
+		mode    os.FileMode
+		err     string // Substring of the error output, "" if the upload succeeds.
+	}{
+		{name: "tilde", dst: "~/releases/current", file: "{home}/releases/current/dist/app"},
+		{name: "tilde alone", dst: "~", file: "{home}/dist/app"},
+		{name: "tilde with spaces", dst: "~/my releases/$SUP_RELEASE", file: "{home}/my releases/20260101/dist/app"},
+		{name: "absolute", dst: "{root}/srv/app", file: "{root}/srv/app/dist/app"},
+		{name: "relative", dst: "releases/app", file: "{home}/releases/app/dist/app"},
+		{name: "dir mode", dst: "~/private/app", dirMode: "0750", file: "{home}/private/app/dist/app", mode: 0750},
+		{name: "file in the way", dst: "~/.profile/app", err: "{home}/.profile"},
+		{name: "dst is a file", dst: "~/.profile", err: "upload: {home}/.profile exists and is not a directory"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			home, root := t.TempDir(), t.TempDir()
+			replace := strings.NewReplacer("{home}", home, "{root}", root).Replace
+			if err := os.WriteFile(filepath.Join(home, ".profile"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			run, err := RemoteUntarCommand(replace(tt.dst), tt.dirMode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream, err := NewTarStreamReader(cwd, "dist", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("sh", "-c", run)
+			cmd.Dir = home
+			cmd.Env = append(os.Environ(), "HOME="+home, "SUP_RELEASE=20260101")
+			cmd.Stdin = stream
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+			err = cmd.Run()
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(stderr.String(), replace(tt.err)) {
+					t.Fatalf("got error %v %q, want error output containing %q", err, stderr.String(), replace(tt.err))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%v: %v", err, stderr.String())
+			}
+			if data, err := os.ReadFile(replace(tt.file)); err != nil || string(data) != "app" {
+				t.Fatalf("uploaded file %v: %q %v", replace(tt.file), data, err)
+			}
+			if tt.mode != 0 {
+				fi, err := os.Stat(filepath.Dir(filepath.Dir(replace(tt.file))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Mode().Perm() != tt.mode {
+					t.Errorf("created directory of mode %v, want %v", fi.Mode().Perm(), tt.mode)
+				}
+			}
+		})
+	}
+}
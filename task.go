@@ -14,56 +14,179 @@ type Task struct {
 	Input   io.Reader
 	Clients []Client
 	TTY     bool
+	Kind    string // One of TaskUpload, TaskScript, TaskRun, TaskWaitFor, TaskGuard or TaskSync.
+	Size    int64  // Size of upload Input, 0 if unknown.
+	Batch   int    // Index of the "serial" group of Clients.
+	Local   bool   // Runs on localhost, see Command.Local and Command.LocalAlso.
+	Header  string // Comment starting the command, before the env exports, see Supfile.EmbedContext.
+
+	hostRuns map[*Host]string // Run of each host of template: commands, see Task.ForHost.
+	retry    *uploadRetry     // Upload re-created after transport errors, see stage.retryUpload.
+
+	CleanEnv bool   // Run with a wiped environment, see Sanitize.
+	Umask    string // Umask set before the command, see Sanitize.
+	Limits   Limits // Priority and CPU limits of the command.
 }
 
+// Task kinds.
+const (
+	TaskUpload  = "upload"
+	TaskScript  = "script"
+	TaskRun     = "run"
+	TaskWaitFor = "wait_for"
+	TaskGuard   = "guard"
+	TaskSync    = "sync"
+)
+
 func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
 	var tasks []*Task
 
-	cwd, err := os.Getwd()
+	cwd, err := sup.conf.BaseDir()
 	if err != nil {
 		return nil, errors.Wrap(err, "resolving CWD failed")
 	}
 
-	// Anything to upload?
-	for _, upload := range cmd.Upload {
+	// Local env vars passed to this command only.
+	passEnv, err := PassEnv(cmd.PassEnv, cmd.PassEnvRequired)
+	if err != nil {
+		return nil, errors.Wrap(err, cmd.Name)
+	}
+	cmdEnv := passEnv.AsExport() + sup.syncChdir(cmd)
+
+	// Health check to be run after the main command.
+	var waitTask *Task
+	if cmd.WaitFor != nil {
+		run, err := cmd.WaitFor.Script()
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		waitTask = &Task{
+			Run:  cmdEnv + run,
+			TTY:  false,
+			Kind: TaskWaitFor,
+		}
+	}
+
+	// Upload build artifacts. Each group of clients reads the same tar file.
+	if cmd.artifactsTar != "" {
+		for i, group := range clientGroups(cmd, clients) {
+			f, err := os.Open(cmd.artifactsTar)
+			if err != nil {
+				return nil, errors.Wrap(err, "build.artifacts")
+			}
+			info, err := f.Stat()
+			if err != nil {
+				return nil, errors.Wrap(err, "build.artifacts")
+			}
+			tasks = append(tasks, &Task{
+				Run:     RemoteTarCommand(cmd.Build.Dst),
+				Input:   f,
+				Clients: group,
+				TTY:     false,
+				Kind:    TaskUpload,
+				Size:    info.Size(),
+				Batch:   i,
+			})
+		}
+	}
+
+	// Anything to upload? Releases of atomic_dir uploads and Dst
+	// templates use the same timestamp on all hosts.
+	for i, upload := range cmd.Upload {
+		files := sup.uploadFiles[&cmd.Upload[i]]
 		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
 		if err != nil {
 			return nil, errors.Wrap(err, "upload: "+upload.Src)
 		}
-		uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
+		upload.Dst, err = sup.release.expand("dst", upload.Dst)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload: "+upload.Src)
+		}
+		var stamp []byte
+		if upload.Stamp {
+			stamp, err = sup.release.stamp(cwd, uploadFile, upload.Exc, files)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+		}
+		run, err := upload.remoteCommand(uploadFile, sup.release.Timestamp, stamp)
+		if err != nil {
+			return nil, errors.Wrap(err, "upload: "+upload.Src)
+		}
+		if upload.Verify != "" {
+			dir, prefix := upload.uploadDir(uploadFile, sup.release.Timestamp)
+			manifest, err := uploadManifest(cwd, uploadFile, upload.Exc, files, prefix)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src+": verify")
+			}
+			if manifest != "" {
+				run += " && " + verifyCommand(manifest, dir)
+			}
+		}
+
+		// Uploads via: bastion are relayed to the hosts behind the network
+		// bastion. Without one, all hosts are uploaded to directly.
+		groups := clientGroups(cmd, clients)
+		if upload.Via == UploadViaBastion && sup.relay != nil {
+			var relayed [][]Client
+			relayed, groups = sup.relay.relayed(groups)
+			relayTasks, err := sup.relay.tasks(relayed, cwd, uploadFile, upload.Exc, files, run)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			tasks = append(tasks, relayTasks...)
+		}
+		direct := false
+		for _, group := range groups {
+			direct = direct || len(group) > 0
+		}
+		if !direct {
+			continue
+		}
+
+		var uploadReader io.Reader
+		var size int64
+		if upload.Method == UploadMethodSCP {
+			uploadReader, size, err = newSCPStreamReader(cwd, uploadFile, upload.Exc, files)
+		} else {
+			uploadReader, err = newTarStreamReader(cwd, uploadFile, upload.Exc, files)
+		}
 		if err != nil {
 			return nil, errors.Wrap(err, "upload: "+upload.Src)
 		}
+		if len(groups) > 1 {
+			// The "serial" groups read the stream at their own time.
+			if uploadReader, err = sup.fanout(uploadReader); err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+		}
 
 		task := Task{
-			Run:   RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
+			Run:   run,
+			Input: uploadReader,
 			TTY:   false,
+			Kind:  TaskUpload,
+			Size:  size,
+			retry: &uploadRetry{upload: upload, cwd: cwd, src: uploadFile, files: files},
 		}
 
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
-				tasks = append(tasks, &copy)
+		for i, group := range groups {
+			if len(group) == 0 {
+				continue
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
+			copy := task
+			copy.Clients = group
+			copy.Batch = i
+			if f, ok := task.Input.(*fanoutReader); ok {
+				copy.Input = f.f.reader()
+			}
+			tasks = append(tasks, &copy)
 		}
 	}
 
 	// Script. Read the file as a multiline input command.
 	if cmd.Script != "" {
-		f, err := os.Open(cmd.Script)
+		f, err := os.Open(resolve(cwd, cmd.Script))
 		if err != nil {
 			return nil, errors.Wrap(err, "can't open script")
 		}
@@ -71,80 +194,188 @@ func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*
 		if err != nil {
 			return nil, errors.Wrap(err, "can't read script")
 		}
+		script, err := sup.conf.useScript(cmd, string(data))
+		if err != nil {
+			return nil, errors.Wrapf(err, "script %v", cmd.Script)
+		}
+		args, err := sup.release.scriptArgs(cmd)
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		// The embed_context header goes into the script file, if it's
+		// known to be a comment there.
+		header := sup.embedContext(cmd)
+		if interpreter, _ := scriptInterpreter(script); header != "" && commentsByHash(interpreter) {
+			script, header = insertAfterShebang(script, header), ""
+		}
 
 		task := Task{
-			Run: string(data),
-			TTY: true,
-		}
-		if sup.debug {
-			task.Run = "set -x;" + task.Run
+			Run:    cmdEnv + scriptRun(script, args, sup.debug),
+			TTY:    !sup.batch,
+			Kind:   TaskScript,
+			Header: header,
 		}
 		if cmd.Stdin {
-			task.Input = os.Stdin
-		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
+			task.Input = sup.input()
+		}
+		for i, group := range clientGroups(cmd, clients) {
+			copy := task
+			copy.Clients = group
+			copy.Batch = i
+			tasks = append(tasks, &copy)
+			if waitTask != nil && cmd.Run == "" && len(cmd.Steps) == 0 && cmd.Service == nil {
+				// Wait for the hosts to become healthy before moving on
+				// to the next "serial" group.
+				copy := *waitTask
+				copy.Clients = group
+				copy.Batch = i
+				tasks = append(tasks, &copy)
+			}
+		}
+	}
+
+	// Scripts directory, run as a single script.
+	if cmd.ScriptsDir != "" {
+		files, err := cmd.scriptsDirFiles(cwd)
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		run, err := sup.conf.scriptsDirRun(files)
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		use, err := sup.conf.fragments(cmd.Use)
+		if err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
+		}
+		run = use + run
+		if len(files) > 0 {
+			task := Task{
+				Run:    cmdEnv + traced(run, sup.debug),
+				TTY:    !sup.batch,
+				Kind:   TaskScript,
+				Header: sup.embedContext(cmd),
+			}
+			if cmd.Stdin {
+				task.Input = sup.input()
+			}
+			for i, group := range clientGroups(cmd, clients) {
 				copy := task
-				copy.Clients = clients[i:j]
+				copy.Clients = group
+				copy.Batch = i
 				tasks = append(tasks, &copy)
+				if waitTask != nil && cmd.Run == "" && len(cmd.Steps) == 0 && cmd.Service == nil {
+					copy := *waitTask
+					copy.Clients = group
+					copy.Batch = i
+					tasks = append(tasks, &copy)
+				}
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
 		}
 	}
 
+	// Clients of Dial run the local commands themselves, by Task.Local.
+	remote := clients
 	var localClients []Client
-	if cmd.Local {
+	if cmd.Local && sup.dial == nil {
 		for _, cl := range clients {
 			localClients = append(localClients, ConvertClientToLocal(cl))
 		}
 		clients = localClients
 	}
 
-	// Remote command.
-	if cmd.Run != "" {
+	// Remote command, followed by the service action, see
+	// ComposeRemoteCommand.
+	run, err := sup.conf.commandRun(cmd)
+	if err != nil {
+		return nil, errors.Wrap(err, cmd.Name)
+	}
+	if run != "" {
 		task := Task{
-			Run: cmd.Run,
-			TTY: true,
+			Run:    cmdEnv + traced(run, sup.debug),
+			TTY:    !sup.batch,
+			Kind:   TaskRun,
+			Local:  cmd.Local,
+			Header: sup.embedContext(cmd),
 		}
-		if sup.debug {
-			task.Run = "set -x;" + task.Run
+		if task.hostRuns, err = sup.hostRuns(cmd, remote, clients, cmdEnv); err != nil {
+			return nil, errors.Wrap(err, cmd.Name)
 		}
 		if cmd.Stdin {
-			task.Input = os.Stdin
-		}
-		if cmd.Once {
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-				copy := task
-				copy.Clients = clients[i:j]
+			task.Input = sup.input()
+		}
+		for i, group := range clientGroups(cmd, clients) {
+			copy := task
+			copy.Clients = group
+			copy.Batch = i
+			tasks = append(tasks, &copy)
+			if waitTask != nil {
+				// Wait for the hosts to become healthy before moving on
+				// to the next "serial" group.
+				copy := *waitTask
+				copy.Clients = group
+				copy.Batch = i
 				tasks = append(tasks, &copy)
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
 		}
 	}
 
+	// Localhost of local: also runs the command first, as a single host,
+	// without the uploads.
+	if cmd.LocalAlso && sup.localAlso != nil {
+		local := *cmd
+		local.Local, local.LocalAlso = true, false
+		local.Upload, local.artifactsTar = nil, ""
+		localTasks, err := sup.createTasks(&local, []Client{sup.localAlso}, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, task := range localTasks {
+			task.Local = true
+		}
+		tasks = append(localTasks, tasks...)
+	}
+
 	return tasks, nil
 }
 
+// clientGroups splits clients into groups, which are processing a task
+// sequentially, based on cmd.Once and cmd.Serial. Clients not selected
+// by cmd.RunOn are left out. Local commands ignore both, see
+// Supfile.checkScheduling.
+func clientGroups(cmd *Command, clients []Client) [][]Client {
+	clients = selectClients(cmd, clients)
+	if len(clients) == 0 {
+		return nil
+	}
+	if cmd.Local {
+		return [][]Client{clients}
+	}
+	if cmd.Once {
+		return [][]Client{clients[:1]}
+	}
+	if cmd.OncePerGroup {
+		representatives, _ := groupRepresentatives(cmd, clients)
+		if len(representatives) == 0 {
+			return nil
+		}
+		clients = representatives
+	}
+	if cmd.Serial > 0 {
+		// Each "serial" task client group is executed sequentially.
+		var groups [][]Client
+		for i := 0; i < len(clients); i += cmd.Serial {
+			j := i + cmd.Serial
+			if j > len(clients) {
+				j = len(clients)
+			}
+			groups = append(groups, clients[i:j])
+		}
+		return groups
+	}
+	return [][]Client{clients}
+}
+
 type ErrTask struct {
 	Task   *Task
 	Reason string
@@ -153,3 +384,29 @@ type ErrTask struct {
 func (e ErrTask) Error() string {
 	return fmt.Sprintf(`Run("%v"): %v`, e.Task, e.Reason)
 }
+
+// DefaultHostGroup is the group of hosts without a group.
+const DefaultHostGroup = "default"
+
+// groupRepresentatives returns the first client of each host group,
+// along with the group names, in order of appearance. Clients without
+// a group form DefaultHostGroup, unless cmd.OncePerGroupStrict is set.
+func groupRepresentatives(cmd *Command, clients []Client) ([]Client, []string) {
+	var representatives []Client
+	var groups []string
+	seen := map[string]bool{}
+	for _, c := range clients {
+		group := DefaultHostGroup
+		if h, ok := c.(interface{ Host() *Host }); ok && h.Host().Group != "" {
+			group = h.Host().Group
+		} else if cmd.OncePerGroupStrict {
+			continue
+		}
+		if !seen[group] {
+			seen[group] = true
+			representatives = append(representatives, c)
+			groups = append(groups, group)
+		}
+	}
+	return representatives, groups
+}
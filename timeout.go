@@ -0,0 +1,253 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Failure reasons of FailureReason.
+const (
+	ReasonConnectTimeout = "connect_timeout"
+	ReasonTimeout        = "timeout"
+	ReasonIdleTimeout    = "idle_timeout"
+)
+
+// killGrace is how long a timed out command has to exit after ^C, before
+// its session is closed.
+const killGrace = 5 * time.Second
+
+// Timeouts limit how long a command may run on each host.
+type Timeouts struct {
+	Timeout     string `yaml:"timeout,omitempty"`      // Total time on each host, from its first task (uploads included), ie. "10m".
+	IdleTimeout string `yaml:"idle_timeout,omitempty"` // Time without a byte of STDOUT or STDERR of run or script, ie. "5m".
+}
+
+// durations returns the parsed Timeout and IdleTimeout, 0 if unset.
+func (t Timeouts) durations() (total, idle time.Duration, err error) {
+	if total, err = parseDuration(t.Timeout, 0); err != nil {
+		return 0, 0, errors.Wrap(err, "timeout")
+	}
+	if idle, err = parseDuration(t.IdleTimeout, 0); err != nil {
+		return 0, 0, errors.Wrap(err, "idle_timeout")
+	}
+	return total, idle, nil
+}
+
+// ErrConnectTimeout is returned for hosts not connected within the
+// network's connect_timeout.
+type ErrConnectTimeout struct {
+	User    string
+	Host    string
+	Timeout time.Duration
+}
+
+func (e ErrConnectTimeout) Error() string {
+	return fmt.Sprintf(`Connect("%v@%v"): not connected within connect_timeout %v`, e.User, e.Host, e.Timeout)
+}
+
+// ErrTimeout is returned for commands killed by their timeout or
+// idle_timeout. It exits with status 124, as by timeout(1).
+type ErrTimeout struct {
+	Reason  string // ReasonTimeout or ReasonIdleTimeout.
+	Timeout time.Duration
+}
+
+func (e ErrTimeout) Error() string {
+	if e.Reason == ReasonIdleTimeout {
+		return fmt.Sprintf("no output for %v, killed by idle_timeout", e.Timeout)
+	}
+	return fmt.Sprintf("still running after %v, killed by timeout", e.Timeout)
+}
+
+// ExitStatus returns the exit status of the timed out command.
+func (e ErrTimeout) ExitStatus() int {
+	return 124
+}
+
+// FailureReason returns the timeout a host failed by, one of
+// ReasonConnectTimeout, ReasonTimeout and ReasonIdleTimeout, or "" for
+// other errors, ie. of Event.Err.
+func FailureReason(err error) string {
+	switch e := errors.Cause(err).(type) {
+	case ErrConnectTimeout:
+		return ReasonConnectTimeout
+	case ErrTimeout:
+		return e.Reason
+	}
+	return ""
+}
+
+// errDialTimeout is returned by dialWithin once the timeout elapses.
+var errDialTimeout = errors.New("dial timed out")
+
+// dialWithin returns dialer giving up after timeout, including the SSH
+// handshake. Connections made too late are closed.
+func dialWithin(dial SSHDialFunc, timeout time.Duration) SSHDialFunc {
+	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		type result struct {
+			client *ssh.Client
+			err    error
+		}
+		done := make(chan result, 1)
+		go func() {
+			client, err := dial(network, addr, config)
+			done <- result{client, err}
+		}()
+		select {
+		case r := <-done:
+			return r.client, r.err
+		case <-time.After(timeout):
+			go func() {
+				if r := <-done; r.client != nil {
+					r.client.Close()
+				}
+			}()
+			return nil, errDialTimeout
+		}
+	}
+}
+
+// watchdog kills the task of a client once the command's deadline passes
+// or its output is idle for too long.
+type watchdog struct {
+	client Client
+	total  time.Duration
+	idle   time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	idler   *time.Timer
+	err     error // ErrTimeout, once fired.
+	stopped bool
+	killed  chan struct{} // Closed once the client is killed.
+}
+
+// newWatchdog returns watchdog of the client's task, the total timeout
+// counting down to deadline, or nil if neither applies.
+func newWatchdog(c Client, task *Task, total time.Duration, deadline time.Time, idle time.Duration) *watchdog {
+	if task.Kind != TaskRun && task.Kind != TaskScript {
+		idle = 0 // Uploads and wait_for are silent.
+	}
+	if total == 0 && idle == 0 {
+		return nil
+	}
+	w := &watchdog{client: c, total: total, idle: idle, killed: make(chan struct{})}
+	if total > 0 {
+		w.timer = time.AfterFunc(time.Until(deadline), func() { w.fire(ReasonTimeout, total) })
+	}
+	if idle > 0 {
+		w.idler = time.AfterFunc(idle, func() { w.fire(ReasonIdleTimeout, idle) })
+	}
+	return w
+}
+
+// fire interrupts the task, and closes its client if it doesn't exit
+// within killGrace.
+func (w *watchdog) fire(reason string, timeout time.Duration) {
+	w.mu.Lock()
+	if w.err != nil || w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.err = ErrTimeout{reason, timeout}
+	w.mu.Unlock()
+
+	w.client.Signal(os.Interrupt)
+	time.AfterFunc(killGrace, func() {
+		w.mu.Lock()
+		stopped := w.stopped
+		w.mu.Unlock()
+		if stopped {
+			return // Exited by ^C.
+		}
+		if l, ok := w.client.(*LocalhostClient); ok {
+			l.Signal(os.Kill)
+		} else {
+			w.client.Close()
+		}
+		close(w.killed)
+	})
+}
+
+// reader returns r resetting the idle timer on each byte read. Output
+// closed by the kill ends as io.EOF.
+func (w *watchdog) reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &watchedReader{r, w}
+}
+
+type watchedReader struct {
+	r io.Reader
+	w *watchdog
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.w.mu.Lock()
+	defer r.w.mu.Unlock()
+	if n > 0 && r.w.idler != nil && r.w.err == nil && !r.w.stopped {
+		r.w.idler.Reset(r.w.idle)
+	}
+	if err != nil && r.w.err != nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// wait waits for the output of the task to be copied, giving up once the
+// killed task doesn't close it, ie. of a local process left behind.
+func (w *watchdog) wait(wg *sync.WaitGroup) {
+	if w == nil {
+		wg.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-w.killed:
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// fired returns ErrTimeout if the task was killed, without stopping the
+// timers.
+func (w *watchdog) fired() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// stop stops the timers and returns ErrTimeout if the task was killed.
+func (w *watchdog) stop() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.idler != nil {
+		w.idler.Stop()
+	}
+	w.stopped = true
+	return w.err
+}
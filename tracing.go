@@ -0,0 +1,283 @@
+package sup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tracer records the run as an OpenTelemetry trace: a root span per run,
+// child spans per command and grandchild spans per host session (task).
+// Spans are exported at the end of the run using OTLP/HTTP JSON encoding.
+// Register Handle with Stackup.OnEvent.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	network  string
+
+	mu       sync.Mutex
+	traceID  string
+	root     *span
+	commands map[string]*span
+	sessions map[string]*span
+	spans    []*span
+}
+
+type span struct {
+	id       string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+}
+
+// NewTracerFromEnv creates a tracer exporting to the endpoint configured by
+// the standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or OTEL_EXPORTER_OTLP_ENDPOINT
+// env vars. It returns nil if no endpoint is configured, so tracing costs
+// nothing unless enabled. The trace joins $TRACEPARENT trace, if present.
+func NewTracerFromEnv(network string) *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+
+	headers := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	for k, v := range parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")) {
+		headers[k] = v
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "sup"
+	}
+
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		network:  network,
+		traceID:  randomHex(16),
+		commands: map[string]*span{},
+		sessions: map[string]*span{},
+	}
+	t.root = t.newSpan("sup "+network, "")
+	t.root.attrs["sup.network"] = network
+
+	// Join the incoming trace, ie. of a CI pipeline.
+	if traceID, parentID, ok := parseTraceparent(os.Getenv("TRACEPARENT")); ok {
+		t.traceID = traceID
+		t.root.parentID = parentID
+	}
+	return t
+}
+
+func (t *Tracer) newSpan(name, parentID string) *span {
+	s := &span{
+		id:       randomHex(8),
+		parentID: parentID,
+		name:     name,
+		start:    time.Now(),
+		attrs:    map[string]interface{}{},
+	}
+	t.spans = append(t.spans, s)
+	return s
+}
+
+// Handle records the event.
+func (t *Tracer) Handle(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessionKey := e.Command + "\x00" + e.Task + "\x00" + e.Host
+	switch e.Type {
+	case CommandStarted:
+		cmd, ok := t.commands[e.Command]
+		if !ok {
+			cmd = t.newSpan(e.Command, t.root.id)
+			cmd.start = e.Time
+			cmd.attrs["sup.command"] = e.Command
+			cmd.attrs["sup.network"] = t.network
+			t.commands[e.Command] = cmd
+		}
+		session := t.newSpan(e.Task+" "+e.Host, cmd.id)
+		session.start = e.Time
+		session.attrs["sup.host"] = e.Host
+		session.attrs["sup.network"] = t.network
+		session.attrs["sup.task"] = e.Task
+		t.sessions[sessionKey] = session
+
+	case UploadProgress:
+		if session, ok := t.sessions[sessionKey]; ok {
+			session.attrs["sup.upload.bytes"] = e.Bytes
+		}
+
+	case CommandFinished:
+		if session, ok := t.sessions[sessionKey]; ok {
+			session.end = e.Time
+			session.err = e.Err
+			session.attrs["sup.exit_code"] = exitStatus(e.Err)
+			if e.Ignored {
+				session.err = nil
+				session.attrs["sup.ignored_error"] = e.Err.Error()
+			}
+			delete(t.sessions, sessionKey)
+		}
+		if cmd, ok := t.commands[e.Command]; ok {
+			cmd.end = e.Time
+			if e.Err != nil && !e.Ignored {
+				cmd.err = e.Err
+			}
+		}
+
+	case RunFinished:
+		t.root.end = e.Time
+		t.root.err = e.Err
+		t.root.attrs["sup.exit_code"] = exitStatus(e.Err)
+	}
+}
+
+// Export sends the recorded spans to the OTLP endpoint.
+func (t *Tracer) Export() error {
+	t.mu.Lock()
+	data, err := json.Marshal(t.otlp())
+	t.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "exporting traces failed")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "exporting traces failed")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "exporting traces failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("exporting traces failed: %v: %s", resp.Status, body)
+	}
+	return nil
+}
+
+// otlp returns the spans as OTLP JSON ExportTraceServiceRequest.
+func (t *Tracer) otlp() interface{} {
+	type kv = map[string]interface{}
+
+	now := time.Now()
+	spans := make([]kv, 0, len(t.spans))
+	for _, s := range t.spans {
+		end := s.end
+		if end.IsZero() {
+			end = now
+		}
+		status := kv{"code": 1} // STATUS_CODE_OK
+		if s.err != nil {
+			status = kv{"code": 2, "message": s.err.Error()} // STATUS_CODE_ERROR
+		}
+		otlpSpan := kv{
+			"traceId":           t.traceID,
+			"spanId":            s.id,
+			"name":              s.name,
+			"kind":              1, // SPAN_KIND_INTERNAL
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+			"status":            status,
+		}
+		if s.parentID != "" {
+			otlpSpan["parentSpanId"] = s.parentID
+		}
+		spans = append(spans, otlpSpan)
+	}
+
+	return kv{
+		"resourceSpans": []kv{{
+			"resource": kv{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name":    t.service,
+					"service.version": VERSION,
+				}),
+			},
+			"scopeSpans": []kv{{
+				"scope": kv{"name": "github.com/pressly/sup", "version": VERSION},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	var result []map[string]interface{}
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+		}
+		result = append(result, map[string]interface{}{"key": k, "value": value})
+	}
+	return result
+}
+
+// parseTraceparent parses W3C traceparent, ie.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(value string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false
+	}
+	return strings.ToLower(parts[1]), strings.ToLower(parts[2]), true
+}
+
+// parseOTLPHeaders parses "key1=value1,key2=value2" headers.
+func parseOTLPHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			continue
+		}
+		headers[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+	}
+	return headers
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,247 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Tunnel is a local port forwarded to Remote through the network bastion,
+// or through the Via host, for the duration of the network's runs of
+// local commands only, ie. terraform or psql against a private database:
+//
+//	tunnels:
+//	  - name: db
+//	    local: 15432
+//	    remote: db.internal:5432
+//
+// The local port is exported to the commands as $SUP_TUNNEL_<NAME>_PORT,
+// ie. $SUP_TUNNEL_DB_PORT.
+type Tunnel struct {
+	Name   string `yaml:"name"`
+	Local  int    `yaml:"local,omitempty"` // Port listened on at 127.0.0.1, 0 picks a free one.
+	Remote string `yaml:"remote"`          // host:port connected to by the bastion.
+	Via    string `yaml:"via,omitempty"`   // Host forwarding the port, the network bastion by default.
+}
+
+var tunnelName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// EnvKey returns the env var of the tunnel's local port.
+func (t Tunnel) EnvKey() string {
+	return "SUP_TUNNEL_" + strings.ToUpper(strings.ReplaceAll(t.Name, "-", "_")) + "_PORT"
+}
+
+// via returns the host forwarding the port.
+func (t Tunnel) via(bastion string) string {
+	if t.Via != "" {
+		return t.Via
+	}
+	return bastion
+}
+
+// checkTunnels returns error of the first invalid tunnel of the network,
+// located at its key by errorAt.
+func (s *Supfile) checkTunnels(name string, network *Network) error {
+	seen := map[string]bool{}
+	for _, t := range network.Tunnels {
+		var msg, key string
+		switch {
+		case !tunnelName.MatchString(t.Name):
+			msg, key = fmt.Sprintf("tunnels: invalid name %q, expected letters, digits, - and _", t.Name), "name"
+		case seen[t.EnvKey()]:
+			msg, key = fmt.Sprintf("tunnels: name %q is used more than once", t.Name), "name"
+		case t.Local < 0 || t.Local > 65535:
+			msg, key = fmt.Sprintf("tunnel %v: invalid local port %d", t.Name, t.Local), "local"
+		case t.via(network.Bastion) == "":
+			msg = fmt.Sprintf("tunnel %v: no via: host and the network has no bastion", t.Name)
+		}
+		if msg == "" {
+			if _, port, err := net.SplitHostPort(t.Remote); err != nil {
+				msg, key = fmt.Sprintf("tunnel %v: invalid remote %q, expected host:port", t.Name, t.Remote), "remote"
+			} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+				msg, key = fmt.Sprintf("tunnel %v: invalid remote port %q", t.Name, port), "remote"
+			}
+		}
+		if msg != "" {
+			path := []string{"networks", name, "tunnels"}
+			if key != "" {
+				path = append(path, key)
+			}
+			return s.errorAt(fmt.Sprintf("network %v: %v", name, msg), path...)
+		}
+		seen[t.EnvKey()] = true
+	}
+	return nil
+}
+
+// Tunneled reports whether the run of the commands on the network opens
+// the network's tunnels, which it does for local commands only. Such runs
+// don't connect to the network's hosts and run each command once.
+func (n *Network) Tunneled(commands []*Command) bool {
+	if len(n.Tunnels) == 0 || len(commands) == 0 {
+		return false
+	}
+	for _, cmd := range commands {
+		if !cmd.Local {
+			return false
+		}
+	}
+	return true
+}
+
+// KeepTunnels keeps the tunnels of the run open after its commands finish,
+// until a line is read from r (ie. os.Stdin) or sup is interrupted.
+func (sup *Stackup) KeepTunnels(r io.Reader) {
+	sup.keepTunnels = r
+}
+
+// openTunnel is a listening tunnel, forwarding the accepted connections
+// once served.
+type openTunnel struct {
+	Tunnel
+	via      string
+	listener net.Listener
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// listenTunnels listens on the local ports of the network's tunnels and
+// sets their env vars. The connections are accepted once the tunnels are
+// served, after connecting to the hosts forwarding them.
+func listenTunnels(network *Network, envVars *EnvList) ([]*openTunnel, error) {
+	var tunnels []*openTunnel
+	for _, t := range network.Tunnels {
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(t.Local)))
+		if err != nil {
+			closeTunnels(tunnels)
+			return nil, errors.Wrapf(err, "tunnel %v", t.Name)
+		}
+		tunnel := &openTunnel{Tunnel: t, via: t.via(network.Bastion), listener: listener, conns: map[net.Conn]bool{}}
+		tunnels = append(tunnels, tunnel)
+		envVars.Set(t.EnvKey(), strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+	}
+	return tunnels, nil
+}
+
+// tunnelVias returns the hosts forwarding the tunnels.
+func tunnelVias(tunnels []*openTunnel) []string {
+	var vias []string
+	for _, t := range tunnels {
+		vias = append(vias, t.via)
+	}
+	return removeDuplicates(vias)
+}
+
+// serve forwards the connections accepted by the tunnel to its remote,
+// dialed by the via host, until the tunnel is closed.
+func (t *openTunnel) serve(via *SSHClient, errorf func(format string, args ...interface{})) {
+	errorf("Tunnel %v: %v -> %v via %v\n", t.Name, t.listener.Addr(), t.Remote, t.via)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			local, err := t.listener.Accept()
+			if err != nil {
+				return // Closed.
+			}
+			t.wg.Add(1)
+			go func() {
+				defer t.wg.Done()
+				if err := t.forward(via, local); err != nil {
+					errorf("tunnel %v: %v\n", t.Name, err)
+				}
+			}()
+		}
+	}()
+}
+
+// forward copies the data of the local connection to the remote and back.
+func (t *openTunnel) forward(via *SSHClient, local net.Conn) error {
+	defer local.Close()
+	remote, err := via.conn.Dial("tcp", t.Remote)
+	if err != nil {
+		return errors.Wrapf(err, "connecting to %v via %v failed", t.Remote, t.via)
+	}
+	defer remote.Close()
+	if !t.track(local, remote) {
+		return nil
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+	return nil
+}
+
+// track registers the connections of the tunnel, so close closes them.
+// It returns false once the tunnel is closed.
+func (t *openTunnel) track(conns ...net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		return false
+	}
+	for _, conn := range conns {
+		t.conns[conn] = true
+	}
+	return true
+}
+
+// close stops listening and closes the forwarded connections.
+func (t *openTunnel) close() {
+	t.listener.Close()
+	t.mu.Lock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+	t.mu.Unlock()
+	t.wg.Wait()
+}
+
+// closeTunnels closes the tunnels.
+func closeTunnels(tunnels []*openTunnel) {
+	for _, t := range tunnels {
+		t.close()
+	}
+}
+
+// holdTunnels waits, if KeepTunnels is set, until a line is read or sup
+// is interrupted, keeping the served tunnels open.
+func (sup *Stackup) holdTunnels(tunnels []*openTunnel) {
+	if sup.keepTunnels == nil || len(tunnels) == 0 {
+		return
+	}
+	sup.errorf("Tunnels are kept open, press Enter to close them\n")
+
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	defer signal.Stop(trap)
+	line := make(chan struct{})
+	go func() {
+		bufio.NewReader(sup.keepTunnels).ReadString('\n')
+		close(line)
+	}()
+	select {
+	case <-line:
+	case <-trap:
+	}
+}
@@ -0,0 +1,56 @@
+package sup_test
+
+import (
+	"testing"
+
+	"github.com/pressly/sup"
+	"github.com/pressly/sup/suptest"
+)
+
+const tunnelSupfile = `
+version: 0.5
+networks:
+  empty:
+    hosts: []
+  tunneled:
+    bastion: jump@10.0.0.1
+    tunnels:
+      - {name: db, local: 15432, remote: db.internal:5432}
+commands:
+  report:
+    local: true
+    run: echo report
+  deploy:
+    run: ./deploy.sh
+`
+
+// TestRunWithoutHosts runs networks of no hosts: only the ones of tunnels
+// fail to run remote commands, the tunnels being for local ones.
+func TestRunWithoutHosts(t *testing.T) {
+	conf, err := sup.NewSupfile([]byte(tunnelSupfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		network string
+		command string
+		err     string // Error of the run, "" if it succeeds.
+	}{
+		{"empty", "report", ""},
+		{"empty", "deploy", ""},
+		{"tunneled", "deploy", "network has no hosts, its tunnels are for local commands only"},
+	} {
+		t.Run(tt.network+"/"+tt.command, func(t *testing.T) {
+			report, err := suptest.Run(conf, tt.network, suptest.NewFakeNetwork(), tt.command)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tt.err == "" && report.Err != nil:
+				t.Errorf("run failed: %v", report.Err)
+			case tt.err != "" && (report.Err == nil || report.Err.Error() != tt.err):
+				t.Errorf("got error %v, want %v", report.Err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package sup
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults of --skip-unreachable.
+const (
+	DefaultUnreachablePath = ".sup/unreachable.json" // Relative to Supfile.
+	DefaultUnreachableTTL  = 10 * time.Minute
+)
+
+// Unreachable records the hosts which couldn't be connected to (dial or
+// auth failure), by network, so runs within a TTL skip them up front
+// instead of timing out on them again. Register Handler of each run with
+// Stackup.OnEvent and Save the records once the runs are over.
+type Unreachable struct {
+	path string
+
+	mu    sync.Mutex
+	hosts map[string]map[string]time.Time // Network -> host -> last failure.
+}
+
+// LoadUnreachable reads the records from the file at path. A missing or
+// corrupt file has no records.
+func LoadUnreachable(path string) *Unreachable {
+	u := &Unreachable{path: path, hosts: map[string]map[string]time.Time{}}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &u.hosts); err != nil || u.hosts == nil {
+			u.hosts = map[string]map[string]time.Time{}
+		}
+	}
+	return u
+}
+
+// Skip splits the hosts of the network into the ones to be connected to
+// and the names of the hosts which failed to connect within ttl.
+func (u *Unreachable) Skip(network string, hosts []*Host, ttl time.Duration) (reachable []*Host, skipped []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for _, host := range hosts {
+		if failed, ok := u.hosts[network][host.GetHostname()]; ok && time.Since(failed) < ttl {
+			skipped = append(skipped, host.GetHostname())
+			continue
+		}
+		reachable = append(reachable, host)
+	}
+	return reachable, skipped
+}
+
+// Clear drops the records of the network.
+func (u *Unreachable) Clear(network string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.hosts, network)
+}
+
+// Handler returns the event handler recording the hosts of the network
+// which failed to connect, and forgetting the ones connected to.
+func (u *Unreachable) Handler(network string) func(Event) {
+	return func(e Event) {
+		if e.Type != HostConnected || e.Host == "" {
+			return
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if e.Err == nil {
+			delete(u.hosts[network], e.Host)
+			return
+		}
+		if u.hosts[network] == nil {
+			u.hosts[network] = map[string]time.Time{}
+		}
+		u.hosts[network][e.Host] = time.Now()
+	}
+}
+
+// Save writes the records to the file, except the ones older than ttl,
+// unless it's 0.
+func (u *Unreachable) Save(ttl time.Duration) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for network, hosts := range u.hosts {
+		for host, failed := range hosts {
+			if ttl > 0 && time.Since(failed) >= ttl {
+				delete(hosts, host)
+			}
+		}
+		if len(hosts) == 0 {
+			delete(u.hosts, network)
+		}
+	}
+	data, err := json.Marshal(u.hosts)
+	if err != nil {
+		return err
+	}
+	if err := writeStateFile(u.path, data); err != nil {
+		return errors.Wrap(err, "saving unreachable hosts failed")
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Uploads failing on a transport error (ie. "connection reset" of a flaky
+// VPN) are retried up to uploadRetries times, re-dialing the host after
+// uploadRetryDelay, doubled on each attempt.
+var (
+	uploadRetries    = 3
+	uploadRetryDelay = 2 * time.Second
+)
+
+// uploadRetry is the upload of a task, re-created after a transport error,
+// see stage.retryUpload. Plain tar and scp uploads are resumed: the files
+// already on the host with the right checksum are skipped. Atomic uploads
+// discard what was received, so they're restarted.
+type uploadRetry struct {
+	upload Upload   // Dst expanded.
+	cwd    string   // Supfile directory.
+	src    string   // Local src, relative to cwd.
+	files  []string // Of git_tracked uploads, nil for all files of src.
+}
+
+// resumable reports whether the upload extracts the files in place, so the
+// ones received completely can be skipped.
+func (r *uploadRetry) resumable() bool {
+	return !r.upload.Atomic && r.upload.AtomicDir == ""
+}
+
+// uploadFile is a file of an upload, by its path relative to src and the
+// path within dst it's uploaded to.
+type uploadFile struct {
+	rel, name string
+	size      int64
+}
+
+// uploadState is the progress of an upload on a host, by its files
+// checked on the host.
+type uploadState struct {
+	files, done []uploadFile
+}
+
+func (s uploadState) String() string {
+	var size, doneSize int64
+	for _, f := range s.files {
+		size += f.size
+	}
+	for _, f := range s.done {
+		doneSize += f.size
+	}
+	return fmt.Sprintf("%d of %d files (%v of %v)", len(s.done), len(s.files), formatSize(doneSize), formatSize(size))
+}
+
+// localFiles returns the files of the upload along with their manifest,
+// as checked by Verify. escaped is set if any name is escaped in the
+// manifest, as such uploads aren't resumed.
+func (r *uploadRetry) localFiles() (files []uploadFile, manifest string, escaped bool, err error) {
+	_, prefix := r.upload.uploadDir(r.src, "")
+	if manifest, err = uploadManifest(r.cwd, r.src, r.upload.Exc, r.files, prefix); err != nil {
+		return nil, "", false, err
+	}
+	root := resolve(r.cwd, r.src)
+	for _, line := range strings.SplitAfter(manifest, "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, `\`) {
+			return nil, manifest, true, nil
+		}
+		_, name := splitManifestLine(strings.TrimSuffix(line, "\n"))
+		rel := "."
+		if name != prefix {
+			rel = strings.TrimPrefix(name, prefix+"/")
+		}
+		f := uploadFile{rel: rel, name: name}
+		if info, err := os.Stat(filepath.Join(root, filepath.FromSlash(rel))); err == nil {
+			f.size = info.Size()
+		}
+		files = append(files, f)
+	}
+	return files, manifest, false, nil
+}
+
+// check returns the state of the upload on the host, checking the
+// manifest of the files by sha256sum (or shasum) in dst.
+func (r *uploadRetry) check(c Client, files []uploadFile, manifest string) (uploadState, error) {
+	run := fmt.Sprintf(`sup_dst=%s; cd "$sup_dst" 2>/dev/null && printf '%%s' %s | `+
+		`{ if command -v sha256sum >/dev/null 2>&1; then sha256sum -c -; else shasum -a 256 -c -; fi; } 2>/dev/null; true`,
+		remotePath(r.upload.Dst), ShellQuote(manifest))
+	out, err := runOutput(c, run)
+	if err != nil {
+		return uploadState{}, err
+	}
+	ok := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		if name := strings.TrimSuffix(line, ": OK"); name != line {
+			ok[name] = true
+		}
+	}
+	state := uploadState{files: files}
+	for _, f := range files {
+		if ok[f.name] {
+			state.done = append(state.done, f)
+		}
+	}
+	return state, nil
+}
+
+// stream returns the stream of the files of the upload, all of them if
+// files is nil, along with its size, 0 if unknown.
+func (r *uploadRetry) stream(files []string) (io.Reader, int64, error) {
+	if r.upload.Method == UploadMethodSCP {
+		return newSCPStreamReader(r.cwd, r.src, r.upload.Exc, files)
+	}
+	input, err := newTarStreamReader(r.cwd, r.src, r.upload.Exc, files)
+	return input, 0, err
+}
+
+// runOutput runs the command on the client and returns its output.
+func runOutput(c Client, run string) (string, error) {
+	if err := c.Run(&Task{Run: run, Kind: TaskUpload}); err != nil {
+		return "", err
+	}
+	c.WriteClose()
+	go io.Copy(io.Discard, c.Stderr())
+	out, err := io.ReadAll(c.Stdout())
+	if werr := c.Wait(); err == nil {
+		err = werr
+	}
+	return string(out), err
+}
+
+// isTransportError reports whether the upload failed because the
+// connection to the host broke, rather than by the remote command.
+func isTransportError(err error) bool {
+	switch e := errors.Cause(err).(type) {
+	case *ssh.ExitMissingError:
+		return true
+	case ErrOpenSSHExit:
+		return e.Status == 255
+	case net.Error:
+		return true
+	}
+	err = errors.Cause(err)
+	return err == io.EOF || err == io.ErrUnexpectedEOF || strings.Contains(err.Error(), "connection reset")
+}
+
+// retryUpload retries the upload task which failed by err on a transport
+// error, re-dialing the host and resuming the upload, see uploadRetry.
+// It returns the error of the last attempt. The attempts are printed
+// under the host prefix, and so is the number of files which made it to
+// the host if it still fails.
+func (s *stage) retryUpload(task *Task, c Client, watch *watchdog, out *hostOutput, event Event, err error) error {
+	sup, retry := s.sup, task.retry
+	r, ok := c.(reconnecter)
+	if !ok {
+		return err
+	}
+	printf := func(format string, args ...interface{}) {
+		prefix := sup.paddedPrefix(c, s.cmd.Name, time.Now(), s.maxLen)
+		sup.errorf("%supload %v: "+format+"\n", append([]interface{}{prefix, retry.upload.Src}, args...)...)
+	}
+
+	files, manifest, escaped, ferr := retry.localFiles()
+	if ferr != nil {
+		return err
+	}
+	var restart string
+	switch {
+	case !retry.resumable():
+		restart = "restarting, atomic uploads can't be resumed"
+	case escaped:
+		restart = "restarting, names with backslashes or newlines can't be resumed"
+	}
+	var state *uploadState
+	for attempt := 1; attempt <= uploadRetries; attempt++ {
+		delay := uploadRetryDelay << (attempt - 1)
+		printf("%v, retrying in %v (%d/%d)", err, delay, attempt, uploadRetries)
+		if err := sleep(delay); err != nil {
+			return err
+		}
+		if err = r.Reconnect(); err != nil {
+			continue
+		}
+
+		var remaining []string
+		if restart == "" {
+			checked, cerr := retry.check(c, files, manifest)
+			if cerr != nil {
+				err = cerr
+				continue
+			}
+			state = &checked
+			if len(checked.done) == len(files) {
+				printf("all %d files are on the host", len(files))
+				return nil
+			}
+			done := map[string]bool{}
+			for _, f := range checked.done {
+				done[f.rel] = true
+			}
+			for _, f := range files {
+				if !done[f.rel] {
+					remaining = append(remaining, f.rel)
+				}
+			}
+			printf("resuming, %v already on the host", checked)
+		} else {
+			printf("%v", restart)
+			remaining = retry.files
+		}
+
+		input, size, serr := retry.stream(remaining)
+		if serr != nil {
+			return serr
+		}
+		resumed := *task
+		resumed.Input, resumed.Size = input, size
+		if _, err = s.execTask(&resumed, c, input, watch, out, event); err == nil || watch.fired() != nil || !isTransportError(err) {
+			return err
+		}
+	}
+	if restart == "" && r.Reconnect() == nil {
+		if checked, cerr := retry.check(c, files, manifest); cerr == nil {
+			state = &checked
+		}
+	}
+	if state != nil {
+		printf("failed, %v made it", state)
+	} else {
+		printf("failed, no files were checked on the host")
+	}
+	return err
+}
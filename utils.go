@@ -1,19 +1,48 @@
 package sup
 
 import (
+	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
 )
 
+// ResolvePath expands leading ~ of path to the current user's home
+// directory and ~user to the user's one. Paths without them are returned
+// as they are.
 func ResolvePath(path string) string {
-	if path == "" {
-		return ""
+	if !strings.HasPrefix(path, "~") {
+		return path
 	}
-	if path[:2] == "~/" {
-		usr, err := user.Current()
-		if err == nil {
-			path = filepath.Join(usr.HomeDir, path[2:])
+	name, rest := path[1:], ""
+	if i := strings.IndexFunc(name, isPathSeparator); i >= 0 {
+		name, rest = name[:i], name[i+1:]
+	}
+
+	var home string
+	if name == "" {
+		if usr, err := user.Current(); err == nil {
+			home = usr.HomeDir
+		} else {
+			home, _ = os.UserHomeDir() // $HOME, or %USERPROFILE% on Windows.
 		}
+	} else if usr, err := user.Lookup(name); err == nil {
+		home = usr.HomeDir
 	}
-	return path
+	if home == "" {
+		return path
+	}
+	return filepath.Join(home, rest)
+}
+
+// isPathSeparator reports whether r separates path elements, which is
+// both / and \ on Windows.
+func isPathSeparator(r rune) bool {
+	return r < 128 && os.IsPathSeparator(uint8(r))
+}
+
+// ShellQuote quotes s to be used as a single word in a POSIX shell
+// command, as sup quotes the words of the remote commands.
+func ShellQuote(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `'\''`) + `'`
 }
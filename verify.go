@@ -0,0 +1,105 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UploadVerifySHA256 is the verify of uploads checking the SHA256 of each
+// uploaded file on the host.
+const UploadVerifySHA256 = "sha256"
+
+func (u Upload) checkVerify() error {
+	if u.Verify != "" && u.Verify != UploadVerifySHA256 {
+		return fmt.Errorf("unknown verify %q, expected %q", u.Verify, UploadVerifySHA256)
+	}
+	return nil
+}
+
+// uploadManifest returns the sha256sum manifest of the regular files of
+// the local src, resolved against cwd, named by the paths they're
+// uploaded to within dir, ie. "dist/app" of src "dist". Files matching
+// exclude patterns are left out, as by tar, and so are the files not
+// listed, unless files is nil. Each file is read once, however many hosts
+// the manifest is checked on.
+func uploadManifest(cwd, src, exclude string, files []string, dir string) (string, error) {
+	root := resolve(cwd, src)
+	excluded := uploadFilter(exclude, files)
+	var lines []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		if rel != "." && excluded(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		lines = append(lines, manifestLine(hex.EncodeToString(h.Sum(nil)), path.Join(dir, filepath.ToSlash(rel))))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, ""), nil
+}
+
+// manifestLine returns the line of the file in sha256sum -c format. Names
+// with backslashes or newlines are escaped, and the line is marked by a
+// leading backslash as such, the same way sha256sum writes them.
+func manifestLine(sum, name string) string {
+	if !strings.ContainsAny(name, "\\\n") {
+		return sum + "  " + name + "\n"
+	}
+	name = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(name)
+	return `\` + sum + "  " + name + "\n"
+}
+
+// uploadDir returns the directory of the upload's files on the host, a
+// path within double quotes, and their path there, relative to it, of
+// the local src. Uploaded by tar or scp, the files keep src's path, which
+// tar strips of leading / and ../. atomic_dir releases hold the files of
+// src directory itself.
+func (u Upload) uploadDir(src, release string) (dir, prefix string) {
+	src = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(src)), "/")
+	if u.AtomicDir == AtomicDirSymlink {
+		return "$sup_dst/releases", release
+	}
+	return "$sup_dst", src
+}
+
+// verifyCommand returns command checking the uploaded files in dir by the
+// manifest of uploadManifest, by sha256sum, or shasum of hosts without it,
+// to be run once the upload succeeds. Files missing or not matching are
+// listed and fail the upload. The manifest is checked by a single command,
+// however many files it lists.
+func verifyCommand(manifest, dir string) string {
+	return fmt.Sprintf(`{ (cd "%s" && printf '%%s' %s | { if command -v sha256sum >/dev/null 2>&1; then sha256sum -c --quiet -; else shasum -a 256 -c --quiet -; fi; }) || `+
+		`{ echo "upload: verify: checksum of the files above doesn't match" >&2; exit 1; }; }`,
+		dir, ShellQuote(manifest))
+}
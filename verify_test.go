@@ -0,0 +1,129 @@
+package sup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyManifest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file names of newlines and backslashes")
+	}
+	for _, tt := range []struct {
+		name  string
+		files map[string]string // Files of src by slash path, "/" suffix for directories.
+		want  []string          // Lines of the manifest.
+	}{
+		{
+			name:  "file",
+			files: map[string]string{"app": "binary"},
+			want:  []string{sha256Hex("binary") + "  dist/app"},
+		},
+		{
+			name:  "spaces",
+			files: map[string]string{"my app.conf": "a = 1"},
+			want:  []string{sha256Hex("a = 1") + "  dist/my app.conf"},
+		},
+		{
+			name:  "newline",
+			files: map[string]string{"line\nbreak": "x"},
+			want:  []string{`\` + sha256Hex("x") + `  dist/line\nbreak`},
+		},
+		{
+			name:  "backslash",
+			files: map[string]string{`back\slash`: "y"},
+			want:  []string{`\` + sha256Hex("y") + `  dist/back\\slash`},
+		},
+		{
+			name:  "empty file",
+			files: map[string]string{"empty": ""},
+			want:  []string{sha256Hex("") + "  dist/empty"},
+		},
+		{
+			name:  "directories",
+			files: map[string]string{"bin/": "", "bin/app": "1", "etc/app/": "", "etc/app/app.conf": "2", "var/": ""},
+			want:  []string{sha256Hex("1") + "  dist/bin/app", sha256Hex("2") + "  dist/etc/app/app.conf"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cwd := t.TempDir()
+			src := filepath.Join(cwd, "dist")
+			writeTree(t, src, tt.files)
+
+			manifest, err := uploadManifest(cwd, "dist", "", nil, "dist")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Join(tt.want, "\n") + "\n"
+			if manifest != want {
+				t.Fatalf("got manifest\n%q\nwant\n%q", manifest, want)
+			}
+			verifyOnHost(t, cwd, manifest, true)
+
+			// A truncated file fails the verify.
+			for name, content := range tt.files {
+				if strings.HasSuffix(name, "/") || content == "" {
+					continue
+				}
+				if err := os.WriteFile(filepath.Join(src, filepath.FromSlash(name)), []byte(content[:len(content)-1]), 0644); err != nil {
+					t.Fatal(err)
+				}
+				verifyOnHost(t, cwd, manifest, false)
+				break
+			}
+		})
+	}
+}
+
+// writeTree creates the files in dir, by slash path, the ones of "/"
+// suffix as directories.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(file, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// verifyOnHost runs the verify command of the manifest by the local shell,
+// the files being uploaded to dir.
+func verifyOnHost(t *testing.T, dir, manifest string, ok bool) {
+	t.Helper()
+	_, err1 := exec.LookPath("sha256sum")
+	_, err2 := exec.LookPath("shasum")
+	if err1 != nil && err2 != nil {
+		t.Skip("sha256sum and shasum are not installed")
+	}
+	cmd := exec.Command("sh", "-c", "sup_dst="+ShellQuote(dir)+"; "+verifyCommand(manifest, "$sup_dst"))
+	out, err := cmd.CombinedOutput()
+	switch {
+	case ok && err != nil:
+		t.Errorf("verify failed: %v: %s", err, out)
+	case !ok && err == nil:
+		t.Errorf("verify of a changed file succeeded: %s", out)
+	case !ok && !strings.Contains(string(out), "checksum of the files above doesn't match"):
+		t.Errorf("verify failed without listing the files: %s", out)
+	}
+}
@@ -0,0 +1,88 @@
+package sup
+
+import (
+	"fmt"
+	"time"
+)
+
+// Default WaitFor polling settings.
+const (
+	DefaultWaitTimeout  = 60 * time.Second
+	DefaultWaitInterval = 2 * time.Second
+)
+
+// WaitFor is a health check polled on each host after the command
+// finishes, ie. {http: "http://localhost:8080/health", timeout: 120s}.
+// The check runs on the host itself, since health endpoints are usually
+// available on localhost only.
+type WaitFor struct {
+	HTTP     string `yaml:"http,omitempty"`     // URL polled with curl.
+	Status   int    `yaml:"status,omitempty"`   // Expected HTTP status, 200 by default.
+	Port     int    `yaml:"port,omitempty"`     // TCP port on localhost polled with nc.
+	Cmd      string `yaml:"cmd,omitempty"`      // Shell command expected to exit with 0.
+	Timeout  string `yaml:"timeout,omitempty"`  // Marks the host failed, 60s by default.
+	Interval string `yaml:"interval,omitempty"` // Time between attempts, 2s by default.
+}
+
+// check returns the shell condition of the health check.
+func (w *WaitFor) check() (string, error) {
+	var checks []string
+	if w.HTTP != "" {
+		status := w.Status
+		if status == 0 {
+			status = 200
+		}
+		checks = append(checks, fmt.Sprintf(`[ "$(curl -s -o /dev/null -w '%%{http_code}' %s)" = "%d" ]`, ShellQuote(w.HTTP), status))
+	}
+	if w.Port != 0 {
+		checks = append(checks, fmt.Sprintf(`nc -z localhost %d >/dev/null 2>&1`, w.Port))
+	}
+	if w.Cmd != "" {
+		checks = append(checks, fmt.Sprintf(`( %s ) >/dev/null 2>&1`, w.Cmd))
+	}
+	if len(checks) != 1 {
+		return "", fmt.Errorf("wait_for: exactly one of http, port or cmd must be set")
+	}
+	return checks[0], nil
+}
+
+// Script returns the remote shell script polling the health check until
+// success or timeout.
+func (w *WaitFor) Script() (string, error) {
+	check, err := w.check()
+	if err != nil {
+		return "", err
+	}
+	timeout, err := parseDuration(w.Timeout, DefaultWaitTimeout)
+	if err != nil {
+		return "", fmt.Errorf("wait_for.timeout: %v", err)
+	}
+	interval, err := parseDuration(w.Interval, DefaultWaitInterval)
+	if err != nil {
+		return "", fmt.Errorf("wait_for.interval: %v", err)
+	}
+
+	return fmt.Sprintf(`sup_wait_start=$(date +%%s);
+while :; do
+  if %s; then break; fi;
+  sup_wait_elapsed=$(( $(date +%%s) - sup_wait_start ));
+  if [ "$sup_wait_elapsed" -ge %d ]; then echo "wait_for: timed out after %ds" >&2; exit 1; fi;
+  echo "waiting (${sup_wait_elapsed}s/%ds)";
+  sleep %g;
+done`, check, int(timeout.Seconds()), int(timeout.Seconds()), int(timeout.Seconds()), interval.Seconds()), nil
+}
+
+// parseDuration parses value like "120s", returning def for empty value.
+func parseDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration must be positive, got %v", value)
+	}
+	return d, nil
+}
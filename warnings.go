@@ -0,0 +1,83 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Warning codes.
+const (
+	WarnDeprecatedRunOnce = "deprecated-run-once"
+	WarnMissingVersion    = "missing-version"
+	WarnStringExclude     = "string-exclude"
+	WarnLocalScheduling   = "local-scheduling"
+)
+
+// Warning is a non-fatal problem found while parsing Supfile, ie. usage of
+// a deprecated construct.
+type Warning struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"` // Line in Supfile, 0 if unknown.
+}
+
+func (w Warning) String() string {
+	if w.Line > 0 {
+		return fmt.Sprintf("Warning: line %v: %v", w.Line, w.Message)
+	}
+	return "Warning: " + w.Message
+}
+
+// warn adds a warning located at the given YAML key path, ie.
+// warn(code, msg, "commands", "build", "run_once").
+func (s *Supfile) warn(code, msg string, path ...string) {
+	s.Warnings = append(s.Warnings, Warning{
+		Code:    code,
+		Message: msg,
+		Line:    findLine(s.data, path...),
+	})
+}
+
+// errorAt returns error located at the given YAML key path, as warn.
+func (s *Supfile) errorAt(msg string, path ...string) error {
+	if line := findLine(s.data, path...); line > 0 {
+		return fmt.Errorf("line %v: %v", line, msg)
+	}
+	return errors.New(msg)
+}
+
+// sortWarnings sorts warnings by their location in Supfile.
+func (s *Supfile) sortWarnings() {
+	sort.SliceStable(s.Warnings, func(i, j int) bool {
+		return s.Warnings[i].Line < s.Warnings[j].Line
+	})
+}
+
+// findLine returns line number of the last key in path, looking up
+// the keys one after another. Returns 0 if the path is not found.
+func findLine(data []byte, path ...string) int {
+	if len(path) == 0 {
+		return 0
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		text = strings.TrimPrefix(text, "- ")
+		key := strings.Trim(strings.SplitN(text, ":", 2)[0], `"'`)
+		if !strings.Contains(text, ":") || key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return line
+		}
+		path = path[1:]
+	}
+	return 0
+}